@@ -1415,11 +1415,46 @@ func (o *Object) MimeType() string {
 	return o.mimeType
 }
 
+// ID returns the ID of the Object if known, or "" if not
+func (o *Object) ID() string {
+	return o.id
+}
+
+// VersionCount returns the number of versions of the object b2 keeps,
+// including the current one, by listing them.
+func (o *Object) VersionCount() (int, error) {
+	baseRemote := o.remote
+	if *b2Versions {
+		_, baseRemote = api.RemoveVersion(baseRemote)
+	}
+	count := 0
+	err := o.fs.list("", fs.MaxLevel, baseRemote, 0, true, func(remote string, object *api.File, isDirectory bool) error {
+		if isDirectory {
+			return nil
+		}
+		// The versions of the object are listed before any
+		// other files starting with its name
+		if remote != baseRemote {
+			return errEndList
+		}
+		if object.Action == "upload" {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 // Check the interfaces are satisfied
 var (
-	_ fs.Fs         = &Fs{}
-	_ fs.Purger     = &Fs{}
-	_ fs.CleanUpper = &Fs{}
-	_ fs.Object     = &Object{}
-	_ fs.MimeTyper  = &Object{}
+	_ fs.Fs             = &Fs{}
+	_ fs.Purger         = &Fs{}
+	_ fs.CleanUpper     = &Fs{}
+	_ fs.Object         = &Object{}
+	_ fs.MimeTyper      = &Object{}
+	_ fs.IDer           = &Object{}
+	_ fs.VersionCounter = &Object{}
 )
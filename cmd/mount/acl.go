@@ -0,0 +1,167 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// aclRule gives the access a user has to the paths matching a glob
+type aclRule struct {
+	glob   string
+	filter *fs.Filter // includes only the paths matching glob
+	uid    int64      // uid the rule applies to or -1 for everyone
+	read   bool       // set if reading is allowed
+	write  bool       // set if writing is allowed
+}
+
+// acl is the list of rules read from --acl-file - the first matching
+// rule is used and if none match access is allowed
+var acl []aclRule
+
+// parseACLRule parses a line of the --acl-file which looks like
+//
+//	glob uid|* r|rw|-
+func parseACLRule(line string) (rule aclRule, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return rule, errors.Errorf("expecting \"glob uid perms\" but got %q", line)
+	}
+	rule.glob = fields[0]
+	rule.filter, err = newGlobFilter(rule.glob)
+	if err != nil {
+		return rule, err
+	}
+	rule.uid = -1
+	if fields[1] != "*" {
+		rule.uid, err = strconv.ParseInt(fields[1], 10, 32)
+		if err != nil {
+			return rule, errors.Wrapf(err, "bad uid in %q", line)
+		}
+	}
+	switch fields[2] {
+	case "rw":
+		rule.read, rule.write = true, true
+	case "r":
+		rule.read = true
+	case "-":
+	default:
+		return rule, errors.Errorf("bad permissions %q in %q - use r, rw or -", fields[2], line)
+	}
+	return rule, nil
+}
+
+// loadACL reads the rules from file ignoring blank lines and lines
+// starting with #
+func loadACL(file string) (rules []aclRule, err error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.CheckClose(in, &err)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rule, err := parseACLRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// aclAllows returns whether uid is allowed to read remote, or write
+// it if write is set
+func aclAllows(uid uint32, remote string, write bool) bool {
+	for _, rule := range acl {
+		if rule.uid >= 0 && rule.uid != int64(uid) {
+			continue
+		}
+		if !rule.filter.Include(remote, 0, time.Time{}) {
+			continue
+		}
+		if write {
+			return rule.write
+		}
+		return rule.read
+	}
+	return true
+}
+
+// aclAllowsDir returns whether uid is allowed to write the directory
+// dir and the paths under it.  The first rule which could match dir or
+// any path under it is used.
+func aclAllowsDir(uid uint32, dir string) bool {
+	for _, rule := range acl {
+		if rule.uid >= 0 && rule.uid != int64(uid) {
+			continue
+		}
+		if !rule.filter.Include(dir, 0, time.Time{}) && !rule.filter.IncludeDirectory(dir) {
+			continue
+		}
+		return rule.write
+	}
+	return true
+}
+
+// checkACL returns EACCES if the user making the request isn't
+// allowed to read remote, or write it if write is set
+func checkACL(hdr *fuse.Header, remote string, write bool) error {
+	if aclAllows(hdr.Uid, remote, write) {
+		return nil
+	}
+	fs.Debug(remote, "Access denied to uid %d by --acl-file (write=%v)", hdr.Uid, write)
+	return fuse.Errno(syscall.EACCES)
+}
+
+// checkACLDir returns EACCES if the user making the request isn't
+// allowed to write the directory dir and the paths under it
+func checkACLDir(hdr *fuse.Header, dir string) error {
+	if aclAllowsDir(hdr.Uid, dir) {
+		return nil
+	}
+	fs.Debug(dir, "Access denied to uid %d to directory by --acl-file", hdr.Uid)
+	return fuse.Errno(syscall.EACCES)
+}
+
+// DirACLHandle is an open directory read with ReadDirAll which leaves
+// out the entries the user which opened it can't read
+type DirACLHandle struct {
+	d   *Dir
+	uid uint32 // user which opened the directory
+}
+
+// Check interface satisfied
+var _ fusefs.HandleReadDirAller = (*DirACLHandle)(nil)
+
+// ReadDirAll reads the directory leaving out the entries the user
+// isn't allowed to read
+func (fh *DirACLHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirents, err := fh.d.ReadDirAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allowed := dirents[:0]
+	for _, dirent := range dirents {
+		if aclAllows(fh.uid, path.Join(fh.d.path, dirent.Name), false) {
+			allowed = append(allowed, dirent)
+		}
+	}
+	return allowed, nil
+}
@@ -0,0 +1,332 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// isArchive returns whether remote is an archive which is shown as a
+// directory of its members with --mount-archives
+func isArchive(remote string) bool {
+	return mountArchives && strings.HasSuffix(strings.ToLower(remote), ".zip")
+}
+
+// archiveBufferSize is the amount of an archive read at once so the
+// small reads of the zip reader don't each open the object
+const archiveBufferSize = 256 * 1024
+
+// objectReaderAt reads an object at offsets, reading at least
+// archiveBufferSize at a time into a buffer the reads are served from
+type objectReaderAt struct {
+	o      fs.Object
+	mu     sync.Mutex
+	buf    []byte // data read from the object
+	bufOff int64  // offset of buf in the object
+}
+
+// ReadAt reads len(p) bytes from offset off in the object
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n < len(p) {
+		if off < r.bufOff || off >= r.bufOff+int64(len(r.buf)) {
+			err = r.fill(off, len(p)-n)
+			if err != nil {
+				return n, err
+			}
+		}
+		copied := copy(p[n:], r.buf[off-r.bufOff:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// fill reads at least size bytes from offset off in the object into
+// the buffer, returning io.EOF if off is at or past the end
+//
+// Not all remotes support ranged reads so this reads from off with
+// a SeekOption and stops reading once it has enough.
+//
+// Call with r.mu held
+func (r *objectReaderAt) fill(off int64, size int) error {
+	if off >= r.o.Size() {
+		return io.EOF
+	}
+	if size < archiveBufferSize {
+		size = archiveBufferSize
+	}
+	in, err := r.o.Open(&fs.SeekOption{Offset: off})
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(in, int64(size)))
+	closeErr := in.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return io.EOF
+	}
+	r.buf, r.bufOff = buf, off
+	return nil
+}
+
+// memberName returns the name of an archive member as it is shown
+// with any leading / removed, or false if it contains a .. which would
+// put it outside the archive
+func memberName(name string) (string, bool) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	return strings.TrimLeft(name, "/"), true
+}
+
+// archive is a zip object whose central directory is read the first
+// time its members are needed
+type archive struct {
+	o    fs.Object
+	once sync.Once
+	r    *zip.Reader
+	err  error
+}
+
+// members returns the members of the archive reading its central
+// directory if necessary
+func (a *archive) members() ([]*zip.File, error) {
+	a.once.Do(func() {
+		fs.Debug(a.o, "Reading archive central directory")
+		a.r, a.err = zip.NewReader(&objectReaderAt{o: a.o}, a.o.Size())
+		if a.err != nil {
+			fs.ErrorLog(a.o, "Failed to read archive: %v", a.err)
+		}
+	})
+	if a.err != nil {
+		return nil, fuse.EIO
+	}
+	return a.r.File, nil
+}
+
+// ArchiveDir is a read only directory in an archive showing the
+// members under prefix
+type ArchiveDir struct {
+	a      *archive
+	prefix string // path of the directory in the archive ending in / or ""
+}
+
+// newArchiveDir makes the directory for the root of the archive o
+func newArchiveDir(o fs.Object) *ArchiveDir {
+	return &ArchiveDir{a: &archive{o: o}}
+}
+
+// Check interfaces satisfied
+var (
+	_ io.ReaderAt               = (*objectReaderAt)(nil)
+	_ fusefs.Node               = (*ArchiveDir)(nil)
+	_ fusefs.NodeStringLookuper = (*ArchiveDir)(nil)
+	_ fusefs.HandleReadDirAller = (*ArchiveDir)(nil)
+	_ fusefs.Node               = (*ArchiveFile)(nil)
+	_ fusefs.NodeOpener         = (*ArchiveFile)(nil)
+	_ fusefs.HandleReader       = (*ArchiveFileHandle)(nil)
+	_ fusefs.HandleReleaser     = (*ArchiveFileHandle)(nil)
+)
+
+// Attr fills out the attributes of the directory using the
+// modification time of the archive
+func (d *ArchiveDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = os.ModeDir | (dirPerms &^ 0222)
+	if !noModTime {
+		modTime := d.a.o.ModTime()
+		a.Atime = modTime
+		a.Mtime = modTime
+		a.Ctime = modTime
+		a.Crtime = modTime
+	}
+	return nil
+}
+
+// children calls fn with the leaf name of each member directly in the
+// directory and the member, or nil if the leaf is a directory
+//
+// Members whose names would put them outside the archive are skipped.
+func (d *ArchiveDir) children(fn func(leaf string, member *zip.File)) error {
+	members, err := d.a.members()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, member := range members {
+		name, ok := memberName(member.Name)
+		if !ok {
+			fs.Debug(d.a.o, "Skipping archive member with unsafe name %q", member.Name)
+			continue
+		}
+		if !strings.HasPrefix(name, d.prefix) {
+			continue
+		}
+		rest := name[len(d.prefix):]
+		if i := strings.IndexRune(rest, '/'); i >= 0 {
+			leaf := rest[:i]
+			if leaf != "" && !dirs[leaf] {
+				dirs[leaf] = true
+				fn(leaf, nil)
+			}
+		} else if rest != "" {
+			fn(rest, member)
+		}
+	}
+	return nil
+}
+
+// Lookup finds the member or directory name in the directory
+func (d *ArchiveDir) Lookup(ctx context.Context, name string) (node fusefs.Node, err error) {
+	fs.Debug(d.a.o, "ArchiveDir.Lookup %q", path.Join(d.prefix, name))
+	err = d.children(func(leaf string, member *zip.File) {
+		if leaf != name || node != nil {
+			return
+		}
+		if member == nil {
+			node = &ArchiveDir{a: d.a, prefix: d.prefix + leaf + "/"}
+		} else {
+			node = &ArchiveFile{member: member}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fuse.ENOENT
+	}
+	return node, nil
+}
+
+// ReadDirAll lists the members and directories in the directory
+func (d *ArchiveDir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	fs.Debug(d.a.o, "ArchiveDir.ReadDirAll %q", d.prefix)
+	err = d.children(func(leaf string, member *zip.File) {
+		dirent := fuse.Dirent{Type: fuse.DT_File, Name: leaf}
+		if member == nil {
+			dirent.Type = fuse.DT_Dir
+		}
+		dirents = append(dirents, dirent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dirents, nil
+}
+
+// ArchiveFile is a read only member of an archive
+type ArchiveFile struct {
+	member *zip.File
+}
+
+// Attr fills out the attributes of the member
+func (f *ArchiveFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = filePerms &^ 0222
+	a.Size = f.member.UncompressedSize64
+	if !noModTime {
+		modTime := f.member.ModTime()
+		a.Atime = modTime
+		a.Mtime = modTime
+		a.Ctime = modTime
+		a.Crtime = modTime
+	}
+	setBlocks(a)
+	return nil
+}
+
+// Open the member for reading
+func (f *ArchiveFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	return &ArchiveFileHandle{member: f.member}, nil
+}
+
+// ArchiveFileHandle is an open archive member.  The member is read
+// from the start as it may be compressed so seeking backwards reopens
+// it and seeking forwards reads and discards the data.
+type ArchiveFileHandle struct {
+	mu     sync.Mutex
+	member *zip.File
+	r      io.ReadCloser // the open member or nil
+	offset int64         // offset of the next byte read from r
+}
+
+// close the open member if any
+//
+// Must be called with fh.mu held
+func (fh *ArchiveFileHandle) close() error {
+	if fh.r == nil {
+		return nil
+	}
+	err := fh.r.Close()
+	fh.r = nil
+	return err
+}
+
+// Read from the member at req.Offset
+func (fh *ArchiveFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.r == nil || req.Offset < fh.offset {
+		_ = fh.close()
+		fh.r, err = fh.member.Open()
+		if err != nil {
+			fs.ErrorLog(fh.member.Name, "ArchiveFileHandle.Read open error: %v", err)
+			return err
+		}
+		fh.offset = 0
+	}
+	if req.Offset > fh.offset {
+		n, err := io.CopyN(ioutil.Discard, fh.r, req.Offset-fh.offset)
+		fh.offset += n
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			fs.ErrorLog(fh.member.Name, "ArchiveFileHandle.Read skip error: %v", err)
+			return err
+		}
+	}
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(fh.r, buf)
+	fh.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		fs.ErrorLog(fh.member.Name, "ArchiveFileHandle.Read error: %v", err)
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Release closes the member
+func (fh *ArchiveFileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	return fh.close()
+}
@@ -0,0 +1,116 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// pendingUploadRetries is the number of failed uploads being retried
+// in the background with --best-effort-uploads - use sync/atomic to
+// access
+var pendingUploadRetries int64
+
+// uploadRetries is waited on for the background upload retries to
+// finish when the mount stops
+var uploadRetries sync.WaitGroup
+
+// uploadRetrySleep is the time to sleep before the first background
+// retry of a failed upload - it doubles for each subsequent retry
+var uploadRetrySleep = time.Second
+
+// newUploadSpool makes the local copy of the data written to a file
+// which a failed upload is retried from with --best-effort-uploads
+func newUploadSpool() (*os.File, error) {
+	return ioutil.TempFile("", "rclone-mount-upload-spool")
+}
+
+// removeUploadSpool closes and removes spool
+func removeUploadSpool(spool *os.File) {
+	_ = spool.Close()
+	err := os.Remove(spool.Name())
+	if err != nil {
+		fs.ErrorLog(spool.Name(), "Failed to remove upload spool: %v", err)
+	}
+}
+
+// retryUpload retries the upload of the data in the spool of fh,
+// which failed with err, in the background up to --low-level-retries
+// times with exponential backoff, removing the spool when done.
+//
+// The retries upload the data the way the write did and give up if
+// the file is written again in the meantime.
+func retryUpload(fh *WriteFileHandle, err error) {
+	file, remote, spool := fh.file, fh.remote, fh.spool
+	file.mu.RLock()
+	base := fh.base
+	file.mu.RUnlock()
+	var sum string
+	if storesHash(fh.dir.f) {
+		sum = fh.hasher.Sums()[fs.HashMD5]
+	}
+	atomic.AddInt64(&pendingUploadRetries, 1)
+	uploadRetries.Add(1)
+	file.addDirty(1)
+	go func() {
+		defer uploadRetries.Done()
+		defer atomic.AddInt64(&pendingUploadRetries, -1)
+		defer file.addDirty(-1)
+		defer removeUploadSpool(spool)
+		d := file.d
+		sleep := uploadRetrySleep
+		lastErr := err
+		for try := 1; try <= fs.Config.LowLevelRetries; try++ {
+			time.Sleep(sleep)
+			sleep *= 2
+			if file.changedSince(base) {
+				fs.Log(remote, "Giving up retrying upload as the file has been written since")
+				return
+			}
+			fi, err := spool.Stat()
+			if err == nil {
+				_, err = spool.Seek(0, 0)
+			}
+			if err != nil {
+				fs.ErrorLog(remote, "Giving up retrying upload: %v", err)
+				logErrorEvent("upload", remote, err, try-1)
+				return
+			}
+			src := fs.NewStaticObjectInfo(remote, fi.ModTime(), fi.Size(), true, nil, d.f)
+			o, err := putObject(d, spool, src)
+			if err == nil {
+				fs.Debug(remote, "Background upload retry succeeded")
+				if !file.setRetriedObject(base, o) {
+					fs.Log(remote, "File written again while retrying upload")
+					return
+				}
+				if sum != "" {
+					err = storeHash(d.f, o, sum)
+					if err != nil {
+						fs.ErrorLog(remote, "Failed to store hash: %v", err)
+					}
+				}
+				return
+			}
+			fs.Debug(remote, "Background upload retry failed (%d/%d): %v", try, fs.Config.LowLevelRetries, err)
+			lastErr = err
+		}
+		fs.ErrorLog(remote, "Giving up retrying upload after %d tries", fs.Config.LowLevelRetries)
+		logErrorEvent("upload", remote, lastErr, fs.Config.LowLevelRetries)
+	}()
+}
+
+// waitUploadRetries waits for the background upload retries to finish
+// when the mount stops so the data they hold isn't lost
+func waitUploadRetries() {
+	if n := atomic.LoadInt64(&pendingUploadRetries); n > 0 {
+		fs.Log(nil, "Waiting for %d background upload retries to finish", n)
+	}
+	uploadRetries.Wait()
+}
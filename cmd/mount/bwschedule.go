@@ -0,0 +1,137 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+)
+
+// bwScheduleNow returns the time used to pick the rate from the
+// --bwlimit-schedule - it is replaced in the tests
+var bwScheduleNow = time.Now
+
+// bwSlot is an entry in a bandwidth schedule - from the time of day
+// at minute the rate is limited to bandwidth bytes per second or
+// unlimited if it is 0
+type bwSlot struct {
+	minute    int
+	bandwidth fs.SizeSuffix
+}
+
+// bwSchedule is a list of bwSlot sorted by time of day
+type bwSchedule []bwSlot
+
+// Sort interface for bwSchedule
+func (s bwSchedule) Len() int           { return len(s) }
+func (s bwSchedule) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bwSchedule) Less(i, j int) bool { return s[i].minute < s[j].minute }
+
+// parseBwSchedule parses a schedule like "08:00,1M 23:00,off"
+func parseBwSchedule(spec string) (bwSchedule, error) {
+	var schedule bwSchedule
+	for _, entry := range strings.Fields(spec) {
+		parts := strings.Split(entry, ",")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("bad bandwidth schedule entry %q - want HH:MM,rate", entry)
+		}
+		when, err := time.Parse("15:04", parts[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad time in bandwidth schedule entry %q", entry)
+		}
+		slot := bwSlot{minute: when.Hour()*60 + when.Minute()}
+		if parts[1] != "off" {
+			err = slot.bandwidth.Set(parts[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad rate in bandwidth schedule entry %q", entry)
+			}
+		}
+		schedule = append(schedule, slot)
+	}
+	if len(schedule) == 0 {
+		return nil, errors.New("empty bandwidth schedule")
+	}
+	sort.Sort(schedule)
+	return schedule, nil
+}
+
+// loadBwSchedule parses spec, or the contents of the file it names
+// if there is one
+func loadBwSchedule(spec string) (bwSchedule, error) {
+	if _, err := os.Stat(spec); err == nil {
+		data, err := ioutil.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(data)
+	}
+	return parseBwSchedule(spec)
+}
+
+// at returns the rate in force at t and when it next changes
+//
+// Before the first slot of the day the last slot of the previous
+// day is in force.
+func (s bwSchedule) at(t time.Time) (bandwidth fs.SizeSuffix, next time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	minute := t.Hour()*60 + t.Minute()
+	bandwidth = s[len(s)-1].bandwidth
+	for _, slot := range s {
+		if slot.minute > minute {
+			return bandwidth, midnight.Add(time.Duration(slot.minute) * time.Minute)
+		}
+		bandwidth = slot.bandwidth
+	}
+	return bandwidth, midnight.AddDate(0, 0, 1).Add(time.Duration(s[0].minute) * time.Minute)
+}
+
+// apply sets the rate of l to the one in force now returning when it
+// next changes
+func (s bwSchedule) apply(l *priorityLimiter) time.Time {
+	bandwidth, next := s.at(bwScheduleNow())
+	if bandwidth > 0 {
+		fs.Debug("bwlimit-schedule", "Limiting reads to %v/s until %v", bandwidth, next.Format("15:04"))
+	} else {
+		fs.Debug("bwlimit-schedule", "Not limiting reads until %v", next.Format("15:04"))
+	}
+	l.setRate(int64(bandwidth))
+	return next
+}
+
+// startBwSchedule sets the rate of l from the schedule in spec at
+// each of its transitions.  SIGHUP reads the schedule again.
+func startBwSchedule(spec string, l *priorityLimiter) error {
+	schedule, err := loadBwSchedule(spec)
+	if err != nil {
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			next := schedule.apply(l)
+			timer := time.NewTimer(next.Sub(bwScheduleNow()))
+			select {
+			case <-timer.C:
+			case <-hup:
+				timer.Stop()
+				newSchedule, err := loadBwSchedule(spec)
+				if err != nil {
+					fs.ErrorLog("bwlimit-schedule", "Failed to reload schedule: %v", err)
+					continue
+				}
+				fs.Log("bwlimit-schedule", "Reloaded schedule")
+				schedule = newSchedule
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,140 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// readCacheBlockSize is the size of the blocks stored in the read cache
+const readCacheBlockSize = 1024 * 1024
+
+// readCache is the cache shared between all the read handles - it is
+// nil if the cache is disabled
+var readCache *blockCache
+
+// cacheKey identifies a block of an object in the cache
+type cacheKey struct {
+	id    string // identity of the object
+	block int64  // number of the block within the object
+}
+
+// cacheID returns the identity of the object for use in the cache
+//
+// This changes if the object is modified so stale data isn't served
+func cacheID(o fs.Object) string {
+	return fmt.Sprintf("%s\x00%d\x00%d", o.Remote(), o.Size(), o.ModTime().UnixNano())
+}
+
+// cacheBlock is a block of data stored in the cache
+type cacheBlock struct {
+	key    cacheKey
+	data   []byte
+	pinned bool // set if the block is never evicted
+}
+
+// blockCache is an LRU cache of blocks of object data
+//
+// The blocks of files matching --cache-pin are never evicted but
+// count towards the size of the cache.
+type blockCache struct {
+	mu        sync.Mutex
+	maxSize   int64 // maximum size of the data in the cache
+	size      int64 // current size of the data in the cache
+	lru       *list.List
+	blocks    map[cacheKey]*list.Element
+	pinnedIDs map[string]string // cache id of the pinned objects by remote
+}
+
+// newBlockCache makes a new blockCache holding up to maxSize bytes
+func newBlockCache(maxSize int64) *blockCache {
+	return &blockCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		blocks:  make(map[cacheKey]*list.Element),
+
+		pinnedIDs: make(map[string]string),
+	}
+}
+
+// get returns the block for key and whether it was found
+func (c *blockCache) get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.blocks[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheBlock).data, true
+}
+
+// put stores data for key in the cache evicting the least recently
+// used blocks if necessary
+func (c *blockCache) put(key cacheKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.blocks[key]; ok {
+		c.remove(el)
+	}
+	pinned := isPinned(key.id)
+	if pinned {
+		c.unpinStale(key.id)
+	}
+	c.blocks[key] = c.lru.PushFront(&cacheBlock{key: key, data: data, pinned: pinned})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// remove the block in el from the cache
+//
+// Call with c.mu held
+func (c *blockCache) remove(el *list.Element) {
+	block := c.lru.Remove(el).(*cacheBlock)
+	delete(c.blocks, block.key)
+	c.size -= int64(len(block.data))
+}
+
+// unpinStale removes the pinned blocks of older versions of the
+// object with cache id as they will never be read again
+//
+// Call with c.mu held
+func (c *blockCache) unpinStale(id string) {
+	remote := cacheIDRemote(id)
+	oldID, ok := c.pinnedIDs[remote]
+	c.pinnedIDs[remote] = id
+	if !ok || oldID == id {
+		return
+	}
+	fs.Debug(remote, "Unpinning old version from cache")
+	for key, el := range c.blocks {
+		if key.id == oldID {
+			c.remove(el)
+		}
+	}
+}
+
+// evict removes the least recently used blocks which aren't pinned
+// until the cache is under its maximum size
+//
+// Call with c.mu held
+func (c *blockCache) evict() {
+	for el := c.lru.Back(); el != nil && c.size > c.maxSize; {
+		prev := el.Prev()
+		if !el.Value.(*cacheBlock).pinned {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+// usage returns the current and maximum size of the data in the cache
+func (c *blockCache) usage() (size, maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, c.maxSize
+}
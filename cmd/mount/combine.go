@@ -0,0 +1,141 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"strings"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// combineRoot is the root of the mount with --combine or nil
+var combineRoot *CombineDir
+
+// CombineDir is the read only root of a mount with --combine which
+// has a directory for each of the remotes combined
+type CombineDir struct {
+	names []string        // names of the directories in the order given
+	dirs  map[string]*Dir // the root of each remote by name
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.Node               = (*CombineDir)(nil)
+	_ fusefs.NodeStringLookuper = (*CombineDir)(nil)
+	_ fusefs.HandleReadDirAller = (*CombineDir)(nil)
+)
+
+// newCombineDir parses a --combine spec like "photos=gdrive:pics
+// docs=s3:documents" making the remotes with newFs
+func newCombineDir(spec string, newFs func(remote string) (fs.Fs, error)) (*CombineDir, error) {
+	d := &CombineDir{
+		dirs: make(map[string]*Dir),
+	}
+	for _, entry := range strings.Fields(spec) {
+		i := strings.IndexRune(entry, '=')
+		if i <= 0 || strings.ContainsRune(entry[:i], '/') {
+			return nil, errors.Errorf("bad entry %q - want name=remote:path", entry)
+		}
+		name, remote := entry[:i], entry[i+1:]
+		if _, found := d.dirs[name]; found {
+			return nil, errors.Errorf("duplicate name %q", name)
+		}
+		f, err := newFs(remote)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to make remote for %q", name)
+		}
+		d.names = append(d.names, name)
+		d.dirs[name] = newDir(f, "")
+	}
+	if len(d.names) == 0 {
+		return nil, errors.New("no remotes given")
+	}
+	return d, nil
+}
+
+// combineNewFs makes the remote for an entry of --combine
+func combineNewFs(remote string) (fs.Fs, error) {
+	if lazyConnect {
+		f, err := newLazyFs(remote, fs.NewFs)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return fs.NewFs(remote)
+}
+
+// firstFs returns the first of the remotes combined
+func (d *CombineDir) firstFs() fs.Fs {
+	return d.dirs[d.names[0]].f
+}
+
+// Attr fills out the attributes of the directory
+func (d *CombineDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	readOnlyDirAttr(a)
+	return nil
+}
+
+// Lookup finds the root of the remote called name
+func (d *CombineDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	dir, ok := d.dirs[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return dir, nil
+}
+
+// ReadDirAll lists the remotes
+func (d *CombineDir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	for _, name := range d.names {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_Dir, Name: name})
+	}
+	return dirents, nil
+}
+
+// moveBetween moves src to remote in f, which is a different remote
+// to the one src is on, by copying it and removing the original.  Its
+// MD5 stored with --compute-hash-on-write is moved with it.
+func moveBetween(src fs.Object, f fs.Fs, remote string) (fs.Object, error) {
+	fs.Debug(src, "Moving to %v by copying", f)
+	sum := ""
+	if storesHash(f) {
+		var err error
+		sum, err = objectHash(src, fs.HashMD5)
+		if err != nil {
+			fs.Debug(src, "Failed to read hash: %v", err)
+		}
+	}
+	in, err := src.Open()
+	if err != nil {
+		return nil, err
+	}
+	info := fs.NewStaticObjectInfo(remote, src.ModTime(), src.Size(), true, nil, f)
+	dst, err := f.Put(in, info)
+	closeErr := in.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if srcFs, ok := src.Fs().(fs.Fs); ok {
+		if stored := storedHashObject(srcFs, src); stored != nil {
+			err = stored.Remove()
+			if err != nil {
+				fs.ErrorLog(src, "Failed to remove stored hash: %v", err)
+			}
+		}
+	}
+	if sum != "" {
+		err = storeHash(f, dst, sum)
+		if err != nil {
+			fs.ErrorLog(dst, "Failed to store hash: %v", err)
+		}
+	}
+	return dst, src.Remove()
+}
@@ -0,0 +1,251 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// Metadata stored with the objects compressed by --compress-on-write
+const (
+	compressionMetadata = "rclone-mount-compression"  // the compression used - always "gzip"
+	decodedSizeMetadata = "rclone-mount-decoded-size" // size of the data before it was compressed
+)
+
+// shouldCompress returns whether the file remote is compressed when
+// it is written with --compress-on-write
+//
+// Files with extensions in --compress-exclude-extensions aren't, and
+// if --compress-extensions is set only files with those are.
+func shouldCompress(remote string) bool {
+	if !compressOnWrite {
+		return false
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(remote), "."))
+	if inExtensions(compressExcludeExtensions, ext) {
+		return false
+	}
+	return compressExtensions == "" || inExtensions(compressExtensions, ext)
+}
+
+// inExtensions returns whether ext is in the comma separated list of
+// extensions
+func inExtensions(extensions, ext string) bool {
+	if ext == "" {
+		return false
+	}
+	for _, e := range strings.Split(extensions, ",") {
+		if strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), ".")) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// compressed returns whether o was compressed by --compress-on-write
+// and the size of the data before it was compressed or -1 if it isn't
+// known
+func compressed(o fs.Object) (bool, int64) {
+	do, ok := o.(fs.Metadataer)
+	if !ok {
+		return false, o.Size()
+	}
+	metadata := do.Metadata()
+	if metadata[compressionMetadata] != "gzip" {
+		return false, o.Size()
+	}
+	size, err := strconv.ParseInt(metadata[decodedSizeMetadata], 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return true, size
+}
+
+// storesMetadata returns whether f stores the metadata marking files
+// as compressed so --compress-on-write can be used
+func storesMetadata(f fs.Fs) bool {
+	do, ok := f.(fs.MetadataStorer)
+	return ok && do.StoresMetadata()
+}
+
+// compressInfo is the src of the upload of a compressed file which
+// gives the metadata marking it as compressed
+type compressInfo struct {
+	fs.ObjectInfo
+	size        int64 // size of the compressed data
+	decodedSize int64 // size of the data before compression
+}
+
+// Check interface satisfied
+var _ fs.Metadataer = (*compressInfo)(nil)
+
+// Size returns the size of the compressed data
+func (ci *compressInfo) Size() int64 {
+	return ci.size
+}
+
+// Metadata marks the object as compressed with the size of the data
+// before compression
+func (ci *compressInfo) Metadata() map[string]string {
+	return map[string]string{
+		compressionMetadata: "gzip",
+		decodedSizeMetadata: strconv.FormatInt(ci.decodedSize, 10),
+	}
+}
+
+// compressUpload compresses the data read from in with gzip into a
+// temporary file and returns it with the src to upload it with.
+//
+// The data is compressed before the upload starts so the size before
+// compression is known, as remotes send the metadata before the data.
+// The file should be removed with removeUploadSpool once the upload
+// is done.
+func compressUpload(in io.Reader, src fs.ObjectInfo) (*os.File, fs.ObjectInfo, error) {
+	fs.Debug(src, "Compressing upload with --compress-on-write")
+	spool, err := ioutil.TempFile("", "rclone-mount-compress")
+	if err != nil {
+		return nil, nil, err
+	}
+	zw := gzip.NewWriter(spool)
+	decodedSize, err := io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	var size int64
+	if err == nil {
+		size, err = spool.Seek(0, 1)
+	}
+	if err == nil {
+		_, err = spool.Seek(0, 0)
+	}
+	if err != nil {
+		removeUploadSpool(spool)
+		return nil, nil, err
+	}
+	return spool, &compressInfo{ObjectInfo: src, size: size, decodedSize: decodedSize}, nil
+}
+
+// CompressedFileHandle is an open file compressed by
+// --compress-on-write which is decompressed as it is read.  It is
+// read from the start so seeking backwards reopens it and seeking
+// forwards reads and discards the data.
+type CompressedFileHandle struct {
+	position int64 // offset of the end of the last read - read and written with atomic - must be 64 bit aligned
+	mu       sync.Mutex
+	o        fs.Object
+	in       io.ReadCloser // the open object or nil
+	r        *gzip.Reader  // decompressing in
+	offset   int64         // offset of the next byte read from r
+	file     *File         // the File opened or nil
+	openDir  *Dir          // directory to release the open of the file in with --per-dir-open-limit or nil
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.HandleReader   = (*CompressedFileHandle)(nil)
+	_ fusefs.HandleReleaser = (*CompressedFileHandle)(nil)
+)
+
+// newCompressedFileHandle opens the compressed object o for reading
+func newCompressedFileHandle(o fs.Object) *CompressedFileHandle {
+	return &CompressedFileHandle{o: o}
+}
+
+// close the open object if any
+//
+// Must be called with fh.mu held
+func (fh *CompressedFileHandle) close() error {
+	if fh.in == nil {
+		return nil
+	}
+	err := fh.in.Close()
+	fh.in, fh.r = nil, nil
+	return err
+}
+
+// open the object reading from the start
+//
+// Must be called with fh.mu held
+func (fh *CompressedFileHandle) open() error {
+	_ = fh.close()
+	in, err := openObject(fh.o, "")
+	if err != nil {
+		return err
+	}
+	r, err := gzip.NewReader(in)
+	if err != nil {
+		_ = in.Close()
+		return err
+	}
+	fh.in, fh.r, fh.offset = in, r, 0
+	return nil
+}
+
+// Read from the decompressed data at req.Offset
+func (fh *CompressedFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.r == nil || req.Offset < fh.offset {
+		err = fh.open()
+		if err != nil {
+			fs.ErrorLog(fh.o, "CompressedFileHandle.Read open error: %v", err)
+			return err
+		}
+	}
+	if req.Offset > fh.offset {
+		n, err := io.CopyN(ioutil.Discard, fh.r, req.Offset-fh.offset)
+		fh.offset += n
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			fs.ErrorLog(fh.o, "CompressedFileHandle.Read skip error: %v", err)
+			return err
+		}
+	}
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(fh.r, buf)
+	fh.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		fs.ErrorLog(fh.o, "CompressedFileHandle.Read error: %v", err)
+		return err
+	}
+	resp.Data = buf[:n]
+	atomic.StoreInt64(&fh.position, fh.offset)
+	return nil
+}
+
+// readPosition returns the offset of the end of the last read
+func (fh *CompressedFileHandle) readPosition() int64 {
+	return atomic.LoadInt64(&fh.position)
+}
+
+// Release closes the object
+func (fh *CompressedFileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.file != nil {
+		fh.file.delReader(fh)
+		fh.file = nil
+	}
+	if fh.openDir != nil {
+		fh.openDir.releaseOpen()
+		fh.openDir = nil
+	}
+	return fh.close()
+}
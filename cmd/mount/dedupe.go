@@ -0,0 +1,87 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// putDedupe uploads in to the remote as src unless an object with the
+// same hash already exists in d in which case it server side copies
+// that instead.  Only d is looked in, not its subdirectories or the
+// rest of the remote.
+//
+// The data is spooled to a temporary file so the hash can be worked
+// out before deciding whether to upload it.
+func putDedupe(d *Dir, in io.Reader, src fs.ObjectInfo) (fs.Object, error) {
+	f, err := connectFs(d.f)
+	if err != nil {
+		return nil, err
+	}
+	copier, ok := f.(fs.Copier)
+	hashType := f.Hashes().GetOne()
+	if !ok || hashType == fs.HashNone {
+		return f.Put(in, src)
+	}
+	tmp, err := ioutil.TempFile("", "rclone-mount-dedupe")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	hasher, err := fs.NewMultiHasherTypes(fs.NewHashSet(hashType))
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), in)
+	if err != nil {
+		return nil, err
+	}
+	sum := hasher.Sums()[hashType]
+	if existing := d.findByHash(hashType, sum, size); existing != nil && existing.Remote() != src.Remote() {
+		fs.Debug(src, "Dedupe: copying identical object %q", existing.Remote())
+		o, err := copier.Copy(existing, src.Remote())
+		if err == nil {
+			return o, nil
+		}
+		fs.Debug(src, "Dedupe: copy failed, uploading instead: %v", err)
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	info := fs.NewStaticObjectInfo(src.Remote(), src.ModTime(), size, true, nil, src.Fs())
+	return f.Put(tmp, info)
+}
+
+// findByHash looks in the directory for an object with the size and
+// hash given returning nil if not found
+func (d *Dir) findByHash(hashType fs.HashType, sum string, size int64) fs.Object {
+	if sum == "" {
+		return nil
+	}
+	err := d.readDir()
+	if err != nil {
+		fs.Debug(d.path, "Dedupe: failed to read directory: %v", err)
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, item := range d.items {
+		o, ok := item.o.(fs.Object)
+		if !ok || o.Size() != size {
+			continue
+		}
+		oSum, err := o.Hash(hashType)
+		if err == nil && oSum == sum {
+			return o
+		}
+	}
+	return nil
+}
@@ -5,7 +5,9 @@ package mount
 import (
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -32,6 +34,37 @@ type Dir struct {
 	mu    sync.RWMutex // protects the following
 	read  time.Time    // time directory entry last read
 	items map[string]*DirEntry
+	// files being created which haven't been uploaded yet by leaf
+	writing map[string]*File
+	newest  time.Time   // newest modification time of the items if --dir-mtime newest-child
+	tags    *TagsDir    // the .tags directory of the root with --tag-browse
+	recent  *RecentDir  // the .recent directory of the root with --recent-count
+	staging *StagingDir // the .staging directory of the root with --staging
+	// tree hash with --tree-hash and the listing it was made from
+	treeHashValue string
+	treeHashRead  time.Time
+	treeHashSubs  map[string]string // tree hashes of the subdirectories with --tree-hash recursive
+	// sidecars of the items by leaf with --sidecar-as-xattr
+	sidecars map[string]*sidecar
+	// closed when the rest of a partial listing has been read with
+	// --dir-first-page or nil if the items are complete
+	listing chan struct{}
+	// closed when the metadata being read in the background with
+	// --dir-prefetch-concurrency has been read or nil if it isn't
+	prefetching chan struct{}
+	// incremented each time an item is added or removed, and the
+	// leaves changed while a listing is in progress or nil
+	generation uint64
+	changed    map[string]struct{}
+
+	uploadsMu     sync.Mutex      // protects the following
+	uploads       int             // number of uploads of children in progress
+	uploadWaiters []chan struct{} // closed when uploads drops to 0
+
+	openOnce  sync.Once
+	openSlots chan struct{} // holds a value for each file open for reading with --per-dir-open-limit
+
+	listMu sync.Mutex // held while the directory is listed - take before mu
 }
 
 func newDir(f fs.Fs, path string) *Dir {
@@ -45,12 +78,32 @@ func newDir(f fs.Fs, path string) *Dir {
 //
 // note that we add new objects rather than updating old ones
 func (d *Dir) addObject(o fs.BasicInfo, node fusefs.Node) *DirEntry {
+	return d.addItem(d.leaf(o.Remote()), o, node)
+}
+
+// Values for --dir-mtime
+const (
+	// dirMtimeNewestChild uses the newest modification time of
+	// the items in a directory as its modification time
+	dirMtimeNewestChild = "newest-child"
+
+	// dirMtimeMaxItems is the largest directory the newest
+	// modification time is found for
+	dirMtimeMaxItems = 10000
+)
+
+// addItem adds a new object or directory to the directory as leaf
+func (d *Dir) addItem(leaf string, o fs.BasicInfo, node fusefs.Node) *DirEntry {
 	item := &DirEntry{
 		o:    o,
 		node: node,
 	}
 	d.mu.Lock()
-	d.items[path.Base(o.Remote())] = item
+	d.items[leaf] = item
+	d.itemChanged(leaf)
+	if dirMtime == dirMtimeNewestChild && o.ModTime().After(d.newest) {
+		d.newest = o.ModTime()
+	}
 	d.mu.Unlock()
 	return item
 }
@@ -59,48 +112,275 @@ func (d *Dir) addObject(o fs.BasicInfo, node fusefs.Node) *DirEntry {
 func (d *Dir) delObject(leaf string) {
 	d.mu.Lock()
 	delete(d.items, leaf)
+	d.itemChanged(leaf)
 	d.mu.Unlock()
 }
 
+// itemChanged records that the item leaf has been added or removed so
+// a listing in progress doesn't lose the change
+//
+// Call with d.mu held
+func (d *Dir) itemChanged(leaf string) {
+	d.generation++
+	if d.changed != nil {
+		d.changed[leaf] = struct{}{}
+	}
+}
+
+// startListing starts recording the items changed while the directory
+// is listed returning the generation the listing started at
+//
+// Call with d.mu held
+func (d *Dir) startListing() uint64 {
+	d.changed = make(map[string]struct{})
+	return d.generation
+}
+
+// writingItems returns the items of files being written which the
+// listing may not have caught up with yet
+//
+// Call without d.mu held as it takes the locks of the files
+func (d *Dir) writingItems() map[string]*DirEntry {
+	d.mu.RLock()
+	items := make(map[string]*DirEntry)
+	for leaf, item := range d.items {
+		if _, ok := item.node.(*File); ok {
+			items[leaf] = item
+		}
+	}
+	d.mu.RUnlock()
+	for leaf, item := range items {
+		if !item.node.(*File).hasWriters() {
+			delete(items, leaf)
+		}
+	}
+	return items
+}
+
+// swapItems replaces the items of the directory with those listed by
+// a listing started at generation gen, keeping the items of files
+// being written and any items changed since the listing started as
+// the listing may not include those changes.
+//
+// Call with d.mu held
+func (d *Dir) swapItems(gen uint64, objs []fs.Object, dirs []*fs.Dir, writing map[string]*DirEntry) {
+	oldItems := d.items
+	changed := d.changed
+	d.changed = nil
+	d.setItems(objs, dirs)
+	for leaf, item := range writing {
+		d.items[leaf] = item
+	}
+	if d.generation == gen {
+		return
+	}
+	fs.Debug(d.path, "Keeping %d items changed while listing", len(changed))
+	for leaf := range changed {
+		if item, ok := oldItems[leaf]; ok {
+			d.items[leaf] = item
+		} else {
+			delete(d.items, leaf)
+		}
+	}
+}
+
+// addWriting records that file is being created as leaf
+func (d *Dir) addWriting(leaf string, file *File) {
+	d.mu.Lock()
+	if d.writing == nil {
+		d.writing = make(map[string]*File)
+	}
+	d.writing[leaf] = file
+	d.mu.Unlock()
+}
+
+// delWriting removes file from the files being created
+func (d *Dir) delWriting(file *File) {
+	d.mu.Lock()
+	for leaf, f := range d.writing {
+		if f == file {
+			delete(d.writing, leaf)
+		}
+	}
+	d.mu.Unlock()
+}
+
+// writingFile returns the file being created as leaf or nil
+func (d *Dir) writingFile(leaf string) *File {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.writing[leaf]
+}
+
+// addUploads adds n to the number of uploads of children being
+// finished by closed handles waking up anyone waiting for them to finish if there are none left
+func (d *Dir) addUploads(n int) {
+	d.uploadsMu.Lock()
+	defer d.uploadsMu.Unlock()
+	d.uploads += n
+	if d.uploads == 0 {
+		for _, waiter := range d.uploadWaiters {
+			close(waiter)
+		}
+		d.uploadWaiters = nil
+	}
+}
+
+// waitForUploads waits for the uploads of children in progress to
+// finish or for ctx to be cancelled
+func (d *Dir) waitForUploads(ctx context.Context) error {
+	d.uploadsMu.Lock()
+	if d.uploads == 0 {
+		d.uploadsMu.Unlock()
+		return nil
+	}
+	fs.Debug(d.path, "Waiting for %d uploads", d.uploads)
+	waiter := make(chan struct{})
+	d.uploadWaiters = append(d.uploadWaiters, waiter)
+	d.uploadsMu.Unlock()
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		return fuse.EINTR
+	}
+}
+
 // read the directory
 func (d *Dir) readDir() error {
+	return d.readDirContext(context.Background())
+}
+
+// readDirContext reads the directory if it hasn't been read within
+// --dir-cache-time
+//
+// Failed listings are retried without d.mu held so the items already
+// read can still be used, giving up if ctx is cancelled.  Changes made
+// to the items meanwhile are kept when the listing replaces them.
+func (d *Dir) readDirContext(ctx context.Context) error {
+	d.listMu.Lock()
+	defer d.listMu.Unlock()
 	d.mu.Lock()
-	defer d.mu.Unlock()
 	when := time.Now()
-	if d.read.IsZero() {
+	if d.listing != nil {
+		// the rest is still being listed
+		d.mu.Unlock()
+		return nil
+	} else if d.read.IsZero() {
 		fs.Debug(d.path, "Reading directory")
 	} else {
 		age := when.Sub(d.read)
 		if age < dirCacheTime {
+			d.mu.Unlock()
 			return nil
 		}
 		fs.Debug(d.path, "Re-reading directory (%v old)", age)
 	}
-	objs, dirs, err := fs.NewLister().SetLevel(1).Start(d.f, d.path).GetAll()
+	level := 1
+	if flatten {
+		level = fs.MaxLevel
+	}
+	gen := d.startListing()
+	d.mu.Unlock()
+	if dirFirstPage > 0 && !assembleParts && overlay == nil {
+		// wait without the lock so the directory can still be
+		// used while the listing is rate limited
+		waitToList()
+		lister := fs.NewLister().SetLevel(level).Start(d.f, d.path)
+		writing := d.writingItems()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.readFirstPage(lister, when, gen, writing)
+	}
+	objs, dirs, err := d.listAll(ctx, level)
+	writing := d.writingItems()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if err == fs.ErrorDirNotFound {
 		// We treat directory not found as empty because we
 		// create directories on the fly
 	} else if err != nil {
+		d.changed = nil
 		return err
 	}
+	objs, dirs = overlayListing(d.path, level, objs, dirs)
+	d.swapItems(gen, objs, dirs, writing)
+	d.read = when
+	return nil
+}
+
+// listRetrySleep is the time to sleep before the first retry of a
+// failed directory listing - it doubles after each retry
+var listRetrySleep = 100 * time.Millisecond
+
+// listAll lists the directory at level, retrying failed listings up
+// to --low-level-retries times with backoff.
+//
+// Like the low level retries of copies only errors which ask to be
+// retried or look temporary, eg timeouts, are retried.  This returns
+// EINTR if ctx is cancelled while waiting to retry.
+//
+// Call without d.mu held
+func (d *Dir) listAll(ctx context.Context, level int) (objs []fs.Object, dirs []*fs.Dir, err error) {
+	sleep := listRetrySleep
+	for try := 1; ; try++ {
+		waitToList()
+		objs, dirs, err = fs.NewLister().SetLevel(level).Start(d.f, d.path).GetAll()
+		retry := fs.IsRetryError(err) || fs.ShouldRetry(err)
+		if !retry || fs.IsNoRetryError(err) || fs.IsFatalError(err) || try >= fs.Config.LowLevelRetries {
+			return objs, dirs, err
+		}
+		fs.Debug(d.path, "List failed - retrying in %v (%d/%d): %v", sleep, try, fs.Config.LowLevelRetries, err)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return nil, nil, fuse.EINTR
+		}
+		sleep *= 2
+	}
+}
+
+// setItems replaces the items of the directory with those listed
+//
+// Call with d.mu held
+func (d *Dir) setItems(objs []fs.Object, dirs []*fs.Dir) {
+	if flatten {
+		// only the objects are shown
+		dirs = nil
+	}
 	// NB when we re-read a directory after its cache has expired
 	// we drop the old files which should lead to correct
 	// behaviour but may not be very efficient.
 
+	if assembleParts {
+		objs = joinParts(objs)
+	}
+
 	// Keep a note of the previous contents of the directory
 	oldItems := d.items
 
 	// Cache the items by name
 	d.items = make(map[string]*DirEntry, len(objs)+len(dirs))
 	for _, obj := range objs {
-		name := path.Base(obj.Remote())
+		name, isDir, ok := d.listedObject(obj)
+		if !ok {
+			continue
+		}
+		if isDir {
+			dirs = append(dirs, &fs.Dir{Name: normalizeKey(obj.Remote()), When: obj.ModTime()})
+			continue
+		}
 		d.items[name] = &DirEntry{
 			o:    obj,
 			node: nil,
 		}
 	}
+	d.sidecars = hideSidecars(d.items)
 	for _, dir := range dirs {
-		name := path.Base(dir.Remote())
+		name, ok := d.listedDir(dir)
+		if !ok {
+			continue
+		}
 		// Use old dir value if it exists
 		if oldItem, ok := oldItems[name]; ok {
 			if _, ok := oldItem.o.(*fs.Dir); ok {
@@ -113,10 +393,110 @@ func (d *Dir) readDir() error {
 			node: nil,
 		}
 	}
-	d.read = when
+	normalizeItems(d.items)
+	d.newest = time.Time{}
+	if dirMtime == dirMtimeNewestChild && len(d.items) <= dirMtimeMaxItems {
+		for _, item := range d.items {
+			if modTime := item.o.ModTime(); modTime.After(d.newest) {
+				d.newest = modTime
+			}
+		}
+	}
+}
+
+// listedObject returns the name the object o listed in d is shown
+// as, whether it is shown as a directory and whether it is shown at
+// all.
+func (d *Dir) listedObject(o fs.Object) (name string, isDir bool, ok bool) {
+	name, ok = d.listedName(o.Remote())
+	if !ok || isStoredHash(o.Remote()) || isDirPlaceholder(o.Remote()) {
+		return "", false, false
+	}
+	if isDirMarker(o) {
+		return name, true, !isFilteredDir(normalizeKey(o.Remote()))
+	}
+	return name, false, !isFiltered(o)
+}
+
+// listedDir returns the name the directory dir listed in d is shown
+// as and whether it is shown at all.
+func (d *Dir) listedDir(dir *fs.Dir) (name string, ok bool) {
+	name, ok = d.listedName(dir.Remote())
+	return name, ok && !isFilteredDir(dir.Remote())
+}
+
+// readFirstPage reads the first --dir-first-page entries from lister
+// into the items then reads the rest in the background, replacing
+// the items with the complete listing when it is done.
+//
+// The listing started at generation gen and writing are the items of
+// files being written when it finished, as used by swapItems.
+//
+// Call with d.mu held
+func (d *Dir) readFirstPage(lister *fs.Lister, when time.Time, gen uint64, writing map[string]*DirEntry) error {
+	var objs []fs.Object
+	var dirs []*fs.Dir
+	for len(objs)+len(dirs) < dirFirstPage {
+		o, dir, err := lister.Get()
+		switch {
+		case err == fs.ErrorDirNotFound:
+			// treat directory not found as empty
+			d.swapItems(gen, objs, dirs, writing)
+			d.read = when
+			return nil
+		case err != nil:
+			lister.Finished()
+			d.changed = nil
+			return err
+		case o != nil:
+			objs = append(objs, o)
+		case dir != nil:
+			dirs = append(dirs, dir)
+		default:
+			// the listing is complete
+			d.swapItems(gen, objs, dirs, writing)
+			d.read = when
+			return nil
+		}
+	}
+	fs.Debug(d.path, "Returning first %d entries and reading the rest in the background", len(objs)+len(dirs))
+	d.swapItems(gen, objs, dirs, writing)
+	gen = d.startListing()
+	listing := make(chan struct{})
+	d.listing = listing
+	go func() {
+		defer close(listing)
+		moreObjs, moreDirs, err := lister.GetAll()
+		writing := d.writingItems()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.listing = nil
+		if err != nil && err != fs.ErrorDirNotFound {
+			// leave the partial items to be read again
+			fs.ErrorLog(d.path, "Failed to read rest of directory: %v", err)
+			d.changed = nil
+			return
+		}
+		d.swapItems(gen, append(objs, moreObjs...), append(dirs, moreDirs...), writing)
+		d.read = when
+		fs.Debug(d.path, "Read rest of directory")
+	}()
 	return nil
 }
 
+// waitForListing waits for any partial listing of the directory to
+// complete returning whether there was one
+func (d *Dir) waitForListing() bool {
+	d.mu.RLock()
+	listing := d.listing
+	d.mu.RUnlock()
+	if listing == nil {
+		return false
+	}
+	<-listing
+	return true
+}
+
 // lookup a single item in the directory
 //
 // returns fuse.ENOENT if not found.
@@ -128,12 +508,45 @@ func (d *Dir) lookup(leaf string) (*DirEntry, error) {
 	d.mu.RLock()
 	item, ok := d.items[leaf]
 	d.mu.RUnlock()
+	if !ok && d.waitForListing() {
+		// leaf may be in the part of the listing not read yet
+		d.mu.RLock()
+		item, ok = d.items[leaf]
+		d.mu.RUnlock()
+	}
+	if name := normalizeUnicode(leaf); !ok && name != leaf {
+		d.mu.RLock()
+		item, ok = d.items[name]
+		d.mu.RUnlock()
+	}
 	if !ok {
 		return nil, fuse.ENOENT
 	}
 	return item, nil
 }
 
+// checkCaseCollision returns EEXIST if --reject-case-collisions is
+// set and there is an item other than except in the directory whose
+// name differs from leaf only in case.
+func (d *Dir) checkCaseCollision(leaf, except string) error {
+	if !rejectCaseCollisions {
+		return nil
+	}
+	err := d.readDir()
+	if err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for name := range d.items {
+		if name != leaf && name != except && strings.EqualFold(name, leaf) {
+			fs.ErrorLog(path.Join(d.path, leaf), "Rejecting name which differs only in case from %q", name)
+			return fuse.EEXIST
+		}
+	}
+	return nil
+}
+
 // Check to see if a directory is empty
 func (d *Dir) isEmpty() (bool, error) {
 	err := d.readDir()
@@ -155,9 +568,56 @@ func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Uid = uid
 	a.Mode = os.ModeDir | dirPerms
 	// FIXME include Valid so get some caching? Also mtime
+	if dirMtime == dirMtimeNewestChild {
+		// use the items already listed rather than listing the
+		// directory for every stat
+		d.mu.RLock()
+		newest := d.newest
+		d.mu.RUnlock()
+		if !newest.IsZero() {
+			a.Atime = newest
+			a.Mtime = newest
+			a.Ctime = newest
+		}
+	}
+	a.Nlink = d.nlink()
 	return nil
 }
 
+// nlink returns the link count of the directory which is 2 plus the
+// number of subdirectories so find can skip stating the files
+//
+// It is 1 if the directory hasn't been listed which tells find the
+// subdirectories aren't known so it must look at every entry.
+func (d *Dir) nlink() uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.read.IsZero() {
+		return 1
+	}
+	nlink := uint32(2)
+	for _, item := range d.items {
+		switch x := item.o.(type) {
+		case fs.Object:
+			if isArchive(x.Remote()) {
+				nlink++
+			}
+		case *fs.Dir:
+			nlink++
+		}
+	}
+	if d.path == "" && tagBrowse {
+		nlink++
+	}
+	if d.path == "" && recentCount > 0 {
+		nlink++
+	}
+	if d.path == "" && staging {
+		nlink++
+	}
+	return nlink
+}
+
 // lookupNode calls lookup then makes sure the node is not nil in the DirEntry
 func (d *Dir) lookupNode(leaf string) (item *DirEntry, err error) {
 	item, err = d.lookup(leaf)
@@ -170,7 +630,11 @@ func (d *Dir) lookupNode(leaf string) (item *DirEntry, err error) {
 	var node fusefs.Node
 	switch x := item.o.(type) {
 	case fs.Object:
-		node, err = newFile(d, x), nil
+		if isArchive(x.Remote()) {
+			node, err = newArchiveDir(x), nil
+		} else {
+			node, err = newFile(d, x), nil
+		}
 	case *fs.Dir:
 		node, err = newDir(d.f, x.Remote()), nil
 	default:
@@ -179,10 +643,42 @@ func (d *Dir) lookupNode(leaf string) (item *DirEntry, err error) {
 	if err != nil {
 		return nil, err
 	}
-	item = d.addObject(item.o, node)
+	item = d.addItem(leaf, item.o, node)
 	return item, err
 }
 
+// acquireOpen waits until fewer than --per-dir-open-limit files in d
+// are open for reading then counts another one, returning whether it
+// did.  It returns EINTR if ctx is cancelled while waiting.
+//
+// If it returns true then releaseOpen must be called when the file is
+// closed.
+func (d *Dir) acquireOpen(ctx context.Context) (bool, error) {
+	if perDirOpenLimit <= 0 {
+		return false, nil
+	}
+	d.openOnce.Do(func() {
+		d.openSlots = make(chan struct{}, perDirOpenLimit)
+	})
+	select {
+	case d.openSlots <- struct{}{}:
+		return true, nil
+	default:
+	}
+	fs.Debug(d.path, "Waiting for a file in the directory to be closed with --per-dir-open-limit")
+	select {
+	case d.openSlots <- struct{}{}:
+		return true, nil
+	case <-ctx.Done():
+		return false, fuse.EINTR
+	}
+}
+
+// releaseOpen lets another file in d be opened for reading
+func (d *Dir) releaseOpen() {
+	<-d.openSlots
+}
+
 // Check interface satisfied
 var _ fusefs.NodeRequestLookuper = (*Dir)(nil)
 
@@ -194,15 +690,38 @@ var _ fusefs.NodeRequestLookuper = (*Dir)(nil)
 // Lookup need not to handle the names "." and "..".
 func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (node fusefs.Node, err error) {
 	path := path.Join(d.path, req.Name)
-	fs.Debug(path, "Dir.Lookup")
+	op := opLog{o: path, id: newRequestID()}
+	fs.Debug(op, "Dir.Lookup")
+	if d.path == "" && req.Name == statusFileName {
+		return &StatusFile{}, nil
+	}
+	if d.path == "" && tagBrowse && req.Name == tagsDirName {
+		return d.tagsDir(), nil
+	}
+	if d.path == "" && recentCount > 0 && req.Name == recentDirName {
+		return d.recentDir(), nil
+	}
+	if d.path == "" && staging && req.Name == stagingDirName {
+		return d.stagingDir(), nil
+	}
 	item, err := d.lookupNode(req.Name)
+	if err == fuse.ENOENT {
+		if file := d.writingFile(req.Name); file != nil {
+			fs.Debug(op, "Dir.Lookup OK (being written)")
+			return file, nil
+		}
+		if meta := d.metaFile(req.Name); meta != nil {
+			fs.Debug(op, "Dir.Lookup OK (metadata file)")
+			return meta, nil
+		}
+	}
 	if err != nil {
 		if err != fuse.ENOENT {
-			fs.ErrorLog(path, "Dir.Lookup error: %v", err)
+			fs.ErrorLog(op, "Dir.Lookup error: %v", err)
 		}
 		return nil, err
 	}
-	fs.Debug(path, "Dir.Lookup OK")
+	fs.Debug(op, "Dir.Lookup OK")
 	return item.node, nil
 }
 
@@ -211,37 +730,59 @@ var _ fusefs.HandleReadDirAller = (*Dir)(nil)
 
 // ReadDirAll reads the contents of the directory
 func (d *Dir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
-	fs.Debug(d.path, "Dir.ReadDirAll")
-	err = d.readDir()
+	op := opLog{o: d.path, id: newRequestID()}
+	fs.Debug(op, "Dir.ReadDirAll")
+	err = d.readDirContext(ctx)
 	if err != nil {
-		fs.Debug(d.path, "Dir.ReadDirAll error: %v", err)
+		fs.Debug(op, "Dir.ReadDirAll error: %v", err)
 		return nil, err
 	}
+	if dirPrefetchConcurrency > 0 {
+		d.startPrefetch()
+	}
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	for _, item := range d.items {
+	for name, item := range d.items {
 		var dirent fuse.Dirent
 		switch x := item.o.(type) {
 		case fs.Object:
 			dirent = fuse.Dirent{
 				// Inode FIXME ???
 				Type: fuse.DT_File,
-				Name: path.Base(x.Remote()),
+				Name: name,
+			}
+			if isArchive(x.Remote()) {
+				dirent.Type = fuse.DT_Dir
 			}
 		case *fs.Dir:
 			dirent = fuse.Dirent{
 				// Inode FIXME ???
 				Type: fuse.DT_Dir,
-				Name: path.Base(x.Remote()),
+				Name: name,
 			}
 		default:
 			err = errors.Errorf("unknown type %T", item)
-			fs.ErrorLog(d.path, "Dir.ReadDirAll error: %v", err)
+			fs.ErrorLog(op, "Dir.ReadDirAll error: %v", err)
 			return nil, err
 		}
 		dirents = append(dirents, dirent)
 	}
-	fs.Debug(d.path, "Dir.ReadDirAll OK with %d entries", len(dirents))
+	for _, name := range d.metaFileNames() {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_File, Name: name})
+	}
+	if d.path == "" && statusFile {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_File, Name: statusFileName})
+	}
+	if d.path == "" && tagBrowse {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_Dir, Name: tagsDirName})
+	}
+	if d.path == "" && recentCount > 0 {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_Dir, Name: recentDirName})
+	}
+	if d.path == "" && staging {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_Dir, Name: stagingDirName})
+	}
+	fs.Debug(op, "Dir.ReadDirAll OK with %d entries", len(dirents))
 	return dirents, nil
 }
 
@@ -249,35 +790,122 @@ var _ fusefs.NodeCreater = (*Dir)(nil)
 
 // Create makes a new file
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
-	path := path.Join(d.path, req.Name)
-	fs.Debug(path, "Dir.Create")
+	path := d.remote(req.Name)
+	op := opLog{o: path, id: newRequestID()}
+	fs.Debug(op, "Dir.Create")
+	err := checkACL(&req.Header, path, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = d.checkCaseCollision(req.Name, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	d.mu.RLock()
+	item := d.items[req.Name]
+	d.mu.RUnlock()
+	if item != nil {
+		if _, ok := item.o.(*partsObject); ok {
+			fs.ErrorLog(op, "Dir.Create can't replace file assembled from parts")
+			return nil, nil, fuse.EPERM
+		}
+	}
+	err = checkFilteredWrite(path, false)
+	if err != nil {
+		return nil, nil, err
+	}
 	src := newCreateInfo(d.f, path)
 	// This gets added to the directory when the file is written
 	file := newFile(d, nil)
-	fh, err := newWriteFileHandle(d, file, src)
+	d.addWriting(req.Name, file)
+	fh, err := newWriteFileHandle(ctx, d, file, src)
+	if err != nil {
+		d.delWriting(file)
+		fs.ErrorLog(op, "Dir.Create error: %v", err)
+		return nil, nil, err
+	}
+	var existing fs.Object
+	if item != nil {
+		existing, _ = item.o.(fs.Object)
+	}
+	if existing != nil {
+		// keep the existing data unless truncating
+		if fh.cache != nil && req.Flags&fuse.OpenTruncate == 0 {
+			err = fh.seedWriteCache(existing)
+		}
+	} else {
+		err = seedFromTemplate(d, req.Name, fh)
+	}
 	if err != nil {
-		fs.ErrorLog(path, "Dir.Create error: %v", err)
+		fs.ErrorLog(op, "Dir.Create seed error: %v", err)
+		fh.abort(err)
 		return nil, nil, err
 	}
-	fs.Debug(path, "Dir.Create OK")
+	fs.Debug(op, "Dir.Create OK")
 	return file, fh, nil
 }
 
+var _ fusefs.NodeFsyncer = (*Dir)(nil)
+
+// Fsync the directory
+//
+// This waits for the uploads of the files closed in the directory so
+// they are all on the remote when it returns.  Files still open for
+// write aren't waited for.
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	op := opLog{o: d.path, id: newRequestID()}
+	fs.Debug(op, "Dir.Fsync")
+	err := d.waitForUploads(ctx)
+	if err != nil {
+		fs.ErrorLog(op, "Dir.Fsync error: %v", err)
+		return err
+	}
+	fs.Debug(op, "Dir.Fsync OK")
+	return nil
+}
+
 var _ fusefs.NodeMkdirer = (*Dir)(nil)
 
 // Mkdir creates a new directory
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
 	// We just pretend to have created the directory - rclone will
 	// actually create the directory if we write files into it
-	path := path.Join(d.path, req.Name)
-	fs.Debug(path, "Dir.Mkdir")
+	path := d.remote(req.Name)
+	op := opLog{o: path, id: newRequestID()}
+	fs.Debug(op, "Dir.Mkdir")
+	err := checkACL(&req.Header, path, true)
+	if err != nil {
+		return nil, err
+	}
+	err = d.checkCaseCollision(req.Name, "")
+	if err != nil {
+		return nil, err
+	}
+	if flatten {
+		fs.ErrorLog(op, "Dir.Mkdir can't make directories with --flatten")
+		return nil, fuse.EPERM
+	}
+	err = checkFilteredWrite(path, true)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFreeSpace(d.f)
+	if err != nil {
+		fs.ErrorLog(op, "Dir.Mkdir error: %v", err)
+		return nil, err
+	}
+	err = writeDirPlaceholder(d.f, path)
+	if err != nil {
+		fs.ErrorLog(op, "Dir.Mkdir placeholder error: %v", err)
+		return nil, err
+	}
 	fsDir := &fs.Dir{
 		Name: path,
 		When: time.Now(),
 	}
 	dir := newDir(d.f, path)
 	d.addObject(fsDir, dir)
-	fs.Debug(path, "Dir.Mkdir OK")
+	fs.Debug(op, "Dir.Mkdir OK")
 	return dir, nil
 }
 
@@ -287,20 +915,55 @@ var _ fusefs.NodeRemover = (*Dir)(nil)
 // the receiver, which must be a directory.  The entry to be removed
 // may correspond to a file (unlink) or to a directory (rmdir).
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	path := path.Join(d.path, req.Name)
-	fs.Debug(path, "Dir.Remove")
+	path := d.remote(req.Name)
+	op := opLog{o: path, id: newRequestID()}
+	fs.Debug(op, "Dir.Remove")
+	err := checkACL(&req.Header, path, true)
+	if err != nil {
+		return err
+	}
+	cancelled := false
+	if file := d.writingFile(req.Name); file != nil {
+		// stop the upload of the file being created
+		file.cancelWriters()
+		d.delWriting(file)
+		cancelled = true
+	}
 	item, err := d.lookupNode(req.Name)
+	if err == fuse.ENOENT && cancelled {
+		fs.Debug(op, "Dir.Remove OK (upload cancelled)")
+		return nil
+	}
 	if err != nil {
-		fs.ErrorLog(path, "Dir.Remove error: %v", err)
+		fs.ErrorLog(op, "Dir.Remove error: %v", err)
 		return err
 	}
 	switch x := item.o.(type) {
 	case fs.Object:
+		if _, ok := item.node.(*ArchiveDir); ok {
+			// the archive is shown as a read only directory
+			fs.ErrorLog(op, "Dir.Remove can't remove mounted archive")
+			return fuse.EPERM
+		}
+		if overlayProtected(x) {
+			fs.ErrorLog(op, "Dir.Remove can't remove file on the remote with --overlay-writes")
+			return fuse.EPERM
+		}
+		if file, ok := item.node.(*File); ok {
+			// stop any uploads replacing the file
+			file.cancelWriters()
+		}
 		err = x.Remove()
 		if err != nil {
-			fs.ErrorLog(path, "Dir.Remove file error: %v", err)
+			fs.ErrorLog(op, "Dir.Remove file error: %v", err)
 			return err
 		}
+		if stored := storedHashObject(d.f, x); stored != nil {
+			err = stored.Remove()
+			if err != nil {
+				fs.ErrorLog(op, "Dir.Remove stored hash error: %v", err)
+			}
+		}
 	case *fs.Dir:
 		// Do nothing for deleting directory - rclone can't
 		// currently remote a random directory
@@ -309,21 +972,55 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		dir := item.node.(*Dir)
 		empty, err := dir.isEmpty()
 		if err != nil {
-			fs.ErrorLog(path, "Dir.Remove dir error: %v", err)
+			fs.ErrorLog(op, "Dir.Remove dir error: %v", err)
 			return err
 		}
 		if !empty {
 			// return fuse.ENOTEMPTY - doesn't exist though so use EEXIST
-			fs.ErrorLog(path, "Dir.Remove not empty")
+			fs.ErrorLog(op, "Dir.Remove not empty")
 			return fuse.EEXIST
 		}
+		err = removeDirPlaceholder(dir.f, dir.path)
+		if err != nil {
+			fs.ErrorLog(op, "Dir.Remove placeholder error: %v", err)
+			return err
+		}
 	default:
-		fs.ErrorLog(path, "Dir.Remove unknown type %T", item)
+		fs.ErrorLog(op, "Dir.Remove unknown type %T", item)
 		return errors.Errorf("unknown type %T", item)
 	}
 	// Remove the item from the directory listing
 	d.delObject(req.Name)
-	fs.Debug(path, "Dir.Remove OK")
+	fs.Debug(op, "Dir.Remove OK")
+	return nil
+}
+
+// checkRenameTarget returns EBUSY if leaf is a file with open write
+// handles as their uploads would replace whatever is renamed over it,
+// or EPERM if it is an object which can't be replaced with --immutable.
+//
+// Files with open read handles can be renamed over.  Adding the new
+// object replaces the File for leaf so the handles keep the object
+// they were opened on while the name refers to the new one.
+func (d *Dir) checkRenameTarget(leaf string) error {
+	d.mu.RLock()
+	item := d.items[leaf]
+	d.mu.RUnlock()
+	if item != nil && immutable {
+		if _, ok := item.o.(fs.Object); ok {
+			// replacing the file would modify it
+			return fuse.EPERM
+		}
+	}
+	file := d.writingFile(leaf)
+	if item != nil {
+		if node, ok := item.node.(*File); ok {
+			file = node
+		}
+	}
+	if file != nil && file.hasWriters() {
+		return fuse.Errno(syscall.EBUSY)
+	}
 	return nil
 }
 
@@ -333,47 +1030,121 @@ var _ fusefs.NodeRenamer = (*Dir)(nil)
 // Rename the file
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
 	oldPath := path.Join(d.path, req.OldName)
+	op := opLog{o: oldPath, id: newRequestID()}
 	destDir, ok := newDir.(*Dir)
 	if !ok {
 		err := errors.Errorf("Unknown Dir type %T", newDir)
-		fs.ErrorLog(oldPath, "Dir.Rename error: %v", err)
+		fs.ErrorLog(op, "Dir.Rename error: %v", err)
+		return err
+	}
+	newPath := destDir.remote(req.NewName)
+	fs.Debug(op, "Dir.Rename to %q", newPath)
+	for _, remote := range []string{oldPath, newPath} {
+		err := checkACL(&req.Header, remote, true)
+		if err != nil {
+			return err
+		}
+	}
+	except := ""
+	if destDir == d {
+		// allow changing the case of a name
+		except = req.OldName
+	}
+	err := destDir.checkCaseCollision(req.NewName, except)
+	if err != nil {
+		return err
+	}
+	err = destDir.checkRenameTarget(req.NewName)
+	if err != nil {
+		fs.ErrorLog(newPath, "Dir.Rename error: %v", err)
 		return err
 	}
-	newPath := path.Join(destDir.path, req.NewName)
-	fs.Debug(oldPath, "Dir.Rename to %q", newPath)
 	oldItem, err := d.lookupNode(req.OldName)
 	if err != nil {
-		fs.ErrorLog(oldPath, "Dir.Rename error: %v", err)
+		fs.ErrorLog(op, "Dir.Rename error: %v", err)
+		return err
+	}
+	if o, ok := oldItem.o.(fs.Object); ok && overlayProtected(o) {
+		fs.ErrorLog(op, "Dir.Rename can't move file on the remote with --overlay-writes")
+		return fuse.EPERM
+	}
+	_, isDir := oldItem.o.(*fs.Dir)
+	if isDir {
+		for _, remote := range []string{oldPath, newPath} {
+			err := checkACLDir(&req.Header, remote)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = checkFilteredWrite(newPath, isDir)
+	if err != nil {
 		return err
 	}
 	var newObj fs.BasicInfo
 	switch x := oldItem.o.(type) {
 	case fs.Object:
 		oldObject := x
-		do, ok := d.f.(fs.Mover)
+		if destDir.f != d.f {
+			// the directories are on different remotes with
+			// --combine so the object can't be moved
+			newObject, err := moveBetween(oldObject, destDir.f, newPath)
+			if err != nil {
+				fs.ErrorLog(op, "Dir.Rename error: %v", err)
+				return err
+			}
+			newObj = newObject
+			break
+		}
+		f, err := connectFs(d.f)
+		if err != nil {
+			fs.ErrorLog(op, "Dir.Rename error: %v", err)
+			return err
+		}
+		do, ok := f.(fs.Mover)
 		if !ok {
 			err := errors.Errorf("Fs %q can't Move files", d.f)
-			fs.ErrorLog(oldPath, "Dir.Rename error: %v", err)
+			fs.ErrorLog(op, "Dir.Rename error: %v", err)
 			return err
 		}
 		newObject, err := do.Move(oldObject, newPath)
 		if err != nil {
-			fs.ErrorLog(oldPath, "Dir.Rename error: %v", err)
+			fs.ErrorLog(op, "Dir.Rename error: %v", err)
 			return err
 		}
+		if stored := storedHashObject(d.f, oldObject); stored != nil {
+			_, err = do.Move(stored, newPath+storedHashSuffix)
+			if err != nil {
+				fs.ErrorLog(op, "Dir.Rename stored hash error: %v", err)
+			}
+		}
 		newObj = newObject
 	case *fs.Dir:
+		if destDir.f != d.f {
+			// the directories are on different remotes with
+			// --combine so let the caller copy the directory
+			fs.Debug(op, "Dir.Rename can't rename directory between remotes")
+			return fuse.Errno(syscall.EXDEV)
+		}
 		oldDir := oldItem.node.(*Dir)
 		empty, err := oldDir.isEmpty()
 		if err != nil {
-			fs.ErrorLog(oldPath, "Dir.Rename dir error: %v", err)
+			fs.ErrorLog(op, "Dir.Rename dir error: %v", err)
 			return err
 		}
 		if !empty {
 			// return fuse.ENOTEMPTY - doesn't exist though so use EEXIST
-			fs.ErrorLog(oldPath, "Dir.Rename can't rename non empty directory")
+			fs.ErrorLog(op, "Dir.Rename can't rename non empty directory")
 			return fuse.EEXIST
 		}
+		err = writeDirPlaceholder(destDir.f, newPath)
+		if err == nil {
+			err = removeDirPlaceholder(oldDir.f, oldDir.path)
+		}
+		if err != nil {
+			fs.ErrorLog(op, "Dir.Rename placeholder error: %v", err)
+			return err
+		}
 		newObj = &fs.Dir{
 			Name: newPath,
 			When: time.Now(),
@@ -3,11 +3,30 @@
 package mount
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func TestDirLs(t *testing.T) {
@@ -131,3 +150,1243 @@ func TestDirRenameFullDir(t *testing.T) {
 	run.rmdir(t, "dir")
 	run.checkDir(t, "")
 }
+
+// decodeDirents returns the names in the dirent data and the offset
+// of the last entry
+func decodeDirents(data []byte) (names []string, off int64) {
+	for len(data) > 0 {
+		header := (*direntHeader)(unsafe.Pointer(&data[0]))
+		name := string(data[direntHeaderSize : direntHeaderSize+int(header.Namelen)])
+		names = append(names, name)
+		off = int64(header.Off)
+		size := (direntHeaderSize + int(header.Namelen) + 7) &^ 7
+		data = data[size:]
+	}
+	return names, off
+}
+
+// Test --dir-stream lists the directory incrementally
+func TestDirStream(t *testing.T) {
+	defer func(old bool) { dirStream = old }(dirStream)
+	dirStream = true
+	f, d := mockDir()
+	const entries = 100
+	for i := 0; i < entries; i++ {
+		f.add(fmt.Sprintf("file%03d", i), "")
+	}
+
+	handle, err := d.Open(context.Background(), &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*DirStreamHandle)
+
+	var names []string
+	var off int64
+	for {
+		resp := &fuse.ReadResponse{}
+		err := fh.Read(context.Background(), &fuse.ReadRequest{Dir: true, Offset: off, Size: 100}, resp)
+		require.NoError(t, err)
+		if len(resp.Data) == 0 {
+			break
+		}
+		if names == nil {
+			f.mu.Lock()
+			listed := f.listed
+			f.mu.Unlock()
+			assert.True(t, listed < entries/2, "listed %d entries after first read", listed)
+		}
+		var newNames []string
+		newNames, off = decodeDirents(resp.Data)
+		names = append(names, newNames...)
+		assert.Equal(t, int64(len(names)), off)
+	}
+	require.Len(t, names, entries)
+	assert.Equal(t, "file000", names[0])
+	assert.Equal(t, "file099", names[entries-1])
+
+	// Check rewinding restarts the listing
+	resp := &fuse.ReadResponse{}
+	require.NoError(t, fh.Read(context.Background(), &fuse.ReadRequest{Dir: true, Offset: 0, Size: 100}, resp))
+	newNames, _ := decodeDirents(resp.Data)
+	assert.Equal(t, "file000", newNames[0])
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --dir-stream hides the same entries as the full listing
+func TestDirStreamHidden(t *testing.T) {
+	defer func(old bool) { dirStream = old }(dirStream)
+	defer func(old string) { dirPlaceholder = old }(dirPlaceholder)
+	defer func(old []aclRule) { acl = old }(acl)
+	dirStream = true
+	dirPlaceholder = ".keep"
+	rule, err := parseACLRule("/secret 1001 -")
+	require.NoError(t, err)
+	acl = []aclRule{rule}
+	f, d := mockDir()
+	f.add(".keep", "")
+	f.add("file", "hello")
+	f.add("secret", "shh")
+
+	streamed := func(uid uint32) []string {
+		handle, err := d.Open(context.Background(), &fuse.OpenRequest{Header: fuse.Header{Uid: uid}, Dir: true}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		fh := handle.(*DirStreamHandle)
+		resp := &fuse.ReadResponse{}
+		require.NoError(t, fh.Read(context.Background(), &fuse.ReadRequest{Dir: true, Size: 4096}, resp))
+		require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+		names, _ := decodeDirents(resp.Data)
+		return names
+	}
+	assert.Equal(t, []string{"file"}, streamed(1001))
+	assert.Equal(t, []string{"file", "secret"}, streamed(1000))
+
+	// flags needing the whole listing don't stream
+	defer func(old bool) { assembleParts = old }(assembleParts)
+	assembleParts = true
+	handle, err := d.Open(context.Background(), &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	assert.IsType(t, &DirACLHandle{}, handle)
+	acl = nil
+	handle, err = d.Open(context.Background(), &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	assert.Equal(t, d, handle)
+}
+
+// Test fsync on a directory waits for the uploads of the files in it
+func TestDirFsyncWaitsForUploads(t *testing.T) {
+	f, d := mockDir()
+	f.putDelay = 50 * time.Millisecond
+	require.NoError(t, d.readDir())
+
+	var wg sync.WaitGroup
+	for _, leaf := range []string{"file1", "file2"} {
+		_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: leaf}, &fuse.CreateResponse{})
+		require.NoError(t, err)
+		fh := handle.(*WriteFileHandle)
+		err = fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte(leaf)}, &fuse.WriteResponse{})
+		require.NoError(t, err)
+		// the kernel releases the handles asynchronously
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+		}()
+	}
+
+	// wait for both handles to start closing
+	for i := 0; i < 100; i++ {
+		d.uploadsMu.Lock()
+		uploads := d.uploads
+		d.uploadsMu.Unlock()
+		if uploads == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, d.Fsync(context.Background(), &fuse.FsyncRequest{Dir: true}))
+	f.mu.Lock()
+	assert.Equal(t, 2, f.puts)
+	assert.Equal(t, "file1", string(f.objects["file1"].contents))
+	assert.Equal(t, "file2", string(f.objects["file2"].contents))
+	f.mu.Unlock()
+	wg.Wait()
+
+	// nothing to wait for
+	require.NoError(t, d.Fsync(context.Background(), &fuse.FsyncRequest{Dir: true}))
+
+	// a handle still open for write isn't waited for
+	_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "file3"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	require.NoError(t, d.Fsync(context.Background(), &fuse.FsyncRequest{Dir: true}))
+	require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// readStatus looks up, opens and reads the status file in the root d
+// returning the stats in it
+func readStatus(t *testing.T, d *Dir) map[string]int64 {
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: statusFileName}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	handle, err := node.(fusefs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	resp := &fuse.ReadResponse{}
+	err = handle.(fusefs.HandleReader).Read(context.Background(), &fuse.ReadRequest{Size: 4096}, resp)
+	require.NoError(t, err)
+	stats := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(string(resp.Data)), "\n") {
+		parts := strings.SplitN(line, ": ", 2)
+		require.Len(t, parts, 2, line)
+		if parts[0] == "uptime" {
+			_, err = time.ParseDuration(parts[1])
+			require.NoError(t, err)
+			continue
+		}
+		stats[parts[0]], err = strconv.ParseInt(parts[1], 10, 64)
+		require.NoError(t, err, line)
+	}
+	return stats
+}
+
+// Test the status file shows the handles open and the bytes read
+func TestDirStatusFile(t *testing.T) {
+	defer func(old bool) { statusFile = old }(statusFile)
+	f, d := mockDir()
+	o := f.add("file", "hello world")
+
+	before := readStatus(t, d)
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readString(t, fh, 0, 5))
+	after := readStatus(t, d)
+	assert.Equal(t, before["open_handles"]+1, after["open_handles"])
+	assert.Equal(t, before["bytes_read"]+5, after["bytes_read"])
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, before["open_handles"], readStatus(t, d)["open_handles"])
+
+	// the status file is read only
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: statusFileName}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	_, err = node.(fusefs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.EPERM, err)
+
+	// and only listed with --status-file
+	for _, listed := range []bool{false, true} {
+		statusFile = listed
+		dirents, err := d.ReadDirAll(context.Background())
+		require.NoError(t, err)
+		found := false
+		for _, dirent := range dirents {
+			found = found || dirent.Name == statusFileName
+		}
+		assert.Equal(t, listed, found)
+	}
+}
+
+// listing returns "name/" for directories and "name" for files in d
+// sorted by name
+func listing(t *testing.T, d *Dir) []string {
+	dirents, err := d.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	var names []string
+	for _, dirent := range dirents {
+		if dirent.Type == fuse.DT_Dir {
+			dirent.Name += "/"
+		}
+		names = append(names, dirent.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Test --normalize-keys cleans up listings of messy keys
+func TestDirNormalizeKeys(t *testing.T) {
+	defer func(old bool) { normalizeKeys = old }(normalizeKeys)
+	f := newMockFs()
+	f.rawList = true
+	f.add("dir/", "")
+	f.add("dir/file", "file")
+	f.add("dir//double", "double")
+	f.add("dir/sub/", "")
+	f.add("dir/trailing/", "trailing")
+
+	assert.Equal(t, []string{"dir", "double", "file", "sub", "trailing"}, listing(t, newDir(f, "dir")))
+
+	normalizeKeys = true
+	d := newDir(f, "dir")
+	assert.Equal(t, []string{"double", "file", "sub/", "trailing"}, listing(t, d))
+
+	// the objects are read with their original keys
+	for _, leaf := range []string{"double", "trailing"} {
+		item, err := d.lookupNode(leaf)
+		require.NoError(t, err)
+		handle, err := item.node.(*File).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		assert.Equal(t, leaf, readString(t, handle.(*ReadFileHandle), 0, 100))
+	}
+}
+
+// Test --flatten shows all the nested files in the root with names
+// which map back to their paths
+func TestDirFlatten(t *testing.T) {
+	defer func(old bool) { flatten = old }(flatten)
+	flatten = true
+	f, d := mockDir()
+	f.add("top", "top")
+	f.add("a/b/nested", "nested")
+	f.add("a/100%", "percent")
+
+	assert.Equal(t, []string{"a%2F100%25", "a%2Fb%2Fnested", "top"}, listing(t, d))
+	for name, remote := range map[string]string{"a%2F100%25": "a/100%", "a%2Fb%2Fnested": "a/b/nested"} {
+		assert.Equal(t, remote, unflattenName(name))
+		assert.Equal(t, name, flattenName(remote))
+	}
+
+	// reading opens the nested object
+	item, err := d.lookupNode("a%2Fb%2Fnested")
+	require.NoError(t, err)
+	handle, err := item.node.(*File).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	assert.Equal(t, "nested", readString(t, handle.(*ReadFileHandle), 0, 100))
+
+	// writing makes a nested object
+	createFile(t, d, "x%2Fy", "new")
+	assert.Equal(t, "new", string(f.objects["x/y"].contents))
+	assert.Contains(t, listing(t, d), "x%2Fy")
+
+	_, err = d.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "dir"})
+	assert.Equal(t, fuse.EPERM, err)
+}
+
+// Test --acl-file rules stop users writing where they aren't allowed
+func TestDirACL(t *testing.T) {
+	defer func(old []aclRule) { acl = old }(acl)
+	acl = nil
+	for _, line := range []string{
+		"/shared/locked/** * r",
+		"/shared/** 1000 rw",
+		"/shared/hidden * -",
+		"/shared/** * r",
+	} {
+		rule, err := parseACLRule(line)
+		require.NoError(t, err)
+		acl = append(acl, rule)
+	}
+	_, err := parseACLRule("/shared/** 1000 rwx")
+	assert.Error(t, err)
+
+	f, root := mockDir()
+	f.add("shared/file", "hello")
+	f.add("shared/hidden", "secret")
+	item, err := root.lookupNode("shared")
+	require.NoError(t, err)
+	d := item.node.(*Dir)
+	require.NoError(t, d.readDir())
+	create := func(uid uint32, leaf string) error {
+		req := &fuse.CreateRequest{Header: fuse.Header{Uid: uid}, Name: leaf}
+		_, handle, err := d.Create(context.Background(), req, &fuse.CreateResponse{})
+		if err == nil {
+			require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+		}
+		return err
+	}
+
+	assert.Equal(t, fuse.Errno(syscall.EACCES), create(1001, "denied"))
+	assert.NoError(t, create(1000, "allowed"))
+	assert.Contains(t, f.objects, "shared/allowed")
+	assert.NotContains(t, f.objects, "shared/denied")
+
+	// everyone can read but only 1000 can remove
+	file, err := d.lookupNode("file")
+	require.NoError(t, err)
+	handle, err := file.node.(*File).Open(context.Background(), &fuse.OpenRequest{Header: fuse.Header{Uid: 1001}, Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	require.NoError(t, handle.(*ReadFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+	err = d.Remove(context.Background(), &fuse.RemoveRequest{Header: fuse.Header{Uid: 1001}, Name: "file"})
+	assert.Equal(t, fuse.Errno(syscall.EACCES), err)
+	err = d.Remove(context.Background(), &fuse.RemoveRequest{Header: fuse.Header{Uid: 1000}, Name: "file"})
+	assert.NoError(t, err)
+
+	// names the user can't read aren't listed
+	list := func(uid uint32) (names []string) {
+		handle, err := d.Open(context.Background(), &fuse.OpenRequest{Header: fuse.Header{Uid: uid}, Dir: true}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		dirents, err := handle.(fusefs.HandleReadDirAller).ReadDirAll(context.Background())
+		require.NoError(t, err)
+		for _, dirent := range dirents {
+			names = append(names, dirent.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	assert.Equal(t, []string{"allowed", "hidden"}, list(1000))
+	assert.Equal(t, []string{"allowed"}, list(1001))
+
+	// renaming a directory needs write access to the paths under it
+	_, err = d.Mkdir(context.Background(), &fuse.MkdirRequest{Header: fuse.Header{Uid: 1000}, Name: "dir"})
+	require.NoError(t, err)
+	rename := func(oldName, newName string) error {
+		return d.Rename(context.Background(), &fuse.RenameRequest{Header: fuse.Header{Uid: 1000}, OldName: oldName, NewName: newName}, d)
+	}
+	assert.Equal(t, fuse.Errno(syscall.EACCES), rename("dir", "locked"))
+	assert.NoError(t, rename("dir", "public"))
+
+	// paths without a rule are allowed
+	assert.True(t, aclAllows(1001, "other/file", true))
+}
+
+// Test --reject-case-collisions refuses names differing only in case
+func TestDirRejectCaseCollisions(t *testing.T) {
+	defer func(old bool) { rejectCaseCollisions = old }(rejectCaseCollisions)
+	rejectCaseCollisions = true
+	f, d := mockDir()
+
+	createFile(t, d, "File.txt", "hello")
+	_, _, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "file.txt"}, &fuse.CreateResponse{})
+	assert.Equal(t, fuse.EEXIST, err)
+	_, err = d.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "FILE.TXT"})
+	assert.Equal(t, fuse.EEXIST, err)
+	assert.Equal(t, []string{"File.txt"}, listing(t, d))
+	assert.Equal(t, 1, f.puts)
+
+	// creating the same name again is still fine
+	_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "File.txt"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, 2, f.puts)
+}
+
+// Test the filter flags hide the files they exclude and
+// --reject-filtered-writes refuses to make them
+func TestDirFilter(t *testing.T) {
+	defer func(old *fs.Filter) { fs.Config.Filter = old }(fs.Config.Filter)
+	defer func(old bool) { rejectFilteredWrites = old }(rejectFilteredWrites)
+	defer func(old bool) { dirStream = old }(dirStream)
+	filter, err := newGlobFilter("*.mp4")
+	require.NoError(t, err)
+	fs.Config.Filter = filter
+	f, d := mockDir()
+	f.add("a.mp4", "video")
+	f.add("b.txt", "text")
+	f.add("sub/c.mp4", "video")
+
+	assert.Equal(t, []string{"a.mp4", "sub/"}, listing(t, d))
+	_, err = d.lookupNode("b.txt")
+	assert.Equal(t, fuse.ENOENT, err)
+	dirStream = true
+	handle, err := d.Open(context.Background(), &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	resp := &fuse.ReadResponse{}
+	require.NoError(t, handle.(*DirStreamHandle).Read(context.Background(), &fuse.ReadRequest{Dir: true, Size: 4096}, resp))
+	names, _ := decodeDirents(resp.Data)
+	assert.Equal(t, []string{"a.mp4", "sub"}, names)
+	require.NoError(t, handle.(*DirStreamHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// excluded names can be written unless --reject-filtered-writes
+	createFile(t, d, "allowed.txt", "text")
+	assert.Contains(t, f.objects, "allowed.txt")
+	rejectFilteredWrites = true
+	_, _, err = d.Create(context.Background(), &fuse.CreateRequest{Name: "rejected.txt"}, &fuse.CreateResponse{})
+	assert.Equal(t, fuse.EPERM, err)
+	assert.NotContains(t, f.objects, "rejected.txt")
+	createFile(t, d, "new.mp4", "video")
+	assert.Contains(t, f.objects, "new.mp4")
+}
+
+// Test --dir-mtime newest-child gives a directory the modification
+// time of its newest item
+func TestDirMtimeNewestChild(t *testing.T) {
+	defer func(old string) { dirMtime = old }(dirMtime)
+	dirMtime = dirMtimeNewestChild
+	f, root := mockDir()
+	newest := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	f.add("dir/old", "old").modTime = newest.Add(-time.Hour)
+	f.add("dir/new", "new").modTime = newest
+	f.add("dir/older", "older").modTime = newest.Add(-48 * time.Hour)
+
+	item, err := root.lookupNode("dir")
+	require.NoError(t, err)
+	var a fuse.Attr
+	require.NoError(t, item.node.Attr(context.Background(), &a))
+	assert.True(t, a.Mtime.IsZero(), "not listed by Attr")
+	assert.Len(t, f.lists, 1)
+
+	require.NoError(t, item.node.(*Dir).readDir())
+	require.NoError(t, item.node.Attr(context.Background(), &a))
+	assert.Equal(t, newest, a.Mtime)
+
+	// empty directories keep the default time
+	empty := newDir(f, "empty")
+	a = fuse.Attr{}
+	require.NoError(t, empty.Attr(context.Background(), &a))
+	assert.True(t, a.Mtime.IsZero())
+}
+
+// Test --dir-prefetch-concurrency reads the metadata of the files in a
+// directory when it is listed
+func TestDirPrefetchConcurrency(t *testing.T) {
+	defer func(old int) { dirPrefetchConcurrency = old }(dirPrefetchConcurrency)
+	dirPrefetchConcurrency = 4
+	f, d := mockDir()
+	var objects []*mockObject
+	for i := 0; i < 10; i++ {
+		objects = append(objects, f.add(fmt.Sprintf("file%d", i), "data"))
+	}
+	f.add("dir/file", "data")
+
+	_, err := d.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	// the metadata is read in the background
+	d.mu.RLock()
+	prefetching := d.prefetching
+	d.mu.RUnlock()
+	require.NotNil(t, prefetching)
+	<-prefetching
+	for _, o := range objects {
+		o.mu.Lock()
+		assert.NotEqual(t, 0, o.modTimes, o.remote)
+		o.mu.Unlock()
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for leaf, item := range d.items {
+		if _, ok := item.o.(fs.Object); ok {
+			assert.NotNil(t, item.node, leaf)
+		}
+	}
+}
+
+// Test renaming over a file open for reading leaves the reader
+// reading the original data and renaming over one open for writing
+// fails
+func TestDirRenameOverOpenFile(t *testing.T) {
+	f, d := mockDir()
+	f.add("a", "new data")
+	f.add("b", "original data")
+	f.add("c", "more data")
+	require.NoError(t, d.readDir())
+	oldFile := lookupFile(t, d, "b")
+	handle, err := oldFile.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*ReadFileHandle)
+	assert.Equal(t, "original", readString(t, fh, 0, 8))
+
+	require.NoError(t, d.Rename(context.Background(), &fuse.RenameRequest{OldName: "a", NewName: "b"}, d))
+	assert.Equal(t, " data", readString(t, fh, 8, 100))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	newFile := lookupFile(t, d, "b")
+	assert.True(t, newFile != oldFile, "File not replaced")
+	assert.Equal(t, "new data", string(f.objects["b"].contents))
+
+	// renaming over a file being written is refused
+	_, handle, err = d.Create(context.Background(), &fuse.CreateRequest{Name: "d"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	err = d.Rename(context.Background(), &fuse.RenameRequest{OldName: "c", NewName: "d"}, d)
+	assert.Equal(t, fuse.Errno(syscall.EBUSY), err)
+	require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+	require.NoError(t, d.Rename(context.Background(), &fuse.RenameRequest{OldName: "c", NewName: "d"}, d))
+}
+
+// Test --mount-archives shows a zip file as a directory of its
+// members which can be read
+func TestDirMountArchives(t *testing.T) {
+	defer func(old bool) { mountArchives = old }(mountArchives)
+	mountArchives = true
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	members := []struct {
+		name     string
+		method   uint16
+		contents string
+	}{
+		{"readme.txt", zip.Store, "read me"},
+		{"docs/manual.txt", zip.Deflate, strings.Repeat("the manual ", 1000)},
+		{"../outside.txt", zip.Store, "outside"},
+		{"/absolute.txt", zip.Store, "absolute"},
+	}
+	for _, member := range members {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: member.name, Method: member.method})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(member.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	f, d := mockDir()
+	o := f.add("archive.zip", buf.String())
+	o.noRanges = true
+
+	dirents, err := d.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{{Type: fuse.DT_Dir, Name: "archive.zip"}}, dirents)
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "archive.zip"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	archiveDir := node.(*ArchiveDir)
+	dirents, err = archiveDir.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{{Type: fuse.DT_File, Name: "readme.txt"}, {Type: fuse.DT_Dir, Name: "docs"}, {Type: fuse.DT_File, Name: "absolute.txt"}}, dirents)
+
+	node, err = archiveDir.Lookup(context.Background(), "docs")
+	require.NoError(t, err)
+	node, err = node.(*ArchiveDir).Lookup(context.Background(), "manual.txt")
+	require.NoError(t, err)
+	var attr fuse.Attr
+	require.NoError(t, node.Attr(context.Background(), &attr))
+	assert.Equal(t, uint64(len(members[1].contents)), attr.Size)
+	_, err = node.(*ArchiveFile).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.EPERM, err)
+	handle, err := node.(*ArchiveFile).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*ArchiveFileHandle)
+	read := func(offset int64, size int) string {
+		resp := &fuse.ReadResponse{}
+		require.NoError(t, fh.Read(context.Background(), &fuse.ReadRequest{Offset: offset, Size: size}, resp))
+		return string(resp.Data)
+	}
+	assert.Equal(t, members[1].contents[5000:5100], read(5000, 100))
+	assert.Equal(t, members[1].contents[:100], read(0, 100))
+	assert.Equal(t, members[1].contents[10900:], read(10900, 1000))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, 1, o.opens, "the archive is read once into the buffer")
+
+	_, err = archiveDir.Lookup(context.Background(), "missing")
+	assert.Equal(t, fuse.ENOENT, err)
+
+	// the archive can't be removed through the mount
+	err = d.Remove(context.Background(), &fuse.RemoveRequest{Name: "archive.zip", Dir: true})
+	assert.Equal(t, fuse.EPERM, err)
+	assert.Len(t, f.objects, 1)
+}
+
+// Test --escape-whitespace shows names with leading and trailing
+// whitespace escaped and turns them back into the original names
+func TestDirEscapeWhitespace(t *testing.T) {
+	defer func(old bool) { escapeWhitespaceNames = old }(escapeWhitespaceNames)
+	escapeWhitespaceNames = true
+	for _, test := range []struct {
+		in   string
+		want string
+	}{
+		{"file", "file"},
+		{"file ", "file␠"},
+		{" \tfile \t", "␠␉file␠␉"},
+		{"a b", "a b"},
+		{"␠file‛", "‛␠file‛‛"},
+		{"   ", "␠␠␠"},
+	} {
+		got := escapeWhitespace(test.in)
+		assert.Equal(t, test.want, got, test.in)
+		assert.Equal(t, test.in, unescapeWhitespace(got), test.in)
+	}
+
+	f, d := mockDir()
+	f.add("file ", "trailing space")
+	f.add("file", "no space")
+	assert.Equal(t, []string{"file", "file␠"}, listing(t, d))
+	file := lookupFile(t, d, "file␠")
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*ReadFileHandle)
+	assert.Equal(t, "trailing space", readString(t, fh, 0, 100))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// new names are turned back into the original names
+	_, handle, err = d.Create(context.Background(), &fuse.CreateRequest{Name: "␠new"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+	_, ok := f.objects[" new"]
+	assert.True(t, ok)
+}
+
+// Test --dir-list-rate paces the listings made from the remote
+func TestDirListRate(t *testing.T) {
+	defer func(old *priorityLimiter) { listLimiter = old }(listLimiter)
+	listLimiter = newPriorityLimiter(20)
+	f, root := mockDir()
+	for i := 0; i < 6; i++ {
+		f.add(fmt.Sprintf("dir%d/file", i), "data")
+	}
+	start := time.Now()
+	require.NoError(t, root.readDir())
+	for i := 0; i < 6; i++ {
+		item, err := root.lookupNode(fmt.Sprintf("dir%d", i))
+		require.NoError(t, err)
+		require.NoError(t, item.node.(*Dir).readDir())
+	}
+	// once the burst allowance of 100ms worth has been used up
+	// the listings are 50ms apart
+	require.Equal(t, 7, len(f.lists))
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, "took %v", time.Since(start))
+	for i := 4; i < len(f.lists); i++ {
+		gap := f.lists[i].Sub(f.lists[i-1])
+		assert.True(t, gap >= 40*time.Millisecond, "gap %d was %v", i, gap)
+	}
+}
+
+// Test --tag-browse shows links to the tagged objects in .tags/<tag>/
+func TestDirTagBrowse(t *testing.T) {
+	defer func(old bool) { tagBrowse = old }(tagBrowse)
+	tagBrowse = true
+	f, d := mockDir()
+	f.add("holiday/beach.jpg", "beach").tags = []string{"photos", "summer"}
+	f.add("cat.jpg", "cat").tags = []string{"photos"}
+	f.add("notes.txt", "notes")
+
+	assert.Equal(t, []string{".tags/", "cat.jpg", "holiday/", "notes.txt"}, listing(t, d))
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: ".tags"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	tags := node.(*TagsDir)
+	dirents, err := tags.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	var names []string
+	for _, dirent := range dirents {
+		assert.Equal(t, fuse.DT_Dir, dirent.Type)
+		names = append(names, dirent.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"photos", "summer"}, names)
+
+	node, err = tags.Lookup(context.Background(), "photos")
+	require.NoError(t, err)
+	photos := node.(*TagDir)
+	dirents, err = photos.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{
+		{Type: fuse.DT_Link, Name: "cat.jpg"},
+		{Type: fuse.DT_Link, Name: "holiday%2Fbeach.jpg"},
+	}, dirents)
+	node, err = photos.Lookup(context.Background(), "holiday%2Fbeach.jpg")
+	require.NoError(t, err)
+	target, err := node.(*TagLink).Readlink(context.Background(), &fuse.ReadlinkRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "../../holiday/beach.jpg", target)
+
+	_, err = photos.Lookup(context.Background(), "notes.txt")
+	assert.Equal(t, fuse.ENOENT, err)
+	_, err = tags.Lookup(context.Background(), "missing")
+	assert.Equal(t, fuse.ENOENT, err)
+}
+
+// Test a directory's link count is 2 plus its number of
+// subdirectories once it has been listed
+func TestDirNlink(t *testing.T) {
+	f, d := mockDir()
+	f.add("a/file", "a")
+	f.add("b/file", "b")
+	f.add("file", "c")
+
+	attr := fuse.Attr{}
+	require.NoError(t, d.Attr(context.Background(), &attr))
+	assert.Equal(t, uint32(1), attr.Nlink)
+
+	_, err := d.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, d.Attr(context.Background(), &attr))
+	assert.Equal(t, uint32(4), attr.Nlink)
+
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "a"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	_, err = node.(*Dir).ReadDirAll(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, node.Attr(context.Background(), &attr))
+	assert.Equal(t, uint32(2), attr.Nlink)
+}
+
+// Test --dir-first-page returns the start of a slow listing straight
+// away and the whole listing once the rest has been read
+func TestDirFirstPage(t *testing.T) {
+	defer func(old int) { dirFirstPage = old }(dirFirstPage)
+	dirFirstPage = 3
+	f, d := mockDir()
+	var want []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%d", i)
+		f.add(name, name)
+		want = append(want, name)
+	}
+	f.listDelay = 20 * time.Millisecond
+
+	start := time.Now()
+	got := listing(t, d)
+	assert.True(t, time.Since(start) < 150*time.Millisecond, "first listing took %v", time.Since(start))
+	assert.Equal(t, want[:3], got)
+
+	// looking up an entry not listed yet waits for it
+	lookupFile(t, d, "file9")
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "lookup only took %v", time.Since(start))
+	assert.Equal(t, want, listing(t, d))
+	assert.Equal(t, 1, len(f.lists))
+
+	_, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "missing"}, &fuse.LookupResponse{})
+	assert.Equal(t, fuse.ENOENT, err)
+}
+
+// Test --combine shows each remote as a directory of the root and
+// renames between them copy
+func TestDirCombine(t *testing.T) {
+	photos, docs := newMockFs(), newMockFs()
+	photos.add("beach.jpg", "sand")
+	docs.add("notes.txt", "todo")
+	remotes := map[string]fs.Fs{"gdrive:pics": photos, "s3:documents": docs}
+	newFs := func(remote string) (fs.Fs, error) {
+		f, ok := remotes[remote]
+		if !ok {
+			return nil, fs.ErrorDirNotFound
+		}
+		return f, nil
+	}
+	_, err := newCombineDir("photos", newFs)
+	assert.Error(t, err)
+	_, err = newCombineDir("photos=gdrive:pics photos=s3:documents", newFs)
+	assert.Error(t, err)
+	_, err = newCombineDir("photos=gdrive:missing", newFs)
+	assert.Error(t, err)
+
+	root, err := newCombineDir("photos=gdrive:pics docs=s3:documents", newFs)
+	require.NoError(t, err)
+	dirents, err := root.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{{Type: fuse.DT_Dir, Name: "photos"}, {Type: fuse.DT_Dir, Name: "docs"}}, dirents)
+	_, err = root.Lookup(context.Background(), "music")
+	assert.Equal(t, fuse.ENOENT, err)
+
+	lookup := func(name string) *Dir {
+		node, err := root.Lookup(context.Background(), name)
+		require.NoError(t, err)
+		return node.(*Dir)
+	}
+	photosDir, docsDir := lookup("photos"), lookup("docs")
+	assert.True(t, root.firstFs() == fs.Fs(photos))
+	assert.True(t, photosDir.f == fs.Fs(photos))
+	assert.True(t, docsDir.f == fs.Fs(docs))
+	assert.Equal(t, []string{"beach.jpg"}, listing(t, photosDir))
+	assert.Equal(t, []string{"notes.txt"}, listing(t, docsDir))
+
+	err = photosDir.Rename(context.Background(), &fuse.RenameRequest{OldName: "beach.jpg", NewName: "beach.jpg"}, docsDir)
+	require.NoError(t, err)
+	assert.Empty(t, listing(t, photosDir))
+	assert.Equal(t, []string{"beach.jpg", "notes.txt"}, listing(t, docsDir))
+	_, err = photos.NewObject("beach.jpg")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+	o, err := docs.NewObject("beach.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "sand", string(o.(*mockObject).contents))
+
+	// directories can't be renamed between remotes
+	_, err = photosDir.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "album"})
+	require.NoError(t, err)
+	err = photosDir.Rename(context.Background(), &fuse.RenameRequest{OldName: "album", NewName: "album"}, docsDir)
+	assert.Equal(t, fuse.Errno(syscall.EXDEV), err)
+	assert.Equal(t, []string{"album/"}, listing(t, photosDir))
+
+	// the stored hash is moved with the file
+	defer func(old bool) { computeHashOnWrite = old }(computeHashOnWrite)
+	computeHashOnWrite = true
+	photos.noHashes, docs.noHashes = true, true
+	o = photos.add("sunset.jpg", "hello")
+	require.NoError(t, storeHash(photos, o, "5d41402abc4b2a76b9719d911017c592"))
+	photosDir.read = time.Time{}
+	err = photosDir.Rename(context.Background(), &fuse.RenameRequest{OldName: "sunset.jpg", NewName: "sunset.jpg"}, docsDir)
+	require.NoError(t, err)
+	assert.NotContains(t, photos.objects, "sunset.jpg"+storedHashSuffix)
+	o, err = docs.NewObject("sunset.jpg")
+	require.NoError(t, err)
+	sum, err := objectHash(o, fs.HashMD5)
+	require.NoError(t, err)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", sum)
+}
+
+// Test --dir-placeholder makes empty directories persist on remotes
+// without directories and hides the placeholders
+func TestDirPlaceholder(t *testing.T) {
+	defer func(old string) { dirPlaceholder = old }(dirPlaceholder)
+	dirPlaceholder = ".keep"
+	f, d := mockDir()
+	require.NoError(t, d.readDir())
+	node, err := d.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "empty"})
+	require.NoError(t, err)
+	assert.Empty(t, listing(t, node.(*Dir)))
+	require.Contains(t, f.objects, "empty/.keep")
+
+	// the directory is still there when listed again
+	d = newDir(f, "")
+	assert.Equal(t, []string{"empty/"}, listing(t, d))
+	node, err = d.Lookup(context.Background(), &fuse.LookupRequest{Name: "empty"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	assert.Empty(t, listing(t, node.(*Dir)))
+
+	// renaming moves the placeholder
+	err = d.Rename(context.Background(), &fuse.RenameRequest{OldName: "empty", NewName: "moved"}, d)
+	require.NoError(t, err)
+	assert.NotContains(t, f.objects, "empty/.keep")
+	assert.Contains(t, f.objects, "moved/.keep")
+
+	// removing the directory removes the placeholder
+	require.NoError(t, d.Remove(context.Background(), &fuse.RemoveRequest{Name: "moved", Dir: true}))
+	assert.Empty(t, f.objects)
+	assert.Empty(t, listing(t, newDir(f, "")))
+}
+
+// Test --meta-files shows the metadata of files as JSON
+func TestDirMetaFiles(t *testing.T) {
+	defer func(old bool) { metaFiles = old }(metaFiles)
+	f, d := mockDir()
+	o := f.add("x", "hello")
+	o.tags = []string{"red"}
+	f.add("y", "world")
+	f.add("y.meta", "real file")
+
+	// only shown with --meta-files
+	_, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "x.meta"}, &fuse.LookupResponse{})
+	assert.Equal(t, fuse.ENOENT, err)
+	metaFiles = true
+	assert.Equal(t, []string{"x", "x.meta", "y", "y.meta", "y.meta.meta"}, listing(t, d))
+
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "x.meta"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	_, err = node.(fusefs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.EPERM, err)
+	fh, err := node.(fusefs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	resp := &fuse.ReadResponse{}
+	require.NoError(t, fh.(fusefs.HandleReader).Read(context.Background(), &fuse.ReadRequest{Size: 4096}, resp))
+	var meta map[string]interface{}
+	require.NoError(t, json.Unmarshal(resp.Data, &meta))
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", meta["hash.md5"])
+	assert.Equal(t, []interface{}{"red"}, meta["tags"])
+	assert.Equal(t, float64(5), meta["size"])
+
+	// a file on the remote is shown rather than the metadata
+	node, err = d.Lookup(context.Background(), &fuse.LookupRequest{Name: "y.meta"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	assert.IsType(t, &File{}, node)
+}
+
+// Test --unicode-normalization finds names stored in another form
+func TestDirUnicodeNormalization(t *testing.T) {
+	defer func(old string) { unicodeNormalization = old }(unicodeNormalization)
+	const (
+		nfc = "caf\u00e9"
+		nfd = "cafe\u0301"
+	)
+	lookup := func(d *Dir, name string) (string, error) {
+		node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+		if err != nil {
+			return "", err
+		}
+		return node.(*File).o.Remote(), nil
+	}
+
+	// an NFD lookup finds an NFC object
+	unicodeNormalization = unicodeNormalizationNFC
+	f, d := mockDir()
+	f.add(nfc, "hello")
+	remote, err := lookup(d, nfd)
+	require.NoError(t, err)
+	assert.Equal(t, nfc, remote)
+
+	// an NFC lookup finds an NFD object which is listed as NFC
+	// but keeps its name on the remote
+	f, d = mockDir()
+	f.add(nfd, "hello")
+	assert.Equal(t, []string{nfc}, listing(t, d))
+	remote, err = lookup(d, nfc)
+	require.NoError(t, err)
+	assert.Equal(t, nfd, remote)
+
+	// both forms are shown if both exist and exact matches win
+	f.add(nfc, "world")
+	d = newDir(f, "")
+	assert.Equal(t, []string{nfd, nfc}, listing(t, d))
+	for _, name := range []string{nfc, nfd} {
+		remote, err = lookup(d, name)
+		require.NoError(t, err)
+		assert.Equal(t, name, remote)
+	}
+
+	// names aren't normalized by default
+	unicodeNormalization = unicodeNormalizationNone
+	f, d = mockDir()
+	f.add(nfc, "hello")
+	_, err = lookup(d, nfd)
+	assert.Equal(t, fuse.ENOENT, err)
+}
+
+// Test --recent-count shows links to the most recently modified
+// files in .recent
+func TestDirRecent(t *testing.T) {
+	defer func(old int) { recentCount = old }(recentCount)
+	defer func(old time.Duration) { recentWindow = old }(recentWindow)
+	recentCount = 2
+	f, d := mockDir()
+	now := time.Now()
+	f.add("old.txt", "old").modTime = now.Add(-48 * time.Hour)
+	f.add("docs/newest.txt", "newest").modTime = now
+	f.add("middle.txt", "middle").modTime = now.Add(-time.Hour)
+	f.add("older.txt", "older").modTime = now.Add(-2 * time.Hour)
+
+	assert.Equal(t, []string{".recent/", "docs/", "middle.txt", "old.txt", "older.txt"}, listing(t, d))
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: recentDirName}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	recent := node.(*RecentDir)
+	dirents, err := recent.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{
+		{Type: fuse.DT_Link, Name: "docs%2Fnewest.txt"},
+		{Type: fuse.DT_Link, Name: "middle.txt"},
+	}, dirents)
+	node, err = recent.Lookup(context.Background(), "docs%2Fnewest.txt")
+	require.NoError(t, err)
+	target, err := node.(*RecentLink).Readlink(context.Background(), &fuse.ReadlinkRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "../docs/newest.txt", target)
+	_, err = recent.Lookup(context.Background(), "older.txt")
+	assert.Equal(t, fuse.ENOENT, err)
+
+	// --recent-window leaves out the files modified before it
+	recentCount = 10
+	recentWindow = 90 * time.Minute
+	recent = &RecentDir{f: f}
+	dirents, err = recent.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(dirents))
+}
+
+// Test --staging keeps files written in .staging locally until they
+// are moved out of it
+func TestDirStaging(t *testing.T) {
+	defer func(old bool) { staging = old }(staging)
+	staging = true
+	f, d := mockDir()
+	f.add("final/other", "other")
+
+	assert.Equal(t, []string{".staging/", "final/"}, listing(t, d))
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: stagingDirName}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	stage := node.(*StagingDir)
+	before := readStatus(t, d)["dirty_files"]
+	_, handle, err := stage.Create(context.Background(), &fuse.CreateRequest{Name: "x"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	fh := handle.(*StagedFileHandle)
+	require.NoError(t, fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("staged data")}, &fuse.WriteResponse{}))
+	resp := &fuse.ReadResponse{}
+	require.NoError(t, fh.Read(context.Background(), &fuse.ReadRequest{Offset: 7, Size: 10}, resp))
+	assert.Equal(t, "data", string(resp.Data))
+
+	// nothing is uploaded while the file is staged
+	assert.Equal(t, 0, f.puts)
+	assert.Equal(t, before+1, readStatus(t, d)["dirty_files"])
+	dirents, err := stage.ReadDirAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []fuse.Dirent{{Type: fuse.DT_File, Name: "x"}}, dirents)
+
+	// moving it out uploads it
+	final, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "final"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	require.NoError(t, stage.Rename(context.Background(), &fuse.RenameRequest{OldName: "x", NewName: "x"}, final))
+	assert.Equal(t, 1, f.puts)
+	assert.Equal(t, "staged data", string(f.objects["final/x"].contents))
+	assert.Equal(t, []string{"other", "x"}, listing(t, final.(*Dir)))
+	_, err = stage.Lookup(context.Background(), "x")
+	assert.Equal(t, fuse.ENOENT, err)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&stagedFiles))
+	assert.Equal(t, before, readStatus(t, d)["dirty_files"])
+
+	// handles still open can carry on reading until released
+	resp = &fuse.ReadResponse{}
+	require.NoError(t, fh.Read(context.Background(), &fuse.ReadRequest{Size: 6}, resp))
+	assert.Equal(t, "staged", string(resp.Data))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Error(t, fh.Read(context.Background(), &fuse.ReadRequest{Size: 6}, &fuse.ReadResponse{}))
+}
+
+// Test --tree-hash changes when the contents of a directory change
+func TestDirTreeHash(t *testing.T) {
+	defer func(old string) { treeHash = old }(treeHash)
+	defer func(old time.Duration) { dirCacheTime = old }(dirCacheTime)
+	dirCacheTime = 0
+	f, d := mockDir()
+	f.add("file", "hello")
+	f.add("sub/file", "world")
+	getHash := func() string {
+		resp := &fuse.GetxattrResponse{}
+		require.NoError(t, d.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: treeHashXattr}, resp))
+		return string(resp.Xattr)
+	}
+
+	// not shown by default
+	err := d.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: treeHashXattr}, &fuse.GetxattrResponse{})
+	assert.Equal(t, fuse.ErrNoXattr, err)
+
+	treeHash = treeHashShallow
+	resp := &fuse.ListxattrResponse{}
+	require.NoError(t, d.Listxattr(context.Background(), &fuse.ListxattrRequest{}, resp))
+	assert.Equal(t, treeHashXattr+"\x00", string(resp.Xattr))
+	before := getHash()
+	assert.Equal(t, before, getHash())
+
+	// adding a child changes it
+	f.add("new", "new")
+	added := getHash()
+	assert.NotEqual(t, before, added)
+
+	// as does changing a file in a subdirectory with recursive
+	f.add("sub/file", "changed")
+	assert.Equal(t, added, getHash())
+	treeHash = treeHashRecursive
+	recursive := getHash()
+	f.add("sub/file", "changed again")
+	assert.NotEqual(t, recursive, getHash())
+
+	// the recursive hash is cached while the listings are
+	dirCacheTime = time.Hour
+	recursive = getHash()
+	o := f.objects["sub/file"]
+	o.mu.Lock()
+	hashes := o.hashes
+	o.mu.Unlock()
+	assert.Equal(t, recursive, getHash())
+	o.mu.Lock()
+	assert.Equal(t, hashes, o.hashes)
+	o.mu.Unlock()
+}
+
+// Check --overlay shows the local files on top of the remote and
+// reads them instead of the objects they shadow
+func TestDirOverlay(t *testing.T) {
+	defer func(old fs.Fs) { overlay = old }(overlay)
+	dir, err := ioutil.TempDir("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("local"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "extra"), []byte("extra"), 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "a"), []byte("local a"), 0600))
+	overlay, err = fs.NewFs(dir)
+	require.NoError(t, err)
+
+	f, d := mockDir()
+	f.add("file", "remote")
+	f.add("other", "other")
+	f.add("sub/a", "remote a")
+	f.add("sub/b", "remote b")
+	assert.Equal(t, []string{"extra", "file", "other", "sub/"}, listing(t, d))
+
+	read := func(d *Dir, leaf string) string {
+		handle, err := lookupFile(t, d, leaf).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		fh := handle.(*ReadFileHandle)
+		defer func() { require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{})) }()
+		return readString(t, fh, 0, 100)
+	}
+	assert.Equal(t, "local", read(d, "file"))
+	assert.Equal(t, "other", read(d, "other"))
+
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "sub"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	sub := node.(*Dir)
+	assert.Equal(t, []string{"a", "b"}, listing(t, sub))
+	assert.Equal(t, "local a", read(sub, "a"))
+	assert.Equal(t, "remote b", read(sub, "b"))
+}
+
+// Test --overlay-writes writes files to the overlay leaving the remote
+// alone
+func TestDirOverlayWrites(t *testing.T) {
+	defer func(old fs.Fs) { overlay = old }(overlay)
+	defer func(old bool) { overlayWrites = old }(overlayWrites)
+	dir, err := ioutil.TempDir("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	overlay, err = fs.NewFs(dir)
+	require.NoError(t, err)
+	overlayWrites = true
+
+	f := newMockFs()
+	f.add("file", "remote")
+	f.add("other", "other")
+	d := newDir(newOverlayFs(f), "")
+
+	createFile(t, d, "new", "new")
+	handle, err := lookupFile(t, d, "file").Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	require.NoError(t, fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("changed")}, &fuse.WriteResponse{}))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(data))
+	assert.Equal(t, "remote", string(f.objects["file"].contents))
+	assert.NotContains(t, f.objects, "new")
+
+	// files only on the remote can't be removed or renamed but the
+	// ones in the overlay can
+	err = d.Remove(context.Background(), &fuse.RemoveRequest{Name: "other"})
+	assert.Equal(t, fuse.EPERM, err)
+	err = d.Rename(context.Background(), &fuse.RenameRequest{OldName: "other", NewName: "moved"}, d)
+	assert.Equal(t, fuse.EPERM, err)
+	assert.Contains(t, f.objects, "other")
+	require.NoError(t, d.Rename(context.Background(), &fuse.RenameRequest{OldName: "new", NewName: "renamed"}, d))
+	require.NoError(t, d.Remove(context.Background(), &fuse.RemoveRequest{Name: "renamed"}))
+	_, err = os.Stat(filepath.Join(dir, "renamed"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Test failed listings which ask to be retried are retried up to
+// --low-level-retries times
+func TestDirListRetry(t *testing.T) {
+	defer func(old time.Duration) { listRetrySleep = old }(listRetrySleep)
+	listRetrySleep = time.Millisecond
+	defer func(old int) { fs.Config.LowLevelRetries = old }(fs.Config.LowLevelRetries)
+	fs.Config.LowLevelRetries = 3
+	f, d := mockDir()
+	f.add("file", "hello")
+
+	f.listErrs = []error{fs.RetryError(errors.New("transient error"))}
+	assert.Equal(t, []string{"file"}, listing(t, d))
+	assert.Len(t, f.lists, 2)
+
+	// gives up after --low-level-retries
+	f, d = mockDir()
+	f.listErrs = []error{fs.RetryError(errors.New("1")), fs.RetryError(errors.New("2")), fs.RetryError(errors.New("3"))}
+	_, err := d.ReadDirAll(context.Background())
+	assert.Error(t, err)
+	assert.Len(t, f.lists, 3)
+
+	// other errors aren't retried
+	for _, listErr := range []error{errors.New("403 Forbidden"), fs.NoRetryError(errors.New("access denied"))} {
+		f, d = mockDir()
+		f.listErrs = []error{listErr}
+		_, err = d.ReadDirAll(context.Background())
+		assert.Error(t, err)
+		assert.Len(t, f.lists, 1)
+	}
+
+	// the retries stop when the request is interrupted
+	listRetrySleep = time.Hour
+	f, d = mockDir()
+	f.listErrs = []error{fs.RetryError(errors.New("transient error"))}
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	_, err = d.ReadDirAll(ctx)
+	assert.Equal(t, fuse.EINTR, err)
+	assert.Len(t, f.lists, 1)
+}
+
+// Test changes made while a directory is being listed aren't lost
+// when the listing replaces the items
+func TestDirChangedWhileListing(t *testing.T) {
+	f, d := mockDir()
+	a := f.add("a", "a")
+	b := f.add("b", "b")
+	require.NoError(t, d.readDir())
+
+	// a is removed and c uploaded after the listing was made
+	d.mu.Lock()
+	gen := d.startListing()
+	d.mu.Unlock()
+	d.delObject("a")
+	c := f.add("c", "c")
+	d.addObject(c, nil)
+	d.mu.Lock()
+	d.swapItems(gen, []fs.Object{a, b}, nil, nil)
+	d.mu.Unlock()
+	assert.Equal(t, []string{"b", "c"}, listing(t, d))
+
+	// files being written keep their node
+	item, err := d.lookupNode("b")
+	require.NoError(t, err)
+	file := item.node.(*File)
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	writing := d.writingItems()
+	assert.Contains(t, writing, "b")
+	assert.NotContains(t, writing, "c")
+	d.mu.Lock()
+	d.swapItems(d.startListing(), []fs.Object{b, c}, nil, writing)
+	d.mu.Unlock()
+	item, err = d.lookupNode("b")
+	require.NoError(t, err)
+	assert.True(t, item.node == file)
+	require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+}
@@ -0,0 +1,89 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// prefetchSlots holds a value for each file whose metadata is being
+// read by any directory with --dir-prefetch-concurrency
+var (
+	prefetchSlotsOnce sync.Once
+	prefetchSlots     chan struct{}
+)
+
+// startPrefetch starts reading the metadata of the files in the
+// directory in the background unless it is being read already
+func (d *Dir) startPrefetch() {
+	d.mu.Lock()
+	if d.prefetching != nil {
+		d.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	d.prefetching = done
+	d.mu.Unlock()
+	go func() {
+		d.prefetchMetadata()
+		d.mu.Lock()
+		d.prefetching = nil
+		d.mu.Unlock()
+		close(done)
+	}()
+}
+
+// prefetchMetadata reads the metadata of the files in the directory
+// which stat needs and makes their nodes, so the stats of them which
+// usually follow a listing don't each wait for the remote in turn.
+//
+// At most --dir-prefetch-concurrency files are read at once over all
+// the directories and each waits for the --open-rate limiter as it
+// may need a request to the remote.
+//
+// The remotes cache the metadata in their objects once read.  Hashes
+// aren't read as some remotes work them out by reading the whole file.
+func (d *Dir) prefetchMetadata() {
+	d.mu.RLock()
+	var leaves []string
+	for leaf, item := range d.items {
+		if _, ok := item.o.(fs.Object); ok && item.node == nil {
+			leaves = append(leaves, leaf)
+		}
+	}
+	d.mu.RUnlock()
+	if len(leaves) == 0 {
+		return
+	}
+	fs.Debug(d.path, "Prefetching metadata of %d files", len(leaves))
+	prefetchSlotsOnce.Do(func() {
+		prefetchSlots = make(chan struct{}, dirPrefetchConcurrency)
+	})
+	var wg sync.WaitGroup
+	for _, leaf := range leaves {
+		prefetchSlots <- struct{}{}
+		wg.Add(1)
+		go func(leaf string) {
+			defer func() {
+				<-prefetchSlots
+				wg.Done()
+			}()
+			_ = waitToOpen(context.Background())
+			item, err := d.lookupNode(leaf)
+			if err != nil {
+				fs.Debug(d.path, "Failed to prefetch %q: %v", leaf, err)
+				return
+			}
+			if o, ok := item.o.(fs.Object); ok {
+				_ = o.Size()
+				if !noModTime {
+					_ = o.ModTime()
+				}
+			}
+		}(leaf)
+	}
+	wg.Wait()
+}
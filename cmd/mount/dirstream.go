@@ -0,0 +1,231 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"hash/fnv"
+	"path"
+	"unsafe"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// Check interface satisfied
+var _ fusefs.NodeOpener = (*Dir)(nil)
+
+// Open the directory for reading
+//
+// With --dir-stream the directory is read with a DirStreamHandle
+// which lists the remote incrementally, otherwise the Dir is used as
+// its own handle and ReadDirAll is called.  This is always the case
+// with the flags which need the whole listing at once, eg --overlay
+// so the overlay is merged into the listing.
+//
+// With --acl-file the entries the user can't read are left out.
+func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !dirStream || needsWholeListing() {
+		if acl != nil {
+			return &DirACLHandle{d: d, uid: req.Header.Uid}, nil
+		}
+		return d, nil
+	}
+	fs.Debug(d.path, "Dir.Open streaming")
+	return newDirStreamHandle(d, req.Header.Uid), nil
+}
+
+// needsWholeListing returns whether the flags in use need the whole
+// listing of a directory to decide which entries to show so it can't
+// be streamed
+func needsWholeListing() bool {
+	_, normalizing := unicodeForm()
+	return overlay != nil || assembleParts || sidecarSuffix != "" || normalizing
+}
+
+// DirStreamHandle is an open directory which is listed incrementally
+// as the kernel reads it.
+//
+// The offsets given to the kernel are entry numbers so only the
+// entries not yet returned are held in memory.
+type DirStreamHandle struct {
+	d       *Dir
+	uid     uint32 // user which opened the directory
+	lister  *fs.Lister
+	n       int64  // number of entries returned so far
+	pending []byte // encoded entry which didn't fit in the last read
+	done    bool   // set when the listing is complete
+}
+
+// Check interface satisfied
+var _ fusefs.HandleReader = (*DirStreamHandle)(nil)
+
+func newDirStreamHandle(d *Dir, uid uint32) *DirStreamHandle {
+	return &DirStreamHandle{
+		d:   d,
+		uid: uid,
+	}
+}
+
+// stop any listing in progress
+func (fh *DirStreamHandle) stop() {
+	lister := fh.lister
+	if lister == nil {
+		return
+	}
+	fh.lister = nil
+	// drain the listing so the lister isn't blocked adding to it
+	go func() {
+		for {
+			o, dir, err := lister.Get()
+			if o == nil && dir == nil && err == nil {
+				return
+			}
+		}
+	}()
+	lister.Finished()
+}
+
+// restart the listing from the beginning
+func (fh *DirStreamHandle) restart() {
+	fh.stop()
+	level := 1
+	if flatten {
+		level = fs.MaxLevel
+	}
+	waitToList()
+	fh.lister = fs.NewLister().SetLevel(level).Start(fh.d.f, fh.d.path)
+	fh.n = 0
+	fh.pending = nil
+	fh.done = false
+}
+
+// next returns the next encoded entry or nil at the end of the
+// listing
+func (fh *DirStreamHandle) next() ([]byte, error) {
+	if fh.pending != nil {
+		entry := fh.pending
+		fh.pending = nil
+		return entry, nil
+	}
+	if fh.done {
+		return nil, nil
+	}
+	for {
+		o, dir, err := fh.lister.Get()
+		if err == fs.ErrorDirNotFound {
+			// treat directory not found as empty
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// use the same rules as Dir.setItems to choose what is shown
+		var dirent fuse.Dirent
+		var isDir, ok bool
+		switch {
+		case o != nil:
+			dirent.Type = fuse.DT_File
+			dirent.Name, isDir, ok = fh.d.listedObject(o)
+			if isDir || isArchive(o.Remote()) {
+				dirent.Type = fuse.DT_Dir
+			}
+		case dir != nil && flatten:
+			// only the objects are shown
+			continue
+		case dir != nil:
+			dirent.Type = fuse.DT_Dir
+			dirent.Name, ok = fh.d.listedDir(dir)
+		default:
+			fh.done = true
+			return nil, nil
+		}
+		remote := path.Join(fh.d.path, dirent.Name)
+		if ok && aclAllows(fh.uid, remote, false) {
+			return appendDirent(nil, dirent, remote, fh.n+1), nil
+		}
+	}
+}
+
+// Read returns the next entries in the directory which start at
+// entry number req.Offset
+func (fh *DirStreamHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	fs.Debug(fh.d.path, "DirStreamHandle.Read size %d offset %d", req.Size, req.Offset)
+	if fh.lister == nil || req.Offset < fh.n {
+		fh.restart()
+	}
+	// skip entries if the kernel seeked forwards
+	for fh.n < req.Offset {
+		entry, err := fh.next()
+		if err != nil {
+			fs.ErrorLog(fh.d.path, "DirStreamHandle.Read error: %v", err)
+			return err
+		}
+		if entry == nil {
+			break
+		}
+		fh.n++
+	}
+	data := make([]byte, 0, req.Size)
+	for {
+		entry, err := fh.next()
+		if err != nil {
+			fs.ErrorLog(fh.d.path, "DirStreamHandle.Read error: %v", err)
+			return err
+		}
+		if entry == nil {
+			break
+		}
+		if len(data)+len(entry) > req.Size {
+			fh.pending = entry
+			break
+		}
+		data = append(data, entry...)
+		fh.n++
+	}
+	resp.Data = data
+	fs.Debug(fh.d.path, "DirStreamHandle.Read OK with %d bytes", len(data))
+	return nil
+}
+
+// Check interface satisfied
+var _ fusefs.HandleReleaser = (*DirStreamHandle)(nil)
+
+// Release stops any listing in progress
+func (fh *DirStreamHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	fh.stop()
+	return nil
+}
+
+// direntHeader is the header of a dirent as read by the kernel
+type direntHeader struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+const direntHeaderSize = int(unsafe.Sizeof(direntHeader{}))
+
+// appendDirent appends the encoded dirent to data using off as the
+// offset of the next entry and an inode number made from remote.
+//
+// fuse.AppendDirent can't be used as it sets the offset to the byte
+// position in data.
+func appendDirent(data []byte, dirent fuse.Dirent, remote string, off int64) []byte {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(remote))
+	header := direntHeader{
+		Ino:     h.Sum64() | 1, // never 0 as that means a deleted entry
+		Off:     uint64(off),
+		Namelen: uint32(len(dirent.Name)),
+		Type:    uint32(dirent.Type),
+	}
+	data = append(data, (*[direntHeaderSize]byte)(unsafe.Pointer(&header))[:]...)
+	data = append(data, dirent.Name...)
+	if pad := (direntHeaderSize + len(dirent.Name)) % 8; pad != 0 {
+		data = append(data, make([]byte, 8-pad)...)
+	}
+	return data
+}
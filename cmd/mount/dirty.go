@@ -0,0 +1,50 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"sync/atomic"
+)
+
+// dirtyXattr is the extended attribute showing whether the file has
+// data written to it which hasn't been uploaded yet as "1" or "0"
+const dirtyXattr = xattrPrefix + "dirty"
+
+// dirtyFiles is the number of files with data which hasn't been
+// uploaded yet - use sync/atomic to access
+var dirtyFiles int64
+
+// addDirty adds n to the number of writes to the file whose data
+// hasn't been uploaded yet
+//
+// The file is dirty from when it is opened for write until the upload
+// of the data written has finished, including any retries in the
+// background with --best-effort-uploads.
+func (f *File) addDirty(n int) {
+	f.mu.Lock()
+	before := f.dirty
+	f.dirty += n
+	after := f.dirty
+	f.mu.Unlock()
+	if before == 0 && after > 0 {
+		atomic.AddInt64(&dirtyFiles, 1)
+	} else if before > 0 && after == 0 {
+		atomic.AddInt64(&dirtyFiles, -1)
+	}
+}
+
+// isDirty returns whether the file has data written to it which
+// hasn't been uploaded yet
+func (f *File) isDirty() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.dirty > 0
+}
+
+// dirtyXattr returns the value of the dirty xattr of the file
+func (f *File) dirtyXattr() string {
+	if f.isDirty() {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,219 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+)
+
+// diskCache is the cache of blocks on disk with --read-cache-dir
+// which is kept between mounts, or nil if there isn't one
+var diskCache *diskBlockCache
+
+// diskCacheTempSuffix is the suffix of blocks being written to the
+// disk cache
+const diskCacheTempSuffix = ".tmp"
+
+// diskBlock is a block stored in a file in the disk cache
+type diskBlock struct {
+	name string    // name of the file in the cache directory
+	size int64     // size of the data
+	used time.Time // when the block was last read or written
+}
+
+// diskBlockCache is a cache of blocks in files in a directory.  The
+// blocks are found by a key made from the hash of the object so they
+// are found again by the next mount using the directory, and as each
+// block is only written once it has been read completely, a read
+// which was interrupted carries on from the blocks it didn't get.
+//
+// The least recently used blocks are removed to keep the files under
+// maxSize bytes, or under the space the write caches leave with
+// --cache-max-total-size.
+type diskBlockCache struct {
+	dir     string
+	mu      sync.Mutex
+	maxSize int64                 // maximum size of the files
+	size    int64                 // current size of the files
+	blocks  map[string]*diskBlock // blocks in the cache by name
+}
+
+// newDiskBlockCache opens the disk cache in dir making it if
+// necessary and finds the blocks stored there already
+func newDiskBlockCache(dir string, maxSize int64) (*diskBlockCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make read cache directory")
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read read cache directory")
+	}
+	c := &diskBlockCache{
+		dir:     dir,
+		maxSize: maxSize,
+		blocks:  make(map[string]*diskBlock, len(infos)),
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(info.Name(), diskCacheTempSuffix) {
+			// left by a mount which stopped while writing it
+			_ = os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		c.blocks[info.Name()] = &diskBlock{name: info.Name(), size: info.Size(), used: info.ModTime()}
+		c.size += info.Size()
+	}
+	fs.Debug(dir, "Found %d blocks of %d bytes in read cache directory", len(c.blocks), c.size)
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// diskBlockName returns the name of the file key is stored in
+func diskBlockName(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the block for key and whether it was found
+func (c *diskBlockCache) get(key string) ([]byte, bool) {
+	name := diskBlockName(key)
+	c.mu.Lock()
+	block, ok := c.blocks[name]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blocks[name] != block {
+		// removed or replaced while it was being read
+		return nil, false
+	}
+	if err != nil || int64(len(data)) != block.size {
+		fs.Debug(c.dir, "Failed to read block from read cache directory: %v", err)
+		c.remove(block)
+		return nil, false
+	}
+	block.used = time.Now()
+	// record the use for the next mount - it doesn't matter if
+	// this fails
+	_ = os.Chtimes(filepath.Join(c.dir, name), block.used, block.used)
+	return data, true
+}
+
+// put stores data for key in the cache removing the least recently
+// used blocks if necessary
+func (c *diskBlockCache) put(key string, data []byte) {
+	name := diskBlockName(key)
+	c.mu.Lock()
+	_, ok := c.blocks[name]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+	// write to a temporary file first so a partial block is
+	// never found
+	path := filepath.Join(c.dir, name)
+	err := ioutil.WriteFile(path+diskCacheTempSuffix, data, 0600)
+	if err == nil {
+		err = os.Rename(path+diskCacheTempSuffix, path)
+	}
+	if err != nil {
+		fs.ErrorLog(c.dir, "Failed to write block to read cache directory: %v", err)
+		_ = os.Remove(path + diskCacheTempSuffix)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[name]; ok {
+		// written by another reader at the same time
+		return
+	}
+	c.blocks[name] = &diskBlock{name: name, size: int64(len(data)), used: time.Now()}
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// remove the block from the cache
+//
+// Call with c.mu held
+func (c *diskBlockCache) remove(block *diskBlock) {
+	err := os.Remove(filepath.Join(c.dir, block.name))
+	if err != nil && !os.IsNotExist(err) {
+		fs.ErrorLog(c.dir, "Failed to remove block from read cache directory: %v", err)
+	}
+	delete(c.blocks, block.name)
+	c.size -= block.size
+}
+
+// diskBlocks sorts blocks by when they were last used, oldest first
+type diskBlocks []*diskBlock
+
+func (bs diskBlocks) Len() int           { return len(bs) }
+func (bs diskBlocks) Swap(i, j int)      { bs[i], bs[j] = bs[j], bs[i] }
+func (bs diskBlocks) Less(i, j int) bool { return bs[i].used.Before(bs[j].used) }
+
+// limit returns the size the cache must be kept under
+func (c *diskBlockCache) limit() int64 {
+	if totalCache != nil {
+		if maxSize := totalCache.readMaxSize(); maxSize < c.maxSize {
+			return maxSize
+		}
+	}
+	return c.maxSize
+}
+
+// trim removes blocks if the write caches have grown into the space
+// of the cache
+func (c *diskBlockCache) trim() {
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+}
+
+// evict removes the least recently used blocks until the cache is
+// under its maximum size
+//
+// Call with c.mu held
+func (c *diskBlockCache) evict() {
+	maxSize := c.limit()
+	if c.size <= maxSize {
+		return
+	}
+	blocks := make(diskBlocks, 0, len(c.blocks))
+	for _, block := range c.blocks {
+		blocks = append(blocks, block)
+	}
+	sort.Sort(blocks)
+	for _, block := range blocks {
+		if c.size <= maxSize {
+			break
+		}
+		c.remove(block)
+	}
+}
+
+// usage returns the current and maximum size of the files in the
+// cache
+func (c *diskBlockCache) usage() (size, maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, c.maxSize
+}
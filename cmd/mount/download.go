@@ -0,0 +1,141 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+)
+
+// downloadChunkSize is the size of the reads the download makes -
+// cancellation is checked between each one
+const downloadChunkSize = 64 * 1024
+
+// errDownloadCancelled is the error a download stops with if its
+// handle was closed before it was complete
+var errDownloadCancelled = errors.New("download cancelled")
+
+// download is a copy of an object being downloaded in the background
+// to a local temporary file with --read-download.
+//
+// Reads of the data downloaded so far are served from the file and
+// reads of the rest wait for it to arrive so a handle can seek
+// anywhere without reopening the object.
+type download struct {
+	o        fs.Object
+	file     *os.File
+	cancel   chan struct{} // closed to stop the download
+	finished chan struct{} // closed when the download has stopped
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled when more data is downloaded
+	size     int64      // bytes downloaded so far
+	err      error      // io.EOF if the download is complete or the error it failed with
+}
+
+// newDownload starts downloading r, the stream of o, to a temporary
+// file calling limit with the size of each read made
+//
+// r is closed when the download stops.
+func newDownload(o fs.Object, r io.ReadCloser, limit func(n int)) (*download, error) {
+	file, err := ioutil.TempFile("", "rclone-mount-download")
+	if err != nil {
+		return nil, err
+	}
+	d := &download{
+		o:        o,
+		file:     file,
+		cancel:   make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	go d.run(r, limit)
+	return d, nil
+}
+
+// run copies r into the file until it ends, fails or is cancelled
+func (d *download) run(r io.ReadCloser, limit func(n int)) {
+	defer close(d.finished)
+	buf := make([]byte, downloadChunkSize)
+	var err error
+	for err == nil {
+		select {
+		case <-d.cancel:
+			err = errDownloadCancelled
+			continue
+		default:
+		}
+		var n int
+		n, err = io.ReadFull(r, buf)
+		limit(n)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if n > 0 {
+			_, writeErr := d.file.WriteAt(buf[:n], d.size)
+			if writeErr != nil {
+				err = writeErr
+			}
+		}
+		d.mu.Lock()
+		d.size += int64(n)
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}
+	if err != io.EOF && err != errDownloadCancelled {
+		fs.ErrorLog(d.o, "Download failed: %v", err)
+	} else if err == io.EOF {
+		fs.Debug(d.o, "Download complete")
+	}
+	closeErr := r.Close()
+	if closeErr != nil {
+		fs.Debug(d.o, "Download close failed: %v", closeErr)
+	}
+	d.mu.Lock()
+	d.err = err
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// ReadAt reads len(p) bytes at off from the file waiting for them to
+// be downloaded if necessary
+func (d *download) ReadAt(p []byte, off int64) (n int, err error) {
+	d.mu.Lock()
+	for d.size < off+int64(len(p)) && d.err == nil {
+		d.cond.Wait()
+	}
+	size, downloadErr := d.size, d.err
+	d.mu.Unlock()
+	if off >= size {
+		if downloadErr == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, downloadErr
+	}
+	if end := size - off; end < int64(len(p)) {
+		p = p[:end]
+		err = downloadErr
+	}
+	n, readErr := d.file.ReadAt(p, off)
+	if readErr != nil {
+		return n, readErr
+	}
+	return n, err
+}
+
+// close stops the download if it is still running and removes the
+// file
+func (d *download) close() error {
+	close(d.cancel)
+	<-d.finished
+	err := d.file.Close()
+	removeErr := os.Remove(d.file.Name())
+	if err == nil {
+		err = removeErr
+	}
+	return err
+}
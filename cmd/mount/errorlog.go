@@ -0,0 +1,93 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// errorLogQueue is the number of error events which can be waiting
+// to be written before more are dropped
+const errorLogQueue = 1024
+
+// errorLog writes the error events to the --error-log file or is nil
+var errorLog *errorEventLog
+
+// errorEvent is an error written to the --error-log as a line of JSON
+type errorEvent struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`   // what failed - read, hash or upload
+	Path    string    `json:"path"` // path of the file in the mount
+	Error   string    `json:"error"`
+	Retries int       `json:"retries"` // number of retries made before failing
+}
+
+// errorEventLog writes error events as JSON lines in the background
+// so logging them never holds up the FUSE operations
+type errorEventLog struct {
+	out     io.WriteCloser
+	events  chan errorEvent
+	done    chan struct{}
+	dropped int64 // number of events dropped as the queue was full - use with atomic
+}
+
+// newErrorEventLog starts writing the error events to out
+func newErrorEventLog(out io.WriteCloser) *errorEventLog {
+	l := &errorEventLog{
+		out:    out,
+		events: make(chan errorEvent, errorLogQueue),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// run writes the events until the log is closed
+func (l *errorEventLog) run() {
+	defer close(l.done)
+	enc := json.NewEncoder(l.out)
+	for event := range l.events {
+		if err := enc.Encode(event); err != nil {
+			fs.ErrorLog(nil, "Failed to write to --error-log: %v", err)
+		}
+	}
+}
+
+// add queues an event dropping it if the queue is full
+func (l *errorEventLog) add(event errorEvent) {
+	select {
+	case l.events <- event:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+// close writes the events queued then closes the file
+func (l *errorEventLog) close() error {
+	close(l.events)
+	<-l.done
+	if dropped := atomic.LoadInt64(&l.dropped); dropped > 0 {
+		fs.ErrorLog(nil, "Dropped %d events from --error-log as it couldn't keep up", dropped)
+	}
+	return l.out.Close()
+}
+
+// logErrorEvent records that op on remote failed with err after the
+// number of retries given if --error-log is set
+func logErrorEvent(op, remote string, err error, retries int) {
+	if errorLog == nil {
+		return
+	}
+	errorLog.add(errorEvent{
+		Time:    time.Now(),
+		Op:      op,
+		Path:    remote,
+		Error:   err.Error(),
+		Retries: retries,
+	})
+}
@@ -5,6 +5,7 @@ package mount
 import (
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -16,11 +17,20 @@ import (
 
 // File represents a file
 type File struct {
-	size    int64        // size of file - read and written with atomic int64 - must be 64 bit aligned
-	d       *Dir         // parent directory - read only
-	mu      sync.RWMutex // protects the following
-	o       fs.Object    // NB o may be nil if file is being written
-	writers int          // number of writers for this file
+	size    int64              // size of file - read and written with atomic int64 - must be 64 bit aligned
+	d       *Dir               // parent directory - read only
+	mu      sync.RWMutex       // protects the following
+	o       fs.Object          // NB o may be nil if file is being written
+	writers []*WriteFileHandle // open write handles for this file
+	readers []fileReader       // open read handles for this file
+	atime   time.Time          // access time if set with Setattr, zero otherwise
+	dirty   int                // number of writes whose data hasn't been uploaded yet
+
+	versions   int       // number of versions of versionsOf
+	versionsOf fs.Object // the object whose versions were counted or nil
+
+	hashes   map[fs.HashType]string // hashes of hashesOf read for the xattrs
+	hashesOf fs.Object              // the object whose hashes were read or nil
 }
 
 // newFile creates a new File
@@ -31,13 +41,144 @@ func newFile(d *Dir, o fs.Object) *File {
 	}
 }
 
-// addWriters increments or decrements the writers
-func (f *File) addWriters(n int) {
+// errArchived is returned when opening a file for read whose object
+// is in an archive storage class without --allow-archive-reads rather
+// than stalling until the read fails
+var errArchived = fuse.Errno(syscall.EACCES)
+
+// errFileBusy is returned when opening a file for write which is
+// already open for write as the uploads would overwrite each other
+var errFileBusy = fuse.Errno(syscall.EBUSY)
+
+// addWriter adds fh to the writers noting the object the file has
+// now, or returns errFileBusy if there is a writer already
+func (f *File) addWriter(fh *WriteFileHandle) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.writers) > 0 {
+		return errFileBusy
+	}
+	fh.base = f.o
+	f.writers = append(f.writers, fh)
+	return nil
+}
+
+// changedSince returns whether the object of the file is no longer o
+func (f *File) changedSince(o fs.Object) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.o != o
+}
+
+// writerStale returns whether the object of the file has changed
+// since fh was opened for write
+func (f *File) writerStale(fh *WriteFileHandle) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.o != fh.base
+}
+
+// setRetriedObject sets the object of the file to o uploaded by a
+// background retry of a write made when the object was base,
+// returning false without setting it if the file has changed since.
+//
+// A writer opened since is replacing the same data so its base is
+// moved on to o rather than failing it with errFileChanged.
+func (f *File) setRetriedObject(base, o fs.Object) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.o != base {
+		return false
+	}
+	f.o = o
+	f.d.addObject(o, f)
+	for _, writer := range f.writers {
+		if writer.base == base {
+			writer.base = o
+		}
+	}
+	return true
+}
+
+// delWriter removes fh from the writers
+func (f *File) delWriter(fh *WriteFileHandle) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, writer := range f.writers {
+		if writer == fh {
+			f.writers = append(f.writers[:i], f.writers[i+1:]...)
+			return
+		}
+	}
+}
+
+// fileReader is an open read handle of a File
+type fileReader interface {
+	// readPosition returns the offset of the end of the last read
+	readPosition() int64
+}
+
+// addReader adds fh to the readers
+func (f *File) addReader(fh fileReader) {
 	f.mu.Lock()
-	f.writers += n
+	f.readers = append(f.readers, fh)
 	f.mu.Unlock()
 }
 
+// delReader removes fh from the readers
+func (f *File) delReader(fh fileReader) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, reader := range f.readers {
+		if reader == fh {
+			f.readers = append(f.readers[:i], f.readers[i+1:]...)
+			return
+		}
+	}
+}
+
+// readProgress returns the furthest offset any of the open read
+// handles has read to and whether there are any
+func (f *File) readProgress() (position int64, ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, fh := range f.readers {
+		if p := fh.readPosition(); p > position {
+			position = p
+		}
+	}
+	return position, len(f.readers) > 0
+}
+
+// hasWriters returns whether the file has open write handles
+func (f *File) hasWriters() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.writers) > 0
+}
+
+// cancelWriters cancels the uploads of the writers as the file has
+// been removed
+func (f *File) cancelWriters() {
+	f.mu.RLock()
+	writers := append([]*WriteFileHandle(nil), f.writers...)
+	f.mu.RUnlock()
+	for _, fh := range writers {
+		fh.cancel()
+	}
+}
+
+// contentEncoded returns whether o is stored with a content encoding
+// so the data read from it is decoded, and the size of the decoded
+// data or -1 if it isn't known.
+func contentEncoded(o fs.Object) (encoded bool, size int64) {
+	do, ok := o.(fs.ContentEncoder)
+	if !ok || do.ContentEncoding() == "" {
+		return false, o.Size()
+	}
+	return true, do.DecodedSize()
+}
+
 // Check interface satisfied
 var _ fusefs.Node = (*File)(nil)
 
@@ -54,17 +195,109 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 		a.Size = uint64(atomic.LoadInt64(&f.size))
 	} else {
 		a.Size = uint64(f.o.Size())
+		if encoded, size := contentEncoded(f.o); encoded && size >= 0 {
+			a.Size = uint64(size)
+		}
+		if isCompressed, size := compressed(f.o); isCompressed && size >= 0 {
+			a.Size = uint64(size)
+		}
 		if !noModTime {
 			modTime := f.o.ModTime()
 			a.Atime = modTime
 			a.Mtime = modTime
 			a.Ctime = modTime
 			a.Crtime = modTime
+			if do, ok := f.o.(fs.CreationTimer); ok {
+				if created := do.CreationTime(); !created.IsZero() {
+					a.Crtime = created
+				}
+			}
 		}
 	}
+	if !f.atime.IsZero() {
+		a.Atime = f.atime
+	}
+	setBlocks(a)
 	return nil
 }
 
+// setModTimeRetrySleep is the time to sleep before the first retry of
+// a failed SetModTime - it doubles for each subsequent retry
+var setModTimeRetrySleep = 100 * time.Millisecond
+
+// setModTime sets the modification time of o retrying up to
+// --low-level-retries times with exponential backoff if it fails.
+//
+// ErrorCantSetModTime and errors which can't succeed on a retry are
+// returned straight away and EINTR if ctx is cancelled while waiting
+// to retry.
+func setModTime(ctx context.Context, op opLog, o fs.Object, modTime time.Time) (err error) {
+	sleep := setModTimeRetrySleep
+	for try := 1; ; try++ {
+		err = o.SetModTime(modTime)
+		if err == nil || err == fs.ErrorCantSetModTime || fs.IsNoRetryError(err) || fs.IsFatalError(err) || try >= fs.Config.LowLevelRetries {
+			return err
+		}
+		fs.Debug(op, "SetModTime failed - retrying in %v (%d/%d): %v", sleep, try, fs.Config.LowLevelRetries, err)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return fuse.EINTR
+		}
+		sleep *= 2
+	}
+}
+
+// Check interface satisfied
+var _ fusefs.NodeSetattrer = (*File)(nil)
+
+// Setattr sets the access and modification times of the file
+//
+// Only the times flagged in req.Valid are changed so that a time
+// passed as UTIME_OMIT to utimensat is left alone.
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	f.mu.Lock()
+	op := opLog{o: f.o, id: newRequestID()}
+	fs.Debug(op, "File.Setattr %v", req.Valid)
+	if immutable && f.o != nil && (req.Valid.Size() || req.Valid.Mtime() || req.Valid.MtimeNow()) {
+		f.mu.Unlock()
+		fs.Debug(op, "File.Setattr can't modify file with --immutable")
+		return fuse.EPERM
+	}
+	if f.o != nil && overlayProtected(f.o) && (req.Valid.Mtime() || req.Valid.MtimeNow()) {
+		f.mu.Unlock()
+		fs.Debug(op, "File.Setattr can't modify file on the remote with --overlay-writes")
+		return fuse.EPERM
+	}
+	now := time.Now()
+	if f.o != nil && f.atime.IsZero() {
+		// remember the current access time before mtime changes
+		f.atime = f.o.ModTime()
+	}
+	if req.Valid.AtimeNow() {
+		f.atime = now
+	} else if req.Valid.Atime() {
+		f.atime = req.Atime
+	}
+	o := f.o
+	f.mu.Unlock()
+	if (req.Valid.Mtime() || req.Valid.MtimeNow()) && o != nil {
+		modTime := req.Mtime
+		if req.Valid.MtimeNow() {
+			modTime = now
+		}
+		// without f.mu held so the file can be used while retrying
+		err := setModTime(ctx, op, o, modTime)
+		if err == fs.ErrorCantSetModTime {
+			fs.Debug(op, "File.Setattr can't set modification time")
+		} else if err != nil {
+			fs.ErrorLog(op, "File.Setattr error: %v", err)
+			return err
+		}
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
 // Update the size while writing
 func (f *File) written(n int64) {
 	atomic.AddInt64(&f.size, n)
@@ -86,7 +319,7 @@ func (f *File) waitForValidObject() (o fs.Object, err error) {
 	for i := 0; i < 50; i++ {
 		f.mu.Lock()
 		o = f.o
-		writers := f.writers
+		writers := len(f.writers)
 		f.mu.Unlock()
 		if o != nil {
 			return o, nil
@@ -103,28 +336,138 @@ func (f *File) waitForValidObject() (o fs.Object, err error) {
 var _ fusefs.NodeOpener = (*File)(nil)
 
 // Open the file for read or write
+//
+// With --read-your-writes opening a file for read while it is being
+// written reads the data written so far.
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
-	// if o is nil it isn't valid yet
-	o, err := f.waitForValidObject()
+	// with --read-your-writes a file being written can be read
+	// before its object is valid
+	var o fs.Object
+	remote := ""
+	if readYourWrites && req.Flags.IsReadOnly() {
+		remote = f.writingRemote()
+		f.mu.RLock()
+		o = f.o
+		f.mu.RUnlock()
+	}
+	if remote == "" {
+		// if o is nil it isn't valid yet
+		var err error
+		o, err = f.waitForValidObject()
+		if err != nil {
+			return nil, err
+		}
+		remote = o.Remote()
+	}
+
+	op := opLog{o: remote, id: newRequestID()}
+	fs.Debug(op, "File.Open")
+
+	err := checkACL(&req.Header, remote, !req.Flags.IsReadOnly())
 	if err != nil {
 		return nil, err
 	}
-
-	fs.Debug(o, "File.Open")
+	if _, ok := o.(*partsObject); ok && !req.Flags.IsReadOnly() {
+		fs.Debug(op, "File.Open can't modify file assembled from parts")
+		return nil, fuse.EPERM
+	}
 
 	switch {
 	case req.Flags.IsReadOnly():
+		if uploadOnly {
+			fs.Debug(op, "File.Open read refused with --upload-only")
+			return nil, fuse.Errno(syscall.EACCES)
+		}
+		if do, ok := o.(fs.StorageClasser); ok && do.Archived() && !allowArchiveReads {
+			fs.ErrorLog(op, "File.Open read refused as in archive storage class %q - restore it or use --allow-archive-reads", do.StorageClass())
+			return nil, errArchived
+		}
+		if readYourWrites {
+			if fh := f.openWriteCache(); fh != nil {
+				// the data changes as it is written
+				resp.Flags |= fuse.OpenDirectIO
+				return fh, nil
+			}
+			if o == nil {
+				// the writer finished in the meantime
+				o, err = f.waitForValidObject()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
 		if noSeek {
 			resp.Flags |= fuse.OpenNonSeekable
 		}
-		return newReadFileHandle(o)
+		if keepCache || immutable {
+			// the contents can't change so let the kernel
+			// keep its page cache between opens
+			resp.Flags |= fuse.OpenKeepCache
+		}
+		limited, err := f.d.acquireOpen(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if isCompressed, size := compressed(o); isCompressed {
+			if size < 0 {
+				// the size reported is the compressed size
+				resp.Flags |= fuse.OpenDirectIO
+			}
+			fs.Debug(op, "File.Open decompressing file compressed with --compress-on-write")
+			fh := newCompressedFileHandle(hotTierObject(o))
+			if limited {
+				fh.openDir = f.d
+			}
+			fh.file = f
+			f.addReader(fh)
+			return fh, nil
+		}
+		if encoded, size := contentEncoded(o); encoded && size < 0 {
+			// the size reported is smaller than the data so
+			// stop the kernel stopping reading at it
+			fs.Debug(op, "File.Open using direct IO for content encoded object")
+			resp.Flags |= fuse.OpenDirectIO
+		}
+		fh, err := newReadFileHandleID(ctx, hotTierObject(o), op.id)
+		if err != nil && limited {
+			f.d.releaseOpen()
+		}
+		if errors.Cause(err) == fs.ErrorObjectNotFound {
+			// deleted since it was listed
+			fs.Debug(op, "File.Open object not found: %v", err)
+			f.d.delObject(f.d.leaf(o.Remote()))
+			return nil, fuse.ENOENT
+		}
+		if err != nil {
+			return nil, err
+		}
+		if limited {
+			fh.openDir = f.d
+		}
+		fh.file = f
+		f.addReader(fh)
+		return fh, nil
 	case req.Flags.IsWriteOnly():
-		resp.Flags |= fuse.OpenNonSeekable
+		if immutable {
+			fs.Debug(op, "File.Open can't modify file with --immutable")
+			return nil, fuse.EPERM
+		}
+		if !writeCacheEnabled {
+			resp.Flags |= fuse.OpenNonSeekable
+		}
 		src := newCreateInfo(f.d.f, o.Remote())
-		fh, err := newWriteFileHandle(f.d, f, src)
+		fh, err := newWriteFileHandle(ctx, f.d, f, src)
 		if err != nil {
 			return nil, err
 		}
+		if fh.cache != nil && req.Flags&fuse.OpenTruncate == 0 {
+			err = fh.seedWriteCache(o)
+			if err != nil {
+				fs.ErrorLog(op, "File.Open write cache error: %v", err)
+				fh.abort(err)
+				return nil, err
+			}
+		}
 		return fh, nil
 	case req.Flags.IsReadWrite():
 		return nil, errors.New("can't open read and write")
@@ -0,0 +1,529 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// lookupFile looks up the File leaf in d
+func lookupFile(t *testing.T, d *Dir, leaf string) *File {
+	item, err := d.lookupNode(leaf)
+	require.NoError(t, err)
+	return item.node.(*File)
+}
+
+// Test the object metadata is readable as xattrs but can't be changed
+func TestFileXattrs(t *testing.T) {
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	file := lookupFile(t, d, "file")
+
+	resp := &fuse.ListxattrResponse{}
+	require.NoError(t, file.Listxattr(context.Background(), &fuse.ListxattrRequest{}, resp))
+	assert.Equal(t, "user.rclone.hash.md5\x00user.rclone.id\x00user.rclone.modtime\x00", string(resp.Xattr))
+
+	md5, err := o.Hash(fs.HashMD5)
+	require.NoError(t, err)
+	getResp := &fuse.GetxattrResponse{}
+	require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.hash.md5"}, getResp))
+	assert.Equal(t, md5, string(getResp.Xattr))
+
+	err = file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.other"}, getResp)
+	assert.Equal(t, fuse.ErrNoXattr, err)
+	before := o.hashes
+	require.NoError(t, file.Listxattr(context.Background(), &fuse.ListxattrRequest{}, &fuse.ListxattrResponse{}))
+	require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.hash.md5"}, getResp))
+	assert.Equal(t, before, o.hashes, "the xattrs are only made once for each object")
+
+	err = file.Setxattr(context.Background(), &fuse.SetxattrRequest{Name: "user.rclone.hash.md5", Xattr: []byte("potato")})
+	assert.Equal(t, fuse.EPERM, err)
+	err = file.Removexattr(context.Background(), &fuse.RemovexattrRequest{Name: "user.rclone.id"})
+	assert.Equal(t, fuse.EPERM, err)
+}
+
+// Test --hide-hashes hides the hash xattrs and the hashes in errors
+// but still checks them
+func TestFileHideHashes(t *testing.T) {
+	defer func(old bool) { hideHashes = old }(hideHashes)
+	hideHashes = true
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	file := lookupFile(t, d, "file")
+
+	resp := &fuse.ListxattrResponse{}
+	require.NoError(t, file.Listxattr(context.Background(), &fuse.ListxattrRequest{}, resp))
+	assert.Equal(t, "user.rclone.modtime\x00", string(resp.Xattr))
+	err := file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.hash.md5"}, &fuse.GetxattrResponse{})
+	assert.Equal(t, fuse.ErrNoXattr, err)
+	// the ETag is the MD5 so isn't shown as the ID either
+	err = file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.id"}, &fuse.GetxattrResponse{})
+	assert.Equal(t, fuse.ErrNoXattr, err)
+
+	md5, err := o.Hash(fs.HashMD5)
+	require.NoError(t, err)
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	o.contents = []byte("HELLO")
+	assert.Equal(t, "hello", readString(t, fh, 0, 100))
+	err = fh.Release(context.Background(), &fuse.ReleaseRequest{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "corrupted on transfer")
+	assert.NotContains(t, err.Error(), md5)
+}
+
+// Test --sidecar-as-xattr shows the keys of a file's JSON sidecar as
+// xattrs and hides the sidecar
+func TestFileSidecarAsXattr(t *testing.T) {
+	defer func(old string) { sidecarSuffix = old }(sidecarSuffix)
+	sidecarSuffix = ".json"
+	f, d := mockDir()
+	f.add("photo.jpg", "jpeg data")
+	f.add("photo.jpg.json", `{"camera": "pinhole", "iso": 400, "tags": ["sea", "sky"]}`)
+	f.add("orphan.json", `{"camera": "none"}`)
+
+	assert.Equal(t, []string{"orphan.json", "photo.jpg"}, listing(t, d))
+	file := lookupFile(t, d, "photo.jpg")
+	resp := &fuse.ListxattrResponse{}
+	require.NoError(t, file.Listxattr(context.Background(), &fuse.ListxattrRequest{}, resp))
+	assert.Equal(t, "user.camera\x00user.iso\x00user.rclone.hash.md5\x00user.rclone.id\x00user.rclone.modtime\x00user.tags\x00", string(resp.Xattr))
+	for name, want := range map[string]string{
+		"user.camera": "pinhole",
+		"user.iso":    "400",
+		"user.tags":   `["sea","sky"]`,
+	} {
+		getResp := &fuse.GetxattrResponse{}
+		require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: name}, getResp))
+		assert.Equal(t, want, string(getResp.Xattr), name)
+	}
+
+	// files without a sidecar don't get any
+	orphan := lookupFile(t, d, "orphan.json")
+	err := orphan.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.camera"}, &fuse.GetxattrResponse{})
+	assert.Equal(t, fuse.ErrNoXattr, err)
+}
+
+// mimeObject is a mockObject which the remote has a MIME type for
+type mimeObject struct {
+	*mockObject
+	mimeType string
+}
+
+// MimeType returns the MIME type of the object
+func (o *mimeObject) MimeType() string { return o.mimeType }
+
+// Test --mime-types shows the MIME type the remote has as an xattr
+func TestFileMimeTypeXattr(t *testing.T) {
+	defer func(old bool) { mimeTypes = old }(mimeTypes)
+	mimeTypes = true
+	f, d := mockDir()
+	file := newFile(d, &mimeObject{mockObject: f.add("picture", "png data"), mimeType: "image/png"})
+	plain := newFile(d, f.add("plain.png", "png data"))
+
+	resp := &fuse.GetxattrResponse{}
+	require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.mime_type"}, resp))
+	assert.Equal(t, "image/png", string(resp.Xattr))
+	err := file.Setxattr(context.Background(), &fuse.SetxattrRequest{Name: "user.mime_type", Xattr: []byte("text/plain")})
+	assert.Equal(t, fuse.EPERM, err)
+
+	// not guessed from the name if the remote doesn't have one
+	err = plain.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.mime_type"}, resp)
+	assert.Equal(t, fuse.ErrNoXattr, err)
+
+	mimeTypes = false
+	err = file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.mime_type"}, resp)
+	assert.Equal(t, fuse.ErrNoXattr, err)
+}
+
+// encodedObject is a mockObject stored with a content encoding so its
+// Size is smaller than the decoded data read from it
+type encodedObject struct {
+	*mockObject
+	size        int64 // size of the encoded data
+	decodedSize int64 // size of the decoded data or -1
+}
+
+// Size returns the size of the encoded data
+func (o *encodedObject) Size() int64 { return o.size }
+
+// ContentEncoding returns the content encoding
+func (o *encodedObject) ContentEncoding() string { return "gzip" }
+
+// DecodedSize returns the size of the decoded data if known
+func (o *encodedObject) DecodedSize() int64 { return o.decodedSize }
+
+// Test content encoded objects report their decoded size if known and
+// can be read in full if not
+func TestFileContentEncoding(t *testing.T) {
+	f, d := mockDir()
+	body := strings.Repeat("decoded body ", 100)
+	o := &encodedObject{mockObject: f.add("file.txt", body), size: 100, decodedSize: -1}
+	file := newFile(d, o)
+
+	var a fuse.Attr
+	require.NoError(t, file.Attr(context.Background(), &a))
+	assert.Equal(t, uint64(100), a.Size)
+
+	resp := &fuse.OpenResponse{}
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, resp)
+	require.NoError(t, err)
+	assert.NotEqual(t, fuse.OpenResponseFlags(0), resp.Flags&fuse.OpenDirectIO)
+	fh := handle.(*ReadFileHandle)
+	var got string
+	for {
+		data := readString(t, fh, int64(len(got)), 64)
+		if data == "" {
+			break
+		}
+		got += data
+	}
+	assert.Equal(t, body, got)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	o.decodedSize = int64(len(body))
+	require.NoError(t, file.Attr(context.Background(), &a))
+	assert.Equal(t, uint64(len(body)), a.Size)
+}
+
+// Test --server-decompress asks the remote to decompress content
+// encoded objects only
+func TestFileServerDecompress(t *testing.T) {
+	defer func(old bool) { serverDecompress = old }(serverDecompress)
+	f, d := mockDir()
+	body := strings.Repeat("decoded body ", 100)
+	encoded := &encodedObject{mockObject: f.add("file.txt", body), size: 100, decodedSize: int64(len(body))}
+	plain := f.add("plain.txt", body)
+	read := func(o fs.Object) {
+		handle, err := newFile(d, o).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		fh := handle.(*ReadFileHandle)
+		assert.Equal(t, body[10:20], readString(t, fh, 10, 10))
+		require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	}
+
+	read(encoded)
+	assert.Equal(t, 0, encoded.decodes)
+
+	serverDecompress = true
+	opens := encoded.opens
+	read(encoded)
+	assert.Equal(t, encoded.opens-opens, encoded.decodes)
+	assert.NotEqual(t, 0, encoded.decodes)
+	read(plain)
+	assert.Equal(t, 0, plain.decodes)
+
+	// the decoded size is reported
+	var a fuse.Attr
+	require.NoError(t, newFile(d, encoded).Attr(context.Background(), &a))
+	assert.Equal(t, uint64(len(body)), a.Size)
+}
+
+// Test --hot-tier reads objects from the hot tier when it has the
+// same contents and from the remote otherwise
+func TestFileHotTier(t *testing.T) {
+	defer func(old fs.Fs) { hotTier = old }(hotTier)
+	hot := newMockFs()
+	hotTier = hot
+	f, d := mockDir()
+	coldBoth := f.add("both", "same")
+	hotBoth := hot.add("both", "same")
+	coldOnly := f.add("cold", "cold only")
+	coldStale := f.add("stale", "new contents")
+	hotStale := hot.add("stale", "old contents")
+
+	read := func(leaf string) string {
+		fh, err := lookupFile(t, d, leaf).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, fh.(fusefs.HandleReleaser).Release(context.Background(), &fuse.ReleaseRequest{}))
+		}()
+		return readString(t, fh.(*ReadFileHandle), 0, 100)
+	}
+	assert.Equal(t, "same", read("both"))
+	assert.Equal(t, 1, hotBoth.opens)
+	assert.Equal(t, 0, coldBoth.opens)
+	assert.Equal(t, "cold only", read("cold"))
+	assert.Equal(t, 1, coldOnly.opens)
+	assert.Equal(t, "new contents", read("stale"))
+	assert.Equal(t, 1, coldStale.opens)
+	assert.Equal(t, 0, hotStale.opens)
+}
+
+// Test the read_progress xattr shows how far the open read handles
+// have read
+func TestFileReadProgress(t *testing.T) {
+	f, d := mockDir()
+	f.add("file", "0123456789")
+	file := lookupFile(t, d, "file")
+	progress := func() string {
+		resp := &fuse.GetxattrResponse{}
+		err := file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.read_progress"}, resp)
+		if err == fuse.ErrNoXattr {
+			return ""
+		}
+		require.NoError(t, err)
+		return string(resp.Xattr)
+	}
+	open := func() *ReadFileHandle {
+		fh, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		return fh.(*ReadFileHandle)
+	}
+	assert.Equal(t, "", progress())
+
+	fh := open()
+	assert.Equal(t, "0/10", progress())
+	assert.Equal(t, "012", readString(t, fh, 0, 3))
+	assert.Equal(t, "3/10", progress())
+
+	// the furthest read of all the handles is shown
+	fh2 := open()
+	assert.Equal(t, "67", readString(t, fh2, 6, 2))
+	assert.Equal(t, "8/10", progress())
+	require.NoError(t, fh2.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, "3/10", progress())
+
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, "", progress())
+}
+
+// Test --per-dir-open-limit makes opens of files in a directory wait
+// for others to be closed
+func TestFilePerDirOpenLimit(t *testing.T) {
+	defer func(old int) { perDirOpenLimit = old }(perDirOpenLimit)
+	perDirOpenLimit = 2
+	f := newMockFs()
+	for _, remote := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		f.add(remote, "hello")
+	}
+	a, b := newDir(f, "a"), newDir(f, "b")
+	open := func(ctx context.Context, d *Dir, leaf string) (fusefs.Handle, error) {
+		return lookupFile(t, d, leaf).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	}
+	release := func(fh fusefs.Handle) {
+		require.NoError(t, fh.(fusefs.HandleReleaser).Release(context.Background(), &fuse.ReleaseRequest{}))
+	}
+
+	fh1, err := open(context.Background(), a, "1")
+	require.NoError(t, err)
+	fh2, err := open(context.Background(), a, "2")
+	require.NoError(t, err)
+
+	// the third open in a waits
+	file3 := lookupFile(t, a, "3")
+	opened := make(chan fusefs.Handle)
+	go func() {
+		fh, err := file3.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		assert.NoError(t, err)
+		opened <- fh
+	}()
+	select {
+	case <-opened:
+		t.Fatal("open didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// but files in other directories don't
+	fhb, err := open(context.Background(), b, "1")
+	require.NoError(t, err)
+	release(fhb)
+
+	// an open which is interrupted gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = open(ctx, a, "1")
+	assert.Equal(t, fuse.EINTR, err)
+
+	// closing a file lets the waiting open carry on
+	release(fh1)
+	select {
+	case fh3 := <-opened:
+		release(fh3)
+	case <-time.After(5 * time.Second):
+		t.Fatal("open still waiting")
+	}
+	release(fh2)
+	assert.Equal(t, 0, len(a.openSlots))
+}
+
+// Test --open-rate paces the opens of files
+func TestFileOpenRate(t *testing.T) {
+	defer func(old *priorityLimiter) { openLimiter = old }(openLimiter)
+	openLimiter = newPriorityLimiter(20)
+	f, d := mockDir()
+	for i := 0; i < 8; i++ {
+		f.add(fmt.Sprintf("file%d", i), "data")
+	}
+	var opened []time.Time
+	for i := 0; i < 8; i++ {
+		file := lookupFile(t, d, fmt.Sprintf("file%d", i))
+		handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		opened = append(opened, time.Now())
+		require.NoError(t, handle.(*ReadFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+	}
+	// once the burst allowance of 100ms worth has been used up
+	// the opens are 50ms apart
+	for i := 3; i < len(opened); i++ {
+		gap := opened[i].Sub(opened[i-1])
+		assert.True(t, gap >= 40*time.Millisecond, "gap %d was %v", i, gap)
+	}
+
+	// writes are paced too
+	start := time.Now()
+	createFile(t, d, "new", "data")
+	assert.True(t, time.Since(start) >= 40*time.Millisecond, "took %v", time.Since(start))
+
+	// an open which is interrupted while waiting gives up
+	openLimiter.wait(10, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err := lookupFile(t, d, "file0").Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.EINTR, err)
+	assert.True(t, time.Since(start) < 200*time.Millisecond, "took %v", time.Since(start))
+}
+
+// Test the creation time is used for the birth time of files where
+// the remote records it
+func TestFileCreationTime(t *testing.T) {
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	modTime := o.modTime
+	o.created = modTime.Add(-24 * time.Hour)
+	f.add("other", "hello")
+
+	var a fuse.Attr
+	require.NoError(t, lookupFile(t, d, "file").Attr(context.Background(), &a))
+	assert.Equal(t, o.created, a.Crtime)
+	assert.Equal(t, modTime, a.Mtime)
+
+	a = fuse.Attr{}
+	require.NoError(t, lookupFile(t, d, "other").Attr(context.Background(), &a))
+	assert.Equal(t, a.Mtime, a.Crtime)
+}
+
+// Test setting the modification time is retried after a transient
+// error and ErrorCantSetModTime is ignored
+func TestFileSetattrRetry(t *testing.T) {
+	defer func(old time.Duration) { setModTimeRetrySleep = old }(setModTimeRetrySleep)
+	setModTimeRetrySleep = time.Millisecond
+	defer func(old int) { fs.Config.LowLevelRetries = old }(fs.Config.LowLevelRetries)
+	fs.Config.LowLevelRetries = 3
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	file := lookupFile(t, d, "file")
+	modTime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	setattr := func() error {
+		req := &fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: modTime}
+		return file.Setattr(context.Background(), req, &fuse.SetattrResponse{})
+	}
+
+	o.setErrs = []error{errors.New("transient error")}
+	require.NoError(t, setattr())
+	assert.Equal(t, 2, o.sets)
+	assert.Equal(t, modTime, o.modTime)
+
+	// gives up after --low-level-retries
+	o.sets = 0
+	o.setErrs = []error{errors.New("1"), errors.New("2"), errors.New("3")}
+	assert.Error(t, setattr())
+	assert.Equal(t, 3, o.sets)
+
+	// remotes which can't set the time aren't retried
+	o.sets = 0
+	o.setErrs = []error{fs.ErrorCantSetModTime}
+	assert.NoError(t, setattr())
+	assert.Equal(t, 1, o.sets)
+
+	// the file can be used while waiting to retry and the retries
+	// stop when the request is interrupted
+	setModTimeRetrySleep = time.Hour
+	o.sets = 0
+	o.setErrs = []error{errors.New("transient error")}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		req := &fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: modTime}
+		done <- file.Setattr(ctx, req, &fuse.SetattrResponse{})
+	}()
+	var a fuse.Attr
+	require.NoError(t, file.Attr(context.Background(), &a))
+	cancel()
+	assert.Equal(t, fuse.EINTR, <-done)
+	assert.Equal(t, 1, o.sets)
+}
+
+// Test the version count of an object on a versioned remote is shown
+// as an xattr and only counted once
+func TestFileVersionCountXattr(t *testing.T) {
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	o.versions = 3
+	f.add("unversioned", "hello")
+
+	getResp := &fuse.GetxattrResponse{}
+	file := lookupFile(t, d, "file")
+	require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.version_count"}, getResp))
+	assert.Equal(t, "3", string(getResp.Xattr))
+	resp := &fuse.ListxattrResponse{}
+	require.NoError(t, file.Listxattr(context.Background(), &fuse.ListxattrRequest{}, resp))
+	assert.Contains(t, string(resp.Xattr), "user.rclone.version_count\x00")
+	assert.Equal(t, 1, o.counts)
+
+	// a new version of the object is counted again
+	newer := f.add("file", "hello again")
+	newer.versions = 4
+	file.setObject(newer)
+	require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.version_count"}, getResp))
+	assert.Equal(t, "4", string(getResp.Xattr))
+
+	err := lookupFile(t, d, "unversioned").Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.rclone.version_count"}, getResp)
+	assert.Equal(t, fuse.ErrNoXattr, err)
+}
+
+// Test the storage class is shown as an xattr and archived objects
+// can't be read without --allow-archive-reads
+func TestFileStorageClass(t *testing.T) {
+	defer func(old bool) { allowArchiveReads = old }(allowArchiveReads)
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	o.class = "GLACIER"
+	file := lookupFile(t, d, "file")
+
+	getResp := &fuse.GetxattrResponse{}
+	require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.storage_class"}, getResp))
+	assert.Equal(t, "GLACIER", string(getResp.Xattr))
+
+	open := func() (fusefs.Handle, error) {
+		return file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	}
+	_, err := open()
+	assert.Equal(t, errArchived, err)
+	assert.Equal(t, 0, o.opens)
+
+	allowArchiveReads = true
+	handle, err := open()
+	require.NoError(t, err)
+	fh := handle.(*ReadFileHandle)
+	assert.Equal(t, "hello", readString(t, fh, 0, 100))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// objects in other classes can be read
+	allowArchiveReads = false
+	o.class = "STANDARD"
+	handle, err = open()
+	require.NoError(t, err)
+	require.NoError(t, handle.(*ReadFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+}
@@ -0,0 +1,51 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"bazil.org/fuse"
+	"github.com/ncw/rclone/fs"
+)
+
+// activeFilter returns the filter from --include, --exclude and the
+// other filter flags or nil if there isn't one
+func activeFilter() *fs.Filter {
+	filter := fs.Config.Filter
+	if filter == nil || filter.InActive() {
+		return nil
+	}
+	return filter
+}
+
+// isFiltered returns whether o is hidden from the listings by the
+// filter flags
+func isFiltered(o fs.Object) bool {
+	filter := activeFilter()
+	return filter != nil && !filter.IncludeObject(o)
+}
+
+// isFilteredDir returns whether the directory remote is hidden from
+// the listings by the filter flags
+func isFilteredDir(remote string) bool {
+	filter := activeFilter()
+	return filter != nil && !filter.IncludeDirectory(remote)
+}
+
+// checkFilteredWrite returns EPERM if --reject-filtered-writes is set
+// and a file, or a directory if isDir, called remote would be hidden
+// by the filter flags
+func checkFilteredWrite(remote string, isDir bool) error {
+	filter := activeFilter()
+	if !rejectFilteredWrites || filter == nil {
+		return nil
+	}
+	include := filter.IncludeName(remote)
+	if isDir {
+		include = filter.IncludeDirectory(remote)
+	}
+	if !include {
+		fs.ErrorLog(remote, "Rejecting write of name excluded by the filters")
+		return fuse.EPERM
+	}
+	return nil
+}
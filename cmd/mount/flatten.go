@@ -0,0 +1,44 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"path"
+	"strings"
+)
+
+// With --flatten every object under the root of the remote is shown
+// in the root directory of the mount with the "/" in its path
+// escaped so the name can be turned back into the path.
+var (
+	flattenReplacer   = strings.NewReplacer("%", "%25", "/", "%2F")
+	unflattenReplacer = strings.NewReplacer("%25", "%", "%2F", "/")
+)
+
+// flattenName returns the name remote is shown as with --flatten
+func flattenName(remote string) string {
+	return flattenReplacer.Replace(remote)
+}
+
+// unflattenName returns the remote for a name made by flattenName
+func unflattenName(name string) string {
+	return unflattenReplacer.Replace(name)
+}
+
+// remote returns the path on the remote of leaf in d
+func (d *Dir) remote(leaf string) string {
+	leaf = unescapeWhitespace(leaf)
+	if flatten {
+		return unflattenName(leaf)
+	}
+	return path.Join(d.path, leaf)
+}
+
+// leaf returns the name remote in d is shown as - the opposite of
+// remote
+func (d *Dir) leaf(remote string) string {
+	if flatten {
+		return escapeWhitespace(flattenName(remote))
+	}
+	return escapeWhitespace(path.Base(remote))
+}
@@ -0,0 +1,103 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/ncw/rclone/fs"
+)
+
+// errLowSpace is returned for writes while the free space on the
+// remote is below --min-free-space
+var errLowSpace = fuse.Errno(syscall.ENOSPC)
+
+// freeSpaceCheckInterval is how long the free space read from a remote
+// is used for before it is read again
+var freeSpaceCheckInterval = time.Minute
+
+// freeSpace is the free space last read from each remote
+var freeSpace = struct {
+	mu     sync.Mutex
+	remote map[fs.Fs]*freeSpaceState
+}{
+	remote: make(map[fs.Fs]*freeSpaceState),
+}
+
+// freeSpaceState is the result of the last check of the free space on
+// a remote
+type freeSpaceState struct {
+	checked time.Time // when the free space was last read
+	free    int64     // the free space or -1 if not known
+	low     bool      // set if it was below --min-free-space
+}
+
+// remoteFreeSpace returns the free space on f or -1 if the remote
+// doesn't know it or it can't be read.
+//
+// The free space is only read from the remote every
+// freeSpaceCheckInterval.  This is used by --min-free-space and for
+// the free space statfs reports.
+func remoteFreeSpace(f fs.Fs) int64 {
+	if lazy, ok := f.(*lazyFs); ok {
+		// don't connect just to read the free space
+		f = lazy.connected()
+		if f == nil {
+			return -1
+		}
+	}
+	do, ok := f.(fs.FreeSpacer)
+	if !ok {
+		return -1
+	}
+	freeSpace.mu.Lock()
+	defer freeSpace.mu.Unlock()
+	state := freeSpace.remote[f]
+	if state == nil {
+		state = &freeSpaceState{free: -1}
+		freeSpace.remote[f] = state
+	}
+	if time.Since(state.checked) >= freeSpaceCheckInterval {
+		free, err := do.FreeSpace()
+		if err != nil {
+			fs.ErrorLog(f, "Failed to read free space: %v", err)
+			free = -1
+		}
+		state.free = free
+		state.checked = time.Now()
+	}
+	return state.free
+}
+
+// checkFreeSpace returns errLowSpace if the free space on f is below
+// --min-free-space so the mount is read only until it recovers.
+//
+// If the remote doesn't know the free space or it can't be read then
+// writes are allowed.
+func checkFreeSpace(f fs.Fs) error {
+	if minFreeSpace <= 0 {
+		return nil
+	}
+	free := remoteFreeSpace(f)
+	low := free >= 0 && free < int64(minFreeSpace)
+	freeSpace.mu.Lock()
+	defer freeSpace.mu.Unlock()
+	state := freeSpace.remote[f]
+	if state == nil {
+		// the remote isn't a FreeSpacer
+		return nil
+	}
+	if low && !state.low {
+		fs.ErrorLog(f, "Free space %d is below --min-free-space - rejecting writes", free)
+	} else if !low && state.low {
+		fs.Log(f, "Free space %d has recovered - allowing writes", free)
+	}
+	state.low = low
+	if low {
+		return errLowSpace
+	}
+	return nil
+}
@@ -5,9 +5,17 @@
 package mount
 
 import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
 	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
 // FS represents the top level filing system
@@ -21,14 +29,83 @@ var _ fusefs.FS = (*FS)(nil)
 // Root returns the root node
 func (f *FS) Root() (fusefs.Node, error) {
 	fs.Debug(f.f, "Root()")
+	if combineRoot != nil {
+		return combineRoot, nil
+	}
 	return newDir(f.f, ""), nil
 }
 
+// Statfs sizes
+const (
+	statfsBlockSize = 4096
+	statfsBlocks    = (1 << 50) / statfsBlockSize
+	statfsFiles     = 1e9
+
+	// conservative values for --minimal-statfs
+	minimalStatfsBlocks = (1 << 40) / statfsBlockSize
+	minimalStatfsFiles  = 1 << 20
+)
+
+// Check interface satisfied
+var _ fusefs.FSStatfser = (*FS)(nil)
+
+// Statfs is called to obtain file system metadata.
+//
+// The remote doesn't tell us its size so we make up some big numbers
+// unless --minimal-statfs is set in which case we return modest ones
+// which clients which check the values for sanity will accept.  If
+// the remote knows its free space that is reported as free, up to
+// the made up size.
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	fs.Debug(f.f, "FS.Statfs")
+	bs := uint64(statfsBlockSize)
+	if blockSize > 0 {
+		bs = uint64(blockSize)
+	}
+	if minimalStatfs {
+		resp.Blocks = minimalStatfsBlocks * statfsBlockSize / bs
+		resp.Bfree = resp.Blocks - resp.Blocks/16
+		resp.Bavail = resp.Bfree
+		resp.Files = minimalStatfsFiles
+		resp.Ffree = minimalStatfsFiles - minimalStatfsFiles/16
+	} else {
+		resp.Blocks = statfsBlocks * statfsBlockSize / bs
+		resp.Bfree = resp.Blocks
+		resp.Bavail = resp.Blocks
+		resp.Files = statfsFiles
+		resp.Ffree = statfsFiles
+	}
+	if free := remoteFreeSpace(f.f); free >= 0 && uint64(free)/bs < resp.Blocks {
+		resp.Bfree = uint64(free) / bs
+		resp.Bavail = resp.Bfree
+	}
+	resp.Bsize = uint32(bs)
+	resp.Namelen = 255
+	resp.Frsize = uint32(bs)
+	return nil
+}
+
+// setBlocks sets the block size in a to --block-size and the number
+// of 512 byte blocks used to a.Size rounded up to a whole number of
+// those blocks.  They are left alone if --block-size isn't set.
+func setBlocks(a *fuse.Attr) {
+	if blockSize <= 0 {
+		return
+	}
+	bs := uint64(blockSize)
+	a.BlockSize = uint32(bs)
+	a.Blocks = (a.Size + bs - 1) / bs * (bs / 512)
+}
+
 // mountOptions configures the options from the command line flags
+//
+// The file system type is shown as fuse.<--fs-type> in the mount
+// table.  The type statfs returns is always the FUSE magic number so
+// this is how tools tell it is a FUSE file system.
 func mountOptions(device string) (options []fuse.MountOption) {
 	options = []fuse.MountOption{
 		fuse.MaxReadahead(uint32(maxReadAhead)),
-		fuse.Subtype("rclone"),
+		fuse.Subtype(fsType),
 		fuse.FSName(device), fuse.VolumeName(device),
 		fuse.NoAppleDouble(),
 		fuse.NoAppleXattr(),
@@ -52,7 +129,7 @@ func mountOptions(device string) (options []fuse.MountOption) {
 	if defaultPermissions {
 		options = append(options, fuse.DefaultPermissions())
 	}
-	if readOnly {
+	if readOnly || (overlay != nil && !overlayWrites) {
 		options = append(options, fuse.ReadOnly())
 	}
 	if writebackCache {
@@ -61,6 +138,75 @@ func mountOptions(device string) (options []fuse.MountOption) {
 	return options
 }
 
+// serveConfig returns the config for the FUSE server
+//
+// With --single-thread each request takes a lock which is released
+// when the server cancels its context after replying so the requests
+// are handled one at a time.  Interrupt, Forget and Destroy don't
+// take the lock so a request which is blocked can still be
+// interrupted.
+func serveConfig() *fusefs.Config {
+	if !singleThread {
+		return nil
+	}
+	var mu sync.Mutex
+	return &fusefs.Config{
+		WithContext: func(ctx context.Context, req fuse.Request) context.Context {
+			switch req.(type) {
+			case *fuse.InterruptRequest, *fuse.ForgetRequest, *fuse.DestroyRequest:
+				return ctx
+			}
+			mu.Lock()
+			go func() {
+				<-ctx.Done()
+				mu.Unlock()
+			}()
+			return ctx
+		},
+	}
+}
+
+// checkMountpoint checks mountpoint is an empty directory, unless
+// --allow-non-empty is set, and nothing is mounted there already
+// returning an error saying what to do if not
+func checkMountpoint(mountpoint string) error {
+	fi, err := os.Stat(mountpoint)
+	if os.IsNotExist(err) {
+		return errors.Errorf("mountpoint %q doesn't exist - make the directory first", mountpoint)
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read mountpoint")
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("mountpoint %q is not a directory", mountpoint)
+	}
+	parent, err := os.Stat(filepath.Join(mountpoint, ".."))
+	if err != nil {
+		return errors.Wrap(err, "failed to read parent of mountpoint")
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	parentSt, parentOk := parent.Sys().(*syscall.Stat_t)
+	if ok && parentOk && st.Dev != parentSt.Dev {
+		// a different device is mounted there
+		return errors.Errorf("mountpoint %q is already mounted - unmount it first", mountpoint)
+	}
+	if allowNonEmpty {
+		return nil
+	}
+	dir, err := os.Open(mountpoint)
+	if err != nil {
+		return errors.Wrap(err, "failed to read mountpoint")
+	}
+	names, err := dir.Readdirnames(1)
+	_ = dir.Close()
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to read mountpoint")
+	}
+	if len(names) > 0 {
+		return errors.Errorf("mountpoint %q is not empty - empty it or use --allow-non-empty to mount over it", mountpoint)
+	}
+	return nil
+}
+
 // mount the file system
 //
 // The mount point will be ready when this returns.
@@ -68,7 +214,15 @@ func mountOptions(device string) (options []fuse.MountOption) {
 // returns an error, and an error channel for the serve process to
 // report an error when fusermount is called.
 func mount(f fs.Fs, mountpoint string) (<-chan error, error) {
-	c, err := fuse.Mount(mountpoint, mountOptions(f.Name()+":"+f.Root())...)
+	device := f.Name() + ":" + f.Root()
+	if combineRoot != nil {
+		device = "combine"
+	}
+	err := checkMountpoint(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	c, err := fuse.Mount(mountpoint, mountOptions(device)...)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +234,7 @@ func mount(f fs.Fs, mountpoint string) (<-chan error, error) {
 	// Serve the mount point in the background returning error to errChan
 	errChan := make(chan error, 1)
 	go func() {
-		err := fusefs.Serve(c, filesys)
+		err := fusefs.New(c, serveConfig()).Serve(filesys)
 		closeErr := c.Close()
 		if err == nil {
 			err = closeErr
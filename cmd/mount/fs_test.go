@@ -12,14 +12,19 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"bazil.org/fuse"
 	"github.com/ncw/rclone/fs"
 	_ "github.com/ncw/rclone/fs/all"
 	"github.com/ncw/rclone/fstest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 // Globals
@@ -262,3 +267,220 @@ func TestRoot(t *testing.T) {
 	assert.True(t, fi.IsDir())
 	assert.Equal(t, fi.Mode().Perm(), os.FileMode(dirPerms))
 }
+
+// Check the values returned by Statfs with --minimal-statfs
+func TestStatfsMinimal(t *testing.T) {
+	defer func(old bool) { minimalStatfs = old }(minimalStatfs)
+	filesys := &FS{f: newMockFs()}
+
+	resp := &fuse.StatfsResponse{}
+	require.NoError(t, filesys.Statfs(context.Background(), &fuse.StatfsRequest{}, resp))
+	assert.Equal(t, uint64(statfsBlocks), resp.Blocks)
+	assert.Equal(t, uint64(statfsFiles), resp.Files)
+
+	minimalStatfs = true
+	resp = &fuse.StatfsResponse{}
+	require.NoError(t, filesys.Statfs(context.Background(), &fuse.StatfsRequest{}, resp))
+	assert.Equal(t, uint64(1<<40), resp.Blocks*uint64(resp.Bsize))
+	assert.True(t, resp.Bfree > resp.Blocks/2 && resp.Bfree < resp.Blocks)
+	assert.Equal(t, resp.Bfree, resp.Bavail)
+	assert.Equal(t, uint64(1<<20), resp.Files)
+	assert.True(t, resp.Ffree > resp.Files/2 && resp.Ffree < resp.Files)
+}
+
+// Check Statfs reports the free space of remotes which know it
+func TestStatfsFreeSpace(t *testing.T) {
+	defer func(old time.Duration) { freeSpaceCheckInterval = old }(freeSpaceCheckInterval)
+	freeSpaceCheckInterval = 0
+	f := newMockFs()
+	filesys := &FS{f: f}
+
+	resp := &fuse.StatfsResponse{}
+	require.NoError(t, filesys.Statfs(context.Background(), &fuse.StatfsRequest{}, resp))
+	assert.Equal(t, resp.Blocks, resp.Bfree, "free space not known")
+
+	f.free = 100 * statfsBlockSize
+	resp = &fuse.StatfsResponse{}
+	require.NoError(t, filesys.Statfs(context.Background(), &fuse.StatfsRequest{}, resp))
+	assert.Equal(t, uint64(statfsBlocks), resp.Blocks)
+	assert.Equal(t, uint64(100), resp.Bfree)
+	assert.Equal(t, uint64(100), resp.Bavail)
+}
+
+// Check --block-size is used by Statfs and Attr
+func TestBlockSize(t *testing.T) {
+	defer func(old fs.SizeSuffix) { blockSize = old }(blockSize)
+	blockSize = 64 * 1024
+	filesys := &FS{f: newMockFs()}
+
+	resp := &fuse.StatfsResponse{}
+	require.NoError(t, filesys.Statfs(context.Background(), &fuse.StatfsRequest{}, resp))
+	assert.Equal(t, uint32(64*1024), resp.Bsize)
+	assert.Equal(t, uint32(64*1024), resp.Frsize)
+	assert.Equal(t, uint64(statfsBlocks*statfsBlockSize/(64*1024)), resp.Blocks)
+
+	_, d := mockDir()
+	file := createFile(t, d, "file", "hello")
+	var a fuse.Attr
+	require.NoError(t, file.Attr(context.Background(), &a))
+	assert.Equal(t, uint32(64*1024), a.BlockSize)
+	assert.Equal(t, uint64(64*1024/512), a.Blocks)
+}
+
+// Check --lazy-connect doesn't connect until the mount is used and
+// keeps trying until the remote is reachable
+func TestLazyConnect(t *testing.T) {
+	remote := newMockFs()
+	remote.add("file", "hello")
+	reachable := false
+	connects := 0
+	f := &lazyFs{
+		remote: "mock:",
+		name:   "mock",
+		newFs: func(string) (fs.Fs, error) {
+			connects++
+			if !reachable {
+				return nil, errors.New("remote unreachable")
+			}
+			return remote, nil
+		},
+	}
+	filesys := &FS{f: f}
+	root, err := filesys.Root()
+	require.NoError(t, err)
+	assert.Equal(t, 0, connects)
+	d := root.(*Dir)
+
+	// errors connecting are returned by each operation
+	_, err = d.Lookup(context.Background(), &fuse.LookupRequest{Name: "file"}, &fuse.LookupResponse{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "remote unreachable")
+	assert.Equal(t, 1, connects)
+	_, err = f.NewObject("file")
+	require.Error(t, err)
+	assert.Equal(t, 2, connects)
+
+	// the optional interfaces of the remote aren't guessed
+	_, ok := interface{}(f).(fs.Copier)
+	assert.False(t, ok)
+	assert.Equal(t, int64(-1), remoteFreeSpace(f))
+	assert.Equal(t, 2, connects)
+	_, err = connectFs(f)
+	require.Error(t, err)
+	assert.Equal(t, 3, connects)
+
+	// once the remote is reachable operations work
+	reachable = true
+	file := lookupFile(t, d, "file")
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*ReadFileHandle)
+	assert.Equal(t, "hello", readString(t, fh, 0, 100))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, 4, connects)
+	assert.Equal(t, []string{"file"}, listing(t, d))
+	assert.Equal(t, 4, connects)
+
+	// and the remote's interfaces are used
+	connected, err := connectFs(f)
+	require.NoError(t, err)
+	assert.Equal(t, remote, connected)
+	assert.Equal(t, int64(-1), remoteFreeSpace(f))
+	assert.Equal(t, 1, remote.frees)
+}
+
+// Check --single-thread makes the server handle one request at a time
+func TestSingleThread(t *testing.T) {
+	defer func(old bool) { singleThread = old }(singleThread)
+	assert.Nil(t, serveConfig())
+	singleThread = true
+	config := serveConfig()
+	require.NotNil(t, config)
+
+	// start a request which is handled until its context is
+	// cancelled
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	config.WithContext(ctx1, &fuse.ReadRequest{})
+
+	started := make(chan struct{})
+	go func() {
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		config.WithContext(ctx2, &fuse.ReadRequest{})
+		close(started)
+		cancel2()
+	}()
+	select {
+	case <-started:
+		t.Fatal("second request started before the first finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// interrupts are handled while the first request is running
+	interrupted := make(chan struct{})
+	go func() {
+		config.WithContext(context.Background(), &fuse.InterruptRequest{})
+		close(interrupted)
+	}()
+	select {
+	case <-interrupted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("interrupt waited for the first request")
+	}
+
+	cancel1()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second request didn't start after the first finished")
+	}
+}
+
+// Check the mountpoint is checked before mounting
+func TestCheckMountpoint(t *testing.T) {
+	defer func(old bool) { allowNonEmpty = old }(allowNonEmpty)
+	dir, err := ioutil.TempDir("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	assert.NoError(t, checkMountpoint(dir))
+
+	err = checkMountpoint(path.Join(dir, "missing"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't exist")
+
+	file := path.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, []byte("hello"), 0600))
+	err = checkMountpoint(file)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not a directory")
+
+	err = checkMountpoint(dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not empty - empty it or use --allow-non-empty")
+	allowNonEmpty = true
+	assert.NoError(t, checkMountpoint(dir))
+
+	if runtime.GOOS == "linux" {
+		err = checkMountpoint("/proc")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "is already mounted")
+	}
+}
+
+// Check the mount advertises the --fs-type in the mount table
+func TestMountFsType(t *testing.T) {
+	run.skipIfNoFUSE(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("the subtype is only shown on linux")
+	}
+
+	out, err := exec.Command("mount").Output()
+	require.NoError(t, err)
+	found := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, " "+run.mountPath+" ") {
+			found = true
+			assert.Contains(t, line, " type fuse."+fsType+" ")
+		}
+	}
+	assert.True(t, found, "mount not found")
+}
@@ -0,0 +1,128 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// storedHashSuffix is added to the name of a file to make the name of
+// the object its MD5 is stored in with --compute-hash-on-write
+const storedHashSuffix = ".rclone-md5"
+
+// storesHash returns whether the MD5 of files written to f is stored
+// alongside them as f doesn't support any hashes itself
+func storesHash(f fs.Info) bool {
+	return computeHashOnWrite && f.Hashes().Count() == 0
+}
+
+// shownHash returns sum for use in logs and errors which is hidden
+// with --hide-hashes
+func shownHash(sum string) string {
+	if hideHashes {
+		return "<hidden>"
+	}
+	return sum
+}
+
+// isStoredHash returns whether remote is an object holding a stored
+// hash - these aren't shown in listings
+func isStoredHash(remote string) bool {
+	return computeHashOnWrite && strings.HasSuffix(remote, storedHashSuffix)
+}
+
+// storeHash stores the MD5 sum of o in f along with its size and
+// modification time so the sum isn't used if o is changed without it
+func storeHash(f fs.Fs, o fs.Object, sum string) error {
+	data := fmt.Sprintf("%s %d %s", sum, o.Size(), o.ModTime().UTC().Format(time.RFC3339Nano))
+	src := fs.NewStaticObjectInfo(o.Remote()+storedHashSuffix, time.Now(), int64(len(data)), true, nil, f)
+	_, err := f.Put(strings.NewReader(data), src)
+	return err
+}
+
+// parseStoredHash returns the sum stored for o in data or "" if o has
+// a different size or modification time from when it was stored
+func parseStoredHash(o fs.Object, data string) string {
+	fields := strings.Fields(data)
+	if len(fields) != 3 {
+		return ""
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size != o.Size() {
+		return ""
+	}
+	modTime, err := time.Parse(time.RFC3339Nano, fields[2])
+	if err != nil {
+		return ""
+	}
+	dt := modTime.Sub(o.ModTime())
+	if dt < 0 {
+		dt = -dt
+	}
+	if precision := o.Fs().Precision(); dt > precision && precision != fs.ModTimeNotSupported {
+		return ""
+	}
+	return fields[0]
+}
+
+// slowHash returns whether finding the hashes of the objects in f
+// reads their data so they shouldn't be found just to name them
+func slowHash(f fs.Info) bool {
+	do, ok := f.(fs.SlowHasher)
+	return ok && do.SlowHash()
+}
+
+// objectHash returns the hash of o, using the stored MD5 if the
+// remote doesn't support hashes.  The stored MD5 is ignored if o has
+// changed since it was stored, eg by another client or if storing it
+// failed after an upload.
+func objectHash(o fs.Object, hashType fs.HashType) (string, error) {
+	sum, err := o.Hash(hashType)
+	if (err == nil && sum != "") || hashType != fs.HashMD5 || !storesHash(o.Fs()) {
+		return sum, err
+	}
+	f, ok := o.Fs().(fs.Fs)
+	if !ok {
+		return "", fs.ErrHashUnsupported
+	}
+	stored, err := f.NewObject(o.Remote() + storedHashSuffix)
+	if err == fs.ErrorObjectNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	in, err := stored.Open()
+	if err != nil {
+		return "", err
+	}
+	defer fs.CheckClose(in, &err)
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+	sum = parseStoredHash(o, string(data))
+	if sum == "" {
+		fs.Debug(o, "Ignoring stored hash as the object has changed")
+	}
+	return sum, nil
+}
+
+// storedHashObject returns the object holding the stored hash of o
+// if there is one
+func storedHashObject(f fs.Fs, o fs.Object) fs.Object {
+	if !storesHash(f) {
+		return nil
+	}
+	stored, err := f.NewObject(o.Remote() + storedHashSuffix)
+	if err != nil {
+		return nil
+	}
+	return stored
+}
@@ -0,0 +1,168 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+)
+
+// lazyFs is an fs.Fs which only makes the remote it stands for the
+// first time it is used, for --lazy-connect.
+//
+// If making the remote fails the error is returned from the operation
+// which needed it and it is tried again on the next one.
+//
+// The optional interfaces of the remote aren't forwarded so use
+// connectFs to check them and its hashes.
+type lazyFs struct {
+	remote string // the remote:path to make
+	name   string // name of the remote from the config
+	root   string // path within the remote
+	newFs  func(remote string) (fs.Fs, error)
+
+	mu sync.Mutex
+	f  fs.Fs // the remote once made or nil
+}
+
+// Check interface satisfied
+var _ fs.Fs = (*lazyFs)(nil)
+
+// newLazyFs returns an Fs for remote which is made with newFs when
+// first used
+//
+// Only the config is read here so unknown remotes are still reported
+// at mount time.
+func newLazyFs(remote string, newFs func(remote string) (fs.Fs, error)) (*lazyFs, error) {
+	_, name, root, err := fs.ParseRemote(remote)
+	if err != nil {
+		return nil, err
+	}
+	return &lazyFs{
+		remote: remote,
+		name:   name,
+		root:   root,
+		newFs:  newFs,
+	}, nil
+}
+
+// connect returns the remote making it if necessary
+func (f *lazyFs) connect() (fs.Fs, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f != nil {
+		return f.f, nil
+	}
+	fs.Debug(f.remote, "Connecting to remote")
+	newF, err := f.newFs(f.remote)
+	if err != nil {
+		fs.ErrorLog(f.remote, "Failed to connect to remote: %v", err)
+		return nil, errors.Wrap(err, "failed to connect to remote")
+	}
+	fs.CalculateModifyWindow(newF)
+	f.f = newF
+	return f.f, nil
+}
+
+// connected returns the remote if it has been made or nil
+func (f *lazyFs) connected() fs.Fs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f
+}
+
+// connectFs returns the remote f stands for, making it if f is a
+// lazyFs, so its optional interfaces and hashes can be checked
+func connectFs(f fs.Fs) (fs.Fs, error) {
+	if lazy, ok := f.(*lazyFs); ok {
+		return lazy.connect()
+	}
+	return f, nil
+}
+
+// Name of the remote (as passed into NewFs)
+func (f *lazyFs) Name() string { return f.name }
+
+// Root of the remote (as passed into NewFs)
+func (f *lazyFs) Root() string { return f.root }
+
+// String returns a description of the FS
+func (f *lazyFs) String() string { return f.remote }
+
+// Precision of the ModTimes in this Fs
+//
+// If the remote can't be made then modification times are treated
+// as unsupported.
+func (f *lazyFs) Precision() time.Duration {
+	newF, err := f.connect()
+	if err != nil {
+		return fs.ModTimeNotSupported
+	}
+	return newF.Precision()
+}
+
+// Hashes returns the supported hash types of the filesystem
+//
+// If the remote can't be made then no hashes are supported so
+// anything depending on them should use connectFs instead.
+func (f *lazyFs) Hashes() fs.HashSet {
+	newF, err := f.connect()
+	if err != nil {
+		return fs.HashSet(fs.HashNone)
+	}
+	return newF.Hashes()
+}
+
+// List the objects and directories of the Fs starting from dir
+//
+// Failing to make the remote isn't retried by the listing as it is
+// tried again by the next operation.
+func (f *lazyFs) List(out fs.ListOpts, dir string) {
+	newF, err := f.connect()
+	if err != nil {
+		out.SetError(fs.NoRetryError(err))
+		out.Finished()
+		return
+	}
+	newF.List(out, dir)
+}
+
+// NewObject finds the Object at remote
+func (f *lazyFs) NewObject(remote string) (fs.Object, error) {
+	newF, err := f.connect()
+	if err != nil {
+		return nil, err
+	}
+	return newF.NewObject(remote)
+}
+
+// Put in to the remote path with the modTime given of the given size
+func (f *lazyFs) Put(in io.Reader, src fs.ObjectInfo) (fs.Object, error) {
+	newF, err := f.connect()
+	if err != nil {
+		return nil, err
+	}
+	return newF.Put(in, src)
+}
+
+// Mkdir makes the directory (container, bucket)
+func (f *lazyFs) Mkdir() error {
+	newF, err := f.connect()
+	if err != nil {
+		return err
+	}
+	return newF.Mkdir()
+}
+
+// Rmdir removes the directory (container, bucket) if empty
+func (f *lazyFs) Rmdir() error {
+	newF, err := f.connect()
+	if err != nil {
+		return err
+	}
+	return newF.Rmdir()
+}
@@ -0,0 +1,221 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// readLimiter is the bandwidth limiter shared by all the read handles
+// or nil if reads aren't limited
+var readLimiter *priorityLimiter
+
+// objectLimiters are the --per-object-read-limit bandwidth limiters
+// of the objects with open read handles by remote
+var objectLimiters = struct {
+	mu       sync.Mutex
+	limiters map[string]*objectLimiter
+}{
+	limiters: make(map[string]*objectLimiter),
+}
+
+// objectLimiter is the limiter for the reads of a single object
+// shared by all its read handles
+type objectLimiter struct {
+	*priorityLimiter
+	handles int // number of read handles using it
+}
+
+// acquireObjectLimiter returns the limiter for reads of remote, or
+// nil if they aren't limited, which must be released with
+// releaseObjectLimiter when the handle is closed
+func acquireObjectLimiter(remote string) *priorityLimiter {
+	if perObjectReadLimit <= 0 {
+		return nil
+	}
+	objectLimiters.mu.Lock()
+	defer objectLimiters.mu.Unlock()
+	l := objectLimiters.limiters[remote]
+	if l == nil {
+		l = &objectLimiter{priorityLimiter: newPriorityLimiter(int64(perObjectReadLimit))}
+		objectLimiters.limiters[remote] = l
+	}
+	l.handles++
+	return l.priorityLimiter
+}
+
+// releaseObjectLimiter releases the limiter for remote, forgetting it
+// once no handles are using it
+func releaseObjectLimiter(remote string) {
+	objectLimiters.mu.Lock()
+	defer objectLimiters.mu.Unlock()
+	l := objectLimiters.limiters[remote]
+	if l == nil {
+		return
+	}
+	l.handles--
+	if l.handles <= 0 {
+		delete(objectLimiters.limiters, remote)
+	}
+}
+
+// listLimiter paces the directory listings made from the remote or
+// is nil if they aren't limited
+var listLimiter *priorityLimiter
+
+// waitToList waits until a directory listing is allowed by the
+// --dir-list-rate limiter
+func waitToList() {
+	if listLimiter != nil {
+		listLimiter.wait(1, false)
+	}
+}
+
+// openLimiter limits the rate files are opened with --open-rate - it
+// is nil if they aren't limited
+var openLimiter *priorityLimiter
+
+// waitToOpen waits until a new file handle is allowed by the
+// --open-rate limiter returning EINTR if ctx is cancelled first
+func waitToOpen(ctx context.Context) error {
+	if openLimiter != nil {
+		return openLimiter.waitContext(ctx, 1, false)
+	}
+	return nil
+}
+
+// highPriorityFilter matches the paths whose reads are high priority
+// or is nil if there are none
+var highPriorityFilter *fs.Filter
+
+// isHighPriority returns whether reads of remote are high priority
+func isHighPriority(remote string) bool {
+	return highPriorityFilter != nil && highPriorityFilter.Include(remote, 0, time.Time{})
+}
+
+// newHighPriorityFilter makes a filter which only includes the paths
+// matching glob
+func newHighPriorityFilter(glob string) (*fs.Filter, error) {
+	return newGlobFilter(glob)
+}
+
+// newGlobFilter makes a filter which only includes the paths
+// matching glob
+func newGlobFilter(glob string) (*fs.Filter, error) {
+	f := &fs.Filter{MinSize: -1, MaxSize: -1}
+	err := f.Add(true, glob)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Add(false, "**")
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// priorityLimiterPoll is the longest a waiter sleeps before checking
+// the limiter again
+const priorityLimiterPoll = 10 * time.Millisecond
+
+// priorityLimiter is a token bucket bandwidth limiter where high
+// priority waiters are given tokens before low priority ones
+type priorityLimiter struct {
+	mu          sync.Mutex
+	rate        float64   // tokens added per second
+	capacity    float64   // maximum tokens the bucket can hold
+	tokens      float64   // tokens in the bucket - negative if in debt
+	last        time.Time // when tokens was last brought up to date
+	highWaiting int       // number of high priority waiters
+}
+
+// newPriorityLimiter makes a limiter allowing rate bytes per second
+// with bursts of up to 100ms worth
+func newPriorityLimiter(rate int64) *priorityLimiter {
+	return &priorityLimiter{
+		rate:     float64(rate),
+		capacity: float64(rate) / 10,
+		tokens:   float64(rate) / 10,
+		last:     time.Now(),
+	}
+}
+
+// setRate changes the rate of the limiter to rate bytes per second
+// or removes the limit if rate is 0
+func (l *priorityLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.rate <= 0 {
+		// start with a full bucket as if it had been limited
+		l.tokens = float64(rate) / 10
+	}
+	l.rate = float64(rate)
+	l.capacity = float64(rate) / 10
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+}
+
+// refill adds the tokens accumulated since the last refill
+//
+// Call with l.mu held
+func (l *priorityLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+	l.last = now
+}
+
+// wait until n bytes may be transferred or return straight away if
+// the limiter has no rate
+//
+// Low priority waiters only get tokens when there are no high
+// priority waiters.  Taking more tokens than are in the bucket puts
+// it into debt which makes the following waiters wait longer.
+func (l *priorityLimiter) wait(n int, high bool) {
+	_ = l.waitContext(context.Background(), n, high)
+}
+
+// waitContext is wait returning EINTR without taking any tokens if
+// ctx is cancelled while waiting
+func (l *priorityLimiter) waitContext(ctx context.Context, n int, high bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if high {
+		l.highWaiting++
+		defer func() { l.highWaiting-- }()
+	}
+	for {
+		if l.rate <= 0 {
+			return nil
+		}
+		l.refill()
+		if l.tokens > 0 && (high || l.highWaiting == 0) {
+			l.tokens -= float64(n)
+			return nil
+		}
+		sleep := priorityLimiterPoll
+		if l.tokens <= 0 {
+			debt := time.Duration(-l.tokens / l.rate * float64(time.Second))
+			if debt < sleep {
+				sleep = debt + time.Millisecond
+			}
+		}
+		l.mu.Unlock()
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			l.mu.Lock()
+			return fuse.EINTR
+		}
+		l.mu.Lock()
+	}
+}
@@ -0,0 +1,139 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// metaFileSuffix is added to the name of a file to make the name of
+// its metadata file with --meta-files
+const metaFileSuffix = ".meta"
+
+// metaText returns the metadata of o as a JSON object
+//
+// This has the keys of the extended attributes of o without their
+// prefix along with its name, size and any tags.
+func metaText(o fs.Object) []byte {
+	meta := make(map[string]interface{})
+	for name, value := range objectXattrs(o, o.Hash) {
+		meta[strings.TrimPrefix(name, xattrPrefix)] = value
+	}
+	meta["remote"] = o.Remote()
+	meta["size"] = o.Size()
+	if do, ok := o.(fs.Tagger); ok {
+		if tags := do.Tags(); len(tags) > 0 {
+			meta["tags"] = tags
+		}
+	}
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		fs.ErrorLog(o, "Failed to make metadata file: %v", err)
+		return nil
+	}
+	return append(data, '\n')
+}
+
+// metaFile returns the metadata file leaf in d with --meta-files or
+// nil if there isn't one
+//
+// A file on the remote with the same name is shown instead.
+func (d *Dir) metaFile(leaf string) *MetaFile {
+	if !metaFiles || !strings.HasSuffix(leaf, metaFileSuffix) {
+		return nil
+	}
+	item, err := d.lookup(strings.TrimSuffix(leaf, metaFileSuffix))
+	if err != nil {
+		return nil
+	}
+	o, ok := item.o.(fs.Object)
+	if !ok || isArchive(o.Remote()) {
+		return nil
+	}
+	return &MetaFile{o: o}
+}
+
+// metaFileNames returns the names of the metadata files to list in
+// d with --meta-files
+//
+// Must be called with d.mu held
+func (d *Dir) metaFileNames() (names []string) {
+	if !metaFiles {
+		return nil
+	}
+	for leaf, item := range d.items {
+		o, ok := item.o.(fs.Object)
+		if !ok || isArchive(o.Remote()) {
+			continue
+		}
+		if _, found := d.items[leaf+metaFileSuffix]; !found {
+			names = append(names, leaf+metaFileSuffix)
+		}
+	}
+	return names
+}
+
+// MetaFile is a read only virtual file showing the metadata of an
+// object as JSON which is regenerated each time it is read
+type MetaFile struct {
+	o fs.Object
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.Node         = (*MetaFile)(nil)
+	_ fusefs.NodeOpener   = (*MetaFile)(nil)
+	_ fusefs.Handle       = (*MetaFile)(nil)
+	_ fusefs.HandleReader = (*MetaFile)(nil)
+)
+
+// Attr fills out the attributes for the file using the modification
+// time of the object
+func (m *MetaFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = filePerms &^ 0222
+	a.Size = uint64(len(metaText(m.o)))
+	modTime := time.Now()
+	if !noModTime {
+		modTime = m.o.ModTime()
+	}
+	a.Atime = modTime
+	a.Mtime = modTime
+	a.Ctime = modTime
+	a.Crtime = modTime
+	return nil
+}
+
+// Open the file for reading
+//
+// Direct IO is used so the kernel doesn't cache the contents or
+// truncate them to the size returned by Attr.
+func (m *MetaFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return m, nil
+}
+
+// Read the metadata from req.Offset
+func (m *MetaFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	data := metaText(m.o)
+	if req.Offset >= int64(len(data)) {
+		return nil
+	}
+	data = data[req.Offset:]
+	if len(data) > req.Size {
+		data = data[:req.Size]
+	}
+	resp.Data = data
+	return nil
+}
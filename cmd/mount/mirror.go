@@ -0,0 +1,35 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// openMirror creates the file in the mirror directory for remote
+// making any directories needed.
+func openMirror(remote string) (*os.File, error) {
+	name := filepath.Join(writeMirror, filepath.FromSlash(remote))
+	err := os.MkdirAll(filepath.Dir(name), 0777)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(name)
+}
+
+// mirrorError deals with err from writing the mirror of remote -
+// returning it unless --write-mirror-ignore-errors is set.
+func mirrorError(remote string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if writeMirrorIgnoreErrors {
+		fs.ErrorLog(remote, "Ignoring error writing mirror: %v", err)
+		return nil
+	}
+	fs.ErrorLog(remote, "Failed to write mirror: %v", err)
+	return err
+}
@@ -0,0 +1,529 @@
+// +build linux darwin freebsd
+
+// Mock remote for testing the FUSE handlers without mounting
+
+package mount
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// mockFs is an in memory fs.Fs
+type mockFs struct {
+	mu        sync.Mutex
+	objects   map[string]*mockObject
+	puts      int           // number of times Put has been called
+	copies    int           // number of times Copy has been called
+	listed    int           // number of entries output by List
+	putDelay  time.Duration // time each Put takes
+	rawList   bool          // List returns all the objects under dir as they are without making directories
+	putRate   int           // if set Put reads at this many bytes per second
+	putErr    error         // if set Put fails with this after reading the data
+	noHashes  bool          // if set the objects don't support any hashes
+	lists     []time.Time   // when each List was called
+	listDelay time.Duration // time List takes to find each entry
+	free      int64         // free space returned by FreeSpace
+	frees     int           // number of times FreeSpace has been called
+	listErrs  []error       // errors returned by the next Lists
+	slowHash  bool          // returned by SlowHash
+}
+
+// newMockFs makes an empty mockFs
+func newMockFs() *mockFs {
+	return &mockFs{
+		objects: make(map[string]*mockObject),
+		free:    -1,
+	}
+}
+
+// Name of the remote (as passed into NewFs)
+func (f *mockFs) Name() string { return "mock" }
+
+// Root of the remote (as passed into NewFs)
+func (f *mockFs) Root() string { return "" }
+
+// String returns a description of the FS
+func (f *mockFs) String() string { return "mock:" }
+
+// Precision of the ModTimes in this Fs
+func (f *mockFs) Precision() time.Duration { return time.Nanosecond }
+
+// Hashes returns the supported hash types of the filesystem
+func (f *mockFs) Hashes() fs.HashSet {
+	if f.noHashes {
+		return fs.HashSet(fs.HashNone)
+	}
+	return fs.NewHashSet(fs.HashMD5)
+}
+
+// add puts an object with the given contents into the mockFs
+func (f *mockFs) add(remote string, contents string) *mockObject {
+	o := &mockObject{
+		f:        f,
+		remote:   remote,
+		contents: []byte(contents),
+		modTime:  time.Now(),
+	}
+	f.mu.Lock()
+	f.objects[remote] = o
+	f.mu.Unlock()
+	return o
+}
+
+// List the objects and directories in dir at level 1 or all the
+// objects under dir at deeper levels
+func (f *mockFs) List(out fs.ListOpts, dir string) {
+	defer out.Finished()
+	f.mu.Lock()
+	f.lists = append(f.lists, time.Now())
+	if len(f.listErrs) > 0 {
+		err := f.listErrs[0]
+		f.listErrs = f.listErrs[1:]
+		f.mu.Unlock()
+		out.SetError(err)
+		return
+	}
+	var remotes []string
+	for remote := range f.objects {
+		remotes = append(remotes, remote)
+	}
+	f.mu.Unlock()
+	sort.Strings(remotes)
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	dirs := make(map[string]struct{})
+	for _, remote := range remotes {
+		if !strings.HasPrefix(remote, prefix) {
+			continue
+		}
+		time.Sleep(f.listDelay)
+		leaf := remote[len(prefix):]
+		if i := strings.IndexRune(leaf, '/'); i >= 0 && !f.rawList && out.Level() == 1 {
+			dirRemote := prefix + leaf[:i]
+			if _, found := dirs[dirRemote]; found {
+				continue
+			}
+			dirs[dirRemote] = struct{}{}
+			if out.AddDir(&fs.Dir{Name: dirRemote, When: time.Now()}) {
+				return
+			}
+		} else {
+			f.mu.Lock()
+			o := f.objects[remote]
+			f.mu.Unlock()
+			if out.Add(o) {
+				return
+			}
+		}
+		f.mu.Lock()
+		f.listed++
+		f.mu.Unlock()
+	}
+}
+
+// NewObject finds the Object at remote
+func (f *mockFs) NewObject(remote string) (fs.Object, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[remote]
+	if !ok {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return o, nil
+}
+
+// Put in to the remote path
+func (f *mockFs) Put(in io.Reader, src fs.ObjectInfo) (fs.Object, error) {
+	f.mu.Lock()
+	rate := f.putRate
+	f.mu.Unlock()
+	if rate > 0 {
+		in = &slowReader{in: in, rate: rate}
+	}
+	var metadata map[string]string
+	if do, ok := src.(fs.Metadataer); ok {
+		// read before the data like the remotes do
+		metadata = do.Metadata()
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	// the upload fails once the data has been read
+	f.mu.Lock()
+	putErr := f.putErr
+	f.mu.Unlock()
+	if putErr != nil {
+		return nil, putErr
+	}
+	f.mu.Lock()
+	f.puts++
+	delay := f.putDelay
+	f.mu.Unlock()
+	time.Sleep(delay)
+	o := f.add(src.Remote(), string(data))
+	o.metadata = metadata
+	return o, nil
+}
+
+// StoresMetadata returns true as the Metadata of the src of Put is kept
+func (f *mockFs) StoresMetadata() bool { return true }
+
+// Mkdir makes the directory
+func (f *mockFs) Mkdir() error { return nil }
+
+// Rmdir removes the directory
+func (f *mockFs) Rmdir() error { return nil }
+
+// Copy src to remote using a server side copy
+func (f *mockFs) Copy(src fs.Object, remote string) (fs.Object, error) {
+	in, err := src.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.copies++
+	f.mu.Unlock()
+	return f.add(remote, string(data)), nil
+}
+
+// Move src to remote using a server side move
+func (f *mockFs) Move(src fs.Object, remote string) (fs.Object, error) {
+	o, err := f.Copy(src, remote)
+	if err != nil {
+		return nil, err
+	}
+	return o, src.Remove()
+}
+
+// FreeSpace returns the free space set in the mockFs
+func (f *mockFs) FreeSpace() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.frees++
+	return f.free, nil
+}
+
+// SlowHash returns whether the hashes are set as slow in the mockFs
+func (f *mockFs) SlowHash() bool { return f.slowHash }
+
+// Check interfaces satisfied
+var (
+	_ fs.Fs         = (*mockFs)(nil)
+	_ fs.Copier     = (*mockFs)(nil)
+	_ fs.Mover      = (*mockFs)(nil)
+	_ fs.FreeSpacer = (*mockFs)(nil)
+	_ fs.SlowHasher = (*mockFs)(nil)
+
+	_ fs.MetadataStorer = (*mockFs)(nil)
+)
+
+// mockObject is an in memory fs.Object which counts the calls made
+// on it
+type mockObject struct {
+	f        *mockFs
+	mu       sync.Mutex
+	remote   string
+	contents []byte
+	modTime  time.Time
+	opens    int // number of times Open has been called
+	reads    int // number of Read calls made on the opened streams
+
+	readDelay time.Duration     // time each Read on the opened streams takes
+	expiry    int               // if set streams fail with an auth expiry error after this many bytes
+	openErrs  []error           // errors to return from the next calls to Open
+	readErr   error             // if set Read on the opened streams fails with this
+	modTimes  int               // number of times ModTime has been called
+	noRange   bool              // if set opening part way through streams the data before the offset too
+	received  int               // number of bytes transferred by the opened streams
+	closes    int               // number of opened streams closed
+	tags      []string          // tags in the metadata
+	metadata  map[string]string // metadata stored from the src of the Put
+	ranges    int               // number of times Open has been called with a RangeOption
+	gen       int64             // generation of the object
+	badFrom   int               // reads of the bytes from here...
+	badTo     int               // ...to here on the opened streams fail if set
+	decodes   int               // number of times Open has been called with a DecompressOption
+	noHash    bool              // if set Hash returns an empty hash as if the remote doesn't know it
+	versions  int               // number of versions the remote keeps or 0 if not versioned
+	counts    int               // number of times VersionCount has been called
+	class     string            // storage class - GLACIER is archived
+	created   time.Time         // creation time or zero if unknown
+	setErrs   []error           // errors to return from the next calls to SetModTime
+	hashes    int               // number of times Hash has been called
+	sets      int               // number of times SetModTime has been called
+	noRanges  bool              // if set Open ignores RangeOption like the local backend
+}
+
+// Fs returns read only access to the Fs that this object is part of
+func (o *mockObject) Fs() fs.Info { return o.f }
+
+// String returns a description of the Object
+func (o *mockObject) String() string { return o.remote }
+
+// Remote returns the remote path
+func (o *mockObject) Remote() string { return o.remote }
+
+// ModTime returns the modification date of the file
+func (o *mockObject) ModTime() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.modTimes++
+	return o.modTime
+}
+
+// Tags returns the tags in the metadata
+func (o *mockObject) Tags() []string { return o.tags }
+
+// Metadata returns the metadata stored from the src of the Put
+func (o *mockObject) Metadata() map[string]string { return o.metadata }
+
+// Generation returns the generation of the object
+func (o *mockObject) Generation() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.gen
+}
+
+// CreationTime returns the time the object was created
+func (o *mockObject) CreationTime() time.Time { return o.created }
+
+// StorageClass returns the storage class of the object
+func (o *mockObject) StorageClass() string { return o.class }
+
+// Archived returns whether the object is in the GLACIER class
+func (o *mockObject) Archived() bool { return o.class == "GLACIER" }
+
+// VersionCount returns the number of versions of the object
+func (o *mockObject) VersionCount() (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.counts++
+	return o.versions, nil
+}
+
+// Size returns the size of the file
+func (o *mockObject) Size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return int64(len(o.contents))
+}
+
+// Hash returns the MD5 of the contents
+func (o *mockObject) Hash(t fs.HashType) (string, error) {
+	if t != fs.HashMD5 || o.f.noHashes {
+		return "", fs.ErrHashUnsupported
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.hashes++
+	if o.noHash {
+		return "", nil
+	}
+	sum := md5.Sum(o.contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ETag returns the MD5 of the contents as the entity tag, without
+// counting as a call of Hash
+func (o *mockObject) ETag() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.f.noHashes || o.noHash {
+		return ""
+	}
+	sum := md5.Sum(o.contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// Storable says whether this object can be stored
+func (o *mockObject) Storable() bool { return true }
+
+// SetModTime sets the modification time
+func (o *mockObject) SetModTime(modTime time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sets++
+	if len(o.setErrs) > 0 {
+		err := o.setErrs[0]
+		o.setErrs = o.setErrs[1:]
+		return err
+	}
+	o.modTime = modTime
+	return nil
+}
+
+// Open opens the object for read honouring SeekOption and RangeOption
+func (o *mockObject) Open(options ...fs.OpenOption) (io.ReadCloser, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.opens++
+	if len(o.openErrs) > 0 {
+		err := o.openErrs[0]
+		o.openErrs = o.openErrs[1:]
+		return nil, err
+	}
+	data := o.contents
+	start := 0
+	for _, option := range options {
+		switch x := option.(type) {
+		case *fs.IfMatchOption:
+			sum := md5.Sum(o.contents)
+			if x.ETag != hex.EncodeToString(sum[:]) {
+				return nil, fs.ErrorObjectChanged
+			}
+		case *fs.SeekOption:
+			data = data[x.Offset:]
+			start = int(x.Offset)
+		case *fs.DecompressOption:
+			o.decodes++
+		case *fs.RangeOption:
+			o.ranges++
+			if o.noRanges {
+				continue
+			}
+			end := int64(len(o.contents))
+			if x.End >= 0 && x.End+1 < end {
+				end = x.End + 1
+			}
+			data = o.contents[x.Start:end]
+			start = int(x.Start)
+		}
+	}
+	if o.noRange {
+		// the remote sends the data before the offset which is
+		// thrown away
+		o.received += start
+	}
+	return &mockReader{o: o, in: bytes.NewReader(data), expiry: o.expiry, off: start}, nil
+}
+
+// Update the object with new contents
+func (o *mockObject) Update(in io.Reader, src fs.ObjectInfo) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.contents = data
+	o.modTime = src.ModTime()
+	o.mu.Unlock()
+	return nil
+}
+
+// Remove the object
+func (o *mockObject) Remove() error {
+	o.f.mu.Lock()
+	delete(o.f.objects, o.remote)
+	o.f.mu.Unlock()
+	return nil
+}
+
+// Check interfaces satisfied
+var (
+	_ fs.Object         = (*mockObject)(nil)
+	_ fs.ETagger        = (*mockObject)(nil)
+	_ fs.Tagger         = (*mockObject)(nil)
+	_ fs.Generationer   = (*mockObject)(nil)
+	_ fs.VersionCounter = (*mockObject)(nil)
+	_ fs.StorageClasser = (*mockObject)(nil)
+	_ fs.CreationTimer  = (*mockObject)(nil)
+	_ fs.Metadataer     = (*mockObject)(nil)
+)
+
+// mockReader counts the reads on an opened mockObject
+type mockReader struct {
+	o      *mockObject
+	in     io.Reader
+	n      int // bytes read so far
+	expiry int // fail with an auth expiry error after this many bytes if set
+	off    int // offset in the object of the next byte read
+	closed bool
+}
+
+// Read from the object counting the calls
+func (r *mockReader) Read(p []byte) (int, error) {
+	r.o.mu.Lock()
+	r.o.reads++
+	closed := r.closed
+	delay := r.o.readDelay
+	readErr := r.o.readErr
+	badFrom, badTo := r.o.badFrom, r.o.badTo
+	r.o.mu.Unlock()
+	time.Sleep(delay)
+	if closed {
+		return 0, errors.New("read on closed stream")
+	}
+	if readErr != nil {
+		return 0, readErr
+	}
+	if r.expiry > 0 {
+		if r.n >= r.expiry {
+			return 0, fs.AuthExpiredError(errors.New("403 Forbidden: signed URL expired"))
+		}
+		if len(p) > r.expiry-r.n {
+			p = p[:r.expiry-r.n]
+		}
+	}
+	if badTo > 0 && r.off < badTo && r.off+len(p) > badFrom {
+		if r.off >= badFrom {
+			return 0, errors.New("unreadable data")
+		}
+		p = p[:badFrom-r.off]
+	}
+	n, err := r.in.Read(p)
+	r.n += n
+	r.off += n
+	r.o.mu.Lock()
+	r.o.received += n
+	r.o.mu.Unlock()
+	return n, err
+}
+
+// Close the reader
+func (r *mockReader) Close() error {
+	r.o.mu.Lock()
+	r.o.closes++
+	r.closed = true
+	r.o.mu.Unlock()
+	return nil
+}
+
+// mockDir makes a Dir at the root of a new mockFs
+func mockDir() (*mockFs, *Dir) {
+	f := newMockFs()
+	return f, newDir(f, "")
+}
+
+// slowReader reads from in at rate bytes per second
+type slowReader struct {
+	in   io.Reader
+	rate int
+}
+
+// Read up to 1k at a time sleeping for the time it would take
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(p) > 1024 {
+		p = p[:1024]
+	}
+	n, err := r.in.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(r.rate))
+	return n, err
+}
@@ -6,6 +6,7 @@ package mount
 
 import (
 	"log"
+	"net/url"
 	"os"
 	"time"
 
@@ -19,10 +20,97 @@ import (
 
 // Globals
 var (
-	noModTime    = false
-	debugFUSE    = false
-	noSeek       = false
-	dirCacheTime = 5 * 60 * time.Second
+	noModTime                 = false
+	debugFUSE                 = false
+	noSeek                    = false
+	dirCacheTime              = 5 * 60 * time.Second
+	minReadSize               = fs.SizeSuffix(0)
+	dedupeOnWrite             = false
+	uploadOnly                = false
+	readCacheSize             = fs.SizeSuffix(0)
+	keepCache                 = false
+	immutable                 = false
+	dirStream                 = false
+	minimalStatfs             = false
+	prefetchSize              = fs.SizeSuffix(0)
+	prefetchMax               = fs.SizeSuffix(0)
+	maxFileSize               = fs.SizeSuffix(0)
+	singleThread              = false
+	allowArchiveReads         = false
+	readYourWrites            = false
+	errorLogFile              = ""
+	openRate                  = 0
+	userAgent                 = ""
+	cacheMaxTotalSize         = fs.SizeSuffix(0)
+	rejectFilteredWrites      = false
+	minFreeSpace              = fs.SizeSuffix(0)
+	compressOnWrite           = false
+	compressExtensions        = ""
+	compressExcludeExtensions = "gz,tgz,bz2,xz,zst,zip,7z,rar,jpg,jpeg,png,gif,webp,mp3,mp4,mkv,avi,mov"
+	showDirty                 = false
+	writeMirror               = ""
+	writeMirrorIgnoreErrors   = false
+	readBwLimit               = fs.SizeSuffix(0)
+	highPriorityPaths         = ""
+	statusFile                = false
+	openRetries               = 3
+	normalizeKeys             = false
+	templateName              = ""
+	assembleParts             = false
+	writeBufferLimit          = fs.SizeSuffix(0)
+	handleRetryBudget         = 0
+	flatten                   = false
+	syncWrites                = false
+	aclFile                   = ""
+	sharedCacheSocket         = ""
+	rejectCaseCollisions      = false
+	writeCacheEnabled         = false
+	computeHashOnWrite        = false
+	blockSize                 = fs.SizeSuffix(0)
+	dirMtime                  = ""
+	dirPrefetchConcurrency    = 0
+	seekSkipSize              = fs.SizeSuffix(0)
+	mimeTypes                 = false
+	hideHashes                = false
+	mountArchives             = false
+	escapeWhitespaceNames     = false
+	dirListRate               = 0
+	warmStreamTimeout         = time.Duration(0)
+	bestEffortUploads         = false
+	perObjectReadLimit        = fs.SizeSuffix(0)
+	tagBrowse                 = false
+	verifyOnEOF               = false
+	multiThreadStreams        = 0
+	multiThreadCutoff         = fs.SizeSuffix(250 * 1024 * 1024)
+	sidecarSuffix             = ""
+	readaheadOnOpen           = fs.SizeSuffix(0)
+	bwLimitSchedule           = ""
+	cachePin                  = ""
+	dirFirstPage              = 0
+	combine                   = ""
+	hotTierRemote             = ""
+	readDownload              = false
+	dirPlaceholder            = ""
+	eofRestatInterval         = time.Second
+	eofRestat                 = false
+	metaFiles                 = false
+	readLeaseInterval         = time.Duration(0)
+	unicodeNormalization      = unicodeNormalizationNone
+	perDirOpenLimit           = 0
+	readErrorsAsZeros         = false
+	readCacheDir              = ""
+	readCacheDirSize          = fs.SizeSuffix(10 * 1024 * 1024 * 1024)
+	recentCount               = 0
+	recentWindow              = time.Duration(0)
+	uploadTimeout             = time.Duration(0)
+	serverDecompress          = false
+	staging                   = false
+	treeHash                  = ""
+	readProxyURL              = ""
+	lazyConnect               = false
+	onUnknownHash             = onUnknownHashSkip
+	overlayDir                = ""
+	overlayWrites             = false
 	// mount options
 	readOnly                         = false
 	allowNonEmpty                    = false
@@ -31,6 +119,7 @@ var (
 	defaultPermissions               = false
 	writebackCache                   = false
 	maxReadAhead       fs.SizeSuffix = 128 * 1024
+	fsType                           = "rclone"
 	umask                            = 0
 	uid                              = uint32(unix.Geteuid())
 	gid                              = uint32(unix.Getegid())
@@ -47,15 +136,103 @@ func init() {
 	mountCmd.Flags().BoolVarP(&noModTime, "no-modtime", "", noModTime, "Don't read the modification time (can speed things up).")
 	mountCmd.Flags().BoolVarP(&debugFUSE, "debug-fuse", "", debugFUSE, "Debug the FUSE internals - needs -v.")
 	mountCmd.Flags().BoolVarP(&noSeek, "no-seek", "", noSeek, "Don't allow seeking in files.")
+	mountCmd.Flags().BoolVarP(&dedupeOnWrite, "dedupe-on-write", "", dedupeOnWrite, "Server side copy identical files in the same directory instead of uploading them.")
+	mountCmd.Flags().BoolVarP(&keepCache, "keep-cache", "", keepCache, "Let the kernel keep cached file data between opens - only use if files don't change on the remote.")
+	mountCmd.Flags().BoolVarP(&immutable, "immutable", "", immutable, "Treat existing files as immutable - they can be created and deleted but not modified.")
 	mountCmd.Flags().DurationVarP(&dirCacheTime, "dir-cache-time", "", dirCacheTime, "Time to cache directory entries for.")
+	mountCmd.Flags().StringVarP(&writeMirror, "write-mirror", "", writeMirror, "Save a copy of files written to this local directory too.")
+	mountCmd.Flags().BoolVarP(&writeMirrorIgnoreErrors, "write-mirror-ignore-errors", "", writeMirrorIgnoreErrors, "Log errors writing the --write-mirror copy rather than failing the write.")
+	mountCmd.Flags().BoolVarP(&statusFile, "status-file", "", statusFile, "Show the "+statusFileName+" file in the root of the mount in listings.")
+	mountCmd.Flags().BoolVarP(&normalizeKeys, "normalize-keys", "", normalizeKeys, "Clean up repeated and trailing / in names from the remote in listings.")
+	mountCmd.Flags().StringVarP(&templateName, "template", "", templateName, "Start new files with the contents of the file with this name in the same directory if there is one.")
+	mountCmd.Flags().BoolVarP(&assembleParts, "assemble-parts", "", assembleParts, "Show files stored as name.partNNNN objects with a name.manifest as a single file.")
+	mountCmd.Flags().BoolVarP(&flatten, "flatten", "", flatten, "Show all the files under the root in the root with the / in their paths escaped as %2F.")
+	mountCmd.Flags().BoolVarP(&bestEffortUploads, "best-effort-uploads", "", bestEffortUploads, "Don't fail closing files whose upload fails - retry the upload in the background instead.")
+	mountCmd.Flags().DurationVarP(&uploadTimeout, "upload-timeout", "", uploadTimeout, "Wait at most this long for uploads when closing files then carry on uploading in the background (0 to always wait).")
+	mountCmd.Flags().BoolVarP(&syncWrites, "sync-writes", "", syncWrites, "Finish and verify uploads when files are closed so close returns any errors.")
+	mountCmd.Flags().StringVarP(&aclFile, "acl-file", "", aclFile, "Read \"glob uid|* r|rw|-\" rules giving users access to paths from this file.")
+	mountCmd.Flags().BoolVarP(&rejectCaseCollisions, "reject-case-collisions", "", rejectCaseCollisions, "Refuse to create names which differ only in case from an existing name in the directory.")
+	mountCmd.Flags().BoolVarP(&computeHashOnWrite, "compute-hash-on-write", "", computeHashOnWrite, "Store the MD5 of files written to remotes without hashes in name"+storedHashSuffix+" to check reads against - it is ignored if the file's size or modification time changes.")
+	mountCmd.Flags().StringVarP(&dirMtime, "dir-mtime", "", dirMtime, "Set to "+dirMtimeNewestChild+" to give directories the modification time of their newest item once they have been listed.")
+	mountCmd.Flags().BoolVarP(&mimeTypes, "mime-types", "", mimeTypes, "Show the MIME type the remote has for each file as the "+mimeTypeXattr+" xattr.")
+	mountCmd.Flags().BoolVarP(&hideHashes, "hide-hashes", "", hideHashes, "Don't show the hashes or ETags of files in xattrs or logs - they are still checked.")
+	mountCmd.Flags().BoolVarP(&mountArchives, "mount-archives", "", mountArchives, "Show .zip files as read only directories of their contents.")
+	mountCmd.Flags().BoolVarP(&escapeWhitespaceNames, "escape-whitespace", "", escapeWhitespaceNames, "Show leading and trailing spaces and tabs in names as ␠ and ␉ so they aren't stripped.")
+	mountCmd.Flags().IntVarP(&dirListRate, "dir-list-rate", "", dirListRate, "Max number of directory listings to make from the remote per second (0 for unlimited).")
+	mountCmd.Flags().IntVarP(&openRate, "open-rate", "", openRate, "Max number of files to open per second, smoothing bursts of opens into a steady stream (0 for unlimited).")
+	mountCmd.Flags().BoolVarP(&tagBrowse, "tag-browse", "", tagBrowse, "Show links to the files with each tag in "+tagsDirName+"/<tag>/ in the root of the mount. Only s3 reports tags, from the comma separated tags user metadata.")
+	mountCmd.Flags().IntVarP(&recentCount, "recent-count", "", recentCount, "Show links to this many of the most recently modified files in "+recentDirName+"/ in the root of the mount (0 to disable).")
+	mountCmd.Flags().DurationVarP(&recentWindow, "recent-window", "", recentWindow, "Only show files modified this recently in "+recentDirName+"/ (0 for any time).")
+	mountCmd.Flags().BoolVarP(&verifyOnEOF, "verify-on-eof", "", verifyOnEOF, "Check the hash of files read as soon as the end is read rather than when they are closed.")
+	mountCmd.Flags().StringVarP(&sidecarSuffix, "sidecar-as-xattr", "", sidecarSuffix, "Show the keys of the JSON object in name<suffix> as user.<key> xattrs of name and hide it, eg .json.")
+	mountCmd.Flags().VarP(&readaheadOnOpen, "readahead-on-open", "", "Read this many bytes from the start of files in the background as soon as they are opened (0 to disable).")
+	mountCmd.Flags().StringVarP(&cachePin, "cache-pin", "", cachePin, "Read files matching this glob into the read cache on mount and never evict them.")
+	mountCmd.Flags().IntVarP(&dirFirstPage, "dir-first-page", "", dirFirstPage, "Return the first this many entries of a directory listing straight away and read the rest in the background (0 to disable).")
+	mountCmd.Flags().StringVarP(&combine, "combine", "", combine, "Mount several remotes as directories of the root, eg \"photos=gdrive:pics docs=s3:documents\" - only the mountpoint is given.")
+	mountCmd.Flags().StringVarP(&hotTierRemote, "hot-tier", "", hotTierRemote, "Read files from this remote instead if it has an identical copy, eg a faster or cheaper tier.")
+	mountCmd.Flags().StringVarP(&dirPlaceholder, "dir-placeholder", "", dirPlaceholder, "Make directories by writing an empty object with this name into them, eg .keep, so they persist on remotes without directories. These are hidden.")
+	mountCmd.Flags().BoolVarP(&eofRestat, "eof-restat", "", eofRestat, "Find files again when read past their end and read any data appended, eg by tail -f - only for remotes without ETags as files are replaced otherwise.")
+	mountCmd.Flags().DurationVarP(&eofRestatInterval, "eof-restat-interval", "", eofRestatInterval, "With --eof-restat find files again to see if they have grown at most this often when read at their end (0 to check on every read).")
+	mountCmd.Flags().BoolVarP(&metaFiles, "meta-files", "", metaFiles, "Show the metadata of each file as JSON in a read only file with "+metaFileSuffix+" added to its name.")
+	mountCmd.Flags().DurationVarP(&readLeaseInterval, "read-lease-interval", "", readLeaseInterval, "Check the generation of files being read this often and fail reads with ESTALE if they have changed since they were opened (0 to disable).")
+	mountCmd.Flags().StringVarP(&unicodeNormalization, "unicode-normalization", "", unicodeNormalization, "Normalize the unicode in names to nfc, nfd or none so names match whichever form they are stored in.")
+	mountCmd.Flags().IntVarP(&perDirOpenLimit, "per-dir-open-limit", "", perDirOpenLimit, "Max number of files in each directory open for reading at once - more opens wait (0 for unlimited).")
+	mountCmd.Flags().BoolVarP(&serverDecompress, "server-decompress", "", serverDecompress, "Ask the remote to decompress files stored with a content encoding rather than sending them compressed, if it can.")
+	mountCmd.Flags().BoolVarP(&staging, "staging", "", staging, "Keep files written in "+stagingDirName+"/ in the root of the mount locally and only upload them when they are moved out of it.")
+	mountCmd.Flags().StringVarP(&treeHash, "tree-hash", "", treeHash, "Show a hash of the contents of directories in the "+treeHashXattr+" xattr, of the files in them if \""+treeHashShallow+"\" or of the whole tree if \""+treeHashRecursive+"\".")
+	mountCmd.Flags().StringVarP(&readProxyURL, "read-proxy-url", "", readProxyURL, "Send the requests which read from the remote through this HTTP proxy, eg a local caching proxy, rather than the one from the environment.")
+	mountCmd.Flags().BoolVarP(&lazyConnect, "lazy-connect", "", lazyConnect, "Don't connect to the remote until the mount is first used - errors connecting are returned by the operations which need it.")
+	mountCmd.Flags().StringVarP(&onUnknownHash, "on-unknown-hash", "", onUnknownHash, "What to do if a file is read to the end but the remote doesn't know its hash to check the data against - \""+onUnknownHashSkip+"\", \""+onUnknownHashWarn+"\" or \""+onUnknownHashFail+"\".")
+	mountCmd.Flags().StringVarP(&overlayDir, "overlay", "", overlayDir, "Show the files in this local directory on top of the remote, replacing any of the same name - the mount is read only unless --overlay-writes is set.")
+	mountCmd.Flags().BoolVarP(&overlayWrites, "overlay-writes", "", overlayWrites, "Write files to the --overlay directory rather than making the mount read only - files on the remote can't be removed or renamed.")
+	mountCmd.Flags().VarP(&maxFileSize, "max-file-size", "", "Fail writes which would make a file bigger than this with EFBIG (0 for unlimited).")
+	mountCmd.Flags().BoolVarP(&singleThread, "single-thread", "", singleThread, "Handle FUSE requests one at a time rather than concurrently - slow but useful for debugging.")
+	mountCmd.Flags().BoolVarP(&allowArchiveReads, "allow-archive-reads", "", allowArchiveReads, "Allow opening files in archive storage classes, eg GLACIER, for reading rather than failing with EACCES.")
+	mountCmd.Flags().BoolVarP(&readYourWrites, "read-your-writes", "", readYourWrites, "Read files which are being written from the --write-cache so the data written so far is seen rather than waiting for the upload.")
+	mountCmd.Flags().StringVarP(&errorLogFile, "error-log", "", errorLogFile, "Append read, hash and upload failures to this file as lines of JSON for monitoring.")
+	mountCmd.Flags().StringVarP(&userAgent, "user-agent", "", userAgent, "Set the User-Agent of the HTTP requests made to the remote, eg for CDNs which route or rate limit on it.")
+	mountCmd.Flags().VarP(&cacheMaxTotalSize, "cache-max-total-size", "", "Max size of --read-cache-dir and the --write-cache files together - read cache blocks are removed first and writes wait if the write cache files alone are bigger (0 for unlimited).")
+	mountCmd.Flags().BoolVarP(&rejectFilteredWrites, "reject-filtered-writes", "", rejectFilteredWrites, "Fail making files and directories with names excluded by --include, --exclude and the other filter flags with EPERM rather than allowing them.")
+	mountCmd.Flags().VarP(&minFreeSpace, "min-free-space", "", "Make the mount read only, failing writes with ENOSPC, while the remote says it has less free space than this (0 to disable). Only local remotes report their free space.")
+	mountCmd.Flags().BoolVarP(&compressOnWrite, "compress-on-write", "", compressOnWrite, "Compress files with gzip as they are uploaded, storing their size in the metadata, and decompress them when read - needs a remote which stores metadata, eg s3.")
+	mountCmd.Flags().StringVarP(&compressExtensions, "compress-extensions", "", compressExtensions, "Comma separated list of the extensions of the files to compress with --compress-on-write (default all).")
+	mountCmd.Flags().StringVarP(&compressExcludeExtensions, "compress-exclude-extensions", "", compressExcludeExtensions, "Comma separated list of the extensions of the files not to compress with --compress-on-write as they are compressed already.")
+	mountCmd.Flags().BoolVarP(&showDirty, "dirty-xattr", "", showDirty, "Show whether each file has data which hasn't been uploaded yet as the "+dirtyXattr+" xattr.")
+	mountCmd.Flags().BoolVarP(&dirStream, "dir-stream", "", dirStream, "List directories incrementally as they are read rather than all at once - not used with --overlay, --assemble-parts, --sidecar-as-xattr or --unicode-normalization.")
+	mountCmd.Flags().IntVarP(&dirPrefetchConcurrency, "dir-prefetch-concurrency", "", dirPrefetchConcurrency, "Read the metadata of the files in directories in the background with this many workers when they are listed (0 to disable).")
+	mountCmd.Flags().DurationVarP(&warmStreamTimeout, "warm-stream-timeout", "", warmStreamTimeout, "Keep the streams of closed files open this long for reuse if the file is opened again (0 to disable).")
+	mountCmd.Flags().IntVarP(&multiThreadStreams, "multi-thread-streams", "", multiThreadStreams, "Read large files sequentially with this many ranged streams at once (0 or 1 to disable).")
+	mountCmd.Flags().VarP(&multiThreadCutoff, "multi-thread-cutoff", "", "Use --multi-thread-streams for files at least this big.")
+	mountCmd.Flags().IntVarP(&openRetries, "open-retries", "", openRetries, "Number of times to retry opening a file for reading if it fails.")
+	mountCmd.Flags().BoolVarP(&readErrorsAsZeros, "read-errors-as-zeros", "", readErrorsAsZeros, "Return zeros for the parts of files which can't be read after retrying rather than EIO - unsafe, for data recovery.")
+	mountCmd.Flags().IntVarP(&handleRetryBudget, "handle-retry-budget", "", handleRetryBudget, "Max number of read retries over the life of an open file before reads fail with EIO (0 for unlimited).")
 	// mount options
 	mountCmd.Flags().BoolVarP(&readOnly, "read-only", "", readOnly, "Mount read-only.")
+	mountCmd.Flags().BoolVarP(&uploadOnly, "upload-only", "", uploadOnly, "Mount write-only - files can be created and written but not read.")
 	mountCmd.Flags().BoolVarP(&allowNonEmpty, "allow-non-empty", "", allowNonEmpty, "Allow mounting over a non-empty directory.")
 	mountCmd.Flags().BoolVarP(&allowRoot, "allow-root", "", allowRoot, "Allow access to root user.")
 	mountCmd.Flags().BoolVarP(&allowOther, "allow-other", "", allowOther, "Allow access to other users.")
 	mountCmd.Flags().BoolVarP(&defaultPermissions, "default-permissions", "", defaultPermissions, "Makes kernel enforce access control based on the file mode.")
+	mountCmd.Flags().BoolVarP(&minimalStatfs, "minimal-statfs", "", minimalStatfs, "Report modest sizes for the file system to statfs for clients like 32 bit or container tools which reject huge ones.")
 	mountCmd.Flags().BoolVarP(&writebackCache, "write-back-cache", "", writebackCache, "Makes kernel buffer writes before sending them to rclone. Without this, writethrough caching is used.")
 	mountCmd.Flags().VarP(&maxReadAhead, "max-read-ahead", "", "The number of bytes that can be prefetched for sequential reads.")
+	mountCmd.Flags().StringVarP(&fsType, "fs-type", "", fsType, "The file system type shown as fuse.<type> in the mount table for tools which check it.")
+	mountCmd.Flags().VarP(&readCacheSize, "read-cache-size", "", "Size of the in memory cache for data read from files (0 to disable).")
+	mountCmd.Flags().StringVarP(&readCacheDir, "read-cache-dir", "", readCacheDir, "Keep the blocks in the read cache in this directory too so they are read from it by later mounts.")
+	mountCmd.Flags().VarP(&readCacheDirSize, "read-cache-dir-size", "", "Max size of the blocks kept in --read-cache-dir.")
+	mountCmd.Flags().StringVarP(&sharedCacheSocket, "shared-cache-socket", "", sharedCacheSocket, "Share the blocks in --read-cache-dir with other mounts using this unix socket.")
+	mountCmd.Flags().VarP(&minReadSize, "min-read-size", "", "Read at least this many bytes from the remote for each read.")
+	mountCmd.Flags().VarP(&seekSkipSize, "seek-skip-size", "", "Read and discard up to this many bytes to seek forwards rather than reopening the file.")
+	mountCmd.Flags().VarP(&perObjectReadLimit, "per-object-read-limit", "", "Bandwidth limit for reading each file from the remote, or use suffix b|k|M|G.")
+	mountCmd.Flags().VarP(&readBwLimit, "read-bwlimit", "", "Bandwidth limit for reading files shared between all open files, or use suffix b|k|M|G.")
+	mountCmd.Flags().StringVarP(&bwLimitSchedule, "bwlimit-schedule", "", bwLimitSchedule, "Limit the bandwidth of reads by time of day, eg \"08:00,1M 23:00,off\", or a file holding this which is reread on SIGHUP - can't be used with --read-bwlimit.")
+	mountCmd.Flags().StringVarP(&highPriorityPaths, "high-priority-paths", "", highPriorityPaths, "Glob of paths whose reads get bandwidth before others under --read-bwlimit.")
+	mountCmd.Flags().BoolVarP(&readDownload, "read-download", "", readDownload, "Download files to a local temporary file in the background when opened for reading and serve the reads from it.")
+	mountCmd.Flags().BoolVarP(&writeCacheEnabled, "write-cache", "", writeCacheEnabled, "Write files to a local temporary file, uploading them when closed, so they can be written in any order. Files opened without O_TRUNC start with their existing contents.")
+	mountCmd.Flags().VarP(&writeBufferLimit, "write-buffer-limit", "", "Buffer up to this much written data per file while it uploads (0 to write straight to the upload).")
+	mountCmd.Flags().VarP(&blockSize, "block-size", "", "Block size reported to statfs and used to work out the blocks files use - a multiple of 512 (0 for 4096 in statfs only).")
+	mountCmd.Flags().VarP(&prefetchSize, "prefetch-size", "", "Read this many bytes ahead in the background after each read (0 to disable).")
+	mountCmd.Flags().VarP(&prefetchMax, "prefetch-max", "", "Double the --prefetch-size up to this when reads have to wait for it, going back to --prefetch-size on seeks (0 to disable).")
 	mountCmd.Flags().IntVarP(&umask, "umask", "", umask, "Override the permission bits set by the filesystem.")
 	mountCmd.Flags().Uint32VarP(&uid, "uid", "", uid, "Override the uid field set by the filesystem.")
 	mountCmd.Flags().Uint32VarP(&gid, "gid", "", gid, "Override the gid field set by the filesystem.")
@@ -87,7 +264,9 @@ Or with OS X
 
 ### Limitations ###
 
-This can only write files seqentially, it can only seek when reading.
+Without --write-cache this can only write files sequentially, it can
+only seek when reading. With --write-cache files can be written in
+any order.
 
 Rclone mount inherits rclone's directory handling.  In rclone's world
 directories don't really exist.  This means that empty directories
@@ -101,6 +280,137 @@ as will ` + "`swift:bucket/path`" + `.
 
 Only supported on Linux, FreeBSD and OS X at the moment.
 
+Unnamed files can't be made with ` + "`O_TMPFILE`" + ` as the kernel doesn't
+pass those opens on to FUSE file systems but fails them with
+` + "`EOPNOTSUPP`" + `, so there is nothing for ` + "`linkat`" + ` to link into
+place either.  Programs which use it fall back to a named temporary
+file which works as normal.
+
+### Reported size ###
+
+The remotes don't report how much space they have, so by default the
+mount tells statfs (and so ` + "`df`" + `) that it is very large with lots
+of free inodes.  Some clients can't cope with numbers that big:
+
+  * 32 bit programs built without large file support (without
+    ` + "`-D_FILE_OFFSET_BITS=64`" + `) get ` + "`EOVERFLOW`" + ` from ` + "`statfs`" + ` as
+    the block count doesn't fit in 32 bits.
+  * Container runtimes which sanity check the size and inode counts of
+    a volume before using it refuse to mount file systems reporting
+    such huge numbers.
+
+If you see errors about the size of the file system when using one of
+these, use ` + "`--minimal-statfs`" + ` which reports a 1TB file system with
+a million inodes, most of them free.
+
+### Status file ###
+
+Reading the file ` + "`.rclone-status`" + ` in the root of the mount shows the
+current status of the mount - how long it has been up, the number of
+open files, the bytes read and written, the number of files with data
+which hasn't been uploaded yet, including those in ` + "`--staging`" + `, and
+how the read cache is doing - as ` + "`name: value`" + ` lines, so
+` + "`dirty_files: 0`" + ` shows all the data has been uploaded.  It is
+regenerated each time it is read.  It isn't shown in directory
+listings unless ` + "`--status-file`" + ` is used.  Note that it hides any
+file of the same name in the root of the remote.
+
+With ` + "`--dirty-xattr`" + ` each file has a ` + "`user.rclone.dirty`" + ` xattr
+which is "1" while it has data which hasn't been uploaded and "0"
+otherwise.
+
+### Shared cache ###
+
+Mounts of the same remote on one machine can share the data they
+have read with ` + "`--shared-cache-socket /path/to/socket`" + `, which
+needs ` + "`--read-cache-dir`" + ` too.  The first mount started serves
+the blocks in its ` + "`--read-cache-dir`" + ` on the socket and the others
+use it, so a block read by one mount is read from that directory by
+the others.
+Blocks are found by the hash of the file so files are only shared if
+the remote supports hashes.  Reads carry on from the remote if the
+cache goes away, eg if the mount serving it is unmounted.
+
+### Disk cache ###
+
+With ` + "`--read-cache-dir /path/to/dir`" + `, which needs ` + "`--read-cache-size`" + `
+too, the blocks read into the read cache are kept in files in the
+directory as well, up to ` + "`--read-cache-dir-size`" + `.  These are found
+again by later mounts using the directory, so reading a large file
+which was interrupted by the mount stopping only reads the blocks it
+didn't get before from the remote.  Like the shared cache, blocks are
+found by the hash of the file so this only works if the remote
+supports hashes, and not on local disks where finding the hash means
+reading the whole file.
+
+If ` + "`--read-cache-dir`" + ` and the files of ` + "`--write-cache`" + ` are on the
+same disk, ` + "`--cache-max-total-size`" + ` limits their size together.
+Files being written can't be removed until they are uploaded, so the
+blocks of the read cache are removed to make room for them, and if
+the files being written alone are bigger then writes wait for the
+others to be uploaded.
+
+### Staging directory ###
+
+With ` + "`--staging`" + ` there is a writable ` + "`.staging`" + ` directory in the
+root of the mount.  Files written there are kept in local temporary
+files and not uploaded until they are moved out of it into the
+mount, eg with ` + "`mv .staging/report.pdf reports/`" + `, so a batch of
+files can be prepared then committed.  Moving a file out uploads it
+the same way as a file written there.  Staged files which haven't
+been moved out are lost when the mount stops, which is logged as an
+error.
+
+### Access control ###
+
+On a mount shared between users (see ` + "`--allow-other`" + `) ` + "`--acl-file`" + `
+can be used to give users different access to different paths.  Each
+line of the file is a rule like
+
+    /shared/** 1000 rw
+    /shared/** * r
+    /private/** * -
+
+giving a glob of the paths it applies to, the uid it applies to (or
+` + "`*`" + ` for everyone) and the access allowed - ` + "`r`" + ` to read, ` + "`rw`" + ` to
+read and write or ` + "`-`" + ` for none.  The first rule matching the path
+and the user is used and if none match access is allowed.  Opening,
+creating, removing and renaming files not allowed give EACCES and
+directory listings leave out the names the user can't read.
+Renaming a directory needs write access to all the paths which could
+be under it.
+
+### Filtering ###
+
+The files and directories excluded by ` + "`--include`" + `, ` + "`--exclude`" + ` and
+the other filter flags are hidden from the mount, so eg
+` + "`--include \"*.mp4\"`" + ` shows only the videos.  Looking up a hidden
+name gives ENOENT.  Files and directories with excluded names can
+still be made unless ` + "`--reject-filtered-writes`" + ` is set, when they
+give EPERM, but they are hidden once they have been uploaded.
+
+### Compression ###
+
+With ` + "`--compress-on-write`" + ` files are compressed with gzip as they
+are uploaded, except those with extensions in
+` + "`--compress-exclude-extensions`" + ` which are compressed already, or
+only those with extensions in ` + "`--compress-extensions`" + ` if set.  This
+needs a remote which stores metadata, currently only s3, as the files
+are marked as compressed in it along with their size before
+compression - rclone mount won't start with it otherwise.  Each file
+is compressed into a temporary file before it is uploaded so its size
+is known.  The files are decompressed when read through the mount and
+show their original size.
+
+### Dedupe on write ###
+
+With ` + "`--dedupe-on-write`" + ` each file written is hashed before it is
+uploaded and if a file with the same size and hash is already in the
+same directory it is server side copied instead.  Only that directory
+is looked in, not the rest of the remote, so identical files in other
+directories are still uploaded.  This needs a remote which supports
+server side copy and hashes - files are uploaded as normal otherwise.
+
 ### rclone mount vs rclone sync/copy ##
 
 File systems expect things to be 100% reliable, whereas cloud storage
@@ -109,6 +419,8 @@ commands cope with this with lots of retries.  However rclone mount
 can't use retries in the same way without making local copies of the
 uploads.  This might happen in the future, but for the moment rclone
 mount won't do that, so will be less reliable than the rclone command.
+Directory listings which fail with errors which look temporary, such
+as timeouts, are retried up to ` + "`--low-level-retries`" + ` times though.
 
 ### Bugs ###
 
@@ -124,8 +436,35 @@ mount won't do that, so will be less reliable than the rclone command.
   * Move directories
 `,
 	Run: func(command *cobra.Command, args []string) {
+		if userAgent != "" {
+			// set before the remotes are made as they may use it
+			fs.UserAgent = userAgent
+		}
+		if combine != "" {
+			// the remotes are given by --combine
+			cmd.CheckArgs(1, 1, command, args)
+			var err error
+			combineRoot, err = newCombineDir(combine, combineNewFs)
+			if err != nil {
+				log.Fatalf("Fatal error: bad --combine: %v", err)
+			}
+			err = Mount(combineRoot.firstFs(), args[0])
+			if err != nil {
+				log.Fatalf("Fatal error: %v", err)
+			}
+			return
+		}
 		cmd.CheckArgs(2, 2, command, args)
-		fdst := cmd.NewFsDst(args)
+		var fdst fs.Fs
+		if lazyConnect {
+			var err error
+			fdst, err = newLazyFs(args[0], fs.NewFs)
+			if err != nil {
+				log.Fatalf("Fatal error: %v", err)
+			}
+		} else {
+			fdst = cmd.NewFsDst(args)
+		}
 		err := Mount(fdst, args[1])
 		if err != nil {
 			log.Fatalf("Fatal error: %v", err)
@@ -135,6 +474,9 @@ mount won't do that, so will be less reliable than the rclone command.
 
 // Mount mounts the remote at mountpoint.
 //
+// With --combine f is the first of the combined remotes which is
+// used for the whole mount, eg for its free space.
+//
 // If noModTime is set then it
 func Mount(f fs.Fs, mountpoint string) error {
 	if debugFUSE {
@@ -147,6 +489,185 @@ func Mount(f fs.Fs, mountpoint string) error {
 	dirPerms = 0777 &^ os.FileMode(umask)
 	filePerms = 0666 &^ os.FileMode(umask)
 
+	mountTime = time.Now()
+
+	if blockSize < 0 || blockSize%512 != 0 {
+		return errors.Errorf("--block-size must be a multiple of 512 but is %d", blockSize)
+	}
+	if dirMtime != "" && dirMtime != dirMtimeNewestChild {
+		return errors.Errorf("--dir-mtime must be %q but is %q", dirMtimeNewestChild, dirMtime)
+	}
+	if _, ok := unicodeForm(); !ok && unicodeNormalization != unicodeNormalizationNone {
+		return errors.Errorf("--unicode-normalization must be %q, %q or %q but is %q", unicodeNormalizationNFC, unicodeNormalizationNFD, unicodeNormalizationNone, unicodeNormalization)
+	}
+	if treeHash != "" && treeHash != treeHashShallow && treeHash != treeHashRecursive {
+		return errors.Errorf("--tree-hash must be %q or %q but is %q", treeHashShallow, treeHashRecursive, treeHash)
+	}
+	if readProxyURL != "" {
+		proxyURL, err := url.Parse(readProxyURL)
+		if err != nil {
+			return errors.Wrap(err, "bad --read-proxy-url")
+		}
+		fs.Config.ReadProxyURL = proxyURL
+	}
+	switch onUnknownHash {
+	case onUnknownHashSkip, onUnknownHashWarn, onUnknownHashFail:
+	default:
+		return errors.Errorf("--on-unknown-hash must be %q, %q or %q but is %q", onUnknownHashSkip, onUnknownHashWarn, onUnknownHashFail, onUnknownHash)
+	}
+	if prefetchMax > 0 && prefetchMax < prefetchSize {
+		return errors.New("--prefetch-max must be at least --prefetch-size")
+	}
+	if prefetchMax > 0 && prefetchSize == 0 {
+		return errors.New("--prefetch-max needs --prefetch-size")
+	}
+	if readYourWrites && !writeCacheEnabled {
+		return errors.New("--read-your-writes needs --write-cache")
+	}
+	if compressOnWrite && syncWrites {
+		return errors.New("can't use --compress-on-write with --sync-writes")
+	}
+	if compressOnWrite && combine != "" {
+		return errors.New("can't use --compress-on-write with --combine")
+	}
+	if compressOnWrite && lazyConnect {
+		// whether the remote stores metadata isn't known yet
+		return errors.New("can't use --compress-on-write with --lazy-connect")
+	}
+	if compressOnWrite && !storesMetadata(f) {
+		return errors.New("--compress-on-write needs a remote which stores metadata, eg s3")
+	}
+	if singleThread && (perDirOpenLimit > 0 || cacheMaxTotalSize > 0 || writeBufferLimit > 0) {
+		// these wait for other requests which would never run
+		return errors.New("can't use --single-thread with --per-dir-open-limit, --cache-max-total-size or --write-buffer-limit")
+	}
+	if uploadTimeout > 0 && syncWrites {
+		return errors.New("can't use --upload-timeout with --sync-writes")
+	}
+	if bestEffortUploads && syncWrites {
+		return errors.New("can't use --best-effort-uploads with --sync-writes")
+	}
+
+	if cacheMaxTotalSize > 0 {
+		if readCacheDir == "" && !writeCacheEnabled {
+			return errors.New("--cache-max-total-size needs --read-cache-dir or --write-cache")
+		}
+		totalCache = newCacheTotal(int64(cacheMaxTotalSize))
+	}
+
+	// Start the read cache if required
+	if readCacheSize > 0 {
+		readCache = newBlockCache(int64(readCacheSize))
+	}
+	if readCacheDir != "" {
+		if readCache == nil {
+			return errors.New("--read-cache-dir needs --read-cache-size")
+		}
+		var err error
+		diskCache, err = newDiskBlockCache(readCacheDir, int64(readCacheDirSize))
+		if err != nil {
+			return err
+		}
+	}
+	if sharedCacheSocket != "" {
+		if diskCache == nil {
+			return errors.New("--shared-cache-socket needs --read-cache-dir")
+		}
+		var err error
+		sharedCache, err = startSharedCache(sharedCacheSocket, diskCache)
+		if err != nil {
+			return err
+		}
+	}
+	if hotTierRemote != "" {
+		var err error
+		hotTier, err = fs.NewFs(hotTierRemote)
+		if err != nil {
+			return errors.Wrap(err, "bad --hot-tier")
+		}
+	}
+	if overlayDir != "" {
+		if combineRoot != nil {
+			return errors.New("can't use --overlay with --combine")
+		}
+		var err error
+		overlay, err = fs.NewFs(overlayDir)
+		if err != nil {
+			return errors.Wrap(err, "bad --overlay")
+		}
+		if overlayWrites {
+			f = newOverlayFs(f)
+		}
+	} else if overlayWrites {
+		return errors.New("--overlay-writes needs --overlay")
+	}
+	if cachePin != "" {
+		if combineRoot != nil {
+			return errors.New("can't use --cache-pin with --combine")
+		}
+		if readCache == nil {
+			return errors.New("--cache-pin needs --read-cache-size")
+		}
+		var err error
+		cachePinFilter, err = newGlobFilter(cachePin)
+		if err != nil {
+			return errors.Wrap(err, "bad --cache-pin")
+		}
+		go pinFiles(f)
+	}
+
+	// Start the read bandwidth limiter if required
+	if readBwLimit > 0 {
+		readLimiter = newPriorityLimiter(int64(readBwLimit))
+	}
+	if bwLimitSchedule != "" {
+		if readLimiter != nil {
+			return errors.New("can't use --bwlimit-schedule with --read-bwlimit")
+		}
+		readLimiter = newPriorityLimiter(0)
+		err := startBwSchedule(bwLimitSchedule, readLimiter)
+		if err != nil {
+			return errors.Wrap(err, "bad --bwlimit-schedule")
+		}
+	}
+	if dirListRate > 0 {
+		listLimiter = newPriorityLimiter(int64(dirListRate))
+	}
+	if openRate > 0 {
+		openLimiter = newPriorityLimiter(int64(openRate))
+	}
+	if highPriorityPaths != "" {
+		var err error
+		highPriorityFilter, err = newHighPriorityFilter(highPriorityPaths)
+		if err != nil {
+			return errors.Wrap(err, "bad --high-priority-paths")
+		}
+	}
+
+	// Read the access control list if required
+	if aclFile != "" {
+		var err error
+		acl, err = loadACL(aclFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read --acl-file")
+		}
+	}
+
+	// Start the error log if required
+	if errorLogFile != "" {
+		out, err := os.OpenFile(errorLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to open --error-log")
+		}
+		errorLog = newErrorEventLog(out)
+		defer func() {
+			err := errorLog.close()
+			if err != nil {
+				fs.ErrorLog(nil, "Failed to close --error-log: %v", err)
+			}
+		}()
+	}
+
 	// Mount it
 	errChan, err := mount(f, mountpoint)
 	if err != nil {
@@ -155,6 +676,9 @@ func Mount(f fs.Fs, mountpoint string) error {
 
 	// Wait for umount
 	err = <-errChan
+	waitBackgroundUploads()
+	waitUploadRetries()
+	warnStagedFiles()
 	if err != nil {
 		return errors.Wrap(err, "failed to umount FUSE fs")
 	}
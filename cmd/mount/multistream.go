@@ -0,0 +1,148 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+)
+
+// multiThreadChunkSize is the size of the ranges of the object each
+// stream reads with --multi-thread-streams
+var multiThreadChunkSize = int64(4 * 1024 * 1024)
+
+// errMultiStreamClosed is returned by a multiStreamReader after it has
+// been closed
+var errMultiStreamClosed = errors.New("multi stream reader closed")
+
+// streamChunk is a range of an object being read by one stream
+type streamChunk struct {
+	done chan struct{} // closed when the chunk has been read
+	data []byte        // the data read - valid once done is closed
+	err  error         // any error reading - valid once done is closed
+}
+
+// multiStreamReader reads an object sequentially from an offset using
+// --multi-thread-streams ranged reads of consecutive chunks of the
+// object at once, returning the data in order.
+type multiStreamReader struct {
+	o       fs.Object
+	options []fs.OpenOption // extra options for each open
+	size    int64           // size of the object
+	next    int64           // offset of the next chunk to start reading
+	chunks  []*streamChunk  // chunks being read in order
+	current []byte          // data of the chunk being returned
+	closed  bool
+	closing chan struct{} // closed by Close to stop the chunks being read
+}
+
+// newMultiStreamReader makes a multiStreamReader reading o from
+// offset, adding options to each open
+func newMultiStreamReader(o fs.Object, offset int64, options ...fs.OpenOption) *multiStreamReader {
+	r := &multiStreamReader{
+		o:       o,
+		options: options,
+		size:    o.Size(),
+		next:    offset,
+		closing: make(chan struct{}),
+	}
+	r.fill()
+	return r
+}
+
+// useMultiStream returns whether o should be read with a
+// multiStreamReader
+func useMultiStream(o fs.Object) bool {
+	return multiThreadStreams > 1 && o.Size() >= int64(multiThreadCutoff)
+}
+
+// fill starts reading chunks until --multi-thread-streams are in
+// progress or the end of the object is reached
+func (r *multiStreamReader) fill() {
+	for len(r.chunks) < multiThreadStreams && r.next < r.size {
+		end := r.next + multiThreadChunkSize
+		if end > r.size {
+			end = r.size
+		}
+		chunk := &streamChunk{done: make(chan struct{})}
+		go chunk.read(r.o, r.next, end, r.options, r.closing)
+		r.chunks = append(r.chunks, chunk)
+		r.next = end
+	}
+}
+
+// read the range start to end of o into the chunk, stopping if closing
+// is closed
+//
+// Not all remotes support ranged reads so this reads from start with a
+// SeekOption and stops reading at end.
+func (chunk *streamChunk) read(o fs.Object, start, end int64, options []fs.OpenOption, closing <-chan struct{}) {
+	defer close(chunk.done)
+	options = append([]fs.OpenOption{&fs.SeekOption{Offset: start}}, options...)
+	in, err := o.Open(options...)
+	if err != nil {
+		chunk.err = err
+		return
+	}
+	var closeOnce sync.Once
+	var closeErr error
+	closeIn := func() {
+		closeOnce.Do(func() { closeErr = in.Close() })
+	}
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-closing:
+			// stop the read in progress
+			closeIn()
+		case <-finished:
+		}
+	}()
+	chunk.data, chunk.err = ioutil.ReadAll(io.LimitReader(in, end-start))
+	close(finished)
+	closeIn()
+	if chunk.err == nil {
+		chunk.err = closeErr
+	}
+	if chunk.err == nil && int64(len(chunk.data)) != end-start {
+		chunk.err = io.ErrUnexpectedEOF
+	}
+}
+
+// Read returns the data from the chunks in order
+func (r *multiStreamReader) Read(p []byte) (n int, err error) {
+	if r.closed {
+		return 0, errMultiStreamClosed
+	}
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := r.chunks[0]
+		<-chunk.done
+		if chunk.err != nil {
+			return 0, chunk.err
+		}
+		r.chunks = r.chunks[1:]
+		r.current = chunk.data
+		r.fill()
+	}
+	n = copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close the reader stopping the chunks still being read
+func (r *multiStreamReader) Close() error {
+	if !r.closed {
+		close(r.closing)
+	}
+	r.closed = true
+	r.chunks = nil
+	r.current = nil
+	return nil
+}
@@ -0,0 +1,50 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"path"
+	"strings"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// normalizeKey collapses repeated "/" in remote and removes any
+// trailing "/"
+func normalizeKey(remote string) string {
+	for strings.Contains(remote, "//") {
+		remote = strings.Replace(remote, "//", "/", -1)
+	}
+	return strings.TrimSuffix(remote, "/")
+}
+
+// isDirMarker returns whether o is an empty object with a trailing
+// "/" which some backends use to mark a directory
+//
+// This is only used with --normalize-keys.
+func isDirMarker(o fs.Object) bool {
+	return normalizeKeys && strings.HasSuffix(o.Remote(), "/") && o.Size() == 0
+}
+
+// listedName returns the name remote, as returned by listing d,
+// should be shown as and whether it should be shown at all.
+//
+// Without --normalize-keys this is the last element of remote.  With
+// it the key is normalized first and keys which normalize to d itself
+// are hidden.  The objects keep their original keys so reading and
+// writing them still uses those.
+//
+// With --flatten it is the whole of remote made into a single name.
+//
+// With --escape-whitespace any leading or trailing whitespace in the
+// name is escaped.
+func (d *Dir) listedName(remote string) (string, bool) {
+	if flatten || !normalizeKeys {
+		return d.leaf(remote), true
+	}
+	remote = normalizeKey(remote)
+	if remote == "" || remote == normalizeKey(d.path) {
+		return "", false
+	}
+	return escapeWhitespace(path.Base(remote)), true
+}
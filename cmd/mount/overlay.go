@@ -0,0 +1,112 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// overlay is the local directory whose files are shown on top of the
+// remote with --overlay or nil
+var overlay fs.Fs
+
+// overlayListing merges the listing of dir in the overlay into the
+// objects and directories listed from the remote
+//
+// The overlay takes precedence so its files replace objects and
+// directories of the same name on the remote and so are read instead
+// of them.
+func overlayListing(dir string, level int, objs []fs.Object, dirs []*fs.Dir) ([]fs.Object, []*fs.Dir) {
+	if overlay == nil {
+		return objs, dirs
+	}
+	overlayObjs, overlayDirs, err := fs.NewLister().SetLevel(level).Start(overlay, dir).GetAll()
+	if err == fs.ErrorDirNotFound {
+		return objs, dirs
+	} else if err != nil {
+		fs.ErrorLog(dir, "Failed to list overlay: %v", err)
+		return objs, dirs
+	}
+	shadowed := make(map[string]bool, len(overlayObjs)+len(overlayDirs))
+	for _, o := range overlayObjs {
+		shadowed[o.Remote()] = true
+	}
+	for _, overlayDir := range overlayDirs {
+		shadowed[overlayDir.Remote()] = true
+	}
+	newObjs := overlayObjs
+	for _, o := range objs {
+		if !shadowed[o.Remote()] {
+			newObjs = append(newObjs, o)
+		}
+	}
+	newDirs := overlayDirs
+	for _, remoteDir := range dirs {
+		if !shadowed[remoteDir.Remote()] {
+			newDirs = append(newDirs, remoteDir)
+		}
+	}
+	return newObjs, newDirs
+}
+
+// overlayFs is the remote with --overlay-writes which writes the
+// files to the overlay rather than the remote.
+//
+// Objects are found in the overlay first.  Objects of the remote
+// can't be moved - see overlayProtected.
+type overlayFs struct {
+	fs.Fs // the remote
+}
+
+// Check interfaces satisfied
+var (
+	_ fs.Fs    = (*overlayFs)(nil)
+	_ fs.Mover = (*overlayFs)(nil)
+)
+
+// newOverlayFs returns remote writing its files to the overlay
+func newOverlayFs(remote fs.Fs) *overlayFs {
+	return &overlayFs{Fs: remote}
+}
+
+// NewObject finds the Object at remote in the overlay or the remote
+func (f *overlayFs) NewObject(remote string) (fs.Object, error) {
+	o, err := overlay.NewObject(remote)
+	if err == nil {
+		return o, nil
+	}
+	return f.Fs.NewObject(remote)
+}
+
+// Put in to the overlay
+func (f *overlayFs) Put(in io.Reader, src fs.ObjectInfo) (fs.Object, error) {
+	return overlay.Put(in, src)
+}
+
+// Mkdir makes the overlay directory
+func (f *overlayFs) Mkdir() error {
+	return overlay.Mkdir()
+}
+
+// Rmdir removes the overlay directory if empty
+func (f *overlayFs) Rmdir() error {
+	return overlay.Rmdir()
+}
+
+// Move src in the overlay to remote in the overlay
+func (f *overlayFs) Move(src fs.Object, remote string) (fs.Object, error) {
+	do, ok := overlay.(fs.Mover)
+	if !ok || overlayProtected(src) {
+		return nil, fs.ErrorCantMove
+	}
+	return do.Move(src, remote)
+}
+
+// overlayProtected returns whether o is an object of the remote which
+// can't be changed as the writes go to the overlay with
+// --overlay-writes
+func overlayProtected(o fs.Object) bool {
+	return overlayWrites && o.Fs() != fs.Info(overlay)
+}
@@ -0,0 +1,231 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+)
+
+// partRe matches the objects which are parts of a chunked file
+var partRe = regexp.MustCompile(`^(.*)\.part(\d{4})$`)
+
+// manifestSuffix is the suffix of the object which marks a chunked file
+const manifestSuffix = ".manifest"
+
+// errPartsReadOnly is returned when trying to modify an assembled file
+var errPartsReadOnly = errors.New("can't modify a file assembled from parts")
+
+// joinParts replaces the objects in objs which make up a chunked
+// file with a single partsObject.
+//
+// A chunked file "name" is stored as the objects "name.part0001",
+// "name.part0002", ... and "name.manifest".  The parts are only
+// assembled if the manifest exists and the parts are numbered
+// contiguously from 1.
+func joinParts(objs []fs.Object) []fs.Object {
+	manifests := make(map[string]bool)
+	parts := make(map[string][]fs.Object)
+	for _, o := range objs {
+		remote := o.Remote()
+		if strings.HasSuffix(remote, manifestSuffix) {
+			manifests[strings.TrimSuffix(remote, manifestSuffix)] = true
+		} else if match := partRe.FindStringSubmatch(remote); match != nil {
+			parts[match[1]] = append(parts[match[1]], o)
+		}
+	}
+	assembled := make(map[string]*partsObject)
+outer:
+	for remote, ps := range parts {
+		if !manifests[remote] {
+			continue
+		}
+		sort.Sort(byRemote(ps))
+		for i, o := range ps {
+			n, _ := strconv.Atoi(partRe.FindStringSubmatch(o.Remote())[2])
+			if n != i+1 {
+				fs.Debug(remote, "Not assembling parts as part %d is missing", i+1)
+				continue outer
+			}
+		}
+		assembled[remote] = newPartsObject(remote, ps)
+	}
+	if len(assembled) == 0 {
+		return objs
+	}
+	out := make([]fs.Object, 0, len(objs))
+	for _, o := range objs {
+		remote := o.Remote()
+		if match := partRe.FindStringSubmatch(remote); match != nil && assembled[match[1]] != nil {
+			continue
+		}
+		if strings.HasSuffix(remote, manifestSuffix) {
+			if po := assembled[strings.TrimSuffix(remote, manifestSuffix)]; po != nil {
+				out = append(out, po)
+				continue
+			}
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+// byRemote sorts objects by their remote
+type byRemote []fs.Object
+
+func (objs byRemote) Len() int           { return len(objs) }
+func (objs byRemote) Swap(i, j int)      { objs[i], objs[j] = objs[j], objs[i] }
+func (objs byRemote) Less(i, j int) bool { return objs[i].Remote() < objs[j].Remote() }
+
+// partsObject is a read only fs.Object made by joining the parts of a
+// chunked file together
+type partsObject struct {
+	remote string
+	parts  []fs.Object
+	starts []int64 // offset of the start of each part
+	size   int64
+}
+
+// newPartsObject makes a partsObject for remote from parts
+func newPartsObject(remote string, parts []fs.Object) *partsObject {
+	o := &partsObject{
+		remote: remote,
+		parts:  parts,
+		starts: make([]int64, len(parts)),
+	}
+	for i, part := range parts {
+		o.starts[i] = o.size
+		o.size += part.Size()
+	}
+	return o
+}
+
+// Fs returns read only access to the Fs that this object is part of
+func (o *partsObject) Fs() fs.Info { return o.parts[0].Fs() }
+
+// String returns a description of the Object
+func (o *partsObject) String() string { return o.remote }
+
+// Remote returns the remote path
+func (o *partsObject) Remote() string { return o.remote }
+
+// ModTime returns the latest modification time of the parts
+func (o *partsObject) ModTime() (modTime time.Time) {
+	for _, part := range o.parts {
+		if t := part.ModTime(); t.After(modTime) {
+			modTime = t
+		}
+	}
+	return modTime
+}
+
+// Size returns the total size of the parts
+func (o *partsObject) Size() int64 { return o.size }
+
+// Hash isn't supported as there is no hash of the whole file
+func (o *partsObject) Hash(t fs.HashType) (string, error) {
+	return "", fs.ErrHashUnsupported
+}
+
+// Storable says whether this object can be stored
+func (o *partsObject) Storable() bool { return true }
+
+// SetModTime isn't supported
+func (o *partsObject) SetModTime(modTime time.Time) error {
+	return fs.ErrorCantSetModTime
+}
+
+// Open the parts for reading as a single stream
+func (o *partsObject) Open(options ...fs.OpenOption) (io.ReadCloser, error) {
+	var offset, limit int64 = 0, -1
+	for _, option := range options {
+		switch x := option.(type) {
+		case *fs.SeekOption:
+			offset = x.Offset
+		case *fs.RangeOption:
+			offset = x.Start
+			if x.End >= 0 {
+				limit = x.End - x.Start + 1
+			}
+		default:
+			if option.Mandatory() {
+				fs.Log(o, "Unsupported mandatory option: %v", option)
+			}
+		}
+	}
+	r := &partsReader{o: o, offset: offset}
+	if limit >= 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(r, limit), r}, nil
+	}
+	return r, nil
+}
+
+// Update isn't supported
+func (o *partsObject) Update(in io.Reader, src fs.ObjectInfo) error {
+	return errPartsReadOnly
+}
+
+// Remove isn't supported
+func (o *partsObject) Remove() error {
+	return errPartsReadOnly
+}
+
+// Check interface satisfied
+var _ fs.Object = (*partsObject)(nil)
+
+// partsReader reads a partsObject opening each part as it is needed
+type partsReader struct {
+	o      *partsObject
+	offset int64         // offset in the partsObject of the next read
+	in     io.ReadCloser // the part being read or nil
+	part   int           // index of the part being read
+}
+
+// Read reads from the part containing offset
+func (r *partsReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.offset >= r.o.size {
+			return 0, io.EOF
+		}
+		if r.in == nil {
+			// find the part containing offset
+			r.part = sort.Search(len(r.o.starts), func(i int) bool { return r.o.starts[i] > r.offset }) - 1
+			start := r.offset - r.o.starts[r.part]
+			r.in, err = r.o.parts[r.part].Open(&fs.SeekOption{Offset: start})
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to open part %d", r.part+1)
+			}
+		}
+		n, err = r.in.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			err = r.in.Close()
+			r.in = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close the part being read
+func (r *partsReader) Close() error {
+	if r.in == nil {
+		return nil
+	}
+	err := r.in.Close()
+	r.in = nil
+	return err
+}
@@ -0,0 +1,71 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// cachePinFilter matches the files whose blocks are never evicted
+// from the read cache or is nil if there are none
+var cachePinFilter *fs.Filter
+
+// cacheIDRemote returns the remote of the object with cache id
+func cacheIDRemote(id string) string {
+	return strings.SplitN(id, "\x00", 2)[0]
+}
+
+// isPinned returns whether the blocks of the object with cache id
+// are pinned in the read cache
+func isPinned(id string) bool {
+	return cachePinFilter != nil && cachePinFilter.Include(cacheIDRemote(id), 0, time.Time{})
+}
+
+// pinFiles reads the files in f matching --cache-pin into the read
+// cache so they are there from when the mount starts
+func pinFiles(f fs.Fs) {
+	objs, _, err := fs.NewLister().SetLevel(fs.MaxLevel).Start(f, "").GetAll()
+	if err != nil {
+		fs.ErrorLog(f, "Failed to list files to pin in cache: %v", err)
+		return
+	}
+	for _, o := range objs {
+		if !isPinned(cacheID(o)) {
+			continue
+		}
+		err = pinObject(o)
+		if err != nil {
+			fs.ErrorLog(o, "Failed to pin in cache: %v", err)
+		}
+	}
+}
+
+// pinObject reads all of o into the read cache
+func pinObject(o fs.Object) error {
+	fs.Debug(o, "Pinning in cache")
+	id := cacheID(o)
+	in, err := o.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	for block := int64(0); ; block++ {
+		data := make([]byte, readCacheBlockSize)
+		n, err := io.ReadFull(in, data)
+		if err == io.EOF {
+			return nil
+		}
+		readCache.put(cacheKey{id: id, block: block}, data[:n])
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"bytes"
+	"path"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// isDirPlaceholder returns whether remote is a --dir-placeholder
+// object which is hidden from the listings
+func isDirPlaceholder(remote string) bool {
+	return dirPlaceholder != "" && path.Base(remote) == dirPlaceholder
+}
+
+// writeDirPlaceholder uploads an empty --dir-placeholder object into
+// the directory dir on f so it exists on remotes without directories
+// even when it is empty
+func writeDirPlaceholder(f fs.Fs, dir string) error {
+	if dirPlaceholder == "" {
+		return nil
+	}
+	remote := path.Join(dir, dirPlaceholder)
+	fs.Debug(remote, "Writing directory placeholder")
+	_, err := f.Put(bytes.NewReader(nil), fs.NewStaticObjectInfo(remote, time.Now(), 0, true, nil, f))
+	return err
+}
+
+// removeDirPlaceholder removes the --dir-placeholder object from the
+// directory dir on f if there is one
+func removeDirPlaceholder(f fs.Fs, dir string) error {
+	if dirPlaceholder == "" {
+		return nil
+	}
+	o, err := f.NewObject(path.Join(dir, dirPlaceholder))
+	if err == fs.ErrorObjectNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if overlayProtected(o) {
+		fs.Debug(o, "Not removing directory placeholder on the remote with --overlay-writes")
+		return nil
+	}
+	fs.Debug(o, "Removing directory placeholder")
+	return o.Remove()
+}
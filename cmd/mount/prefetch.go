@@ -0,0 +1,98 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// prefetchChunkSize is the size of the reads the prefetcher makes -
+// cancellation is checked between each one
+const prefetchChunkSize = 64 * 1024
+
+// errPrefetchCancelled is the error a prefetcher finishes with if it
+// was stopped before reading all its data
+var errPrefetchCancelled = errors.New("prefetch cancelled")
+
+// prefetcher reads data from a stream in the background
+type prefetcher struct {
+	cancel chan struct{} // closed to stop the prefetch
+	done   chan struct{} // closed when the prefetch has finished
+	data   []byte        // data read - only valid once done is closed
+	err    error         // error reading - only valid once done is closed
+	size   int           // number of bytes being read
+}
+
+// newPrefetcher starts reading up to size bytes from r in the
+// background calling limit with the size of each read made
+//
+// r mustn't be used by anything else until the prefetcher is done
+func newPrefetcher(r io.Reader, size int, limit func(n int)) *prefetcher {
+	p := &prefetcher{
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+		size:   size,
+	}
+	go p.run(r, size, limit)
+	return p
+}
+
+// run reads the data in chunks until size bytes have been read, an
+// error occurs or the prefetch is cancelled
+func (p *prefetcher) run(r io.Reader, size int, limit func(n int)) {
+	defer close(p.done)
+	buf := make([]byte, size)
+	n := 0
+	for n < size {
+		select {
+		case <-p.cancel:
+			p.data, p.err = buf[:n], errPrefetchCancelled
+			return
+		default:
+		}
+		end := n + prefetchChunkSize
+		if end > size {
+			end = size
+		}
+		m, err := io.ReadFull(r, buf[n:end])
+		limit(m)
+		n += m
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			p.err = err
+			break
+		}
+	}
+	p.data = buf[:n]
+}
+
+// wait for the prefetch to finish returning the data read and any
+// error
+func (p *prefetcher) wait() ([]byte, error) {
+	<-p.done
+	return p.data, p.err
+}
+
+// finished returns whether the prefetch has finished so its data can
+// be collected without waiting
+func (p *prefetcher) finished() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop the prefetch and wait for it to finish
+//
+// The data read is discarded and the position of the stream is
+// undefined afterwards so it must be seeked before being read again.
+func (p *prefetcher) stop() {
+	close(p.cancel)
+	<-p.done
+}
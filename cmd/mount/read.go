@@ -3,34 +3,230 @@
 package mount
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
 	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
 // ReadFileHandle is an open for read file handle on a File
 type ReadFileHandle struct {
+	position int64 // offset of the end of the last read - read and written with atomic - must be 64 bit aligned
+
 	mu         sync.Mutex
 	closed     bool // set if handle has been closed
 	r          io.ReadCloser
 	o          fs.Object
 	readCalled bool // set if read has been called
 	offset     int64
+	readAhead  []byte // data read from r beyond offset but not yet returned
+
+	prefetch   *prefetcher      // background read of r following readAhead or nil
+	etag       string           // ETag of the object when opened or "" if unknown
+	high       bool             // set if reads are high priority for --read-bwlimit
+	retries    int              // number of read retries made over the life of the handle
+	exhausted  bool             // set if the --handle-retry-budget has run out
+	hash       *fs.MultiHasher  // hash of the data read from the start or nil
+	hashed     int64            // number of bytes from the start in hash
+	sharedID   string           // identity of the object in the shared and disk caches or "" if not shared
+	objLimiter *priorityLimiter // limiter for reads of this object with --per-object-read-limit or nil
+	file       *File            // the File opened or nil
+	download   *download        // the download of r serving the reads with --read-download or nil
+	restated   time.Time        // when restatForTail last found the object again
+	generation int64            // generation of the object when opened with --read-lease-interval or 0
+	leaseCheck time.Time        // when the generation was last checked
+	leaseLost  bool             // set if the generation has changed
+	openDir    *Dir             // directory to release the open of the file in with --per-dir-open-limit or nil
+	requestID  string           // ID of the FUSE operation in progress for the logs or ""
+	window     int              // size of the prefetch grown with --prefetch-max or 0 for --prefetch-size
+}
+
+// readPosition returns the offset of the end of the last read
+func (fh *ReadFileHandle) readPosition() int64 {
+	return atomic.LoadInt64(&fh.position)
+}
+
+// op returns the object with the ID of the operation in progress for
+// logging
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) op() opLog {
+	return opLog{o: fh.o, id: fh.requestID}
+}
+
+// startOp gives the operation starting on the handle a new request
+// ID returning a function to call when it is finished
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) startOp() func() {
+	fh.requestID = newRequestID()
+	return func() {
+		fh.requestID = ""
+	}
+}
+
+// errLeaseLost is returned for reads on a handle whose object has
+// changed generation since it was opened with --read-lease-interval
+var errLeaseLost = fuse.Errno(syscall.ESTALE)
+
+// errRetryBudgetExhausted is returned for reads on a handle which has
+// used up its --handle-retry-budget
+var errRetryBudgetExhausted = fuse.Errno(syscall.EIO)
+
+// openRetrySleep is the time to sleep before the first retry of a
+// failed open - it doubles for each subsequent retry
+var openRetrySleep = 100 * time.Millisecond
+
+// decodeOptions returns the options to open o with so the backend
+// decompresses it if it is content encoded and --server-decompress is
+// set.  If the backend can't then the data is read as it would be
+// otherwise.
+func decodeOptions(o fs.Object) []fs.OpenOption {
+	if !serverDecompress {
+		return nil
+	}
+	if encoded, _ := contentEncoded(o); !encoded {
+		return nil
+	}
+	return []fs.OpenOption{&fs.DecompressOption{}}
+}
+
+// openObject opens o retrying up to --open-retries times with
+// exponential backoff if it fails logging with the request ID id.
+func openObject(o fs.Object, id string) (r io.ReadCloser, err error) {
+	sleep := openRetrySleep
+	for try := 0; ; try++ {
+		r, err = o.Open(decodeOptions(o)...)
+		if err == nil || try >= openRetries {
+			return r, err
+		}
+		fs.Debug(opLog{o: o, id: id}, "Open failed - retrying in %v (%d/%d): %v", sleep, try+1, openRetries, err)
+		time.Sleep(sleep)
+		sleep *= 2
+	}
 }
 
 func newReadFileHandle(o fs.Object) (*ReadFileHandle, error) {
-	r, err := o.Open()
+	return newReadFileHandleID(context.Background(), o, "")
+}
+
+// newReadFileHandleID opens o for reading logging with the request ID
+// id of the operation opening it.  It returns EINTR if ctx is
+// cancelled while waiting for --open-rate.
+func newReadFileHandleID(ctx context.Context, o fs.Object, id string) (fh *ReadFileHandle, err error) {
+	err = waitToOpen(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &ReadFileHandle{
-		r: r,
-		o: o,
-	}, nil
+	fh = &ReadFileHandle{
+		o:         o,
+		high:      isHighPriority(o.Remote()),
+		requestID: id,
+	}
+	// the ID is only for the open
+	defer func() {
+		if fh != nil {
+			fh.requestID = ""
+		}
+	}()
+	if do, ok := o.(fs.ETagger); ok {
+		fh.etag = do.ETag()
+	}
+	if do, ok := o.(fs.Generationer); ok && readLeaseInterval > 0 {
+		fh.generation = do.Generation()
+		fh.leaseCheck = time.Now()
+	}
+	if ws := takeWarmStream(o); ws != nil {
+		fs.Debug(fh.op(), "Reusing warm stream at offset %d", ws.offset)
+		fh.r, fh.offset, fh.readAhead = ws.r, ws.offset, ws.readAhead
+	} else if useMultiStream(o) {
+		fs.Debug(fh.op(), "Reading with %d streams", multiThreadStreams)
+		fh.r = newMultiStreamReader(o, 0, fh.conditions()...)
+	} else {
+		fh.r, err = openObject(o, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hashType := o.Fs().Hashes().GetOne()
+	if storesHash(o.Fs()) {
+		hashType = fs.HashMD5
+	}
+	if hashType != fs.HashNone {
+		fh.hash, err = fs.NewMultiHasherTypes(fs.NewHashSet(hashType))
+		if err != nil {
+			_ = fh.r.Close()
+			return nil, err
+		}
+		if (sharedCache != nil || diskCache != nil) && !slowHash(o.Fs()) {
+			// blocks are shared between mounts by the hash of
+			// the object so other remotes with the same data,
+			// and later mounts, can use them
+			sum, err := objectHash(o, hashType)
+			if err == nil && sum != "" {
+				fh.sharedID = fmt.Sprintf("%v:%s:%d", hashType, sum, o.Size())
+			}
+		}
+	}
+	fh.objLimiter = acquireObjectLimiter(o.Remote())
+	if readDownload {
+		fh.download, err = newDownload(o, fh.r, fh.limit)
+		if err != nil {
+			_ = fh.r.Close()
+			if fh.objLimiter != nil {
+				releaseObjectLimiter(o.Remote())
+			}
+			return nil, err
+		}
+	} else if readaheadOnOpen > 0 && fh.offset == 0 && len(fh.readAhead) == 0 {
+		// start reading the beginning of the file straight
+		// away so the first reads don't wait for the remote
+		fs.Debug(fh.op(), "Prefetching %d bytes on open", readaheadOnOpen)
+		fh.prefetch = newPrefetcher(fh.r, int(readaheadOnOpen), fh.limit)
+	}
+	atomic.AddInt64(&openHandles, 1)
+	return fh, nil
+}
+
+// limit waits until n bytes read from the remote are allowed by the
+// --read-bwlimit and --per-object-read-limit limiters
+func (fh *ReadFileHandle) limit(n int) {
+	if n <= 0 {
+		return
+	}
+	if fh.objLimiter != nil {
+		fh.objLimiter.wait(n, fh.high)
+	}
+	if readLimiter != nil {
+		readLimiter.wait(n, fh.high)
+	}
+}
+
+// openOptions returns the options to reopen the object at offset
+func (fh *ReadFileHandle) openOptions(offset int64) []fs.OpenOption {
+	options := append([]fs.OpenOption{&fs.SeekOption{Offset: offset}}, fh.conditions()...)
+	return append(options, decodeOptions(fh.o)...)
+}
+
+// conditions returns the options for reopening the object
+//
+// If the ETag is known the open is made conditional on it so the
+// object being changed gives an error rather than a mix of old and
+// new data.
+func (fh *ReadFileHandle) conditions() []fs.OpenOption {
+	if fh.etag == "" {
+		return nil
+	}
+	return []fs.OpenOption{&fs.IfMatchOption{ETag: fh.etag}}
 }
 
 // Check interface satisfied
@@ -41,48 +237,615 @@ var _ fusefs.HandleReader = (*ReadFileHandle)(nil)
 
 // seek to a new offset
 //
+// Streams which can't seek are reopened with a single stream even with
+// --multi-thread-streams as seeking suggests the reads aren't
+// sequential.
+//
 // Must be called with fh.mu held
 func (fh *ReadFileHandle) seek(offset int64) error {
+	fh.stopPrefetch()
 	// Can we seek it directly?
 	if do, ok := fh.r.(io.Seeker); ok {
-		fs.Debug(fh.o, "ReadFileHandle.seek from %d to %d (io.Seeker)", fh.offset, offset)
+		fs.Debug(fh.op(), "ReadFileHandle.seek from %d to %d (io.Seeker)", fh.offset, offset)
 		_, err := do.Seek(offset, 0)
 		if err != nil {
-			fs.Debug(fh.o, "ReadFileHandle.Read io.Seeker failed: %v", err)
+			fs.Debug(fh.op(), "ReadFileHandle.Read io.Seeker failed: %v", err)
 			return err
 		}
 	} else {
-		fs.Debug(fh.o, "ReadFileHandle.seek from %d to %d", fh.offset, offset)
+		fs.Debug(fh.op(), "ReadFileHandle.seek from %d to %d", fh.offset, offset)
 		// if not re-open with a seek
-		r, err := fh.o.Open(&fs.SeekOption{Offset: offset})
+		r, err := fh.o.Open(fh.openOptions(offset)...)
+		if fs.IsAuthExpiredError(err) {
+			fs.Debug(fh.op(), "ReadFileHandle.seek refreshing after: %v", err)
+			r, err = fh.refreshOpen(offset)
+		}
 		if err != nil {
-			fs.Debug(fh.o, "ReadFileHandle.Read seek failed: %v", err)
+			fs.Debug(fh.op(), "ReadFileHandle.Read seek failed: %v", err)
 			return err
 		}
 		err = fh.r.Close()
 		if err != nil {
-			fs.Debug(fh.o, "ReadFileHandle.Read seek close old failed: %v", err)
+			fs.Debug(fh.op(), "ReadFileHandle.Read seek close old failed: %v", err)
 		}
 		fh.r = r
 	}
 	fh.offset = offset
+	fh.readAhead = nil
+	return nil
+}
+
+// skipForward moves the stream forwards to offset by reading and
+// discarding the data before it if that is no more than
+// --seek-skip-size bytes.  It returns whether it did.
+//
+// For short skips this is cheaper than reopening the object,
+// especially on remotes which can't open objects part way through so
+// send all the data from the start again.  Backwards seeks always
+// reopen.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) skipForward(offset int64) bool {
+	if _, ok := fh.r.(io.Seeker); ok || offset <= fh.offset || offset-fh.offset > int64(seekSkipSize) {
+		return false
+	}
+	if fh.prefetch != nil {
+		// the prefetch has the data to skip so let it finish
+		// rather than cancelling it
+		data, err := fh.prefetch.wait()
+		fh.prefetch = nil
+		fh.readAhead = append(fh.readAhead, data...)
+		if err != nil && err != io.EOF {
+			fs.Debug(fh.op(), "ReadFileHandle.skipForward prefetch failed: %v", err)
+			return false
+		}
+	}
+	if buffered := fh.offset + int64(len(fh.readAhead)); offset > buffered {
+		fs.Debug(fh.op(), "ReadFileHandle.skipForward from %d to %d", buffered, offset)
+		n, err := io.CopyN(ioutil.Discard, fh.r, offset-buffered)
+		fh.limit(int(n))
+		if err != nil {
+			fs.Debug(fh.op(), "ReadFileHandle.skipForward failed: %v", err)
+			return false
+		}
+		fh.readAhead = nil
+	} else {
+		fh.readAhead = fh.readAhead[offset-fh.offset:]
+	}
+	fh.offset = offset
+	return true
+}
+
+// refresh finds the object again and reopens it at the end of the
+// data read so far keeping the read ahead buffer.
+//
+// This is used when the stream fails because its authorization has
+// expired, eg a signed URL has timed out, as finding the object again
+// fetches fresh authorization.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) refresh() error {
+	r, err := fh.refreshOpen(fh.offset + int64(len(fh.readAhead)))
+	if err != nil {
+		return err
+	}
+	err = fh.r.Close()
+	if err != nil {
+		fs.Debug(fh.op(), "ReadFileHandle.refresh close old failed: %v", err)
+	}
+	fh.r = r
+	return nil
+}
+
+// refreshOpen finds the object again and opens it at offset, which
+// fetches fresh authorization, eg a new download URL
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) refreshOpen(offset int64) (io.ReadCloser, error) {
+	f, ok := fh.o.Fs().(fs.Fs)
+	if !ok {
+		return nil, errors.New("can't refresh object as its Fs is unknown")
+	}
+	o, err := f.NewObject(fh.o.Remote())
+	if err != nil {
+		fs.Debug(fh.op(), "ReadFileHandle.refresh find failed: %v", err)
+		return nil, err
+	}
+	if do, ok := o.(fs.ETagger); ok && fh.etag != "" && do.ETag() != fh.etag {
+		return nil, fs.ErrorObjectChanged
+	}
+	r, err := o.Open(fh.openOptions(offset)...)
+	if err != nil {
+		fs.Debug(fh.op(), "ReadFileHandle.refresh open failed: %v", err)
+		return nil, err
+	}
+	fh.o = o
+	return r, nil
+}
+
+// checkLease finds the object again every --read-lease-interval and
+// returns errLeaseLost if its generation has changed since the handle
+// was opened.  Once lost the lease is never regained.
+//
+// Objects without a generation aren't checked.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) checkLease() error {
+	if fh.leaseLost {
+		return errLeaseLost
+	}
+	if fh.generation == 0 || time.Since(fh.leaseCheck) < readLeaseInterval {
+		return nil
+	}
+	f, ok := fh.o.Fs().(fs.Fs)
+	if !ok {
+		return nil
+	}
+	fh.leaseCheck = time.Now()
+	generation := int64(0)
+	o, err := f.NewObject(fh.o.Remote())
+	if err == nil {
+		if do, ok := o.(fs.Generationer); ok {
+			generation = do.Generation()
+		}
+	} else if err != fs.ErrorObjectNotFound {
+		fs.Debug(fh.op(), "ReadFileHandle.checkLease find failed: %v", err)
+		return nil
+	}
+	if generation != fh.generation {
+		fs.Debug(fh.op(), "ReadFileHandle.checkLease generation changed from %d to %d", fh.generation, generation)
+		fh.leaseLost = true
+		return errLeaseLost
+	}
+	return nil
+}
+
+// restatForTail finds the object again with --eof-restat if a read at
+// off of size bytes goes past its end, as happens when tailing a file,
+// and if it has grown reopens it so the read gets the new data.
+//
+// The object is only used if its ETag is unchanged, otherwise it has
+// been replaced rather than appended to and fs.ErrorObjectChanged is
+// returned, as it is if it has shrunk.
+//
+// With --eof-restat-interval the object is found again at most that
+// often so polling the end of a file doesn't hit the remote each time.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) restatForTail(off int64, size int) error {
+	if !eofRestat || off+int64(size) <= fh.o.Size() {
+		return nil
+	}
+	if encoded, _ := contentEncoded(fh.o); encoded {
+		// reads past Size are expected as the data is decoded
+		return nil
+	}
+	if eofRestatInterval > 0 && time.Since(fh.restated) < eofRestatInterval {
+		return nil
+	}
+	fh.restated = time.Now()
+	f, ok := fh.o.Fs().(fs.Fs)
+	if !ok {
+		return nil
+	}
+	o, err := f.NewObject(fh.o.Remote())
+	if err != nil {
+		fs.Debug(fh.op(), "ReadFileHandle.restatForTail find failed: %v", err)
+		return nil
+	}
+	etag := ""
+	if do, ok := o.(fs.ETagger); ok {
+		etag = do.ETag()
+	}
+	if etag != fh.etag {
+		fs.Debug(fh.op(), "ReadFileHandle.restatForTail ETag changed from %q to %q", fh.etag, etag)
+		return fs.ErrorObjectChanged
+	}
+	if o.Size() < fh.o.Size() {
+		fs.Debug(fh.op(), "ReadFileHandle.restatForTail shrunk from %d to %d bytes", fh.o.Size(), o.Size())
+		return fs.ErrorObjectChanged
+	}
+	if o.Size() == fh.o.Size() {
+		return nil
+	}
+	fs.Debug(fh.op(), "ReadFileHandle.restatForTail grown from %d to %d bytes", fh.o.Size(), o.Size())
+	fh.o = o
+	return fh.reopen()
+}
+
+// stopPrefetch cancels any prefetch in progress discarding its data
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) stopPrefetch() {
+	if fh.prefetch == nil {
+		return
+	}
+	fs.Debug(fh.op(), "ReadFileHandle.stopPrefetch cancelling prefetch")
+	fh.prefetch.stop()
+	fh.prefetch = nil
+}
+
+// collectPrefetch waits for the prefetch in progress to finish and
+// adds the data to the read ahead buffer.
+//
+// If the prefetch failed the stream is reopened at the end of the
+// data read.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) collectPrefetch() error {
+	data, err := fh.prefetch.wait()
+	fh.prefetch = nil
+	fh.readAhead = append(fh.readAhead, data...)
+	if err == nil || err == io.EOF {
+		return nil
+	}
+	fs.Debug(fh.op(), "ReadFileHandle.collectPrefetch failed: %v", err)
+	if fs.IsAuthExpiredError(err) {
+		return fh.refresh()
+	}
+	return fh.reopen()
+}
+
+// reopen the stream at the end of the data read so far keeping the
+// read ahead buffer.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) reopen() error {
+	readAhead := fh.readAhead
+	err := fh.seek(fh.offset + int64(len(readAhead)))
+	if err != nil {
+		return err
+	}
+	fh.offset -= int64(len(readAhead))
+	fh.readAhead = readAhead
+	return nil
+}
+
+// shouldRetry returns whether a read which failed with err should be
+// retried for the try-th time.
+//
+// Reads are retried up to --low-level-retries times for each read,
+// and no more than --handle-retry-budget times over the life of the
+// handle if set.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) shouldRetry(err error, try int) bool {
+	if err == nil || err == io.EOF || err == fs.ErrorObjectChanged || fs.IsAuthExpiredError(err) {
+		return false
+	}
+	if handleRetryBudget > 0 && fh.retries >= handleRetryBudget {
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Read retry budget of %d exhausted", handleRetryBudget)
+		fh.exhausted = true
+		return false
+	}
+	return try <= fs.Config.LowLevelRetries
+}
+
+// readBuffered fills buf using the read ahead buffer first then
+// reading from fh.r.  If more data is needed from fh.r it reads at
+// least minReadSize bytes keeping the excess in the read ahead
+// buffer.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) readBuffered(buf []byte) (n int, err error) {
+	n = copy(buf, fh.readAhead)
+	fh.readAhead = fh.readAhead[n:]
+	if n == len(buf) {
+		return n, nil
+	}
+	want := len(buf) - n
+	if want < int(minReadSize) {
+		want = int(minReadSize)
+	}
+	chunk := make([]byte, want)
+	m, err := io.ReadFull(fh.r, chunk)
+	fh.limit(m)
+	chunk = chunk[:m]
+	copied := copy(buf[n:], chunk)
+	n += copied
+	fh.readAhead = chunk[copied:]
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	return n, err
+}
+
+// readAt fills buf with data from offset off seeking if necessary
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) readAt(buf []byte, off int64) (n int, err error) {
+	if fh.prefetch != nil {
+		// use the prefetch if the read needs the data it is
+		// fetching, otherwise the seek below cancels it
+		buffered := fh.offset + int64(len(fh.readAhead))
+		end := buffered + int64(prefetchSize)
+		if size := int64(fh.prefetch.size); buffered+size > end {
+			end = buffered + size
+		}
+		if off >= fh.offset && off < end && off+int64(len(buf)) > buffered {
+			fh.adaptPrefetch(!fh.prefetch.finished())
+			err = fh.collectPrefetch()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if off > fh.offset && off <= fh.offset+int64(len(fh.readAhead)) {
+		// skip forward through the read ahead buffer
+		fh.readAhead = fh.readAhead[off-fh.offset:]
+		fh.offset = off
+	}
+	if off != fh.offset && !fh.skipForward(off) {
+		// the reads aren't sequential so start the prefetch
+		// small again
+		fh.window = 0
+		err = fh.seek(off)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = fh.readBuffered(buf)
+	fh.offset += int64(n)
+	if fs.IsAuthExpiredError(err) {
+		// carry on from where the stream stopped with fresh
+		// authorization
+		fs.Debug(fh.op(), "ReadFileHandle.Read refreshing after: %v", err)
+		err = fh.refresh()
+		if err != nil {
+			return n, err
+		}
+		var m int
+		m, err = fh.readBuffered(buf[n:])
+		fh.offset += int64(m)
+		n += m
+	}
+	for try := 1; fh.shouldRetry(err, try); try++ {
+		// carry on from where the stream stopped with a new
+		// stream
+		fs.Debug(fh.op(), "ReadFileHandle.Read retrying (%d/%d) after: %v", try, fs.Config.LowLevelRetries, err)
+		fh.retries++
+		err = fh.reopen()
+		if err != nil {
+			continue
+		}
+		var m int
+		m, err = fh.readBuffered(buf[n:])
+		fh.offset += int64(m)
+		n += m
+	}
+	if fh.exhausted {
+		return n, errRetryBudgetExhausted
+	}
+	if window := fh.prefetchWindow(); err == nil && fh.prefetch == nil && len(fh.readAhead) < window {
+		// top up the read ahead buffer in the background
+		fh.prefetch = newPrefetcher(fh.r, window-len(fh.readAhead), fh.limit)
+	}
+	return n, err
+}
+
+// prefetchWindow returns the number of bytes to keep read ahead
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) prefetchWindow() int {
+	if fh.window == 0 {
+		return int(prefetchSize)
+	}
+	return fh.window
+}
+
+// adaptPrefetch doubles the prefetch up to --prefetch-max if the
+// read had to wait for it as the remote isn't being read from fast
+// enough to keep up with sequential reads.  The window goes back to
+// --prefetch-size when the file is seeked.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) adaptPrefetch(waited bool) {
+	if !waited || prefetchMax <= prefetchSize {
+		return
+	}
+	window := 2 * fh.prefetchWindow()
+	if window > int(prefetchMax) {
+		window = int(prefetchMax)
+	}
+	if window != fh.prefetchWindow() {
+		fs.Debug(fh.op(), "ReadFileHandle.Read growing prefetch to %d bytes", window)
+		fh.window = window
+	}
+}
+
+// readCached fills buf with data from offset off using the read
+// cache, reading whole blocks from the remote into the cache if they
+// aren't found.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) readCached(buf []byte, off int64) (n int, err error) {
+	id := cacheID(fh.o)
+	for n < len(buf) {
+		pos := off + int64(n)
+		key := cacheKey{id: id, block: pos / readCacheBlockSize}
+		start := key.block * readCacheBlockSize
+		data, hit := readCache.get(key)
+		if !hit && fh.sharedID != "" {
+			blockID := fmt.Sprintf("%s:%d", fh.sharedID, key.block)
+			if sharedCache != nil {
+				data, hit = sharedCache.get(blockID)
+			}
+			if !hit && diskCache != nil {
+				data, hit = diskCache.get(blockID)
+			}
+			if hit {
+				readCache.put(key, data)
+			}
+		}
+		if !hit {
+			data = make([]byte, readCacheBlockSize)
+			var m int
+			m, err = fh.readAt(data, start)
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+			data = data[:m]
+			readCache.put(key, data)
+			if fh.sharedID != "" {
+				blockID := fmt.Sprintf("%s:%d", fh.sharedID, key.block)
+				if sharedCache != nil {
+					sharedCache.put(blockID, data)
+				}
+				if diskCache != nil {
+					diskCache.put(blockID, data)
+				}
+			}
+			fs.Stats.CacheMiss(int64(m))
+		}
+		if pos-start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		m := copy(buf[n:], data[pos-start:])
+		n += m
+		if hit {
+			fs.Stats.CacheHit(int64(m))
+		}
+	}
+	return n, nil
+}
+
+// hashRead adds data read at off to the hash if it carries on from
+// the data hashed so far, so reading the file in order, even with
+// seeks or overlapping reads, still hashes the whole file.  If there
+// is a gap the hash can't be computed so it is abandoned.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) hashRead(data []byte, off int64) {
+	if fh.hash == nil {
+		return
+	}
+	end := off + int64(len(data))
+	switch {
+	case off > fh.hashed:
+		fs.Debug(fh.op(), "ReadFileHandle.Read not checking hash after gap from %d to %d", fh.hashed, off)
+		fh.hash = nil
+	case end > fh.hashed:
+		_, _ = fh.hash.Write(data[fh.hashed-off:])
+		fh.hashed = end
+	}
+}
+
+// Values for --on-unknown-hash
+const (
+	// onUnknownHashSkip doesn't check the data
+	onUnknownHashSkip = "skip"
+
+	// onUnknownHashWarn logs that the data wasn't checked
+	onUnknownHashWarn = "warn"
+
+	// onUnknownHashFail returns an error
+	onUnknownHashFail = "fail"
+)
+
+// checkHash returns an error if the whole object has been hashed and
+// the hash doesn't match the one the remote has for it
+//
+// If the remote doesn't know the hash then --on-unknown-hash says
+// what to do.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) checkHash() error {
+	if fh.hash == nil || fh.hashed != fh.o.Size() {
+		return nil
+	}
+	for hashType, sum := range fh.hash.Sums() {
+		remoteSum, err := objectHash(fh.o, hashType)
+		if err != nil || remoteSum == "" {
+			switch onUnknownHash {
+			case onUnknownHashWarn:
+				fs.Log(fh.op(), "ReadFileHandle %v hash unknown so data not checked", hashType)
+			case onUnknownHashFail:
+				return errors.Errorf("can't check data: remote doesn't know the %v hash", hashType)
+			}
+			continue
+		}
+		if remoteSum != sum {
+			return errors.Errorf("corrupted on transfer: %v hash differ %q vs %q", hashType, shownHash(remoteSum), shownHash(sum))
+		}
+		fs.Debug(fh.op(), "ReadFileHandle %v hash OK", hashType)
+	}
+	return nil
+}
+
+// verifyAtEOF checks the hash as soon as the whole object has been
+// read with --verify-on-eof rather than waiting for the handle to be
+// closed, returning EIO if it doesn't match.  The hash is only checked
+// once.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) verifyAtEOF() error {
+	if fh.hash == nil || fh.hashed != fh.o.Size() {
+		return nil
+	}
+	err := fh.checkHash()
+	fh.hash = nil
+	if err != nil {
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Read %v", err)
+		logErrorEvent("hash", fh.o.Remote(), err, fh.retries)
+		return fuse.Errno(syscall.EIO)
+	}
 	return nil
 }
 
+// atEOF returns whether a read at off is at or past the end of the
+// object so there is nothing to read.  This is the common case when
+// a file is polled for new data.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) atEOF(off int64) bool {
+	if off < fh.o.Size() {
+		return false
+	}
+	encoded, _ := contentEncoded(fh.o)
+	return !encoded
+}
+
+// zeroFill returns the length of a read of size bytes at off which
+// failed with err after n bytes with --read-errors-as-zeros, so the
+// rest of the read up to the end of the object is returned as the
+// zeros already in the buffer rather than failing.
+//
+// The hash of the data can't be checked after this.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) zeroFill(off int64, size int, n int, err error) int {
+	end := off + int64(size)
+	if objectSize := fh.o.Size(); end > objectSize {
+		end = objectSize
+	}
+	if end <= off+int64(n) {
+		return n
+	}
+	fs.ErrorLog(fh.op(), "ReadFileHandle.Read returning zeros for unreadable bytes %d-%d: %v", off+int64(n), end, err)
+	fh.hash = nil
+	return int(end - off)
+}
+
 // Read from the file handle
 func (fh *ReadFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
-	fs.Debug(fh.o, "ReadFileHandle.Read size %d offset %d", req.Size, req.Offset)
+	defer fh.startOp()()
+	fs.Debug(fh.op(), "ReadFileHandle.Read size %d offset %d", req.Size, req.Offset)
 	if fh.closed {
-		fs.ErrorLog(fh.o, "ReadFileHandle.Read error: %v", errClosedFileHandle)
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Read error: %v", errClosedFileHandle)
 		return errClosedFileHandle
 	}
-	if req.Offset != fh.offset {
-		err := fh.seek(req.Offset)
-		if err != nil {
-			return err
-		}
+	if fh.exhausted {
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Read error: retry budget exhausted")
+		return errRetryBudgetExhausted
+	}
+	if err := fh.checkLease(); err != nil {
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Read error: %v", err)
+		return err
 	}
 	if req.Size > 0 {
 		fh.readCalled = true
@@ -91,16 +854,50 @@ func (fh *ReadFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp
 	// page cache page; a read into page cache is always page aligned.
 	// Make sure we never serve a partial read, to avoid that.
 	buf := make([]byte, req.Size)
-	n, err := io.ReadFull(fh.r, buf)
-	if err == io.ErrUnexpectedEOF || err == io.EOF {
+	var n int
+	var err error
+	if fh.download == nil {
+		err = fh.restatForTail(req.Offset, req.Size)
+		if err != nil {
+			fs.ErrorLog(fh.op(), "ReadFileHandle.Read error: %v", err)
+			return err
+		}
+		if fh.atEOF(req.Offset) {
+			// return nothing without seeking the stream to the end
+			resp.Data = nil
+			fs.Debug(fh.op(), "ReadFileHandle.Read OK at EOF")
+			return nil
+		}
+	}
+	if fh.download != nil {
+		n, err = fh.download.ReadAt(buf, req.Offset)
+	} else if readCache != nil {
+		n, err = fh.readCached(buf, req.Offset)
+	} else {
+		n, err = fh.readAt(buf, req.Offset)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil && readErrorsAsZeros {
+		n = fh.zeroFill(req.Offset, len(buf), n, err)
 		err = nil
 	}
 	resp.Data = buf[:n]
-	fh.offset += int64(n)
+	atomic.StoreInt64(&fh.position, req.Offset+int64(n))
+	fh.hashRead(resp.Data, req.Offset)
+	atomic.AddInt64(&bytesRead, int64(n))
+	if err == nil && verifyOnEOF {
+		err = fh.verifyAtEOF()
+		if err != nil {
+			resp.Data = nil
+		}
+	}
 	if err != nil {
-		fs.ErrorLog(fh.o, "ReadFileHandle.Read error: %v", err)
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Read error: %v", err)
+		logErrorEvent("read", fh.o.Remote(), err, fh.retries)
 	} else {
-		fs.Debug(fh.o, "ReadFileHandle.Read OK")
+		fs.Debug(fh.op(), "ReadFileHandle.Read OK")
 	}
 	return err
 }
@@ -114,7 +911,65 @@ func (fh *ReadFileHandle) close() error {
 		return errClosedFileHandle
 	}
 	fh.closed = true
-	return fh.r.Close()
+	atomic.AddInt64(&openHandles, -1)
+	if fh.file != nil {
+		fh.file.delReader(fh)
+	}
+	if fh.objLimiter != nil {
+		releaseObjectLimiter(fh.o.Remote())
+	}
+	if fh.openDir != nil {
+		fh.openDir.releaseOpen()
+	}
+	var err error
+	if fh.download != nil {
+		err = fh.download.close()
+	} else if !fh.keepWarm() {
+		fh.stopPrefetch()
+		err = fh.r.Close()
+	}
+	hashErr := fh.checkHash()
+	if hashErr != nil {
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Release %v", hashErr)
+		logErrorEvent("hash", fh.o.Remote(), hashErr, fh.retries)
+		if err == nil {
+			err = hashErr
+		}
+	}
+	return err
+}
+
+// keepWarm puts the stream into the warm stream pool with
+// --warm-stream-timeout so a handle opened soon after can carry on
+// reading it, returning whether it did.
+//
+// Streams with a prefetch still running aren't kept as where they are
+// up to isn't known until it finishes.
+//
+// Must be called with fh.mu held
+func (fh *ReadFileHandle) keepWarm() bool {
+	if warmStreamTimeout <= 0 || fh.exhausted {
+		return false
+	}
+	if fh.prefetch != nil {
+		select {
+		case <-fh.prefetch.done:
+		default:
+			return false
+		}
+		data, err := fh.prefetch.wait()
+		fh.prefetch = nil
+		if err != nil && err != io.EOF {
+			return false
+		}
+		fh.readAhead = append(fh.readAhead, data...)
+	}
+	putWarmStream(fh.o, &warmStream{
+		r:         fh.r,
+		offset:    fh.offset,
+		readAhead: fh.readAhead,
+	})
+	return true
 }
 
 // Check interface satisfied
@@ -126,7 +981,8 @@ var _ fusefs.HandleFlusher = (*ReadFileHandle)(nil)
 func (fh *ReadFileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
-	fs.Debug(fh.o, "ReadFileHandle.Flush")
+	defer fh.startOp()()
+	fs.Debug(fh.op(), "ReadFileHandle.Flush")
 
 	// Ignore the Flush as there is nothing we can sensibly do and
 	// it seems quite common for Flush to be called from
@@ -135,17 +991,17 @@ func (fh *ReadFileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) err
 		// If Read hasn't been called then ignore the Flush - Release
 		// will pick it up
 		if !fh.readCalled {
-			fs.Debug(fh.o, "ReadFileHandle.Flush ignoring flush on unread handle")
+			fs.Debug(fh.op(), "ReadFileHandle.Flush ignoring flush on unread handle")
 			return nil
 
 		}
 		err := fh.close()
 		if err != nil {
-			fs.ErrorLog(fh.o, "ReadFileHandle.Flush error: %v", err)
+			fs.ErrorLog(fh.op(), "ReadFileHandle.Flush error: %v", err)
 			return err
 		}
 	}
-	fs.Debug(fh.o, "ReadFileHandle.Flush OK")
+	fs.Debug(fh.op(), "ReadFileHandle.Flush OK")
 	return nil
 }
 
@@ -158,16 +1014,17 @@ var _ fusefs.HandleReleaser = (*ReadFileHandle)(nil)
 func (fh *ReadFileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
+	defer fh.startOp()()
 	if fh.closed {
-		fs.Debug(fh.o, "ReadFileHandle.Release nothing to do")
+		fs.Debug(fh.op(), "ReadFileHandle.Release nothing to do")
 		return nil
 	}
-	fs.Debug(fh.o, "ReadFileHandle.Release closing")
+	fs.Debug(fh.op(), "ReadFileHandle.Release closing")
 	err := fh.close()
 	if err != nil {
-		fs.ErrorLog(fh.o, "ReadFileHandle.Release error: %v", err)
+		fs.ErrorLog(fh.op(), "ReadFileHandle.Release error: %v", err)
 	} else {
-		fs.Debug(fh.o, "ReadFileHandle.Release OK")
+		fs.Debug(fh.op(), "ReadFileHandle.Release OK")
 	}
 	return err
 }
@@ -3,13 +3,26 @@
 package mount
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"regexp"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 // Read by byte including don't read any bytes
@@ -109,3 +122,1226 @@ func TestReadSeek(t *testing.T) {
 
 	run.rm(t, "testfile")
 }
+
+// readSmall reads the whole of o in reads of size bytes returning
+// the data read
+func readSmall(t testing.TB, o *mockObject, size int) []byte {
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	var out []byte
+	for {
+		req := &fuse.ReadRequest{Offset: int64(len(out)), Size: size}
+		resp := &fuse.ReadResponse{}
+		require.NoError(t, fh.Read(context.Background(), req, resp))
+		if len(resp.Data) == 0 {
+			break
+		}
+		out = append(out, resp.Data...)
+	}
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	return out
+}
+
+// Test --min-read-size coalesces small reads
+func TestReadMinReadSize(t *testing.T) {
+	defer func(old fs.SizeSuffix) { minReadSize = old }(minReadSize)
+	f := newMockFs()
+	contents := strings.Repeat("0123456789", 100)
+
+	minReadSize = 0
+	o := f.add("small", contents)
+	assert.Equal(t, contents, string(readSmall(t, o, 10)))
+	assert.Equal(t, 1, o.opens)
+	plainReads := o.reads
+
+	minReadSize = 256
+	o = f.add("small", contents)
+	assert.Equal(t, contents, string(readSmall(t, o, 10)))
+	assert.Equal(t, 1, o.opens)
+	assert.True(t, o.reads < plainReads/10, "expecting %d < %d/10 reads", o.reads, plainReads)
+}
+
+func benchmarkReadSmall(b *testing.B, size fs.SizeSuffix) {
+	defer func(old fs.SizeSuffix) { minReadSize = old }(minReadSize)
+	minReadSize = size
+	o := newMockFs().add("small", strings.Repeat("0123456789", 10000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readSmall(b, o, 16)
+	}
+	b.StopTimer()
+	b.Logf("%d opens, %d reads from the remote", o.opens, o.reads)
+}
+
+// Benchmark small reads without --min-read-size
+func BenchmarkReadSmall(b *testing.B) {
+	benchmarkReadSmall(b, 0)
+}
+
+// Benchmark small reads with --min-read-size 64k
+func BenchmarkReadSmallMinReadSize(b *testing.B) {
+	benchmarkReadSmall(b, 64*1024)
+}
+
+// Benchmark polling the end of a file for new data as tail -f does
+func BenchmarkReadPollAtEOF(b *testing.B) {
+	defer func(old time.Duration) { eofRestatInterval = old }(eofRestatInterval)
+	eofRestatInterval = time.Second
+	o := newMockFs().add("log", "0123456789")
+	fh, err := newReadFileHandle(o)
+	require.NoError(b, err)
+	readString(b, fh, 0, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readString(b, fh, 10, 4096)
+	}
+	b.StopTimer()
+	require.NoError(b, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	b.Logf("%d opens, %d reads from the remote", o.opens, o.reads)
+}
+
+// readString reads size bytes at offset from fh
+func readString(t testing.TB, fh *ReadFileHandle, offset int64, size int) string {
+	req := &fuse.ReadRequest{Offset: offset, Size: size}
+	resp := &fuse.ReadResponse{}
+	require.NoError(t, fh.Read(context.Background(), req, resp))
+	return string(resp.Data)
+}
+
+// Test the read cache records a miss then a hit
+func TestReadCacheStats(t *testing.T) {
+	defer func(old *blockCache) { readCache = old }(readCache)
+	readCache = newBlockCache(16 * 1024 * 1024)
+	fs.Stats.ResetCounters()
+	o := newMockFs().add("file", "hello world")
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "world", readString(t, fh, 6, 5))
+	hits, misses, cacheBytes, remoteBytes := fs.Stats.GetCacheStats()
+	assert.Equal(t, []int64{0, 1, 0, 11}, []int64{hits, misses, cacheBytes, remoteBytes})
+
+	assert.Equal(t, "world", readString(t, fh, 6, 5))
+	hits, misses, cacheBytes, remoteBytes = fs.Stats.GetCacheStats()
+	assert.Equal(t, []int64{1, 1, 5, 11}, []int64{hits, misses, cacheBytes, remoteBytes})
+	assert.Equal(t, 1, o.opens)
+
+	stats, err := json.Marshal(fs.Stats)
+	require.NoError(t, err)
+	assert.Contains(t, string(stats), `"cacheHits":1`)
+
+	fs.Stats.ResetCounters()
+	hits, misses, _, _ = fs.Stats.GetCacheStats()
+	assert.Equal(t, []int64{0, 0}, []int64{hits, misses})
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --immutable sets OpenKeepCache and refuses modification
+func TestReadImmutableKeepCache(t *testing.T) {
+	defer func(old bool) { immutable = old }(immutable)
+	f, d := mockDir()
+	f.add("file", "hello")
+	item, err := d.lookupNode("file")
+	require.NoError(t, err)
+	file := item.node.(*File)
+
+	resp := &fuse.OpenResponse{}
+	_, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, resp)
+	require.NoError(t, err)
+	assert.Equal(t, fuse.OpenResponseFlags(0), resp.Flags&fuse.OpenKeepCache)
+
+	immutable = true
+	resp = &fuse.OpenResponse{}
+	_, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, resp)
+	require.NoError(t, err)
+	assert.Equal(t, fuse.OpenKeepCache, resp.Flags&fuse.OpenKeepCache)
+
+	_, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.EPERM, err)
+	for _, valid := range []fuse.SetattrValid{fuse.SetattrSize, fuse.SetattrMtime, fuse.SetattrMtimeNow} {
+		err = file.Setattr(context.Background(), &fuse.SetattrRequest{Valid: valid}, &fuse.SetattrResponse{})
+		assert.Equal(t, fuse.EPERM, err)
+	}
+	err = file.Setattr(context.Background(), &fuse.SetattrRequest{Valid: fuse.SetattrAtime, Atime: time.Now()}, &fuse.SetattrResponse{})
+	assert.NoError(t, err)
+
+	// files can't be replaced by renaming another over them
+	f.add("other", "new")
+	err = d.Rename(context.Background(), &fuse.RenameRequest{OldName: "other", NewName: "file"}, d)
+	assert.Equal(t, fuse.EPERM, err)
+	assert.Equal(t, "hello", string(f.objects["file"].contents))
+}
+
+// Test a backward seek cancels the prefetch in progress and restarts
+// it from the new offset
+func TestReadPrefetchCancelOnSeek(t *testing.T) {
+	defer func(old fs.SizeSuffix) { prefetchSize = old }(prefetchSize)
+	prefetchSize = 8 * prefetchChunkSize
+	data := make([]byte, 4*int(prefetchSize))
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	o := newMockFs().add("file", string(data))
+	o.readDelay = 10 * time.Millisecond
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[1000:1100]), readString(t, fh, 1000, 100))
+	p := fh.prefetch
+	require.NotNil(t, p)
+
+	// seek backwards while the prefetch is still running
+	assert.Equal(t, string(data[:100]), readString(t, fh, 0, 100))
+	_, err = p.wait()
+	assert.Equal(t, errPrefetchCancelled, err)
+	assert.True(t, len(p.data) < int(prefetchSize), "prefetched %d bytes", len(p.data))
+	assert.Equal(t, 3, o.opens)
+	require.NotNil(t, fh.prefetch)
+	assert.True(t, fh.prefetch != p, "prefetch not restarted")
+
+	// reading on uses the restarted prefetch without reopening
+	size := int(prefetchSize) / 2
+	assert.Equal(t, string(data[100:100+size]), readString(t, fh, 100, size))
+	assert.Equal(t, 3, o.opens)
+
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Nil(t, fh.prefetch)
+}
+
+// Test the prefetch grows with --prefetch-max while sequential reads
+// have to wait for it and goes back to --prefetch-size on a seek
+func TestReadPrefetchAdaptive(t *testing.T) {
+	defer func(old fs.SizeSuffix) { prefetchSize = old }(prefetchSize)
+	defer func(old fs.SizeSuffix) { prefetchMax = old }(prefetchMax)
+	prefetchSize = prefetchChunkSize
+	prefetchMax = 16 * prefetchChunkSize
+	data := make([]byte, 64*prefetchChunkSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	o := newMockFs().add("file", string(data))
+	o.readDelay = time.Millisecond
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, int(prefetchSize), fh.prefetchWindow())
+	size := prefetchChunkSize / 2
+	for off := 0; off < len(data)/2; off += size {
+		assert.Equal(t, string(data[off:off+size]), readString(t, fh, int64(off), size))
+	}
+	assert.Equal(t, int(prefetchMax), fh.prefetchWindow())
+	assert.Equal(t, 1, o.opens)
+
+	// a seek goes back to the smallest prefetch
+	assert.Equal(t, string(data[:size]), readString(t, fh, 0, size))
+	assert.Equal(t, int(prefetchSize), fh.prefetchWindow())
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test a read which fails with an auth expiry error part way through
+// refreshes the object and carries on
+func TestReadAuthExpiryRefresh(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	o := newMockFs().add("file", string(data))
+	o.expiry = 300 * 1024
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	var got []byte
+	for len(got) < len(data) {
+		got = append(got, readString(t, fh, int64(len(got)), 128*1024)...)
+	}
+	assert.Equal(t, data, got)
+	assert.Equal(t, 4, o.opens)
+
+	// opens failing with an auth expiry error find the object again
+	o.openErrs = []error{fs.AuthExpiredError(errors.New("download URL expired"))}
+	assert.Equal(t, string(data[100:200]), readString(t, fh, 100, 100))
+	assert.Equal(t, 6, o.opens)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test replacing the object part way through a read gives an error
+// rather than a mix of old and new data when it is reopened
+func TestReadObjectChanged(t *testing.T) {
+	o := newMockFs().add("file", "0123456789abcdef")
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", readString(t, fh, 0, 4))
+
+	src := fs.NewStaticObjectInfo("file", time.Now(), 16, true, nil, nil)
+	require.NoError(t, o.Update(strings.NewReader("ABCDEFGHIJKLMNOP"), src))
+
+	// carrying on with the open stream is fine
+	assert.Equal(t, "4567", readString(t, fh, 4, 4))
+
+	// but seeking reopens the object which has changed
+	resp := &fuse.ReadResponse{}
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 12, Size: 4}, resp)
+	assert.Equal(t, fs.ErrorObjectChanged, err)
+	assert.Empty(t, resp.Data)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test a high priority read gets tokens from the limiter before a low
+// priority one which was waiting first
+func TestReadPriorityLimiter(t *testing.T) {
+	l := newPriorityLimiter(1000000)
+	l.wait(150000, false) // put the limiter 50ms into debt
+
+	order := make(chan string, 2)
+	go func() {
+		l.wait(1000, false)
+		order <- "low"
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		l.wait(1000, true)
+		order <- "high"
+	}()
+	assert.Equal(t, "high", <-order)
+	assert.Equal(t, "low", <-order)
+}
+
+// Test --high-priority-paths marks the matching handles high priority
+func TestReadHighPriorityPaths(t *testing.T) {
+	defer func(old *fs.Filter) { highPriorityFilter = old }(highPriorityFilter)
+	var err error
+	highPriorityFilter, err = newHighPriorityFilter("/videos/**")
+	require.NoError(t, err)
+	f := newMockFs()
+	for _, test := range []struct {
+		remote string
+		high   bool
+	}{
+		{"videos/film.mkv", true},
+		{"videos/series/episode.mkv", true},
+		{"backup/videos/film.mkv", false},
+		{"file.txt", false},
+	} {
+		fh, err := newReadFileHandle(f.add(test.remote, "data"))
+		require.NoError(t, err)
+		assert.Equal(t, test.high, fh.high, test.remote)
+	}
+}
+
+// Test opening a file for read retries transient errors and returns
+// ENOENT if the file has gone
+func TestReadOpenRetries(t *testing.T) {
+	defer func(old time.Duration) { openRetrySleep = old }(openRetrySleep)
+	openRetrySleep = time.Millisecond
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	item, err := d.lookupNode("file")
+	require.NoError(t, err)
+	file := item.node.(*File)
+	open := func() (fusefs.Handle, error) {
+		return file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	}
+
+	o.openErrs = []error{errors.New("transient error")}
+	handle, err := open()
+	require.NoError(t, err)
+	assert.Equal(t, 2, o.opens)
+	assert.Equal(t, "hello", readString(t, handle.(*ReadFileHandle), 0, 5))
+	require.NoError(t, handle.(*ReadFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	o.openErrs = []error{fs.ErrorObjectNotFound, fs.ErrorObjectNotFound, fs.ErrorObjectNotFound, fs.ErrorObjectNotFound}
+	_, err = open()
+	assert.Equal(t, fuse.ENOENT, err)
+	assert.Equal(t, 2+1+openRetries, o.opens)
+	_, err = d.lookupNode("file")
+	assert.Equal(t, fuse.ENOENT, err)
+}
+
+// Test --handle-retry-budget limits the retries over the life of a
+// handle on a stream which always fails
+func TestReadHandleRetryBudget(t *testing.T) {
+	defer func(old int) { handleRetryBudget = old }(handleRetryBudget)
+	defer func(old int) { fs.Config.LowLevelRetries = old }(fs.Config.LowLevelRetries)
+	handleRetryBudget = 5
+	fs.Config.LowLevelRetries = 3
+	f, _ := mockDir()
+	o := f.add("file", "hello")
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	readErr := errors.New("connection reset")
+	o.readErr = readErr
+	read := func() error {
+		return fh.Read(context.Background(), &fuse.ReadRequest{Size: 5}, &fuse.ReadResponse{})
+	}
+
+	// the first read retries up to --low-level-retries times
+	assert.Equal(t, readErr, read())
+	assert.Equal(t, 1+3, o.opens)
+
+	// the second runs out of budget part way through
+	assert.Equal(t, errRetryBudgetExhausted, read())
+	assert.Equal(t, 1+5, o.opens)
+
+	// then reads fail straight away
+	o.readErr = nil
+	assert.Equal(t, errRetryBudgetExhausted, read())
+	assert.Equal(t, 1+5, o.opens)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --read-errors-as-zeros returns zeros for the parts of a file
+// which can't be read and the rest of the data around them
+func TestReadErrorsAsZeros(t *testing.T) {
+	defer func(old bool) { readErrorsAsZeros = old }(readErrorsAsZeros)
+	defer func(old int) { fs.Config.LowLevelRetries = old }(fs.Config.LowLevelRetries)
+	fs.Config.LowLevelRetries = 2
+	f, _ := mockDir()
+	o := f.add("file", "0123456789abcdefghij")
+	o.badFrom, o.badTo = 8, 12
+
+	// without the flag the read fails
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 4, Size: 8}, &fuse.ReadResponse{})
+	assert.Error(t, err)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	readErrorsAsZeros = true
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	var out []byte
+	for off := 0; off < 20; off += 4 {
+		out = append(out, readString(t, fh, int64(off), 4)...)
+	}
+	assert.Equal(t, "01234567\x00\x00\x00\x00cdefghij", string(out))
+	assert.Equal(t, "", readString(t, fh, 20, 4))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --assemble-parts shows parts with a manifest as a single file
+// which reads across the parts
+func TestReadAssembleParts(t *testing.T) {
+	defer func(old bool) { assembleParts = old }(assembleParts)
+	assembleParts = true
+	f, d := mockDir()
+	f.add("big.part0001", "0123")
+	f.add("big.part0002", "456789")
+	f.add("big.part0003", "abcdef")
+	f.add("big.manifest", "")
+	f.add("orphan.part0001", "no manifest")
+
+	assert.Equal(t, []string{"big", "orphan.part0001"}, listing(t, d))
+
+	item, err := d.lookupNode("big")
+	require.NoError(t, err)
+	file := item.node.(*File)
+	var a fuse.Attr
+	require.NoError(t, file.Attr(context.Background(), &a))
+	assert.Equal(t, uint64(16), a.Size)
+
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*ReadFileHandle)
+	assert.Equal(t, "0123456789abcdef", readString(t, fh, 0, 100))
+	for _, test := range []struct {
+		offset int64
+		size   int
+		want   string
+	}{
+		{0, 4, "0123"},
+		{3, 2, "34"},
+		{4, 6, "456789"},
+		{9, 3, "9ab"},
+		{2, 12, "23456789abcd"},
+		{15, 5, "f"},
+	} {
+		assert.Equal(t, test.want, readString(t, fh, test.offset, test.size), "offset %d size %d", test.offset, test.size)
+	}
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// it can't be written
+	_, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.EPERM, err)
+	_, _, err = d.Create(context.Background(), &fuse.CreateRequest{Name: "big"}, &fuse.CreateResponse{})
+	assert.Equal(t, fuse.EPERM, err)
+}
+
+// Test the hash is checked after reading a file in contiguous
+// segments and abandoned if there is a gap
+func TestReadHashContiguousSegments(t *testing.T) {
+	f, _ := mockDir()
+	o := f.add("file", "0123456789abcdef")
+	read := func(fh *ReadFileHandle, offset int64, size int) {
+		err := fh.Read(context.Background(), &fuse.ReadRequest{Offset: offset, Size: size}, &fuse.ReadResponse{})
+		require.NoError(t, err)
+	}
+
+	// contiguous and overlapping reads which seek are hashed
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	read(fh, 0, 4)
+	read(fh, 4, 4)
+	read(fh, 6, 6)
+	read(fh, 12, 4)
+	assert.NotNil(t, fh.hash)
+	assert.Equal(t, int64(16), fh.hashed)
+	assert.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// data which doesn't match the remote's hash is an error
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	read(fh, 0, 8)
+	o.contents = []byte("0123456789ABCDEF")
+	read(fh, 8, 8)
+	err = fh.Release(context.Background(), &fuse.ReleaseRequest{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "corrupted on transfer")
+
+	// a gap abandons the hash
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	read(fh, 0, 4)
+	read(fh, 8, 8)
+	assert.Nil(t, fh.hash)
+	assert.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --verify-on-eof fails the read reaching the end of a corrupted
+// file rather than waiting for it to be closed
+func TestReadVerifyOnEOF(t *testing.T) {
+	defer func(old bool) { verifyOnEOF = old }(verifyOnEOF)
+	verifyOnEOF = true
+	o := newMockFs().add("file", "0123456789abcdef")
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789abcdef", readString(t, fh, 0, 16))
+	assert.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "01234567", readString(t, fh, 0, 8))
+	o.contents = []byte("0123456789ABCDEF")
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 8, Size: 8}, &fuse.ReadResponse{})
+	assert.Equal(t, fuse.Errno(syscall.EIO), err)
+	// the corruption has been reported already
+	assert.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test two mounts sharing a cache with --shared-cache-socket read the
+// blocks the other has read from the cache
+func TestReadSharedCache(t *testing.T) {
+	defer func(old *blockCache) { readCache = old }(readCache)
+	defer func(old *sharedCacheClient) { sharedCache = old }(sharedCache)
+	dir, err := ioutil.TempDir("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	cache, err := newDiskBlockCache(dir+"/blocks", 16*1024*1024)
+	require.NoError(t, err)
+	socket := dir + "/cache.sock"
+	server, err := serveSharedCache(socket, cache)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, server.Close())
+	}()
+
+	// each mount has its own read cache and the same remote
+	mount := func() *mockObject {
+		readCache = newBlockCache(16 * 1024 * 1024)
+		sharedCache, err = startSharedCache(socket, cache)
+		require.NoError(t, err)
+		return newMockFs().add("file", "hello shared cache")
+	}
+	read := func(o *mockObject) string {
+		fh, err := newReadFileHandle(o)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+		}()
+		return readString(t, fh, 6, 6)
+	}
+
+	first := mount()
+	assert.Equal(t, "shared", read(first))
+	assert.NotEqual(t, 0, first.reads)
+
+	// wait for the block to be put in the shared cache
+	for i := 0; i < 100; i++ {
+		if size, _ := server.cache.usage(); size > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second := mount()
+	assert.Equal(t, "shared", read(second))
+	assert.Equal(t, 0, second.reads)
+
+	// blocks longer than the block size are refused
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte{sharedCachePut})
+	require.NoError(t, err)
+	require.NoError(t, writeSharedCacheData(conn, []byte("big")))
+	require.NoError(t, binary.Write(conn, binary.BigEndian, uint32(readCacheBlockSize+1)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "connection dropped")
+	require.NoError(t, conn.Close())
+	_, found := cache.get("big")
+	assert.False(t, found)
+}
+
+// Test a read interrupted by the mount stopping carries on from the
+// blocks kept in --read-cache-dir by the next mount
+func TestReadCacheDir(t *testing.T) {
+	defer func(old *blockCache) { readCache = old }(readCache)
+	defer func(old *diskBlockCache) { diskCache = old }(diskCache)
+	dir, err := ioutil.TempDir("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	data := make([]byte, 3*readCacheBlockSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// each mount has a new read cache and disk cache from dir
+	mount := func() *mockObject {
+		readCache = newBlockCache(16 * 1024 * 1024)
+		diskCache, err = newDiskBlockCache(dir, 16*1024*1024)
+		require.NoError(t, err)
+		return newMockFs().add("file", string(data))
+	}
+
+	// the first mount reads the first two blocks
+	first := mount()
+	fh, err := newReadFileHandle(first)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[:2*readCacheBlockSize]), readString(t, fh, 0, 2*readCacheBlockSize))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	size, _ := diskCache.usage()
+	assert.Equal(t, int64(2*readCacheBlockSize), size)
+
+	// the next mount only reads the rest from the remote
+	second := mount()
+	size, _ = diskCache.usage()
+	assert.Equal(t, int64(2*readCacheBlockSize), size)
+	fh, err = newReadFileHandle(second)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), readString(t, fh, 0, len(data)))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, len(data)-2*readCacheBlockSize, second.received)
+
+	// the least recently used blocks are removed to keep under
+	// the maximum size
+	diskCache, err = newDiskBlockCache(dir, 2*readCacheBlockSize)
+	require.NoError(t, err)
+	size, _ = diskCache.usage()
+	assert.True(t, size <= 2*readCacheBlockSize, size)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.True(t, len(files) < 4)
+
+	// remotes with slow hashes aren't hashed to name the blocks
+	f := newMockFs()
+	f.slowHash = true
+	o := f.add("file", string(data))
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[:100]), readString(t, fh, 0, 100))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, "", fh.sharedID)
+	assert.Equal(t, 0, o.hashes)
+}
+
+// Test reading the end of a file which grows between reads gets the
+// new data
+func TestReadTailGrowingFile(t *testing.T) {
+	defer func(old time.Duration) { eofRestatInterval = old }(eofRestatInterval)
+	defer func(old bool) { eofRestat = old }(eofRestat)
+	eofRestatInterval = 0
+	f, _ := mockDir()
+	o := f.add("log", "0123456789")
+
+	// the growth isn't seen without --eof-restat
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	f.add("log", "0123456789abcdef")
+	assert.Equal(t, "89", readString(t, fh, 8, 10))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// objects whose ETag changes have been replaced
+	eofRestat = true
+	o = f.add("log", "0123456789")
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	f.add("log", "0123456789abcdef")
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 8, Size: 10}, &fuse.ReadResponse{})
+	assert.Equal(t, fs.ErrorObjectChanged, err)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// objects without ETags are appended to
+	f.noHashes = true
+	o = f.add("log", "0123456789")
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "56789", readString(t, fh, 5, 5))
+
+	// the remote object is replaced by a longer one
+	f.add("log", "0123456789abcdef")
+	assert.Equal(t, "89abcdef", readString(t, fh, 8, 10))
+
+	f.add("log", "0123456789abcdefghij")
+	assert.Equal(t, "ghij", readString(t, fh, 16, 10))
+
+	// but not a shorter one
+	f.add("log", "0123")
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 20, Size: 10}, &fuse.ReadResponse{})
+	assert.Equal(t, fs.ErrorObjectChanged, err)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test reads at the end of a file return nothing without reopening it
+// and --eof-restat-interval throttles finding it again
+func TestReadPollAtEOF(t *testing.T) {
+	defer func(old time.Duration) { eofRestatInterval = old }(eofRestatInterval)
+	defer func(old bool) { eofRestat = old }(eofRestat)
+	eofRestatInterval = time.Hour
+	eofRestat = true
+	f, _ := mockDir()
+	f.noHashes = true
+	o := f.add("log", "0123456789")
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", readString(t, fh, 0, 10))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "", readString(t, fh, 10, 10))
+	}
+	assert.Equal(t, 1, o.opens)
+
+	// the growth isn't seen until the interval has passed
+	f.add("log", "0123456789abcdef")
+	assert.Equal(t, "", readString(t, fh, 10, 10))
+	fh.restated = time.Time{}
+	assert.Equal(t, "abcdef", readString(t, fh, 10, 10))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --read-lease-interval fails reads once the object has changed
+// generation
+func TestReadLease(t *testing.T) {
+	defer func(old time.Duration) { readLeaseInterval = old }(readLeaseInterval)
+	readLeaseInterval = time.Hour
+	f, _ := mockDir()
+	o := f.add("file", "0123456789")
+	o.gen = 1
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, "01234", readString(t, fh, 0, 5))
+
+	// the change isn't seen until the lease is checked
+	o.mu.Lock()
+	o.gen = 2
+	o.mu.Unlock()
+	assert.Equal(t, "56", readString(t, fh, 5, 2))
+	fh.leaseCheck = time.Time{}
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 7, Size: 3}, &fuse.ReadResponse{})
+	assert.Equal(t, errLeaseLost, err)
+
+	// and the lease isn't regained
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 7, Size: 3}, &fuse.ReadResponse{})
+	assert.Equal(t, errLeaseLost, err)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// objects without a generation aren't checked
+	o.gen = 0
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	fh.leaseCheck = time.Time{}
+	assert.Equal(t, "0123456789", readString(t, fh, 0, 10))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --seek-skip-size reads through short forward seeks rather than
+// reopening on a remote which can't open part way through
+func TestReadSeekSkipSize(t *testing.T) {
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	// read 1k every 4k through the file returning the bytes
+	// received from the remote and the number of opens
+	skipRead := func(skip fs.SizeSuffix) (int, int) {
+		defer func(old fs.SizeSuffix) { seekSkipSize = old }(seekSkipSize)
+		seekSkipSize = skip
+		o := newMockFs().add("file", string(data))
+		o.noRange = true
+		fh, err := newReadFileHandle(o)
+		require.NoError(t, err)
+		for off := 0; off < len(data); off += 4096 {
+			assert.Equal(t, string(data[off:off+1024]), readString(t, fh, int64(off), 1024))
+		}
+		require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+		return o.received, o.opens
+	}
+
+	received, opens := skipRead(0)
+	assert.Equal(t, 64, opens)
+	assert.True(t, received > 16*len(data), "received %d bytes", received)
+
+	received, opens = skipRead(4096)
+	assert.Equal(t, 1, opens)
+	assert.True(t, received <= len(data), "received %d bytes", received)
+}
+
+// Test --warm-stream-timeout lets a handle opened just after one is
+// closed carry on with its stream and closes unused streams
+func TestReadWarmStream(t *testing.T) {
+	defer func(old time.Duration) { warmStreamTimeout = old }(warmStreamTimeout)
+	warmStreamTimeout = 100 * time.Millisecond
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	o := newMockFs().add("file", string(data))
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[:1000]), readString(t, fh, 0, 1000))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, 0, o.closes)
+
+	// reopening carries on with the warm stream
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[1000:2000]), readString(t, fh, 1000, 1000))
+	assert.Equal(t, 1, o.opens)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// the stream is closed if it isn't reused in time
+	time.Sleep(2 * warmStreamTimeout)
+	o.mu.Lock()
+	assert.Equal(t, 1, o.closes)
+	o.mu.Unlock()
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[2000:3000]), readString(t, fh, 2000, 1000))
+	assert.Equal(t, 3, o.opens)
+	warmStreamTimeout = 0
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --per-object-read-limit paces the reads of each object
+// independently
+func TestReadPerObjectReadLimit(t *testing.T) {
+	defer func(old fs.SizeSuffix) { perObjectReadLimit = old }(perObjectReadLimit)
+	perObjectReadLimit = 100000
+	data := strings.Repeat("x", 50000)
+	f := newMockFs()
+	a := f.add("a", data)
+	b := f.add("b", data)
+	open := func(o *mockObject) *ReadFileHandle {
+		fh, err := newReadFileHandle(o)
+		require.NoError(t, err)
+		return fh
+	}
+	// read the object in 10k chunks returning how long it took
+	read := func(fh *ReadFileHandle) time.Duration {
+		start := time.Now()
+		for off := 0; off < len(data); off += 10000 {
+			assert.Equal(t, data[off:off+10000], readString(t, fh, int64(off), 10000))
+		}
+		return time.Since(start)
+	}
+
+	fhA, fhA2, fhB := open(a), open(a), open(b)
+	assert.True(t, fhA.objLimiter == fhA2.objLimiter, "handles of the same object don't share a limiter")
+	assert.True(t, fhA.objLimiter != fhB.objLimiter, "handles of different objects share a limiter")
+	start := time.Now()
+	done := make(chan time.Duration)
+	go func() { done <- read(fhB) }()
+	tookA := read(fhA)
+	tookB := <-done
+	// each takes at least 300ms at 100k/s after the 10k burst but
+	// they don't slow each other down
+	assert.True(t, tookA >= 250*time.Millisecond, "a took %v", tookA)
+	assert.True(t, tookB >= 250*time.Millisecond, "b took %v", tookB)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "took %v", time.Since(start))
+	for _, fh := range []*ReadFileHandle{fhA, fhA2, fhB} {
+		require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	}
+	assert.Empty(t, objectLimiters.limiters)
+
+	// objects aren't limited without the flag
+	perObjectReadLimit = 0
+	fhA = open(a)
+	assert.Nil(t, fhA.objLimiter)
+	took := read(fhA)
+	assert.True(t, took < 100*time.Millisecond, "unlimited read took %v", took)
+	require.NoError(t, fhA.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --multi-thread-streams reads large files sequentially with
+// several ranged streams and falls back to one after a seek
+func TestReadMultiThreadStreams(t *testing.T) {
+	defer func(old int) { multiThreadStreams = old }(multiThreadStreams)
+	defer func(old fs.SizeSuffix) { multiThreadCutoff = old }(multiThreadCutoff)
+	defer func(old int64) { multiThreadChunkSize = old }(multiThreadChunkSize)
+	multiThreadStreams = 4
+	multiThreadCutoff = 16 * 1024
+	multiThreadChunkSize = 4 * 1024
+	data := make([]byte, 40*1024+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	f := newMockFs()
+	o := f.add("file", string(data))
+	o.readDelay = time.Millisecond
+	o.noRanges = true
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	var got []byte
+	for len(got) < len(data) {
+		got = append(got, readString(t, fh, int64(len(got)), 10000)...)
+	}
+	assert.Equal(t, data, got)
+	assert.Equal(t, 11, o.opens)
+
+	// seeking backwards reopens with a single stream
+	assert.Equal(t, string(data[100:200]), readString(t, fh, 100, 100))
+	assert.Equal(t, 12, o.opens)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// releasing the handle stops the chunks being read
+	o.readDelay = 20 * time.Millisecond
+	o.opens, o.closes, o.received = 0, 0, 0
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[:100]), readString(t, fh, 0, 100))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	for i := 0; i < 100; i++ {
+		o.mu.Lock()
+		closed := o.closes == o.opens
+		o.mu.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.mu.Lock()
+	assert.Equal(t, o.opens, o.closes)
+	assert.True(t, o.received < 5*4*1024, "read %d bytes after release", o.received)
+	o.mu.Unlock()
+
+	// small files use a single stream
+	small := f.add("small", string(data[:1000]))
+	fh, err = newReadFileHandle(small)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[:1000]), readString(t, fh, 0, 2000))
+	assert.Equal(t, 1, small.opens)
+	assert.Equal(t, 0, small.ranges)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --readahead-on-open starts reading the start of the file when
+// it is opened and cancels it if the first read is elsewhere
+func TestReadReadaheadOnOpen(t *testing.T) {
+	defer func(old fs.SizeSuffix) { readaheadOnOpen = old }(readaheadOnOpen)
+	readaheadOnOpen = 4 * prefetchChunkSize
+	data := make([]byte, 64*prefetchChunkSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	o := newMockFs().add("file", string(data))
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	p := fh.prefetch
+	require.NotNil(t, p, "prefetch not started on open")
+	_, err = p.wait()
+	assert.NoError(t, err)
+	assert.Equal(t, int(readaheadOnOpen), o.received)
+
+	// the first reads are served from the prefetch
+	reads := o.reads
+	assert.Equal(t, string(data[:100]), readString(t, fh, 0, 100))
+	assert.Equal(t, string(data[100:10000]), readString(t, fh, 100, 9900))
+	assert.Equal(t, reads, o.reads)
+	assert.Equal(t, 1, o.opens)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// a first read far away cancels the prefetch
+	o.readDelay = 10 * time.Millisecond
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	p = fh.prefetch
+	require.NotNil(t, p)
+	assert.Equal(t, string(data[len(data)-100:]), readString(t, fh, int64(len(data)-100), 100))
+	_, err = p.wait()
+	assert.Equal(t, errPrefetchCancelled, err)
+	assert.Equal(t, 3, o.opens)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// nothing is prefetched without the flag
+	readaheadOnOpen = 0
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Nil(t, fh.prefetch)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test the --bwlimit-schedule sets the rate of the read limiter at
+// each transition
+func TestReadBwLimitSchedule(t *testing.T) {
+	defer func(old func() time.Time) { bwScheduleNow = old }(bwScheduleNow)
+	now := time.Date(2017, 1, 2, 7, 59, 0, 0, time.UTC)
+	bwScheduleNow = func() time.Time { return now }
+
+	_, err := parseBwSchedule("08:00")
+	assert.Error(t, err)
+	_, err = parseBwSchedule("25:00,1M")
+	assert.Error(t, err)
+	schedule, err := parseBwSchedule("23:00,off 08:00,1M 12:30,512k")
+	require.NoError(t, err)
+
+	l := newPriorityLimiter(0)
+	for _, test := range []struct {
+		now  time.Time
+		rate float64
+		next time.Time
+	}{
+		{now, 0, time.Date(2017, 1, 2, 8, 0, 0, 0, time.UTC)},
+		{now.Add(time.Minute), 1024 * 1024, time.Date(2017, 1, 2, 12, 30, 0, 0, time.UTC)},
+		{now.Add(5 * time.Hour), 512 * 1024, time.Date(2017, 1, 2, 23, 0, 0, 0, time.UTC)},
+		{now.Add(16 * time.Hour), 0, time.Date(2017, 1, 3, 8, 0, 0, 0, time.UTC)},
+	} {
+		now = test.now
+		next := schedule.apply(l)
+		assert.Equal(t, test.rate, l.rate, test.now.String())
+		assert.Equal(t, test.next, next, test.now.String())
+	}
+
+	// an unlimited limiter doesn't wait
+	start := time.Now()
+	l.wait(10*1024*1024, false)
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "took %v", time.Since(start))
+}
+
+// Test --cache-pin reads the matching files into the read cache on
+// mount and they survive evictions which remove the other blocks
+func TestReadCachePin(t *testing.T) {
+	defer func(old *blockCache) { readCache = old }(readCache)
+	defer func(old *fs.Filter) { cachePinFilter = old }(cachePinFilter)
+	readCache = newBlockCache(2 * readCacheBlockSize)
+	var err error
+	cachePinFilter, err = newGlobFilter("index")
+	require.NoError(t, err)
+	f := newMockFs()
+	index := f.add("index", "a, b, c")
+	block := strings.Repeat("x", readCacheBlockSize)
+	var others []*mockObject
+	for _, remote := range []string{"a", "b", "c"} {
+		others = append(others, f.add(remote, block))
+	}
+
+	pinFiles(f)
+	assert.Equal(t, 1, index.opens)
+	pinned := cacheKey{id: cacheID(index), block: 0}
+	_, hit := readCache.get(pinned)
+	assert.True(t, hit, "index not pre-populated")
+	for _, o := range others {
+		assert.Equal(t, 0, o.opens)
+	}
+
+	read := func(o *mockObject) string {
+		fh, err := newReadFileHandle(o)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+		}()
+		return readString(t, fh, 0, 100)
+	}
+	for _, o := range others {
+		read(o)
+	}
+	_, hit = readCache.get(cacheKey{id: cacheID(others[0]), block: 0})
+	assert.False(t, hit, "unpinned block not evicted")
+	_, hit = readCache.get(pinned)
+	assert.True(t, hit, "pinned block evicted")
+	assert.Equal(t, "a, b, c", read(index))
+	assert.Equal(t, 7, index.received)
+
+	// a changed file is read again replacing the old version
+	index.mu.Lock()
+	index.contents = []byte("a, b, c, d")
+	index.modTime = index.modTime.Add(time.Second)
+	index.mu.Unlock()
+	assert.Equal(t, "a, b, c, d", read(index))
+	assert.Equal(t, 17, index.received)
+	_, hit = readCache.get(pinned)
+	assert.False(t, hit, "old version still pinned")
+}
+
+// Test --read-download downloads the whole file in the background
+// when opened and serves seeks from the download without reopening
+func TestReadDownload(t *testing.T) {
+	defer func(old bool) { readDownload = old }(readDownload)
+	readDownload = true
+	data := make([]byte, 8*downloadChunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	o := newMockFs().add("file", string(data))
+	o.readDelay = 5 * time.Millisecond
+
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	require.NotNil(t, fh.download)
+	end := int64(len(data))
+	assert.Equal(t, string(data[end-100:]), readString(t, fh, end-100, 200))
+	o.mu.Lock()
+	assert.Equal(t, len(data), o.received)
+	o.mu.Unlock()
+	assert.Equal(t, string(data[100:200]), readString(t, fh, 100, 100))
+	assert.Equal(t, string(data[5000:9000]), readString(t, fh, 5000, 4000))
+	assert.Equal(t, "", readString(t, fh, end, 100))
+	assert.Equal(t, 1, o.opens)
+	name := fh.download.file.Name()
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err), "download not removed")
+
+	// closing the handle early cancels the download
+	o.readDelay = 20 * time.Millisecond
+	fh, err = newReadFileHandle(o)
+	require.NoError(t, err)
+	assert.Equal(t, string(data[:100]), readString(t, fh, 0, 100))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	o.mu.Lock()
+	received := o.received - len(data)
+	closes := o.closes
+	o.mu.Unlock()
+	assert.True(t, received < len(data), "downloaded all %d bytes", received)
+	assert.Equal(t, 2, closes)
+}
+
+// Check the log lines of each read share a request ID which differs
+// between reads
+func TestReadRequestID(t *testing.T) {
+	defer func(old bool) { fs.Config.Verbose = old }(fs.Config.Verbose)
+	fs.Config.Verbose = true
+	var buf bytes.Buffer
+	fs.DebugLogger.SetOutput(&buf)
+	defer fs.DebugLogger.SetOutput(os.Stdout)
+
+	o := newMockFs().add("file", "0123456789abcdef")
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	ids := func() map[string]int {
+		found := map[string]int{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			match := regexp.MustCompile(`file \[(\w+)\]: `).FindStringSubmatch(line)
+			require.NotNil(t, match, "no request ID in %q", line)
+			found[match[1]]++
+		}
+		buf.Reset()
+		return found
+	}
+
+	assert.Equal(t, "0123", readString(t, fh, 0, 4))
+	first := ids()
+	assert.Len(t, first, 1)
+
+	// the seek is logged with the read which caused it
+	assert.Equal(t, "cdef", readString(t, fh, 12, 4))
+	second := ids()
+	require.Len(t, second, 1)
+	for id, lines := range second {
+		assert.NotContains(t, first, id)
+		assert.True(t, lines > 2, "only %d lines", lines)
+	}
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// as do the lines of opening and writing files
+	f, d := mockDir()
+	f.add("file", "hello")
+	file := lookupFile(t, d, "file")
+	buf.Reset()
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	assert.Len(t, ids(), 1)
+	require.NoError(t, handle.(*ReadFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+	buf.Reset()
+	_, handle, err = d.Create(context.Background(), &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	assert.Len(t, ids(), 1)
+	wfh := handle.(*WriteFileHandle)
+	require.NoError(t, wfh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("new")}, &fuse.WriteResponse{}))
+	assert.Len(t, ids(), 1)
+	require.NoError(t, wfh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Len(t, ids(), 1)
+}
+
+// Check --on-unknown-hash when the remote doesn't know the hash of a
+// file which has been read to the end
+func TestReadOnUnknownHash(t *testing.T) {
+	defer func(old string) { onUnknownHash = old }(onUnknownHash)
+	o := newMockFs().add("file", "0123456789abcdef")
+	o.noHash = true
+	readAll := func() error {
+		fh, err := newReadFileHandle(o)
+		require.NoError(t, err)
+		assert.Equal(t, "0123456789abcdef", readString(t, fh, 0, 100))
+		return fh.Release(context.Background(), &fuse.ReleaseRequest{})
+	}
+
+	for _, mode := range []string{onUnknownHashSkip, onUnknownHashWarn} {
+		onUnknownHash = mode
+		assert.NoError(t, readAll(), mode)
+	}
+
+	onUnknownHash = onUnknownHashFail
+	err := readAll()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't know the MD5 hash")
+
+	// a known hash which matches is fine
+	o.noHash = false
+	assert.NoError(t, readAll())
+}
+
+// Test a read failure is written to the --error-log as JSON
+func TestReadErrorLog(t *testing.T) {
+	defer func(old *errorEventLog) { errorLog = old }(errorLog)
+	defer func(old int) { fs.Config.LowLevelRetries = old }(fs.Config.LowLevelRetries)
+	fs.Config.LowLevelRetries = 2
+	out, err := ioutil.TempFile("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(out.Name()) }()
+	errorLog = newErrorEventLog(out)
+
+	o := newMockFs().add("dir/file", "hello")
+	fh, err := newReadFileHandle(o)
+	require.NoError(t, err)
+	o.readErr = errors.New("connection reset")
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Size: 5}, &fuse.ReadResponse{})
+	assert.Equal(t, o.readErr, err)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	require.NoError(t, errorLog.close())
+
+	data, err := ioutil.ReadFile(out.Name())
+	require.NoError(t, err)
+	var event errorEvent
+	require.NoError(t, json.Unmarshal(data, &event))
+	assert.Equal(t, "read", event.Op)
+	assert.Equal(t, "dir/file", event.Path)
+	assert.Equal(t, "connection reset", event.Error)
+	assert.Equal(t, 2, event.Retries)
+	assert.WithinDuration(t, time.Now(), event.Time, time.Minute)
+}
@@ -0,0 +1,160 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// recentDirName is the name of the directory in the root of the mount
+// showing the most recently modified objects with --recent-count
+const recentDirName = ".recent"
+
+// RecentDir is the read only directory of links to the
+// --recent-count most recently modified objects on the remote,
+// modified within --recent-window if set.  The links are named with
+// the flattened path of the object.
+//
+// The objects are found by listing the whole remote which is done
+// again when the listing is older than --dir-cache-time.
+type RecentDir struct {
+	f       fs.Fs
+	mu      sync.Mutex
+	read    time.Time // when the remote was last listed
+	remotes []string  // remotes of the objects, most recently modified first
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.Node               = (*RecentDir)(nil)
+	_ fusefs.NodeStringLookuper = (*RecentDir)(nil)
+	_ fusefs.HandleReadDirAller = (*RecentDir)(nil)
+	_ fusefs.Node               = (*RecentLink)(nil)
+	_ fusefs.NodeReadlinker     = (*RecentLink)(nil)
+)
+
+// recentDir returns the RecentDir for the root directory d
+func (d *Dir) recentDir() *RecentDir {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.recent == nil {
+		d.recent = &RecentDir{f: d.f}
+	}
+	return d.recent
+}
+
+// recentObjects sorts objects by modification time, newest first
+type recentObjects struct {
+	objs     []fs.Object
+	modTimes []time.Time
+}
+
+func (r recentObjects) Len() int { return len(r.objs) }
+func (r recentObjects) Swap(i, j int) {
+	r.objs[i], r.objs[j] = r.objs[j], r.objs[i]
+	r.modTimes[i], r.modTimes[j] = r.modTimes[j], r.modTimes[i]
+}
+func (r recentObjects) Less(i, j int) bool { return r.modTimes[i].After(r.modTimes[j]) }
+
+// load the most recently modified objects on the remote if they are
+// out of date returning their remotes
+func (r *RecentDir) load() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.remotes != nil && time.Since(r.read) < dirCacheTime {
+		return r.remotes, nil
+	}
+	fs.Debug(recentDirName, "Reading modification times")
+	waitToList()
+	objs, _, err := fs.NewLister().SetLevel(fs.MaxLevel).Start(r.f, "").GetAll()
+	if err != nil && err != fs.ErrorDirNotFound {
+		return nil, err
+	}
+	var recent recentObjects
+	for _, o := range objs {
+		modTime := o.ModTime()
+		if recentWindow > 0 && time.Since(modTime) > recentWindow {
+			continue
+		}
+		recent.objs = append(recent.objs, o)
+		recent.modTimes = append(recent.modTimes, modTime)
+	}
+	sort.Stable(recent)
+	if len(recent.objs) > recentCount {
+		recent.objs = recent.objs[:recentCount]
+	}
+	remotes := make([]string, 0, len(recent.objs))
+	for _, o := range recent.objs {
+		remotes = append(remotes, o.Remote())
+	}
+	r.remotes = remotes
+	r.read = time.Now()
+	return remotes, nil
+}
+
+// Attr fills out the attributes of the directory
+func (r *RecentDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	readOnlyDirAttr(a)
+	return nil
+}
+
+// Lookup finds the link called name
+func (r *RecentDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	remotes, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	remote := unflattenName(name)
+	for _, recent := range remotes {
+		if recent == remote {
+			return &RecentLink{remote: remote}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// ReadDirAll lists the links to the objects, most recently modified
+// first
+func (r *RecentDir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	remotes, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, remote := range remotes {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_Link, Name: flattenName(remote)})
+	}
+	return dirents, nil
+}
+
+// RecentLink is a symlink to an object from the recent directory
+type RecentLink struct {
+	remote string
+}
+
+// Attr fills out the attributes of the link
+func (l *RecentLink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = os.ModeSymlink | 0777
+	a.Size = uint64(len(l.target()))
+	return nil
+}
+
+// target returns the path the link points to relative to the recent
+// directory
+func (l *RecentLink) target() string {
+	return "../" + l.remote
+}
+
+// Readlink returns the target of the link
+func (l *RecentLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.target(), nil
+}
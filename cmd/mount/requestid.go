@@ -0,0 +1,38 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// lastRequestID is the ID given to the last FUSE operation - use
+// with atomic
+var lastRequestID uint64
+
+// newRequestID returns a short ID for a FUSE operation which is shown
+// in all its log lines so they can be picked out from those of the
+// operations running at the same time.
+//
+// The backends aren't passed the ID as their calls don't take a
+// context so the lines they log themselves don't show it.
+func newRequestID() string {
+	return strconv.FormatUint(atomic.AddUint64(&lastRequestID, 1), 36)
+}
+
+// opLog is the thing logged about by a FUSE operation along with the
+// ID of the operation
+type opLog struct {
+	o  interface{}
+	id string // request ID or "" if not in an operation
+}
+
+// String shows the thing logged about followed by the request ID
+func (l opLog) String() string {
+	if l.id == "" {
+		return fmt.Sprint(l.o)
+	}
+	return fmt.Sprintf("%v [%s]", l.o, l.id)
+}
@@ -0,0 +1,256 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+)
+
+// sharedCache is the client of the cache shared between mounts with
+// --shared-cache-socket or nil if there isn't one
+var sharedCache *sharedCacheClient
+
+// The shared cache protocol is a series of requests on a unix socket
+//
+//	'G' key          - get a block, answered with its data or a miss
+//	'P' key data     - put a block, not answered
+//
+// where key and data are sent as a big endian uint32 length then
+// the bytes.  A miss is sent as a length of sharedCacheMiss.  Keys
+// longer than sharedCacheMaxKey and blocks longer than
+// readCacheBlockSize are refused.
+const (
+	sharedCacheGet    = 'G'
+	sharedCachePut    = 'P'
+	sharedCacheMiss   = ^uint32(0)
+	sharedCacheMaxKey = 1024
+)
+
+// startSharedCache connects to the shared cache on the unix socket
+// addr, serving the blocks in the disk cache if no other mount is
+// serving it already.
+func startSharedCache(addr string, cache *diskBlockCache) (*sharedCacheClient, error) {
+	conn, err := net.Dial("unix", addr)
+	if err == nil {
+		_ = conn.Close()
+		fs.Debug(addr, "Using shared cache served by another mount")
+	} else {
+		// remove the socket left by a mount which has gone
+		_ = os.Remove(addr)
+		_, err = serveSharedCache(addr, cache)
+		if err != nil {
+			return nil, err
+		}
+		fs.Debug(addr, "Serving shared cache")
+	}
+	return newSharedCacheClient(addr), nil
+}
+
+// sharedCacheServer serves a diskBlockCache to the mounts on a unix
+// socket
+type sharedCacheServer struct {
+	listener net.Listener
+	cache    *diskBlockCache
+}
+
+// serveSharedCache starts serving the blocks in cache on the unix
+// socket addr in the background
+func serveSharedCache(addr string, cache *diskBlockCache) (*sharedCacheServer, error) {
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serve shared cache")
+	}
+	s := &sharedCacheServer{
+		listener: listener,
+		cache:    cache,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// serve accepts connections until the listener is closed
+func (s *sharedCacheServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle the requests on conn until it is closed
+func (s *sharedCacheServer) handle(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		op, err := rw.ReadByte()
+		if err != nil {
+			return
+		}
+		key, err := readSharedCacheData(rw, sharedCacheMaxKey)
+		if err != nil {
+			return
+		}
+		k := string(key)
+		switch op {
+		case sharedCacheGet:
+			data, ok := s.cache.get(k)
+			if ok {
+				err = writeSharedCacheData(rw, data)
+			} else {
+				err = binary.Write(rw, binary.BigEndian, sharedCacheMiss)
+			}
+			if err == nil {
+				err = rw.Flush()
+			}
+		case sharedCachePut:
+			var data []byte
+			data, err = readSharedCacheData(rw, readCacheBlockSize)
+			if err == nil {
+				s.cache.put(k, data)
+			}
+		default:
+			err = errors.Errorf("unknown shared cache request %q", op)
+		}
+		if err != nil {
+			fs.Debug("shared cache", "Dropping connection: %v", err)
+			return
+		}
+	}
+}
+
+// Close stops serving the cache
+func (s *sharedCacheServer) Close() error {
+	return s.listener.Close()
+}
+
+// sharedCacheClient gets and puts blocks in the shared cache
+//
+// Errors talking to the cache are logged and treated as misses so
+// reads carry on from the remote if the cache goes away.
+type sharedCacheClient struct {
+	mu   sync.Mutex
+	addr string
+	conn net.Conn // connection to the cache or nil if not connected
+	rw   *bufio.ReadWriter
+}
+
+// newSharedCacheClient makes a client for the cache on the unix
+// socket addr
+func newSharedCacheClient(addr string) *sharedCacheClient {
+	return &sharedCacheClient{
+		addr: addr,
+	}
+}
+
+// request sends a request to the cache connecting if necessary
+//
+// Call with c.mu held
+func (c *sharedCacheClient) request(op byte, key string, data []byte) error {
+	if c.conn == nil {
+		conn, err := net.Dial("unix", c.addr)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+		c.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+	err := c.rw.WriteByte(op)
+	if err == nil {
+		err = writeSharedCacheData(c.rw, []byte(key))
+	}
+	if err == nil && op == sharedCachePut {
+		err = writeSharedCacheData(c.rw, data)
+	}
+	if err == nil {
+		err = c.rw.Flush()
+	}
+	return err
+}
+
+// disconnect after an error so the next request reconnects
+//
+// Call with c.mu held
+func (c *sharedCacheClient) disconnect(err error) {
+	fs.Debug(c.addr, "Shared cache error: %v", err)
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// get returns the block for key and whether it was found
+func (c *sharedCacheClient) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.request(sharedCacheGet, key, nil)
+	if err != nil {
+		c.disconnect(err)
+		return nil, false
+	}
+	data, err := readSharedCacheData(c.rw, readCacheBlockSize)
+	if err == errSharedCacheMiss {
+		return nil, false
+	}
+	if err != nil {
+		c.disconnect(err)
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores the block for key in the cache
+func (c *sharedCacheClient) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.request(sharedCachePut, key, data)
+	if err != nil {
+		c.disconnect(err)
+	}
+}
+
+// errSharedCacheMiss is returned by readSharedCacheData for a miss
+var errSharedCacheMiss = errors.New("not in shared cache")
+
+// writeSharedCacheData writes the length of data then data
+func writeSharedCacheData(w io.Writer, data []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readSharedCacheData reads data written by writeSharedCacheData
+// returning an error if it is longer than max bytes
+func readSharedCacheData(r io.Reader, max int) ([]byte, error) {
+	var n uint32
+	err := binary.Read(r, binary.BigEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	if n == sharedCacheMiss {
+		return nil, errSharedCacheMiss
+	}
+	if int64(n) > int64(max) {
+		return nil, errors.Errorf("shared cache data too long: %d bytes", n)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
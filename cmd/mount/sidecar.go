@@ -0,0 +1,101 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// maxSidecarSize is the most of a sidecar which is read
+const maxSidecarSize = 1024 * 1024
+
+// sidecarXattrPrefix is the prefix of the extended attributes made
+// from the keys of a sidecar
+const sidecarXattrPrefix = "user."
+
+// sidecar is the JSON object with --sidecar-as-xattr whose keys are
+// shown as extended attributes of the file it is beside
+type sidecar struct {
+	o      fs.Object
+	once   sync.Once
+	xattrs map[string]string // read from o the first time they are needed
+}
+
+// hideSidecars removes the sidecars of the files in items returning
+// them by the name of their file
+//
+// A sidecar is only hidden if there is a file for it to be beside.
+func hideSidecars(items map[string]*DirEntry) map[string]*sidecar {
+	if sidecarSuffix == "" {
+		return nil
+	}
+	sidecars := make(map[string]*sidecar)
+	for leaf, item := range items {
+		o, ok := item.o.(fs.Object)
+		if !ok || !strings.HasSuffix(leaf, sidecarSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(leaf, sidecarSuffix)
+		if main, ok := items[name]; ok {
+			if _, ok := main.o.(fs.Object); ok {
+				sidecars[name] = &sidecar{o: o}
+			}
+		}
+	}
+	for name := range sidecars {
+		delete(items, name+sidecarSuffix)
+	}
+	return sidecars
+}
+
+// sidecarXattrs returns the extended attributes from the sidecar of
+// leaf in d or nil if there isn't one
+func (d *Dir) sidecarXattrs(leaf string) map[string]string {
+	d.mu.RLock()
+	s := d.sidecars[leaf]
+	d.mu.RUnlock()
+	if s == nil {
+		return nil
+	}
+	s.once.Do(func() {
+		s.xattrs = readSidecar(s.o)
+	})
+	return s.xattrs
+}
+
+// readSidecar reads the keys of the JSON object in o as extended
+// attributes.  String values are used as they are and other values
+// as JSON.
+func readSidecar(o fs.Object) map[string]string {
+	in, err := o.Open()
+	if err != nil {
+		fs.ErrorLog(o, "Failed to open sidecar: %v", err)
+		return nil
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	var values map[string]interface{}
+	err = json.NewDecoder(io.LimitReader(in, maxSidecarSize)).Decode(&values)
+	if err != nil {
+		fs.ErrorLog(o, "Failed to read sidecar: %v", err)
+		return nil
+	}
+	xattrs := make(map[string]string, len(values))
+	for key, value := range values {
+		if s, ok := value.(string); ok {
+			xattrs[sidecarXattrPrefix+key] = s
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err == nil {
+			xattrs[sidecarXattrPrefix+key] = string(data)
+		}
+	}
+	return xattrs
+}
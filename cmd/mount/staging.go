@@ -0,0 +1,367 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// stagingDirName is the name of the directory in the root of the
+// mount holding files which aren't uploaded until they are moved out
+// of it with --staging
+const stagingDirName = ".staging"
+
+// StagingDir is a writable directory whose files are kept in local
+// temporary files rather than uploaded.  A file is uploaded when it
+// is renamed into a directory of the mount, so a batch of files can
+// be written then committed by moving them into place.
+//
+// The files are lost when the mount stops, which is logged.
+type StagingDir struct {
+	root  *Dir
+	mu    sync.Mutex
+	files map[string]*StagedFile // files by name
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.Node               = (*StagingDir)(nil)
+	_ fusefs.NodeStringLookuper = (*StagingDir)(nil)
+	_ fusefs.HandleReadDirAller = (*StagingDir)(nil)
+	_ fusefs.NodeCreater        = (*StagingDir)(nil)
+	_ fusefs.NodeRemover        = (*StagingDir)(nil)
+	_ fusefs.NodeRenamer        = (*StagingDir)(nil)
+	_ fusefs.Node               = (*StagedFile)(nil)
+	_ fusefs.NodeOpener         = (*StagedFile)(nil)
+	_ fusefs.NodeSetattrer      = (*StagedFile)(nil)
+	_ fusefs.Handle             = (*StagedFileHandle)(nil)
+	_ fusefs.HandleReader       = (*StagedFileHandle)(nil)
+	_ fusefs.HandleWriter       = (*StagedFileHandle)(nil)
+	_ fusefs.HandleReleaser     = (*StagedFileHandle)(nil)
+)
+
+// stagedFiles is the number of files in the staging directory - use
+// sync/atomic to access
+var stagedFiles int64
+
+// stagingDir returns the StagingDir for the root directory d
+func (d *Dir) stagingDir() *StagingDir {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.staging == nil {
+		d.staging = &StagingDir{root: d, files: make(map[string]*StagedFile)}
+	}
+	return d.staging
+}
+
+// Attr fills out the attributes of the directory
+func (s *StagingDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = os.ModeDir | dirPerms
+	return nil
+}
+
+// Lookup finds the file called name
+func (s *StagingDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return file, nil
+}
+
+// ReadDirAll lists the files
+func (s *StagingDir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.files {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_File, Name: name})
+	}
+	return dirents, nil
+}
+
+// Create makes a new file replacing any of the same name
+func (s *StagingDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	name := path.Join(stagingDirName, req.Name)
+	fs.Debug(name, "StagingDir.Create")
+	spool, err := ioutil.TempFile("", "rclone-mount-staging")
+	if err != nil {
+		fs.ErrorLog(name, "StagingDir.Create error: %v", err)
+		return nil, nil, err
+	}
+	file := &StagedFile{spool: spool, modTime: time.Now()}
+	atomic.AddInt64(&stagedFiles, 1)
+	s.mu.Lock()
+	old := s.files[req.Name]
+	s.files[req.Name] = file
+	s.mu.Unlock()
+	if old != nil {
+		old.remove()
+	}
+	return file, file.open(), nil
+}
+
+// Remove the file called req.Name throwing away its data
+func (s *StagingDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	s.mu.Lock()
+	file, ok := s.files[req.Name]
+	delete(s.files, req.Name)
+	s.mu.Unlock()
+	if !ok {
+		return fuse.ENOENT
+	}
+	file.remove()
+	return nil
+}
+
+// Rename the file req.OldName to req.NewName in newDir
+//
+// Renaming it into a directory of the mount uploads it there, the
+// file only leaving the staging directory if the upload succeeds.
+func (s *StagingDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	oldName := path.Join(stagingDirName, req.OldName)
+	s.mu.Lock()
+	file, ok := s.files[req.OldName]
+	s.mu.Unlock()
+	if !ok {
+		return fuse.ENOENT
+	}
+	switch destDir := newDir.(type) {
+	case *StagingDir:
+		fs.Debug(oldName, "StagingDir.Rename to %q", req.NewName)
+		s.mu.Lock()
+		old := s.files[req.NewName]
+		delete(s.files, req.OldName)
+		s.files[req.NewName] = file
+		s.mu.Unlock()
+		if old != nil && old != file {
+			old.remove()
+		}
+		return nil
+	case *Dir:
+		remote := destDir.remote(req.NewName)
+		fs.Debug(oldName, "StagingDir.Rename committing to %q", remote)
+		err := checkACL(&req.Header, remote, true)
+		if err != nil {
+			return err
+		}
+		err = file.commit(ctx, destDir, req.NewName)
+		if err != nil {
+			fs.ErrorLog(remote, "StagingDir.Rename error: %v", err)
+			return err
+		}
+		s.mu.Lock()
+		if s.files[req.OldName] == file {
+			delete(s.files, req.OldName)
+		}
+		s.mu.Unlock()
+		file.remove()
+		fs.Debug(remote, "StagingDir.Rename OK")
+		return nil
+	}
+	return fuse.Errno(syscall.EXDEV)
+}
+
+// StagedFile is a file in the staging directory whose data is kept in
+// a local temporary file.
+//
+// The temporary file is kept until the file has been removed from the
+// staging directory and all its handles have been released.
+type StagedFile struct {
+	mu      sync.Mutex
+	spool   *os.File  // local copy of the data
+	size    int64     // size of the data
+	modTime time.Time // when the data was last written
+	opens   int       // number of open handles
+	removed bool      // set once removed from the staging directory
+}
+
+// StagedFileHandle is an open handle on a StagedFile
+type StagedFileHandle struct {
+	file *StagedFile
+}
+
+// Attr fills out the attributes for the file
+func (sf *StagedFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = filePerms
+	a.Size = uint64(sf.size)
+	a.Atime = sf.modTime
+	a.Mtime = sf.modTime
+	a.Ctime = sf.modTime
+	a.Crtime = sf.modTime
+	setBlocks(a)
+	return nil
+}
+
+// Open the file for reading or writing
+func (sf *StagedFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if req.Flags&fuse.OpenTruncate != 0 {
+		err := sf.truncate(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sf.open(), nil
+}
+
+// open returns a new handle on the file
+func (sf *StagedFile) open() *StagedFileHandle {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.opens++
+	return &StagedFileHandle{file: sf}
+}
+
+// Setattr changes the size of the file
+func (sf *StagedFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		return sf.truncate(int64(req.Size))
+	}
+	return nil
+}
+
+// truncate the file to size
+func (sf *StagedFile) truncate(size int64) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	err := sf.spool.Truncate(size)
+	if err != nil {
+		return err
+	}
+	sf.size = size
+	sf.modTime = time.Now()
+	return nil
+}
+
+// Read data from the file at req.Offset
+func (fh *StagedFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	sf := fh.file
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	buf := make([]byte, req.Size)
+	n, err := sf.spool.ReadAt(buf, req.Offset)
+	if err != nil && n == 0 && req.Offset < sf.size {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Write data to the file at req.Offset
+func (fh *StagedFileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	sf := fh.file
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	n, err := sf.spool.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	if end := req.Offset + int64(n); end > sf.size {
+		sf.size = end
+	}
+	sf.modTime = time.Now()
+	atomic.AddInt64(&bytesWritten, int64(n))
+	return err
+}
+
+// Release the handle closing the local copy of the data if the file
+// has been removed and this was the last handle
+func (fh *StagedFileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	sf := fh.file
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.opens--
+	if sf.removed && sf.opens == 0 {
+		sf.closeSpool()
+	}
+	return nil
+}
+
+// commit uploads the file as leaf in d through a write handle, so it
+// is checked and uploaded the same way as a file created there.
+func (sf *StagedFile) commit(ctx context.Context, d *Dir, leaf string) error {
+	remote := d.remote(leaf)
+	err := d.readDir()
+	if err != nil {
+		return err
+	}
+	err = d.checkRenameTarget(leaf)
+	if err != nil {
+		return err
+	}
+	err = d.checkCaseCollision(leaf, "")
+	if err != nil {
+		return err
+	}
+	err = checkFilteredWrite(remote, false)
+	if err != nil {
+		return err
+	}
+	if _, err := d.lookup(leaf); immutable && err == nil {
+		fs.Debug(remote, "StagingDir.Rename can't replace file with --immutable")
+		return fuse.EPERM
+	}
+	file := newFile(d, nil)
+	d.addWriting(leaf, file)
+	fh, err := newWriteFileHandle(ctx, d, file, newCreateInfo(d.f, remote))
+	if err != nil {
+		d.delWriting(file)
+		return err
+	}
+	sf.mu.Lock()
+	err = fh.writeFrom(io.NewSectionReader(sf.spool, 0, sf.size))
+	sf.mu.Unlock()
+	if err != nil {
+		fh.abort(err)
+		return err
+	}
+	return fh.Release(ctx, &fuse.ReleaseRequest{})
+}
+
+// remove the file from the staging directory throwing away the local
+// copy of the data once it is no longer open
+func (sf *StagedFile) remove() {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.removed {
+		return
+	}
+	sf.removed = true
+	atomic.AddInt64(&stagedFiles, -1)
+	if sf.opens == 0 {
+		sf.closeSpool()
+	}
+}
+
+// closeSpool closes and removes the local copy of the data
+//
+// Call with sf.mu held
+func (sf *StagedFile) closeSpool() {
+	_ = sf.spool.Close()
+	_ = os.Remove(sf.spool.Name())
+}
+
+// warnStagedFiles logs the files left in the staging directory when
+// the mount stops as their data is lost
+func warnStagedFiles() {
+	if n := atomic.LoadInt64(&stagedFiles); n > 0 {
+		fs.ErrorLog(nil, "%d files in %s weren't moved out before unmounting - their data has been lost", n, stagingDirName)
+	}
+}
@@ -0,0 +1,119 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// statusFileName is the name of the status file in the root of the
+// mount
+const statusFileName = ".rclone-status"
+
+// Counters for the status file - use sync/atomic to access
+var (
+	mountTime    = time.Now() // when the mount started
+	openHandles  int64        // number of open file handles
+	bytesRead    int64        // bytes read from files
+	bytesWritten int64        // bytes written to files
+)
+
+// statusText returns the current status of the mount as text with
+// one "name: value" pair per line
+func statusText() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "uptime: %v\n", time.Since(mountTime)-time.Since(mountTime)%time.Second)
+	fmt.Fprintf(buf, "open_handles: %d\n", atomic.LoadInt64(&openHandles))
+	fmt.Fprintf(buf, "bytes_read: %d\n", atomic.LoadInt64(&bytesRead))
+	fmt.Fprintf(buf, "bytes_written: %d\n", atomic.LoadInt64(&bytesWritten))
+	// files in --staging aren't uploaded until they are moved out
+	fmt.Fprintf(buf, "dirty_files: %d\n", atomic.LoadInt64(&dirtyFiles)+atomic.LoadInt64(&stagedFiles))
+	if uploadTimeout > 0 {
+		fmt.Fprintf(buf, "background_uploads: %d\n", atomic.LoadInt64(&backgroundUploads))
+		fmt.Fprintf(buf, "background_upload_errors: %d\n", atomic.LoadInt64(&backgroundUploadErrors))
+	}
+	if bestEffortUploads {
+		fmt.Fprintf(buf, "pending_upload_retries: %d\n", atomic.LoadInt64(&pendingUploadRetries))
+	}
+	hits, misses, cacheBytes, remoteBytes := fs.Stats.GetCacheStats()
+	fmt.Fprintf(buf, "cache_hits: %d\n", hits)
+	fmt.Fprintf(buf, "cache_misses: %d\n", misses)
+	fmt.Fprintf(buf, "cache_bytes: %d\n", cacheBytes)
+	fmt.Fprintf(buf, "remote_bytes: %d\n", remoteBytes)
+	if readCache != nil {
+		size, maxSize := readCache.usage()
+		fmt.Fprintf(buf, "cache_size: %d\n", size)
+		fmt.Fprintf(buf, "cache_max_size: %d\n", maxSize)
+	}
+	if diskCache != nil {
+		size, maxSize := diskCache.usage()
+		fmt.Fprintf(buf, "disk_cache_size: %d\n", size)
+		fmt.Fprintf(buf, "disk_cache_max_size: %d\n", maxSize)
+	}
+	if totalCache != nil {
+		writeSize, maxSize := totalCache.usage()
+		fmt.Fprintf(buf, "write_cache_size: %d\n", writeSize)
+		fmt.Fprintf(buf, "cache_max_total_size: %d\n", maxSize)
+	}
+	return buf.Bytes()
+}
+
+// StatusFile is a read only virtual file showing the status of the
+// mount which is regenerated each time it is read
+type StatusFile struct{}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.Node         = (*StatusFile)(nil)
+	_ fusefs.NodeOpener   = (*StatusFile)(nil)
+	_ fusefs.Handle       = (*StatusFile)(nil)
+	_ fusefs.HandleReader = (*StatusFile)(nil)
+)
+
+// Attr fills out the attributes for the file
+func (s *StatusFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = filePerms &^ 0222
+	a.Size = uint64(len(statusText()))
+	now := time.Now()
+	a.Atime = now
+	a.Mtime = now
+	a.Ctime = now
+	a.Crtime = now
+	return nil
+}
+
+// Open the file for reading
+//
+// Direct IO is used so the kernel doesn't cache the contents or
+// truncate them to the size returned by Attr.
+func (s *StatusFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return s, nil
+}
+
+// Read the status from req.Offset
+func (s *StatusFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	data := statusText()
+	if req.Offset >= int64(len(data)) {
+		return nil
+	}
+	data = data[req.Offset:]
+	if len(data) > req.Size {
+		data = data[:req.Size]
+	}
+	resp.Data = data
+	return nil
+}
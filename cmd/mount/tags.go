@@ -0,0 +1,198 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// tagsDirName is the name of the directory in the root of the mount
+// showing the objects by their tags with --tag-browse
+const tagsDirName = ".tags"
+
+// TagsDir is the read only directory containing a directory for
+// each tag the objects on the remote have.
+//
+// The tags are found by listing the whole remote which is done again
+// when the listing is older than --dir-cache-time.
+type TagsDir struct {
+	f    fs.Fs
+	mu   sync.Mutex
+	read time.Time           // when the remote was last listed
+	tags map[string][]string // remotes of the objects by tag
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.Node               = (*TagsDir)(nil)
+	_ fusefs.NodeStringLookuper = (*TagsDir)(nil)
+	_ fusefs.HandleReadDirAller = (*TagsDir)(nil)
+	_ fusefs.Node               = (*TagDir)(nil)
+	_ fusefs.NodeStringLookuper = (*TagDir)(nil)
+	_ fusefs.HandleReadDirAller = (*TagDir)(nil)
+	_ fusefs.Node               = (*TagLink)(nil)
+	_ fusefs.NodeReadlinker     = (*TagLink)(nil)
+)
+
+// tagsDir returns the TagsDir for the root directory d
+func (d *Dir) tagsDir() *TagsDir {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tags == nil {
+		d.tags = &TagsDir{f: d.f}
+	}
+	return d.tags
+}
+
+// load the tags of the objects on the remote if they are out of date
+// returning them
+func (t *TagsDir) load() (map[string][]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tags != nil && time.Since(t.read) < dirCacheTime {
+		return t.tags, nil
+	}
+	fs.Debug(tagsDirName, "Reading tags")
+	waitToList()
+	objs, _, err := fs.NewLister().SetLevel(fs.MaxLevel).Start(t.f, "").GetAll()
+	if err != nil && err != fs.ErrorDirNotFound {
+		return nil, err
+	}
+	tags := make(map[string][]string)
+	for _, o := range objs {
+		do, ok := o.(fs.Tagger)
+		if !ok {
+			continue
+		}
+		for _, tag := range do.Tags() {
+			if tag != "" && !strings.Contains(tag, "/") {
+				tags[tag] = append(tags[tag], o.Remote())
+			}
+		}
+	}
+	t.tags = tags
+	t.read = time.Now()
+	return tags, nil
+}
+
+// readOnlyDirAttr fills out the attributes of a read only virtual
+// directory
+func readOnlyDirAttr(a *fuse.Attr) {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = os.ModeDir | (dirPerms &^ 0222)
+}
+
+// Attr fills out the attributes of the directory
+func (t *TagsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	readOnlyDirAttr(a)
+	return nil
+}
+
+// Lookup finds the directory for tag
+func (t *TagsDir) Lookup(ctx context.Context, tag string) (fusefs.Node, error) {
+	tags, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tags[tag]; !ok {
+		return nil, fuse.ENOENT
+	}
+	return &TagDir{t: t, tag: tag}, nil
+}
+
+// ReadDirAll lists a directory for each tag
+func (t *TagsDir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	tags, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	for tag := range tags {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_Dir, Name: tag})
+	}
+	return dirents, nil
+}
+
+// TagDir is the read only directory of links to the objects with a
+// tag.  The links are named with the flattened path of the object.
+type TagDir struct {
+	t   *TagsDir
+	tag string
+}
+
+// remotes returns the sorted remotes of the objects with the tag
+func (d *TagDir) remotes() ([]string, error) {
+	tags, err := d.t.load()
+	if err != nil {
+		return nil, err
+	}
+	remotes := append([]string(nil), tags[d.tag]...)
+	sort.Strings(remotes)
+	return remotes, nil
+}
+
+// Attr fills out the attributes of the directory
+func (d *TagDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	readOnlyDirAttr(a)
+	return nil
+}
+
+// Lookup finds the link called name
+func (d *TagDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	remotes, err := d.remotes()
+	if err != nil {
+		return nil, err
+	}
+	remote := unflattenName(name)
+	i := sort.SearchStrings(remotes, remote)
+	if i >= len(remotes) || remotes[i] != remote {
+		return nil, fuse.ENOENT
+	}
+	return &TagLink{remote: remote}, nil
+}
+
+// ReadDirAll lists the links to the objects with the tag
+func (d *TagDir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	remotes, err := d.remotes()
+	if err != nil {
+		return nil, err
+	}
+	for _, remote := range remotes {
+		dirents = append(dirents, fuse.Dirent{Type: fuse.DT_Link, Name: flattenName(remote)})
+	}
+	return dirents, nil
+}
+
+// TagLink is a symlink to an object from its tag directory
+type TagLink struct {
+	remote string
+}
+
+// Attr fills out the attributes of the link
+func (l *TagLink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Gid = gid
+	a.Uid = uid
+	a.Mode = os.ModeSymlink | 0777
+	a.Size = uint64(len(l.target()))
+	return nil
+}
+
+// target returns the path the link points to relative to its tag
+// directory
+func (l *TagLink) target() string {
+	return "../../" + l.remote
+}
+
+// Readlink returns the target of the link
+func (l *TagLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.target(), nil
+}
@@ -0,0 +1,50 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io/ioutil"
+
+	"bazil.org/fuse"
+	"github.com/ncw/rclone/fs"
+)
+
+// seedFromTemplate writes the contents of the --template file in d,
+// if there is one, to fh so the new file leaf starts with them.
+//
+// Only call this for files which don't exist yet as it replaces the
+// existing contents.
+func seedFromTemplate(d *Dir, leaf string, fh *WriteFileHandle) error {
+	if templateName == "" || leaf == templateName {
+		return nil
+	}
+	item, err := d.lookup(templateName)
+	if err == fuse.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	o, ok := item.o.(fs.Object)
+	if !ok {
+		// ignore directories with the template name
+		return nil
+	}
+	in, err := o.Open()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(in)
+	closeErr := in.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fs.Debug(fh.remote, "Starting new file with %d bytes from %q", len(data), templateName)
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	_, err = fh.write(data, 0)
+	return err
+}
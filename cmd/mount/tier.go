@@ -0,0 +1,46 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"github.com/ncw/rclone/fs"
+)
+
+// hotTier is the remote with copies of the objects which is read
+// from in preference with --hot-tier or nil
+var hotTier fs.Fs
+
+// hotTierObject returns the copy of o in the hot tier if there is
+// one with the same contents, otherwise o
+//
+// The copies are compared by size and by hash if the remotes have a
+// hash in common.  Writes always go to the remote being mounted.
+func hotTierObject(o fs.Object) fs.Object {
+	if hotTier == nil {
+		return o
+	}
+	hot, err := hotTier.NewObject(o.Remote())
+	if err != nil {
+		if err != fs.ErrorObjectNotFound {
+			fs.Debug(o, "Failed to find in hot tier: %v", err)
+		}
+		return o
+	}
+	if hot.Size() != o.Size() {
+		fs.Debug(o, "Hot tier copy differs in size")
+		return o
+	}
+	if hashType := o.Fs().Hashes().Overlap(hot.Fs().Hashes()).GetOne(); hashType != fs.HashNone {
+		sum, err := o.Hash(hashType)
+		if err != nil {
+			return o
+		}
+		hotSum, err := hot.Hash(hashType)
+		if err != nil || (sum != "" && hotSum != "" && sum != hotSum) {
+			fs.Debug(o, "Hot tier copy differs in %v", hashType)
+			return o
+		}
+	}
+	fs.Debug(o, "Reading from hot tier")
+	return hot
+}
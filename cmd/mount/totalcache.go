@@ -0,0 +1,85 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// totalCache limits the combined size of the blocks in
+// --read-cache-dir and the files of --write-cache with
+// --cache-max-total-size, or is nil if they aren't limited together
+var totalCache *cacheTotal
+
+// cacheTotal keeps the read and write caches on disk under maxSize
+// bytes between them.
+//
+// The write caches hold data which hasn't been uploaded yet so can't
+// be removed - the blocks of the read cache are removed to make room
+// for them instead.  If the write caches alone would go over maxSize
+// then writes wait for the other write caches to be uploaded.
+type cacheTotal struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	maxSize   int64 // maximum size of both caches
+	writeSize int64 // size of the data in the write caches
+}
+
+// newCacheTotal makes a cacheTotal keeping the caches under maxSize
+// bytes
+func newCacheTotal(maxSize int64) *cacheTotal {
+	t := &cacheTotal{
+		maxSize: maxSize,
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// readMaxSize returns the space left for the read cache
+func (t *cacheTotal) readMaxSize() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.writeSize >= t.maxSize {
+		return 0
+	}
+	return t.maxSize - t.writeSize
+}
+
+// grow reserves n more bytes for a write cache already holding own
+// bytes, removing blocks from the read cache to make room.
+//
+// This waits while the other write caches are using the space.  A
+// single write cache which is bigger than maxSize on its own isn't
+// stopped as nothing would ever make room for it.
+func (t *cacheTotal) grow(own, n int64) {
+	t.mu.Lock()
+	if t.writeSize+n > t.maxSize && t.writeSize > own {
+		fs.Debug(nil, "Waiting for write caches to be uploaded to keep under --cache-max-total-size")
+		for t.writeSize+n > t.maxSize && t.writeSize > own {
+			t.cond.Wait()
+		}
+	}
+	t.writeSize += n
+	t.mu.Unlock()
+	if diskCache != nil {
+		diskCache.trim()
+	}
+}
+
+// release frees n bytes when a write cache is removed
+func (t *cacheTotal) release(n int64) {
+	t.mu.Lock()
+	t.writeSize -= n
+	t.mu.Unlock()
+	t.cond.Broadcast()
+}
+
+// usage returns the current size of the write caches and the maximum
+// size of both caches
+func (t *cacheTotal) usage() (writeSize, maxSize int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeSize, t.maxSize
+}
@@ -0,0 +1,165 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// Values for --tree-hash
+const (
+	// treeHashShallow hashes the children of a directory only
+	treeHashShallow = "shallow"
+
+	// treeHashRecursive includes the tree hashes of the
+	// subdirectories too
+	treeHashRecursive = "recursive"
+)
+
+// treeHashXattr is the extended attribute of a directory showing its
+// tree hash with --tree-hash
+const treeHashXattr = xattrPrefix + "tree_hash"
+
+// treeHash returns a hash of the names, sizes and hashes of the
+// children of d from its cached listing, so it changes if any of
+// them change.  Objects are hashed by their modification time if the
+// remote doesn't support hashes.
+//
+// With --tree-hash recursive the subdirectories are hashed by their
+// tree hashes, listing them if necessary, otherwise only by name.
+//
+// The hash is cached until the listing is read again or, with
+// --tree-hash recursive, the tree hash of a subdirectory changes.
+func (d *Dir) treeHash() (string, error) {
+	err := d.readDir()
+	if err != nil {
+		return "", err
+	}
+	d.mu.RLock()
+	read := d.read
+	cached := d.treeHashValue != "" && d.treeHashRead.Equal(read)
+	value, oldSubs := d.treeHashValue, d.treeHashSubs
+	names := make([]string, 0, len(d.items))
+	for name := range d.items {
+		names = append(names, name)
+	}
+	d.mu.RUnlock()
+	sort.Strings(names)
+	var subs map[string]string
+	if treeHash == treeHashRecursive {
+		subs, err = d.subTreeHashes(names)
+		if err != nil {
+			return "", err
+		}
+	}
+	if cached && sameTreeHashes(subs, oldSubs) {
+		return value, nil
+	}
+	hashType := d.f.Hashes().GetOne()
+	h := sha1.New()
+	for _, name := range names {
+		item, err := d.lookup(name)
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		switch x := item.o.(type) {
+		case fs.Object:
+			sum := ""
+			if hashType != fs.HashNone {
+				sum, err = objectHash(x, hashType)
+				if err != nil {
+					fs.Debug(x, "Failed to read hash for tree hash: %v", err)
+				}
+			}
+			if sum == "" {
+				sum = fmt.Sprintf("modtime:%d", x.ModTime().UnixNano())
+			}
+			fmt.Fprintf(h, "f %q %d %s\n", name, x.Size(), sum)
+		case *fs.Dir:
+			fmt.Fprintf(h, "d %q %s\n", name, subs[name])
+		}
+	}
+	value = hex.EncodeToString(h.Sum(nil))
+	d.mu.Lock()
+	d.treeHashValue, d.treeHashRead, d.treeHashSubs = value, read, subs
+	d.mu.Unlock()
+	return value, nil
+}
+
+// subTreeHashes returns the tree hashes of the subdirectories of d
+// called names by name
+func (d *Dir) subTreeHashes(names []string) (map[string]string, error) {
+	subs := make(map[string]string)
+	for _, name := range names {
+		item, err := d.lookup(name)
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		if _, ok := item.o.(*fs.Dir); !ok {
+			continue
+		}
+		item, err = d.lookupNode(name)
+		if err != nil {
+			return nil, err
+		}
+		if child, ok := item.node.(*Dir); ok {
+			subs[name], err = child.treeHash()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return subs, nil
+}
+
+// sameTreeHashes returns whether the tree hashes of the
+// subdirectories a and b are the same
+func sameTreeHashes(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, sum := range a {
+		if other, ok := b[name]; !ok || other != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.NodeGetxattrer  = (*Dir)(nil)
+	_ fusefs.NodeListxattrer = (*Dir)(nil)
+)
+
+// Getxattr gets the extended attribute req.Name of the directory
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if treeHash == "" || req.Name != treeHashXattr {
+		return fuse.ErrNoXattr
+	}
+	value, err := d.treeHash()
+	if err != nil {
+		fs.ErrorLog(d.path, "Dir.Getxattr tree hash error: %v", err)
+		return err
+	}
+	resp.Xattr = []byte(value)
+	return nil
+}
+
+// Listxattr lists the extended attributes of the directory
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if treeHash != "" {
+		resp.Append(treeHashXattr)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"sort"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Values for --unicode-normalization
+const (
+	unicodeNormalizationNone = "none"
+	unicodeNormalizationNFC  = "nfc"
+	unicodeNormalizationNFD  = "nfd"
+)
+
+// unicodeForm returns the form names are normalized to with
+// --unicode-normalization and whether they are normalized at all
+func unicodeForm() (norm.Form, bool) {
+	switch unicodeNormalization {
+	case unicodeNormalizationNFC:
+		return norm.NFC, true
+	case unicodeNormalizationNFD:
+		return norm.NFD, true
+	}
+	return 0, false
+}
+
+// normalizeUnicode returns leaf normalized with
+// --unicode-normalization
+func normalizeUnicode(leaf string) string {
+	form, ok := unicodeForm()
+	if !ok {
+		return leaf
+	}
+	return form.String(leaf)
+}
+
+// normalizeItems moves the items whose names aren't normalized with
+// --unicode-normalization to their normalized names.
+//
+// If an item already has the normalized name it keeps it and the
+// other item keeps its original name, so an exact match is always
+// found first.  The objects keep their original names so reading and
+// writing them still uses those.
+func normalizeItems(items map[string]*DirEntry) {
+	if _, ok := unicodeForm(); !ok {
+		return
+	}
+	var leaves []string
+	for leaf := range items {
+		if normalizeUnicode(leaf) != leaf {
+			leaves = append(leaves, leaf)
+		}
+	}
+	sort.Strings(leaves)
+	for _, leaf := range leaves {
+		name := normalizeUnicode(leaf)
+		if _, found := items[name]; !found {
+			items[name] = items[leaf]
+			delete(items, leaf)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// warmStream is a stream from a closed read handle kept open for
+// --warm-stream-timeout so a handle opened on the object soon after
+// can carry on reading from it
+type warmStream struct {
+	r         io.ReadCloser
+	offset    int64  // offset of readAhead in the object
+	readAhead []byte // data read from r but not returned
+	timer     *time.Timer
+}
+
+// warmStreams holds the warm streams by the cacheID of their object -
+// only the most recently closed stream of each object is kept
+var warmStreams = struct {
+	mu      sync.Mutex
+	streams map[string]*warmStream
+}{
+	streams: make(map[string]*warmStream),
+}
+
+// putWarmStream keeps ws for reuse by the next handle opened on o
+// closing it after --warm-stream-timeout if it isn't used
+func putWarmStream(o fs.Object, ws *warmStream) {
+	id := cacheID(o)
+	warmStreams.mu.Lock()
+	defer warmStreams.mu.Unlock()
+	if old := warmStreams.streams[id]; old != nil && old.timer.Stop() {
+		_ = old.r.Close()
+	}
+	warmStreams.streams[id] = ws
+	ws.timer = time.AfterFunc(warmStreamTimeout, func() {
+		warmStreams.mu.Lock()
+		if warmStreams.streams[id] == ws {
+			delete(warmStreams.streams, id)
+		}
+		warmStreams.mu.Unlock()
+		fs.Debug(o, "Closing unused warm stream")
+		_ = ws.r.Close()
+	})
+}
+
+// takeWarmStream returns the warm stream for o removing it from the
+// pool or nil if there isn't one
+func takeWarmStream(o fs.Object) *warmStream {
+	id := cacheID(o)
+	warmStreams.mu.Lock()
+	defer warmStreams.mu.Unlock()
+	ws := warmStreams.streams[id]
+	if ws == nil {
+		return nil
+	}
+	delete(warmStreams.streams, id)
+	if !ws.timer.Stop() {
+		// it is being closed
+		return nil
+	}
+	return ws
+}
@@ -0,0 +1,74 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// With --escape-whitespace the leading and trailing spaces and tabs
+// in names, which many programs and operating systems silently strip,
+// are shown as visible substitutes.  Any substitutes or quotes in the
+// original name are quoted so the name can be turned back into the
+// original exactly.
+const (
+	spaceSubstitute = '␠' // shown for a leading or trailing space
+	tabSubstitute   = '␉' // shown for a leading or trailing tab
+	escapeQuote     = '‛' // quotes the next character
+)
+
+// isEdgeSpace returns whether r is whitespace which is escaped at
+// the start or end of a name
+func isEdgeSpace(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// escapeWhitespace returns the name leaf is shown as with
+// --escape-whitespace
+func escapeWhitespace(leaf string) string {
+	if !escapeWhitespaceNames {
+		return leaf
+	}
+	start := len(leaf) - len(strings.TrimLeftFunc(leaf, isEdgeSpace))
+	end := len(strings.TrimRightFunc(leaf, isEdgeSpace))
+	var out []byte
+	for i, r := range leaf {
+		switch {
+		case i < start || i >= end:
+			if r == ' ' {
+				r = spaceSubstitute
+			} else {
+				r = tabSubstitute
+			}
+		case r == spaceSubstitute || r == tabSubstitute || r == escapeQuote:
+			out = append(out, string(escapeQuote)...)
+		}
+		out = append(out, string(r)...)
+	}
+	return string(out)
+}
+
+// unescapeWhitespace returns the original name for a name made by
+// escapeWhitespace
+func unescapeWhitespace(name string) string {
+	if !escapeWhitespaceNames {
+		return name
+	}
+	var out []byte
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		i += size
+		switch r {
+		case escapeQuote:
+			r, size = utf8.DecodeRuneInString(name[i:])
+			i += size
+		case spaceSubstitute:
+			r = ' '
+		case tabSubstitute:
+			r = '\t'
+		}
+		out = append(out, string(r)...)
+	}
+	return string(out)
+}
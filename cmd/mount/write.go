@@ -3,13 +3,17 @@
 package mount
 
 import (
-	"errors"
 	"io"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
 	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -22,76 +26,454 @@ type WriteFileHandle struct {
 	remote      string
 	pipeReader  *io.PipeReader
 	pipeWriter  *io.PipeWriter
+	out         io.WriteCloser // where the data is written - pipeWriter, a writeBuffer or cache
+	cache       *writeCache    // local copy of the data if --write-cache
 	o           fs.Object
 	result      chan error
 	file        *File
-	writeCalled bool // set the first time Write() is called
+	dir         *Dir
+	writeCalled bool            // set the first time Write() is called
+	size        int64           // bytes written to the upload so far without --write-cache
+	cancelled   int32           // set atomically if the upload is cancelled
+	mirror      *os.File        // local copy of the data written if --write-mirror
+	hasher      *fs.MultiHasher // hashes of the data written if --sync-writes or --compute-hash-on-write
+	spool       *os.File        // local copy of the data to retry the upload from if --best-effort-uploads
+	base        fs.Object       // object the file had when opened or nil if it was new
 }
 
+// Counters for the uploads carrying on after --upload-timeout - use
+// sync/atomic to access
+var (
+	backgroundUploads      int64 // number of uploads in progress
+	backgroundUploadErrors int64 // number of uploads which have failed
+)
+
+// backgroundUploadsDone is waited on for the uploads finishing with
+// --upload-timeout to be done when the mount stops
+var backgroundUploadsDone sync.WaitGroup
+
+// waitBackgroundUploads waits for the uploads carrying on after
+// --upload-timeout to finish when the mount stops so their data isn't
+// lost
+func waitBackgroundUploads() {
+	if n := atomic.LoadInt64(&backgroundUploads); n > 0 {
+		fs.Log(nil, "Waiting for %d background uploads to finish", n)
+	}
+	backgroundUploadsDone.Wait()
+}
+
+// errFileTooBig is returned for writes which would make the file
+// bigger than --max-file-size
+var errFileTooBig = fuse.Errno(syscall.EFBIG)
+
+// errFileChanged is the error the upload of a file fails with if the
+// file was replaced while it was being written as uploading it would
+// overwrite the newer data
+var errFileChanged = errors.New("file changed while it was being written")
+
 // Check interface satisfied
 var _ fusefs.Handle = (*WriteFileHandle)(nil)
 
-func newWriteFileHandle(d *Dir, f *File, src fs.ObjectInfo) (*WriteFileHandle, error) {
+// newWriteFileHandle opens f for write uploading the data written to
+// src in d
+//
+// Only one handle may write to a File at once so the uploads don't
+// overwrite each other - opening another fails with EBUSY.  Opening
+// fails with EINTR if ctx is cancelled while waiting for --open-rate.
+func newWriteFileHandle(ctx context.Context, d *Dir, f *File, src fs.ObjectInfo) (_ *WriteFileHandle, err error) {
+	err = checkFreeSpace(d.f)
+	if err != nil {
+		return nil, err
+	}
+	err = waitToOpen(ctx)
+	if err != nil {
+		return nil, err
+	}
 	fh := &WriteFileHandle{
 		remote: src.Remote(),
 		result: make(chan error, 1),
 		file:   f,
+		dir:    d,
+	}
+	err = f.addWriter(fh)
+	if err != nil {
+		fs.Debug(fh.remote, "Already open for write")
+		return nil, err
+	}
+	f.addDirty(1)
+	defer func() {
+		if err != nil {
+			f.delWriter(fh)
+			f.addDirty(-1)
+		}
+	}()
+	if writeMirror != "" {
+		mirror, err := openMirror(fh.remote)
+		err = mirrorError(fh.remote, err)
+		if err != nil {
+			return nil, err
+		}
+		fh.mirror = mirror
+	}
+	if bestEffortUploads {
+		spool, err := newUploadSpool()
+		if err != nil {
+			return nil, err
+		}
+		fh.spool = spool
+	}
+	remote, err := connectFs(d.f)
+	if err != nil {
+		return nil, err
+	}
+	if syncWrites || storesHash(remote) {
+		hashes := remote.Hashes()
+		if storesHash(remote) {
+			hashes = fs.NewHashSet(fs.HashMD5)
+		}
+		hasher, err := fs.NewMultiHasherTypes(hashes)
+		if err != nil {
+			return nil, err
+		}
+		fh.hasher = hasher
 	}
 	fh.pipeReader, fh.pipeWriter = io.Pipe()
+	fh.out = fh.pipeWriter
+	if writeCacheEnabled {
+		cache, err := newWriteCache(fh.pipeWriter)
+		if err != nil {
+			return nil, err
+		}
+		if fh.hasher != nil {
+			cache.hash = fh.hasher
+		}
+		fh.cache = cache
+		fh.out = cache
+	} else if writeBufferLimit > 0 {
+		fh.out = newWriteBuffer(fh.pipeWriter, int(writeBufferLimit))
+	}
 	go func() {
-		o, err := d.f.Put(fh.pipeReader, src)
+		var o fs.Object
+		var err error
+		o, err = putObject(d, fh.pipeReader, src)
 		fh.o = o
+		// stop any more writes blocking if the upload failed
+		_ = fh.pipeReader.CloseWithError(err)
 		fh.result <- err
 	}()
-	fh.file.addWriters(1)
+	atomic.AddInt64(&openHandles, 1)
 	return fh, nil
 }
 
+// putObject uploads in to d as src compressing it with
+// --compress-on-write and deduplicating it with --dedupe-on-write
+func putObject(d *Dir, in io.Reader, src fs.ObjectInfo) (fs.Object, error) {
+	if shouldCompress(src.Remote()) {
+		spool, compressed, err := compressUpload(in, src)
+		if err != nil {
+			return nil, err
+		}
+		defer removeUploadSpool(spool)
+		in, src = spool, compressed
+	}
+	if dedupeOnWrite {
+		return putDedupe(d, in, src)
+	}
+	return d.f.Put(in, src)
+}
+
 // Check interface satisfied
 var _ fusefs.HandleWriter = (*WriteFileHandle)(nil)
 
 // Write data to the file handle
 func (fh *WriteFileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	fs.Debug(fh.remote, "WriteFileHandle.Write len=%d", len(req.Data))
+	op := opLog{o: fh.remote, id: newRequestID()}
+	fs.Debug(op, "WriteFileHandle.Write len=%d", len(req.Data))
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 	if fh.closed {
-		fs.ErrorLog(fh.remote, "WriteFileHandle.Write error: %v", errClosedFileHandle)
+		fs.ErrorLog(op, "WriteFileHandle.Write error: %v", errClosedFileHandle)
 		return errClosedFileHandle
 	}
-	fh.writeCalled = true
-	// FIXME should probably check the file isn't being seeked?
-	n, err := fh.pipeWriter.Write(req.Data)
+	n, err := fh.write(req.Data, req.Offset)
 	resp.Size = n
-	fh.file.written(int64(n))
 	if err != nil {
-		fs.ErrorLog(fh.remote, "WriteFileHandle.Write error: %v", err)
+		fs.ErrorLog(op, "WriteFileHandle.Write error: %v", err)
 		return err
 	}
-	fs.Debug(fh.remote, "WriteFileHandle.Write OK (%d bytes written)", n)
+	fs.Debug(op, "WriteFileHandle.Write OK (%d bytes written)", n)
 	return nil
 }
 
+// write data to the upload and the mirror if any
+//
+// The data is written at offset with --write-cache, otherwise it is
+// added to the end of the upload.
+//
+// Must be called with fh.mu held
+func (fh *WriteFileHandle) write(data []byte, offset int64) (int, error) {
+	fh.writeCalled = true
+	if fh.isCancelled() {
+		return len(data), nil
+	}
+	if maxFileSize > 0 {
+		end := fh.size + int64(len(data))
+		if fh.cache != nil {
+			end = offset + int64(len(data))
+		}
+		if end > int64(maxFileSize) {
+			return 0, errFileTooBig
+		}
+	}
+	if fh.mirror != nil {
+		var err error
+		if fh.cache != nil {
+			_, err = fh.mirror.WriteAt(data, offset)
+		} else {
+			_, err = fh.mirror.Write(data)
+		}
+		if err != nil {
+			fh.closeMirror()
+			err = mirrorError(fh.remote, err)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if fh.spool != nil {
+		var err error
+		if fh.cache != nil {
+			_, err = fh.spool.WriteAt(data, offset)
+		} else {
+			_, err = fh.spool.Write(data)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if fh.cache != nil {
+		size := fh.cache.size
+		n, err := fh.cache.WriteAt(data, offset)
+		fh.file.written(fh.cache.size - size)
+		atomic.AddInt64(&bytesWritten, int64(n))
+		return n, err
+	}
+	// FIXME should probably check the file isn't being seeked?
+	n, err := fh.out.Write(data)
+	if err != nil && (fh.isCancelled() || fh.spool != nil) {
+		// the data is in the spool to retry the upload from
+		fh.size += int64(len(data))
+		return len(data), nil
+	}
+	fh.size += int64(n)
+	if fh.hasher != nil {
+		_, _ = fh.hasher.Write(data[:n])
+	}
+	fh.file.written(int64(n))
+	atomic.AddInt64(&bytesWritten, int64(n))
+	return n, err
+}
+
+// writeFrom writes all the data read from in to the handle from the
+// start of the file
+func (fh *WriteFileHandle) writeFrom(in io.Reader) error {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	buf := make([]byte, 64*1024)
+	var offset int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			_, writeErr := fh.write(buf[:n], offset)
+			if writeErr != nil {
+				return writeErr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// errUploadCancelled stops the upload of a file which is removed
+// while it is being written
+var errUploadCancelled = errors.New("upload cancelled as file removed")
+
+// cancel the upload as the file has been removed
+//
+// Writes carry on succeeding but the data is thrown away.  This
+// doesn't take fh.mu so it can stop a write blocked on the upload.
+func (fh *WriteFileHandle) cancel() {
+	fs.Debug(fh.remote, "WriteFileHandle cancelling upload")
+	atomic.StoreInt32(&fh.cancelled, 1)
+	_ = fh.pipeWriter.CloseWithError(errUploadCancelled)
+}
+
+// isCancelled returns whether the upload has been cancelled
+func (fh *WriteFileHandle) isCancelled() bool {
+	return atomic.LoadInt32(&fh.cancelled) != 0
+}
+
+// abort the upload with err and close the handle
+func (fh *WriteFileHandle) abort(err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	_ = fh.pipeWriter.CloseWithError(err)
+	_ = fh.close(opLog{o: fh.remote})
+}
+
 // close the file handle returning errClosedFileHandle if it has been
-// closed already.
+// closed already.  The logs of the upload are made with the operation
+// op closing it.
 //
 // Must be called with fh.mu held
-func (fh *WriteFileHandle) close() error {
+func (fh *WriteFileHandle) close(op opLog) error {
 	if fh.closed {
 		return errClosedFileHandle
 	}
 	fh.closed = true
-	fh.file.addWriters(-1)
-	writeCloseErr := fh.pipeWriter.Close()
+	// only count the upload once it is finishing so a directory
+	// fsync doesn't wait for handles still open for write
+	fh.dir.addUploads(1)
+	if !fh.isCancelled() && fh.file.writerStale(fh) {
+		// fail the upload rather than overwrite the newer object
+		fs.ErrorLog(op, "WriteFileHandle.Release error: %v", errFileChanged)
+		_ = fh.pipeWriter.CloseWithError(errFileChanged)
+	}
+	atomic.AddInt64(&openHandles, -1)
+	if uploadTimeout <= 0 {
+		return fh.finishUpload(op)
+	}
+	done := make(chan error, 1)
+	backgroundUploadsDone.Add(1)
+	go func() {
+		done <- fh.finishUpload(op)
+	}()
+	select {
+	case err := <-done:
+		backgroundUploadsDone.Done()
+		return err
+	case <-time.After(uploadTimeout):
+	}
+	// let the app carry on while the upload finishes
+	fs.Log(op, "Upload not finished after --upload-timeout %v - carrying on in the background", uploadTimeout)
+	atomic.AddInt64(&backgroundUploads, 1)
+	go func() {
+		defer backgroundUploadsDone.Done()
+		err := <-done
+		atomic.AddInt64(&backgroundUploads, -1)
+		if err != nil {
+			fs.ErrorLog(op, "Background upload failed: %v", err)
+			atomic.AddInt64(&backgroundUploadErrors, 1)
+		}
+	}()
+	return nil
+}
+
+// finishUpload waits for the upload of the data written to finish
+// and updates the file with the new object returning any error.
+//
+// The handle stays one of the writers of the file until the upload
+// has finished so the file can't be opened for write meanwhile.
+//
+// With --upload-timeout this may carry on running after the handle
+// has been released so it doesn't need fh.mu held.
+func (fh *WriteFileHandle) finishUpload(op opLog) error {
+	defer fh.file.addDirty(-1)
+	defer fh.file.delWriter(fh)
+	writeCloseErr := fh.out.Close()
 	err := <-fh.result
 	readCloseErr := fh.pipeReader.Close()
+	if fh.isCancelled() {
+		fs.Debug(op, "WriteFileHandle upload cancelled")
+		fh.dir.delWriting(fh.file)
+		fh.dir.addUploads(-1)
+		if fh.mirror != nil {
+			_ = fh.closeMirror()
+		}
+		if fh.spool != nil {
+			removeUploadSpool(fh.spool)
+			fh.spool = nil
+		}
+		return nil
+	}
 	if err == nil {
 		fh.file.setObject(fh.o)
 		err = writeCloseErr
 	}
+	fh.dir.delWriting(fh.file)
+	fh.dir.addUploads(-1)
 	if err == nil {
 		err = readCloseErr
 	}
+	if fh.mirror != nil {
+		mirrorErr := mirrorError(fh.remote, fh.closeMirror())
+		if err == nil {
+			err = mirrorErr
+		}
+	}
+	if err == nil && storesHash(fh.dir.f) {
+		err = storeHash(fh.dir.f, fh.o, fh.hasher.Sums()[fs.HashMD5])
+		if err != nil {
+			fs.ErrorLog(op, "Failed to store hash: %v", err)
+		}
+	}
+	if err == nil && syncWrites {
+		err = fh.verify(op)
+	}
+	if fh.spool != nil {
+		if err != nil && errors.Cause(err) != errFileChanged {
+			// the event is logged if the retries fail too
+			fs.ErrorLog(op, "Upload failed - retrying in the background: %v", err)
+			retryUpload(fh, err)
+			err = nil
+		} else {
+			removeUploadSpool(fh.spool)
+		}
+		fh.spool = nil
+	}
+	if err != nil {
+		// the upload was only tried once
+		logErrorEvent("upload", fh.remote, err, 0)
+	}
+	return err
+}
+
+// verify checks the uploaded object can be found on the remote and
+// has the size and hashes of the data written.
+//
+// Must be called with fh.mu held
+func (fh *WriteFileHandle) verify(op opLog) error {
+	o, err := fh.dir.f.NewObject(fh.remote)
+	if err != nil {
+		return errors.Wrap(err, "failed to find uploaded object")
+	}
+	if o.Size() != fh.hasher.Size() {
+		return errors.Errorf("uploaded object is %d bytes but %d bytes were written", o.Size(), fh.hasher.Size())
+	}
+	for hashType, sum := range fh.hasher.Sums() {
+		remoteSum, err := objectHash(o, hashType)
+		if err != nil || remoteSum == "" {
+			continue
+		}
+		if remoteSum != sum {
+			return errors.Errorf("uploaded object has %v %s but the data written has %s", hashType, shownHash(remoteSum), shownHash(sum))
+		}
+	}
+	fs.Debug(op, "WriteFileHandle verified upload")
+	return nil
+}
+
+// closeMirror closes the mirror file stopping any more writes to it
+//
+// Must be called with fh.mu held
+func (fh *WriteFileHandle) closeMirror() error {
+	err := fh.mirror.Close()
+	fh.mirror = nil
 	return err
 }
 
@@ -113,22 +495,26 @@ var _ fusefs.HandleFlusher = (*WriteFileHandle)(nil)
 //
 // Filesystems shouldn't assume that flush will always be called after
 // some writes, or that if will be called at all.
+//
+// With --sync-writes the upload is always finished and verified here
+// so close() only succeeds if the data is on the remote.
 func (fh *WriteFileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
-	fs.Debug(fh.remote, "WriteFileHandle.Flush")
+	op := opLog{o: fh.remote, id: newRequestID()}
+	fs.Debug(op, "WriteFileHandle.Flush")
 	// If Write hasn't been called then ignore the Flush - Release
 	// will pick it up
-	if !fh.writeCalled {
-		fs.Debug(fh.remote, "WriteFileHandle.Flush ignoring flush on unwritten handle")
+	if !fh.writeCalled && !syncWrites {
+		fs.Debug(op, "WriteFileHandle.Flush ignoring flush on unwritten handle")
 		return nil
 
 	}
-	err := fh.close()
+	err := fh.close(op)
 	if err != nil {
-		fs.ErrorLog(fh.remote, "WriteFileHandle.Flush error: %v", err)
+		fs.ErrorLog(op, "WriteFileHandle.Flush error: %v", err)
 	} else {
-		fs.Debug(fh.remote, "WriteFileHandle.Flush OK")
+		fs.Debug(op, "WriteFileHandle.Flush OK")
 	}
 	return err
 }
@@ -142,16 +528,17 @@ var _ fusefs.HandleReleaser = (*WriteFileHandle)(nil)
 func (fh *WriteFileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
+	op := opLog{o: fh.remote, id: newRequestID()}
 	if fh.closed {
-		fs.Debug(fh.remote, "WriteFileHandle.Release nothing to do")
+		fs.Debug(op, "WriteFileHandle.Release nothing to do")
 		return nil
 	}
-	fs.Debug(fh.remote, "WriteFileHandle.Release closing")
-	err := fh.close()
+	fs.Debug(op, "WriteFileHandle.Release closing")
+	err := fh.close(op)
 	if err != nil {
-		fs.ErrorLog(fh.remote, "WriteFileHandle.Release error: %v", err)
+		fs.ErrorLog(op, "WriteFileHandle.Release error: %v", err)
 	} else {
-		fs.Debug(fh.remote, "WriteFileHandle.Release OK")
+		fs.Debug(op, "WriteFileHandle.Release OK")
 	}
 	return err
 }
@@ -3,11 +3,25 @@
 package mount
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
+	"bazil.org/fuse"
+	"github.com/ncw/rclone/fs"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 // Test writing a file with no write()'s to it
@@ -101,3 +115,815 @@ func TestWriteFileDoubleClose(t *testing.T) {
 
 	run.rm(t, "testdoubleclose")
 }
+
+// createFile creates leaf in d via the handlers writing contents to it
+func createFile(t *testing.T, d *Dir, leaf string, contents string) *File {
+	_, err := d.lookup(leaf)
+	require.Equal(t, fuse.ENOENT, err)
+	node, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: leaf}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	if contents != "" {
+		err = fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte(contents)}, &fuse.WriteResponse{})
+		require.NoError(t, err)
+	}
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	return node.(*File)
+}
+
+// Test --dedupe-on-write copies rather than uploads identical files
+func TestWriteDedupeOnWrite(t *testing.T) {
+	defer func(old bool) { dedupeOnWrite = old }(dedupeOnWrite)
+	dedupeOnWrite = true
+	f, d := mockDir()
+	f.add("existing", "hello world")
+
+	createFile(t, d, "copy", "hello world")
+	assert.Equal(t, 1, f.copies)
+	assert.Equal(t, 0, f.puts)
+
+	createFile(t, d, "different", "goodbye world")
+	assert.Equal(t, 1, f.copies)
+	assert.Equal(t, 1, f.puts)
+
+	o, err := f.NewObject("copy")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(o.(*mockObject).contents))
+}
+
+// Test --upload-only refuses reads but allows writes
+func TestWriteUploadOnly(t *testing.T) {
+	defer func(old bool) { uploadOnly = old }(uploadOnly)
+	uploadOnly = true
+	f, d := mockDir()
+	f.add("file", "hello")
+
+	item, err := d.lookupNode("file")
+	require.NoError(t, err)
+	file := item.node.(*File)
+
+	var a fuse.Attr
+	require.NoError(t, file.Attr(context.Background(), &a))
+	assert.Equal(t, uint64(5), a.Size)
+
+	_, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.Errno(syscall.EACCES), err)
+
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	err = fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("potato")}, &fuse.WriteResponse{})
+	require.NoError(t, err)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, "potato", string(f.objects["file"].contents))
+}
+
+// Test Setattr only changes the times flagged as valid
+func TestWriteSetattrMtimeOnly(t *testing.T) {
+	f, d := mockDir()
+	o := f.add("file", "hello")
+	oldTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	newTime := time.Date(2011, 12, 13, 14, 15, 16, 0, time.UTC)
+	require.NoError(t, o.SetModTime(oldTime))
+	item, err := d.lookupNode("file")
+	require.NoError(t, err)
+	file := item.node.(*File)
+
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: newTime}
+	resp := &fuse.SetattrResponse{}
+	require.NoError(t, file.Setattr(context.Background(), req, resp))
+	assert.Equal(t, newTime, o.ModTime())
+	assert.Equal(t, newTime, resp.Attr.Mtime)
+	assert.Equal(t, oldTime, resp.Attr.Atime)
+
+	req = &fuse.SetattrRequest{Valid: fuse.SetattrAtime, Atime: newTime.Add(time.Hour)}
+	require.NoError(t, file.Setattr(context.Background(), req, resp))
+	assert.Equal(t, newTime, o.ModTime())
+	assert.Equal(t, newTime.Add(time.Hour), resp.Attr.Atime)
+}
+
+// Test --write-mirror saves a local copy of files written
+func TestWriteMirror(t *testing.T) {
+	defer func(old string) { writeMirror = old }(writeMirror)
+	dir, err := ioutil.TempDir("", "rclone-mount-mirror")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	writeMirror = filepath.Join(dir, "mirror")
+	f := newMockFs()
+
+	createFile(t, newDir(f, "sub/dir"), "file", "hello mirror")
+	assert.Equal(t, "hello mirror", string(f.objects["sub/dir/file"].contents))
+	data, err := ioutil.ReadFile(filepath.Join(writeMirror, "sub", "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello mirror", string(data))
+}
+
+// Test a failure to write the mirror fails the write unless
+// --write-mirror-ignore-errors is set
+func TestWriteMirrorError(t *testing.T) {
+	defer func(old string, oldIgnore bool) {
+		writeMirror, writeMirrorIgnoreErrors = old, oldIgnore
+	}(writeMirror, writeMirrorIgnoreErrors)
+	tmp, err := ioutil.TempFile("", "rclone-mount-mirror")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	writeMirror = tmp.Name() // a file so the mirror can't be created
+	f, d := mockDir()
+
+	_, _, err = d.Create(context.Background(), &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	assert.Error(t, err)
+	assert.Equal(t, 0, f.puts)
+
+	writeMirrorIgnoreErrors = true
+	createFile(t, d, "file", "hello")
+	assert.Equal(t, "hello", string(f.objects["file"].contents))
+}
+
+// Test --template starts new files with the template in the directory
+func TestWriteTemplate(t *testing.T) {
+	defer func(old string) { templateName = old }(templateName)
+	templateName = ".template"
+	f := newMockFs()
+	f.add("conf/.template", "# default config\n")
+
+	createFile(t, newDir(f, "conf"), "new.conf", "edits\n")
+	assert.Equal(t, "# default config\nedits\n", string(f.objects["conf/new.conf"].contents))
+
+	// directories without a template are unaffected
+	createFile(t, newDir(f, "other"), "new.conf", "edits\n")
+	assert.Equal(t, "edits\n", string(f.objects["other/new.conf"].contents))
+}
+
+// Test --write-buffer-limit bounds the data buffered when writing
+// faster than the upload
+func TestWriteBufferLimit(t *testing.T) {
+	defer func(old fs.SizeSuffix) { writeBufferLimit = old }(writeBufferLimit)
+	writeBufferLimit = 16 * 1024
+	f, d := mockDir()
+	f.putRate = 1024 * 1024
+	require.NoError(t, d.readDir())
+
+	_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	var want []byte
+	for i := 0; i < 64; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i%26)}, 4096)
+		want = append(want, data...)
+		err = fh.Write(context.Background(), &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{})
+		require.NoError(t, err)
+	}
+	buf := fh.out.(*writeBuffer)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	assert.True(t, buf.peak <= int(writeBufferLimit), "buffered %d bytes", buf.peak)
+	assert.True(t, buf.peak > 0)
+	assert.Equal(t, string(want), string(f.objects["file"].contents))
+}
+
+// Test a write which fits under the low watermark but not the limit
+// still waits for room in the buffer
+func TestWriteBufferRoom(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	buf := newWriteBuffer(pipeWriter, 16)
+	for i := 0; i < 4; i++ {
+		_, err := buf.Write([]byte("ab"))
+		require.NoError(t, err)
+	}
+	written := make(chan struct{})
+	go func() {
+		_, err := buf.Write([]byte("0123456789ab"))
+		assert.NoError(t, err)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write didn't wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// draining the buffer lets it through
+	done := make(chan []byte)
+	go func() {
+		data, err := ioutil.ReadAll(pipeReader)
+		assert.NoError(t, err)
+		done <- data
+	}()
+	<-written
+	require.NoError(t, buf.Close())
+	assert.Equal(t, "abababab0123456789ab", string(<-done))
+	assert.True(t, buf.peak <= 16, "buffered %d bytes", buf.peak)
+}
+
+// Test --upload-timeout lets closing a file return while a slow
+// upload carries on in the background
+func TestWriteUploadTimeout(t *testing.T) {
+	defer func(old time.Duration) { uploadTimeout = old }(uploadTimeout)
+	uploadTimeout = 50 * time.Millisecond
+	f, d := mockDir()
+	f.putDelay = time.Second
+	require.NoError(t, d.readDir())
+
+	_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	err = fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("slow upload")}, &fuse.WriteResponse{})
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "close took %v", time.Since(start))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&backgroundUploads))
+
+	// the handle is a writer of the file until the upload is done
+	assert.True(t, fh.file.hasWriters())
+
+	// the upload finishes later and is waited for when the mount
+	// stops
+	waitBackgroundUploads()
+	assert.False(t, fh.file.hasWriters())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&backgroundUploads))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&backgroundUploadErrors))
+	f.mu.Lock()
+	assert.Equal(t, "slow upload", string(f.objects["file"].contents))
+	f.mu.Unlock()
+}
+
+// Test --sync-writes returns upload errors from Flush
+func TestWriteSyncWrites(t *testing.T) {
+	defer func(old bool) { syncWrites = old }(syncWrites)
+	syncWrites = true
+	f, d := mockDir()
+	require.NoError(t, d.readDir())
+	create := func(leaf, contents string) error {
+		_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: leaf}, &fuse.CreateResponse{})
+		require.NoError(t, err)
+		fh := handle.(*WriteFileHandle)
+		if contents != "" {
+			err = fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte(contents)}, &fuse.WriteResponse{})
+			require.NoError(t, err)
+		}
+		err = fh.Flush(context.Background(), &fuse.FlushRequest{})
+		require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+		return err
+	}
+
+	require.NoError(t, create("file", "hello"))
+	assert.Equal(t, "hello", string(f.objects["file"].contents))
+
+	// empty files are uploaded on Flush too
+	require.NoError(t, create("empty", ""))
+	assert.Equal(t, 2, f.puts)
+	assert.Contains(t, f.objects, "empty")
+
+	f.putErr = errors.New("upload failed")
+	err := create("failed", "hello")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "upload failed")
+	assert.NotContains(t, f.objects, "failed")
+}
+
+// Test --write-cache lets files be written in any order
+func TestWriteCacheSeek(t *testing.T) {
+	defer func(old bool) { writeCacheEnabled = old }(writeCacheEnabled)
+	writeCacheEnabled = true
+	f, d := mockDir()
+	f.add("file", "")
+	item, err := d.lookupNode("file")
+	require.NoError(t, err)
+	resp := &fuse.OpenResponse{}
+	handle, err := item.node.(*File).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, resp)
+	require.NoError(t, err)
+	assert.Equal(t, fuse.OpenResponseFlags(0), resp.Flags&fuse.OpenNonSeekable)
+	fh := handle.(*WriteFileHandle)
+
+	write := func(offset int64, data string) {
+		err := fh.Write(context.Background(), &fuse.WriteRequest{Offset: offset, Data: []byte(data)}, &fuse.WriteResponse{})
+		require.NoError(t, err)
+	}
+	write(1000, "hello")
+	write(0, "start")
+	assert.Equal(t, int64(1005), fh.cache.size)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	want := make([]byte, 1005)
+	copy(want, "start")
+	copy(want[1000:], "hello")
+	assert.Equal(t, want, f.objects["file"].contents)
+	assert.Equal(t, 1, f.puts)
+}
+
+// Test --write-cache keeps the existing data of files opened without
+// O_TRUNC and the template isn't used for existing files
+func TestWriteCacheExistingData(t *testing.T) {
+	defer func(old bool) { writeCacheEnabled = old }(writeCacheEnabled)
+	writeCacheEnabled = true
+	defer func(old string) { templateName = old }(templateName)
+	templateName = ".template"
+	f, d := mockDir()
+	f.add(".template", "template")
+	f.add("file", "0123456789")
+	f.add("created", "0123456789")
+	require.NoError(t, d.readDir())
+
+	write := func(fh *WriteFileHandle, offset int64, data string) {
+		err := fh.Write(context.Background(), &fuse.WriteRequest{Offset: offset, Data: []byte(data)}, &fuse.WriteResponse{})
+		require.NoError(t, err)
+		require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	}
+	open := func(flags fuse.OpenFlags) *WriteFileHandle {
+		item, err := d.lookupNode("file")
+		require.NoError(t, err)
+		handle, err := item.node.(*File).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | flags}, &fuse.OpenResponse{})
+		require.NoError(t, err)
+		return handle.(*WriteFileHandle)
+	}
+
+	write(open(0), 2, "ab")
+	assert.Equal(t, "01ab456789", string(f.objects["file"].contents))
+
+	write(open(fuse.OpenTruncate), 0, "new")
+	assert.Equal(t, "new", string(f.objects["file"].contents))
+
+	_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "created", Flags: fuse.OpenWriteOnly}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	write(handle.(*WriteFileHandle), 8, "yz")
+	assert.Equal(t, "01234567yz", string(f.objects["created"].contents))
+}
+
+// Test --compute-hash-on-write stores the MD5 of files written to a
+// remote without hashes and reads are checked against it
+func TestWriteComputeHashOnWrite(t *testing.T) {
+	defer func(old bool) { computeHashOnWrite = old }(computeHashOnWrite)
+	computeHashOnWrite = true
+	f, d := mockDir()
+	f.noHashes = true
+
+	createFile(t, d, "file", "hello")
+	require.Contains(t, f.objects, "file"+storedHashSuffix)
+	o := f.objects["file"]
+	assert.Equal(t, fmt.Sprintf("5d41402abc4b2a76b9719d911017c592 5 %s", o.modTime.UTC().Format(time.RFC3339Nano)), string(f.objects["file"+storedHashSuffix].contents))
+	d.read = time.Time{}
+	assert.Equal(t, []string{"file"}, listing(t, d))
+
+	read := func() error {
+		fh, err := newReadFileHandle(f.objects["file"])
+		require.NoError(t, err)
+		assert.Equal(t, "hello", readString(t, fh, 0, 100))
+		return fh.Release(context.Background(), &fuse.ReleaseRequest{})
+	}
+	assert.NoError(t, read())
+
+	stored := f.objects["file"+storedHashSuffix]
+	good := stored.contents
+	stored.contents = []byte(strings.Replace(string(good), "5d41402abc4b2a76b9719d911017c592", "00000000000000000000000000000000", 1))
+	err := read()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "corrupted on transfer")
+
+	// the stored hash is ignored once the file has been changed
+	o.modTime = o.modTime.Add(time.Hour)
+	assert.NoError(t, read())
+	sum, err := objectHash(o, fs.HashMD5)
+	require.NoError(t, err)
+	assert.Equal(t, "", sum)
+	o.modTime = o.modTime.Add(-time.Hour)
+	stored.contents = good
+
+	require.NoError(t, d.Remove(context.Background(), &fuse.RemoveRequest{Name: "file"}))
+	assert.Empty(t, f.objects)
+}
+
+// Test removing a file while it is being written cancels the upload
+func TestWriteRemoveCancelsUpload(t *testing.T) {
+	f, d := mockDir()
+	require.NoError(t, d.readDir())
+	_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "tmp"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	write := func() {
+		err := fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("temporary data")}, &fuse.WriteResponse{})
+		require.NoError(t, err)
+	}
+	write()
+
+	node, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: "tmp"}, &fuse.LookupResponse{})
+	require.NoError(t, err)
+	assert.Equal(t, fh.file, node)
+
+	require.NoError(t, d.Remove(context.Background(), &fuse.RemoveRequest{Name: "tmp"}))
+	_, err = d.Lookup(context.Background(), &fuse.LookupRequest{Name: "tmp"}, &fuse.LookupResponse{})
+	assert.Equal(t, fuse.ENOENT, err)
+
+	// writes carry on working but nothing is uploaded
+	write()
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, 0, f.puts)
+	assert.Empty(t, f.objects)
+	assert.Empty(t, listing(t, d))
+}
+
+// Test --best-effort-uploads doesn't fail closing a file whose upload
+// failed and retries the upload in the background
+func TestWriteBestEffortUploads(t *testing.T) {
+	defer func(old bool) { bestEffortUploads = old }(bestEffortUploads)
+	defer func(old time.Duration) { uploadRetrySleep = old }(uploadRetrySleep)
+	bestEffortUploads = true
+	uploadRetrySleep = 10 * time.Millisecond
+	f, d := mockDir()
+	f.add("file", "original")
+	file := lookupFile(t, d, "file")
+	f.putErr = errors.New("upload failed")
+
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	err = fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{})
+	require.NoError(t, err)
+	require.NoError(t, fh.Flush(context.Background(), &fuse.FlushRequest{}))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Contains(t, string(statusText()), "pending_upload_retries: 1\n")
+
+	// a writer opened while the upload is retried isn't failed by
+	// the retry finishing
+	handle, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh2 := handle.(*WriteFileHandle)
+
+	// the retry succeeds once the remote is working again and is
+	// waited for when the mount stops
+	time.Sleep(50 * time.Millisecond)
+	f.mu.Lock()
+	f.putErr = nil
+	f.mu.Unlock()
+	waitUploadRetries()
+	assert.Contains(t, string(statusText()), "pending_upload_retries: 0\n")
+	f.mu.Lock()
+	require.Contains(t, f.objects, "file")
+	assert.Equal(t, "hello", string(f.objects["file"].contents))
+	f.mu.Unlock()
+
+	err = fh2.Write(context.Background(), &fuse.WriteRequest{Data: []byte("again")}, &fuse.WriteResponse{})
+	require.NoError(t, err)
+	require.NoError(t, fh2.Release(context.Background(), &fuse.ReleaseRequest{}))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	assert.Equal(t, "again", string(f.objects["file"].contents))
+}
+
+// Test the --error-log event for an upload which fails with
+// --best-effort-uploads is written once the retries have failed too
+func TestWriteBestEffortErrorLog(t *testing.T) {
+	defer func(old bool) { bestEffortUploads = old }(bestEffortUploads)
+	defer func(old time.Duration) { uploadRetrySleep = old }(uploadRetrySleep)
+	defer func(old int) { fs.Config.LowLevelRetries = old }(fs.Config.LowLevelRetries)
+	defer func(old *errorEventLog) { errorLog = old }(errorLog)
+	bestEffortUploads = true
+	uploadRetrySleep = time.Millisecond
+	fs.Config.LowLevelRetries = 2
+	out, err := ioutil.TempFile("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(out.Name()) }()
+	errorLog = newErrorEventLog(out)
+	f, d := mockDir()
+	f.putErr = errors.New("upload failed")
+
+	createFile(t, d, "file", "hello")
+	waitUploadRetries()
+	require.NoError(t, errorLog.close())
+
+	data, err := ioutil.ReadFile(out.Name())
+	require.NoError(t, err)
+	var event errorEvent
+	require.NoError(t, json.Unmarshal(data, &event))
+	assert.Equal(t, "upload", event.Op)
+	assert.Equal(t, "file", event.Path)
+	assert.Equal(t, "upload failed", event.Error)
+	assert.Equal(t, 2, event.Retries)
+}
+
+// Test a file can only have one writer and that a writer fails
+// rather than overwrite the file if it was replaced underneath it
+func TestWriteConcurrentWriters(t *testing.T) {
+	f, d := mockDir()
+	o := f.add("file", "original")
+	file := lookupFile(t, d, "file")
+	open := func() (*WriteFileHandle, error) {
+		handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			return nil, err
+		}
+		return handle.(*WriteFileHandle), nil
+	}
+	write := func(fh *WriteFileHandle, data string) error {
+		err := fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{})
+		if err != nil {
+			return err
+		}
+		return fh.Release(context.Background(), &fuse.ReleaseRequest{})
+	}
+
+	fh, err := open()
+	require.NoError(t, err)
+	_, err = open()
+	assert.Equal(t, errFileBusy, err)
+	require.NoError(t, write(fh, "first"))
+	assert.Equal(t, "first", string(f.objects["file"].contents))
+
+	// the writer closed so the file can be opened again
+	fh, err = open()
+	require.NoError(t, err)
+	// the file is replaced while being written
+	newer := f.add("file", "newer")
+	file.setObject(newer)
+	err = write(fh, "stale")
+	assert.Equal(t, errFileChanged, err)
+	assert.Equal(t, "newer", string(f.objects["file"].contents))
+	assert.False(t, file.hasWriters())
+	assert.Equal(t, 0, o.opens)
+}
+
+// Test --max-file-size fails the write which would take the file
+// past the limit
+func TestWriteMaxFileSize(t *testing.T) {
+	defer func(old fs.SizeSuffix) { maxFileSize = old }(maxFileSize)
+	maxFileSize = 10
+	f, d := mockDir()
+	require.NoError(t, d.readDir())
+	_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	fh := handle.(*WriteFileHandle)
+	write := func(data string) error {
+		return fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{})
+	}
+	require.NoError(t, write("0123"))
+	require.NoError(t, write("4567"))
+	assert.Equal(t, errFileTooBig, write("89a"))
+	require.NoError(t, write("89"))
+	assert.Equal(t, errFileTooBig, write("a"))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, "0123456789", string(f.objects["file"].contents))
+
+	// rewriting the file is checked against the new data only
+	item, err := d.lookupNode("file")
+	require.NoError(t, err)
+	handle, err = item.node.(*File).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | fuse.OpenTruncate}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh = handle.(*WriteFileHandle)
+	require.NoError(t, write("abcdefghij"))
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, "abcdefghij", string(f.objects["file"].contents))
+}
+
+// Test --read-your-writes reads a file being written from the write
+// cache
+func TestWriteReadYourWrites(t *testing.T) {
+	defer func(old bool) { writeCacheEnabled = old }(writeCacheEnabled)
+	defer func(old bool) { readYourWrites = old }(readYourWrites)
+	writeCacheEnabled = true
+	readYourWrites = true
+	f, d := mockDir()
+	require.NoError(t, d.readDir())
+	node, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	file := node.(*File)
+	fh := handle.(*WriteFileHandle)
+	write := func(data string, offset int64) {
+		require.NoError(t, fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte(data), Offset: offset}, &fuse.WriteResponse{}))
+	}
+	write("hello", 0)
+
+	resp := &fuse.OpenResponse{}
+	rhandle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, resp)
+	require.NoError(t, err)
+	rfh, ok := rhandle.(*WriteCacheReadHandle)
+	require.True(t, ok, "not reading from the write cache")
+	assert.Equal(t, fuse.OpenDirectIO, resp.Flags&fuse.OpenDirectIO)
+	read := func() string {
+		readResp := &fuse.ReadResponse{}
+		require.NoError(t, rfh.Read(context.Background(), &fuse.ReadRequest{Size: 100}, readResp))
+		return string(readResp.Data)
+	}
+	assert.Equal(t, "hello", read())
+	write(" world", 5)
+	write("H", 0)
+	assert.Equal(t, "Hello world", read())
+
+	// the reader carries on working once the file is uploaded
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, "Hello world", string(f.objects["file"].contents))
+	assert.Equal(t, "Hello world", read())
+	require.NoError(t, rfh.Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// files which aren't being written are read from the remote
+	rhandle, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	require.NoError(t, rhandle.(*ReadFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+
+	// files being written can't be read with --upload-only
+	defer func(old bool) { uploadOnly = old }(uploadOnly)
+	uploadOnly = true
+	handle, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	_, err = file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.Errno(syscall.EACCES), err)
+	require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+}
+
+// Test --cache-max-total-size removes read cache blocks to make room
+// for the write cache and writes wait if the write caches are full
+func TestWriteCacheMaxTotalSize(t *testing.T) {
+	defer func(old *cacheTotal) { totalCache = old }(totalCache)
+	defer func(old *diskBlockCache) { diskCache = old }(diskCache)
+	dir, err := ioutil.TempDir("", "rclone-mount-test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	totalCache = newCacheTotal(300)
+	diskCache, err = newDiskBlockCache(dir, 1000)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		diskCache.put(key, make([]byte, 100))
+	}
+	size, _ := diskCache.usage()
+	assert.Equal(t, int64(300), size)
+
+	// the read cache makes room for the write cache
+	first := &closeRecorder{}
+	c, err := newWriteCache(first)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("x"), 150)
+	_, err = c.Write(data)
+	require.NoError(t, err)
+	size, _ = diskCache.usage()
+	assert.Equal(t, int64(100), size)
+	_, ok := diskCache.get("c")
+	assert.True(t, ok, "most recent block kept")
+
+	// another write cache which doesn't fit waits for the first
+	// to be uploaded
+	second := &closeRecorder{}
+	c2, err := newWriteCache(second)
+	require.NoError(t, err)
+	written := make(chan struct{})
+	go func() {
+		_, err := c2.Write(make([]byte, 200))
+		assert.NoError(t, err)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write didn't wait for space")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, c.Close())
+	assert.Equal(t, data, first.Bytes(), "write cache preserved")
+	<-written
+	size, _ = diskCache.usage()
+	assert.Equal(t, int64(100), size)
+	writeSize, _ := totalCache.usage()
+	assert.Equal(t, int64(200), writeSize)
+	require.NoError(t, c2.Close())
+	writeSize, _ = totalCache.usage()
+	assert.Equal(t, int64(0), writeSize)
+}
+
+// Test writes are rejected while the free space is below
+// --min-free-space and the free space is only read every
+// freeSpaceCheckInterval
+func TestWriteMinFreeSpace(t *testing.T) {
+	defer func(old fs.SizeSuffix) { minFreeSpace = old }(minFreeSpace)
+	minFreeSpace = 100
+	defer func(old time.Duration) { freeSpaceCheckInterval = old }(freeSpaceCheckInterval)
+	freeSpaceCheckInterval = time.Hour
+	f, d := mockDir()
+	f.free = 1000
+	require.NoError(t, d.readDir())
+	create := func(leaf string) error {
+		_, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: leaf}, &fuse.CreateResponse{})
+		if err == nil {
+			require.NoError(t, handle.(*WriteFileHandle).Release(context.Background(), &fuse.ReleaseRequest{}))
+		}
+		return err
+	}
+
+	require.NoError(t, create("first"))
+	f.free = 10
+	require.NoError(t, create("second"), "free space is cached")
+	assert.Equal(t, 1, f.frees)
+
+	// the next check finds the space is low
+	freeSpaceCheckInterval = 0
+	assert.Equal(t, errLowSpace, create("third"))
+	_, err := d.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "dir"})
+	assert.Equal(t, errLowSpace, err)
+	assert.NotContains(t, f.objects, "third")
+
+	// writes are allowed again when the space recovers
+	f.free = 1000
+	require.NoError(t, create("fourth"))
+	assert.Contains(t, f.objects, "fourth")
+}
+
+// Test --compress-on-write compresses the files it should when they
+// are uploaded and they are read back decompressed with their size
+func TestWriteCompressOnWrite(t *testing.T) {
+	defer func(old bool) { compressOnWrite = old }(compressOnWrite)
+	defer func(old int) { perDirOpenLimit = old }(perDirOpenLimit)
+	compressOnWrite = true
+	perDirOpenLimit = 1
+	f, d := mockDir()
+	require.NoError(t, d.readDir())
+	body := strings.Repeat("compressible text ", 10000)
+	createFile(t, d, "file.txt", body)
+	createFile(t, d, "photo.jpg", body)
+
+	o := f.objects["file.txt"]
+	assert.True(t, len(o.contents) < len(body)/10, "compressed to %d bytes", len(o.contents))
+	assert.Equal(t, body, string(f.objects["photo.jpg"].contents))
+	isCompressed, size := compressed(o)
+	assert.True(t, isCompressed)
+	assert.Equal(t, int64(len(body)), size)
+	assert.True(t, storesMetadata(f))
+	assert.False(t, storesMetadata(struct{ fs.Fs }{f}))
+
+	file := lookupFile(t, d, "file.txt")
+	var a fuse.Attr
+	require.NoError(t, file.Attr(context.Background(), &a))
+	assert.Equal(t, uint64(len(body)), a.Size)
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	fh := handle.(*CompressedFileHandle)
+	read := func(off int64, size int) string {
+		resp := &fuse.ReadResponse{}
+		require.NoError(t, fh.Read(context.Background(), &fuse.ReadRequest{Offset: off, Size: size}, resp))
+		return string(resp.Data)
+	}
+	var got string
+	for {
+		data := read(int64(len(got)), 4096)
+		if data == "" {
+			break
+		}
+		got += data
+	}
+	assert.Equal(t, body, got)
+	assert.Equal(t, body[18:36], read(18, 18), "seeking backwards")
+
+	// the open is counted like any other read
+	assert.Len(t, d.openSlots, 1)
+	position, reading := file.readProgress()
+	assert.True(t, reading)
+	assert.Equal(t, int64(36), position)
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Len(t, d.openSlots, 0)
+	_, reading = file.readProgress()
+	assert.False(t, reading)
+
+	assert.False(t, shouldCompress("archive.TGZ"))
+	defer func(old string) { compressExtensions = old }(compressExtensions)
+	compressExtensions = "txt, .csv"
+	assert.True(t, shouldCompress("data.csv"))
+	assert.False(t, shouldCompress("data.json"))
+}
+
+// Test a file with an open write reports dirty until it is flushed
+func TestWriteDirty(t *testing.T) {
+	defer func(old bool) { showDirty = old }(showDirty)
+	showDirty = true
+	_, d := mockDir()
+	require.NoError(t, d.readDir())
+	dirty := func(file *File) string {
+		resp := &fuse.GetxattrResponse{}
+		require.NoError(t, file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: dirtyXattr}, resp))
+		return string(resp.Xattr)
+	}
+	before := readStatus(t, d)["dirty_files"]
+
+	node, handle, err := d.Create(context.Background(), &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	require.NoError(t, err)
+	file := node.(*File)
+	fh := handle.(*WriteFileHandle)
+	require.NoError(t, fh.Write(context.Background(), &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}))
+	assert.True(t, file.isDirty())
+	assert.Equal(t, "1", dirty(file))
+	assert.Equal(t, before+1, readStatus(t, d)["dirty_files"])
+
+	require.NoError(t, fh.Flush(context.Background(), &fuse.FlushRequest{}))
+	assert.False(t, file.isDirty())
+	assert.Equal(t, "0", dirty(file))
+	assert.Equal(t, before, readStatus(t, d)["dirty_files"])
+	require.NoError(t, fh.Release(context.Background(), &fuse.ReleaseRequest{}))
+	assert.Equal(t, before, readStatus(t, d)["dirty_files"])
+}
+
+// closeRecorder is an io.WriteCloser which keeps the data written
+type closeRecorder struct {
+	bytes.Buffer
+}
+
+// Close does nothing
+func (r *closeRecorder) Close() error {
+	return nil
+}
@@ -0,0 +1,108 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"io"
+	"sync"
+)
+
+// writeBuffer lets writes return before the data has been uploaded
+// while limiting how much data is buffered.
+//
+// The data written is passed to out in the background.  Writes which
+// would take the buffer over limit bytes block until the buffer drains
+// below half the limit and has room for them, so slow uploads push
+// back on the writer rather than the buffer growing without bound.  A
+// single write bigger than limit waits for the buffer to empty.
+type writeBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	out    io.WriteCloser
+	chunks [][]byte      // data waiting to be written to out
+	size   int           // number of bytes in chunks
+	peak   int           // the largest size has been
+	limit  int           // high watermark - writes block above this
+	low    int           // low watermark - blocked writes resume below this
+	closed bool          // set when Close has been called
+	err    error         // error writing to out
+	done   chan struct{} // closed when the background writer has finished
+}
+
+// newWriteBuffer makes a writeBuffer writing to out buffering up to
+// limit bytes
+func newWriteBuffer(out io.WriteCloser, limit int) *writeBuffer {
+	b := &writeBuffer{
+		out:   out,
+		limit: limit,
+		low:   limit / 2,
+		done:  make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	go b.writer()
+	return b
+}
+
+// writer writes the buffered chunks to out until the buffer is closed
+// and empty or a write fails
+func (b *writeBuffer) writer() {
+	defer close(b.done)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		for len(b.chunks) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.chunks) == 0 {
+			return
+		}
+		chunk := b.chunks[0]
+		b.mu.Unlock()
+		_, err := b.out.Write(chunk)
+		b.mu.Lock()
+		b.chunks = b.chunks[1:]
+		b.size -= len(chunk)
+		b.cond.Broadcast()
+		if err != nil {
+			b.err = err
+			b.chunks = nil
+			b.size = 0
+			return
+		}
+	}
+}
+
+// Write copies p into the buffer, blocking if the buffer is full
+func (b *writeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size+len(p) > b.limit {
+		for b.size > 0 && (b.size > b.low || b.size+len(p) > b.limit) && b.err == nil {
+			b.cond.Wait()
+		}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.chunks = append(b.chunks, append([]byte(nil), p...))
+	b.size += len(p)
+	if b.size > b.peak {
+		b.peak = b.size
+	}
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close waits for the buffered data to be written then closes out
+func (b *writeBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	<-b.done
+	err := b.out.Close()
+	if b.err != nil {
+		err = b.err
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// writeCache keeps the data written to a file in a local temporary
+// file so it can be written in any order.
+//
+// The data is only passed to out when the cache is closed, so the
+// upload happens then.
+type writeCache struct {
+	file     *os.File       // the local copy of the data
+	size     int64          // size of the data written
+	reserved int64          // space reserved with --cache-max-total-size
+	out      io.WriteCloser // where the data goes on Close
+	hash     io.Writer      // if set the data is written here too on Close
+}
+
+// newWriteCache makes a writeCache which writes to out when closed
+func newWriteCache(out io.WriteCloser) (*writeCache, error) {
+	file, err := ioutil.TempFile("", "rclone-mount-write-cache")
+	if err != nil {
+		return nil, err
+	}
+	return &writeCache{
+		file: file,
+		out:  out,
+	}, nil
+}
+
+// Write data to the end of the cache
+func (c *writeCache) Write(data []byte) (int, error) {
+	return c.WriteAt(data, c.size)
+}
+
+// WriteAt writes data at offset off in the cache
+//
+// With --cache-max-total-size this waits for space for the data.
+func (c *writeCache) WriteAt(data []byte, off int64) (int, error) {
+	if end := off + int64(len(data)); totalCache != nil && end > c.reserved {
+		totalCache.grow(c.reserved, end-c.reserved)
+		c.reserved = end
+	}
+	n, err := c.file.WriteAt(data, off)
+	if end := off + int64(n); end > c.size {
+		c.size = end
+	}
+	return n, err
+}
+
+// Close copies the cached data to out then closes it and removes the
+// local copy
+func (c *writeCache) Close() error {
+	_, err := c.file.Seek(0, 0)
+	if err == nil {
+		var in io.Reader = c.file
+		if c.hash != nil {
+			in = io.TeeReader(in, c.hash)
+		}
+		_, err = io.Copy(c.out, in)
+	}
+	closeErr := c.out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	closeErr = c.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	removeErr := os.Remove(c.file.Name())
+	if err == nil {
+		err = removeErr
+	}
+	if totalCache != nil {
+		totalCache.release(c.reserved)
+		c.reserved = 0
+	}
+	return err
+}
+
+// seedWriteCache copies the contents of o into the write cache of fh
+// before anything else is written, so a file opened for write without
+// O_TRUNC keeps the data which isn't overwritten.
+func (fh *WriteFileHandle) seedWriteCache(o fs.Object) (err error) {
+	in, err := o.Open()
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(in, &err)
+	var r io.Reader = in
+	if isCompressed, _ := compressed(o); isCompressed {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	fs.Debug(fh.remote, "Starting write cache with the existing data")
+	return fh.writeFrom(r)
+}
+
+// cacheName returns the name of the write cache of the handle or ""
+// if it has none or it has been closed
+func (fh *WriteFileHandle) cacheName() string {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.cache == nil || fh.closed {
+		return ""
+	}
+	return fh.cache.file.Name()
+}
+
+// WriteCacheReadHandle is a file open for read with --read-your-writes
+// while it is being written which reads the data written so far from
+// the write cache
+type WriteCacheReadHandle struct {
+	file *os.File
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.HandleReader   = (*WriteCacheReadHandle)(nil)
+	_ fusefs.HandleReleaser = (*WriteCacheReadHandle)(nil)
+)
+
+// writingRemote returns the remote of a handle writing the file with a
+// write cache or "" if there isn't one
+func (f *File) writingRemote() string {
+	f.mu.RLock()
+	writers := append([]*WriteFileHandle(nil), f.writers...)
+	f.mu.RUnlock()
+	for _, writer := range writers {
+		if writer.cacheName() != "" {
+			return writer.remote
+		}
+	}
+	return ""
+}
+
+// openWriteCache opens the write cache of the handle writing the file
+// for reading returning nil if it isn't being written
+//
+// The cache is opened separately so it can still be read once the
+// writer has closed and removed it.
+func (f *File) openWriteCache() *WriteCacheReadHandle {
+	f.mu.RLock()
+	writers := append([]*WriteFileHandle(nil), f.writers...)
+	f.mu.RUnlock()
+	for _, writer := range writers {
+		name := writer.cacheName()
+		if name == "" {
+			continue
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			// the writer closed in the meantime
+			fs.Debug(writer.remote, "Failed to open write cache for reading: %v", err)
+			continue
+		}
+		fs.Debug(writer.remote, "Reading from write cache")
+		return &WriteCacheReadHandle{file: file}
+	}
+	return nil
+}
+
+// Read from the write cache at req.Offset
+func (fh *WriteCacheReadHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := fh.file.ReadAt(buf, req.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		fs.ErrorLog(fh.file.Name(), "WriteCacheReadHandle.Read error: %v", err)
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Release closes the write cache
+func (fh *WriteCacheReadHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return fh.file.Close()
+}
@@ -0,0 +1,227 @@
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// xattrPrefix is the prefix of the extended attributes made from the
+// object metadata
+const xattrPrefix = "user.rclone."
+
+// mimeTypeXattr is the extended attribute showing the MIME type the
+// remote has for the object with --mime-types
+const mimeTypeXattr = "user.mime_type"
+
+// storageClassXattr is the extended attribute showing the storage
+// class of the object, eg to find the files in cold storage
+const storageClassXattr = "user.storage_class"
+
+// objectXattrs returns the extended attributes for o made from its
+// cached metadata
+//
+// The ID is the backend's ID for the object or its ETag, and there
+// is a hash.<type> attribute for each hash the remote supports.  The
+// ETag is often the MD5 of the object so it is left out along with
+// the hashes with --hide-hashes.  The hashes are read with hash which may
+// cache them as they may be slow to read.
+//
+// With --mime-types the MIME type is shown as user.mime_type if the
+// remote has one - it isn't guessed from the name.
+//
+// The storage class is shown as user.storage_class if the remote has
+// storage classes.
+func objectXattrs(o fs.Object, hash func(fs.HashType) (string, error)) map[string]string {
+	xattrs := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			xattrs[xattrPrefix+name] = value
+		}
+	}
+	if do, ok := o.(fs.IDer); ok {
+		set("id", do.ID())
+	} else if do, ok := o.(fs.ETagger); ok && !hideHashes {
+		set("id", do.ETag())
+	}
+	hashes := o.Fs().Hashes()
+	if hideHashes {
+		hashes = fs.HashSet(fs.HashNone)
+	}
+	for _, hashType := range hashes.Array() {
+		sum, err := hash(hashType)
+		if err != nil {
+			fs.Debug(o, "Failed to read %v hash for xattr: %v", hashType, err)
+			continue
+		}
+		set("hash."+strings.ToLower(strings.Replace(hashType.String(), "-", "", -1)), sum)
+	}
+	set("modtime", o.ModTime().Format(time.RFC3339Nano))
+	if do, ok := o.(fs.StorageClasser); ok {
+		if storageClass := do.StorageClass(); storageClass != "" {
+			xattrs[storageClassXattr] = storageClass
+		}
+	}
+	if do, ok := o.(fs.MimeTyper); ok && mimeTypes {
+		if mimeType := do.MimeType(); mimeType != "" {
+			xattrs[mimeTypeXattr] = mimeType
+		}
+	}
+	return xattrs
+}
+
+// objectHash returns the hash of type hashType of o, the object the
+// file has
+//
+// The hashes are read once for each object the file has as this
+// reads all the data on some remotes, eg local.
+func (f *File) objectHash(o fs.Object, hashType fs.HashType) (string, error) {
+	f.mu.RLock()
+	sum, ok := f.hashes[hashType]
+	cached := f.hashesOf == o && ok
+	f.mu.RUnlock()
+	if cached {
+		return sum, nil
+	}
+	sum, err := o.Hash(hashType)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	if f.hashesOf != o {
+		f.hashes, f.hashesOf = make(map[fs.HashType]string), o
+	}
+	f.hashes[hashType] = sum
+	f.mu.Unlock()
+	return sum, nil
+}
+
+// versionCount returns the number of versions the remote keeps of o
+// or 0 if it doesn't
+//
+// The versions are only counted the first time they are needed for
+// each object the file has as listing them may be slow.
+func (f *File) versionCount(o fs.Object) int {
+	do, ok := o.(fs.VersionCounter)
+	if !ok {
+		return 0
+	}
+	f.mu.RLock()
+	versions, versionsOf := f.versions, f.versionsOf
+	f.mu.RUnlock()
+	if versionsOf == o {
+		return versions
+	}
+	versions, err := do.VersionCount()
+	if err != nil {
+		fs.Debug(o, "Failed to count versions for xattr: %v", err)
+		return 0
+	}
+	f.mu.Lock()
+	f.versions, f.versionsOf = versions, o
+	f.mu.Unlock()
+	return versions
+}
+
+// xattrs returns the extended attributes of the file - there are
+// none until it has been uploaded apart from dirty
+//
+// With --dirty-xattr dirty shows whether the file has data written to
+// it which hasn't been uploaded yet.
+//
+// While the file is open for reading read_progress shows how far
+// through it the handles have read as "offset/size".
+//
+// If the remote keeps versions of the object version_count shows how
+// many there are.
+//
+// With --sidecar-as-xattr the keys of the file's sidecar are added
+// unless they clash with the attributes from the object metadata.
+func (f *File) xattrs() map[string]string {
+	f.mu.Lock()
+	o := f.o
+	f.mu.Unlock()
+	if o == nil {
+		if showDirty {
+			return map[string]string{dirtyXattr: f.dirtyXattr()}
+		}
+		return nil
+	}
+	xattrs := objectXattrs(o, func(hashType fs.HashType) (string, error) {
+		return f.objectHash(o, hashType)
+	})
+	if showDirty {
+		xattrs[dirtyXattr] = f.dirtyXattr()
+	}
+	if position, ok := f.readProgress(); ok {
+		xattrs[xattrPrefix+"read_progress"] = fmt.Sprintf("%d/%d", position, o.Size())
+	}
+	if versions := f.versionCount(o); versions > 0 {
+		xattrs[xattrPrefix+"version_count"] = strconv.Itoa(versions)
+	}
+	for name, value := range f.d.sidecarXattrs(f.d.leaf(o.Remote())) {
+		if _, ok := xattrs[name]; !ok {
+			xattrs[name] = value
+		}
+	}
+	return xattrs
+}
+
+// Check interfaces satisfied
+var (
+	_ fusefs.NodeGetxattrer    = (*File)(nil)
+	_ fusefs.NodeListxattrer   = (*File)(nil)
+	_ fusefs.NodeSetxattrer    = (*File)(nil)
+	_ fusefs.NodeRemovexattrer = (*File)(nil)
+)
+
+// Getxattr gets the extended attribute req.Name
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, ok := f.xattrs()[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(value)
+	return nil
+}
+
+// Listxattr lists the extended attributes of the file
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	var names []string
+	for name := range f.xattrs() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	return nil
+}
+
+// Setxattr refuses to set extended attributes as they are read only
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return xattrReadOnly(req.Name)
+}
+
+// Removexattr refuses to remove extended attributes as they are read
+// only
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return xattrReadOnly(req.Name)
+}
+
+// xattrReadOnly returns the error for trying to change the extended
+// attribute name
+func xattrReadOnly(name string) error {
+	if strings.HasPrefix(name, xattrPrefix) || name == mimeTypeXattr {
+		return fuse.EPERM
+	}
+	return fuse.Errno(syscall.ENOTSUP)
+}
@@ -133,6 +133,7 @@ type Object struct {
 	md5sum       string // md5sum of the object
 	bytes        int64  // size of the object
 	modifiedDate string // RFC3339 time it was last modified
+	createdDate  string // RFC3339 time it was created
 	isDocument   bool   // if set this is a Google doc
 	mimeType     string
 }
@@ -178,6 +179,26 @@ func shouldRetry(err error) (again bool, errOut error) {
 	return again, err
 }
 
+// downloadURLExpired returns whether err from fetching an object's
+// download URL means the authorization in it has expired.
+//
+// This is a 401, or a 403 either with the authError reason or without
+// a reason as returned for an expired download URL.  Other 403s, eg
+// rateLimitExceeded or downloadQuotaExceeded, aren't.
+func downloadURLExpired(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	switch gerr.Code {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		return len(gerr.Errors) == 0 || gerr.Errors[0].Reason == "authError"
+	}
+	return false
+}
+
 // parseParse parses a drive 'url'
 func parseDrivePath(path string) (root string, err error) {
 	root = strings.Trim(path, "/")
@@ -843,6 +864,7 @@ func (o *Object) setMetaData(info *drive.File) {
 	o.md5sum = strings.ToLower(info.Md5Checksum)
 	o.bytes = info.FileSize
 	o.modifiedDate = info.ModifiedDate
+	o.createdDate = info.CreatedDate
 	o.mimeType = info.MimeType
 }
 
@@ -895,6 +917,22 @@ func (o *Object) ModTime() time.Time {
 	return modTime
 }
 
+// CreationTime returns the time the drive object was created or the
+// zero time if it isn't known
+func (o *Object) CreationTime() time.Time {
+	err := o.readMetaData()
+	if err != nil {
+		fs.Log(o, "Failed to read metadata: %v", err)
+		return time.Time{}
+	}
+	createdTime, err := time.Parse(timeFormatIn, o.createdDate)
+	if err != nil {
+		fs.Debug(o, "Failed to read creation time from object: %v", err)
+		return time.Time{}
+	}
+	return createdTime
+}
+
 // SetModTime sets the modification time of the drive fs object
 func (o *Object) SetModTime(modTime time.Time) error {
 	err := o.readMetaData()
@@ -937,6 +975,14 @@ func (o *Object) httpResponse(method string, options []fs.OpenOption) (req *http
 	fs.OpenOptionAddHTTPHeaders(req.Header, options)
 	err = o.fs.pacer.Call(func() (bool, error) {
 		res, err = o.fs.client.Do(req)
+		if err == nil {
+			// turn error responses into a googleapi.Error so
+			// rate limits are retried
+			err = googleapi.CheckResponse(res)
+			if err != nil {
+				_ = res.Body.Close() // ignore error
+			}
+		}
 		return shouldRetry(err)
 	})
 	if err != nil {
@@ -980,6 +1026,11 @@ var _ io.ReadCloser = &openFile{}
 func (o *Object) Open(options ...fs.OpenOption) (in io.ReadCloser, err error) {
 	req, res, err := o.httpResponse("GET", options)
 	if err != nil {
+		if downloadURLExpired(err) {
+			// the download URL is short lived so finding the
+			// object again fetches a fresh one
+			err = fs.AuthExpiredError(err)
+		}
 		return nil, err
 	}
 	_, isRanging := req.Header["Range"]
@@ -1064,6 +1115,11 @@ func (o *Object) MimeType() string {
 	return o.mimeType
 }
 
+// ID returns the ID of the Object if known, or "" if not
+func (o *Object) ID() string {
+	return o.id
+}
+
 // Check the interfaces are satisfied
 var (
 	_ fs.Fs             = (*Fs)(nil)
@@ -1074,4 +1130,6 @@ var (
 	_ fs.PutUncheckeder = (*Fs)(nil)
 	_ fs.Object         = (*Object)(nil)
 	_ fs.MimeTyper      = &Object{}
+	_ fs.IDer           = &Object{}
+	_ fs.CreationTimer  = &Object{}
 )
@@ -6,6 +6,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
 )
 
 func TestInternalParseExtensions(t *testing.T) {
@@ -61,3 +62,20 @@ func TestInternalFindExportFormat(t *testing.T) {
 		assert.Equal(t, test.wantLink, gotLink)
 	}
 }
+
+func TestInternalDownloadURLExpired(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection reset"), false},
+		{&googleapi.Error{Code: 401}, true},
+		{&googleapi.Error{Code: 403}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "authError"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, false},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "downloadQuotaExceeded"}}}, false},
+		{&googleapi.Error{Code: 404}, false},
+	} {
+		assert.Equal(t, test.want, downloadURLExpired(test.err), test.err.Error())
+	}
+}
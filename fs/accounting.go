@@ -4,6 +4,7 @@ package fs
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"sort"
@@ -105,6 +106,10 @@ type StatsInfo struct {
 	transferring stringSet
 	start        time.Time
 	inProgress   *inProgress
+	cacheHits    int64 // number of reads served from the read cache
+	cacheMisses  int64 // number of reads which missed the read cache
+	cacheBytes   int64 // bytes served from the read cache
+	remoteBytes  int64 // bytes fetched from the remote to fill the read cache
 }
 
 // NewStats cretates an initialised StatsInfo
@@ -141,6 +146,11 @@ Elapsed time:  %10v
 		s.checks,
 		s.transfers,
 		dtRounded)
+	if s.cacheHits != 0 || s.cacheMisses != 0 {
+		fmt.Fprintf(buf, "Cache hits:    %10d (%s)\nCache misses:  %10d (%s)\n",
+			s.cacheHits, SizeSuffix(s.cacheBytes).Unit("Bytes"),
+			s.cacheMisses, SizeSuffix(s.remoteBytes).Unit("Bytes"))
+	}
 	if len(s.checking) > 0 {
 		fmt.Fprintf(buf, "Checking:\n%s\n", s.checking)
 	}
@@ -150,6 +160,22 @@ Elapsed time:  %10v
 	return buf.String()
 }
 
+// MarshalJSON returns the counters in the StatsInfo as JSON
+func (s *StatsInfo) MarshalJSON() ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return json.Marshal(map[string]int64{
+		"bytes":       s.bytes,
+		"errors":      s.errors,
+		"checks":      s.checks,
+		"transfers":   s.transfers,
+		"cacheHits":   s.cacheHits,
+		"cacheMisses": s.cacheMisses,
+		"cacheBytes":  s.cacheBytes,
+		"remoteBytes": s.remoteBytes,
+	})
+}
+
 // Log outputs the StatsInfo to the log
 func (s *StatsInfo) Log() {
 	Log(nil, "%v\n", s)
@@ -169,6 +195,31 @@ func (s *StatsInfo) Errors(errors int64) {
 	s.errors += errors
 }
 
+// CacheHit records bytes served from the read cache
+func (s *StatsInfo) CacheHit(bytes int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cacheHits++
+	s.cacheBytes += bytes
+}
+
+// CacheMiss records bytes fetched from the remote after missing
+// the read cache
+func (s *StatsInfo) CacheMiss(bytes int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cacheMisses++
+	s.remoteBytes += bytes
+}
+
+// GetCacheStats reads the read cache hits and misses and the bytes
+// served from the cache and fetched from the remote
+func (s *StatsInfo) GetCacheStats() (hits, misses, cacheBytes, remoteBytes int64) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cacheHits, s.cacheMisses, s.cacheBytes, s.remoteBytes
+}
+
 // GetErrors reads the number of errors
 func (s *StatsInfo) GetErrors() int64 {
 	s.lock.RLock()
@@ -176,14 +227,19 @@ func (s *StatsInfo) GetErrors() int64 {
 	return s.errors
 }
 
-// ResetCounters sets the counters (bytes, checks, errors, transfers) to 0
+// ResetCounters sets the counters (bytes, checks, errors, transfers
+// and the read cache counters) to 0
 func (s *StatsInfo) ResetCounters() {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.bytes = 0
 	s.errors = 0
 	s.checks = 0
 	s.transfers = 0
+	s.cacheHits = 0
+	s.cacheMisses = 0
+	s.cacheBytes = 0
+	s.remoteBytes = 0
 }
 
 // ResetErrors sets the errors count to 0
@@ -15,6 +15,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
@@ -299,6 +300,7 @@ type ConfigInfo struct {
 	IgnoreSize         bool
 	NoTraverse         bool
 	NoUpdateModTime    bool
+	ReadProxyURL       *url.URL // if set GET requests are sent through this proxy
 }
 
 // Find the config directory
@@ -161,6 +161,50 @@ func IsNoRetryError(err error) bool {
 	return false
 }
 
+// AuthExpirer is an optional interface for error as to whether the
+// operation failed because its authorization has expired, for
+// example a signed URL timing out part way through a download.
+//
+// Backends should return this from the readers returned by Open if
+// the object can be resolved again to get fresh authorization.
+type AuthExpirer interface {
+	error
+	AuthExpired() bool
+}
+
+// wrappedAuthExpiredError is an error wrapped so it will satisfy the
+// AuthExpirer interface and return true
+type wrappedAuthExpiredError struct {
+	error
+}
+
+// AuthExpired interface
+func (err wrappedAuthExpiredError) AuthExpired() bool {
+	return true
+}
+
+// Check interface
+var _ AuthExpirer = wrappedAuthExpiredError{(error)(nil)}
+
+// AuthExpiredError makes an error which indicates the authorization
+// for the operation has expired.
+func AuthExpiredError(err error) error {
+	return wrappedAuthExpiredError{err}
+}
+
+// IsAuthExpiredError returns true if err conforms to the AuthExpirer
+// interface and calling the AuthExpired method returns true.
+func IsAuthExpiredError(err error) bool {
+	if err == nil {
+		return false
+	}
+	err = errors.Cause(err)
+	if r, ok := err.(AuthExpirer); ok {
+		return r.AuthExpired()
+	}
+	return false
+}
+
 // isClosedConnError reports whether err is an error from use of a closed
 // network connection.
 //
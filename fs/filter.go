@@ -366,6 +366,17 @@ func (f *Filter) includeRemote(remote string) bool {
 	return true
 }
 
+// IncludeName returns whether a file called remote passes the filter
+// rules, ignoring its size and modification time.
+func (f *Filter) IncludeName(remote string) bool {
+	// filesFrom takes precedence
+	if f.files != nil {
+		_, include := f.files[remote]
+		return include
+	}
+	return f.includeRemote(remote)
+}
+
 // IncludeDirectory returns whether this directory should be included
 // in the sync or not.
 func (f *Filter) IncludeDirectory(remote string) bool {
@@ -46,6 +46,7 @@ var (
 	ErrorIsFile               = errors.New("is a file not a directory")
 	ErrorNotDeleting          = errors.New("not deleting files as there were IO errors")
 	ErrorCantMoveOverlapping  = errors.New("can't move files on overlapping remotes")
+	ErrorObjectChanged        = errors.New("object changed while it was being read")
 )
 
 // RegInfo provides information about a filesystem
@@ -217,6 +218,85 @@ type MimeTyper interface {
 	MimeType() string
 }
 
+// IDer is an optional interface for Object
+type IDer interface {
+	// ID returns the ID of the Object if known, or "" if not
+	ID() string
+}
+
+// ETagger is an optional interface for Object
+type ETagger interface {
+	// ETag returns the entity tag of the Object if known, or ""
+	// if not.  This changes whenever the Object is modified.
+	ETag() string
+}
+
+// ContentEncoder is an optional interface for Object
+type ContentEncoder interface {
+	// ContentEncoding returns the Content-Encoding the Object is
+	// stored with, eg "gzip", or "" if it isn't encoded.  The
+	// data read from an encoded Object is decoded so its length
+	// may not be Size.
+	ContentEncoding() string
+
+	// DecodedSize returns the length of the decoded data if
+	// known, or -1 if not
+	DecodedSize() int64
+}
+
+// Generationer is an optional interface for Object
+type Generationer interface {
+	// Generation returns the generation or version number of the
+	// Object if known, or 0 if not.  This changes whenever the
+	// Object is modified.
+	Generation() int64
+}
+
+// CreationTimer is an optional interface for Object
+type CreationTimer interface {
+	// CreationTime returns the time the Object was created if the
+	// remote records it, or the zero time if not
+	CreationTime() time.Time
+}
+
+// StorageClasser is an optional interface for Object
+type StorageClasser interface {
+	// StorageClass returns the storage class of the Object, eg
+	// STANDARD or GLACIER, or "" if not known
+	StorageClass() string
+
+	// Archived returns whether the Object is in an archive
+	// storage class so it must be restored before it can be read
+	Archived() bool
+}
+
+// VersionCounter is an optional interface for Object
+type VersionCounter interface {
+	// VersionCount returns the number of versions of the Object
+	// the remote keeps including the current one, or 0 if the
+	// remote doesn't keep versions.  This lists the versions so
+	// may be slow.
+	VersionCount() (int, error)
+}
+
+// Tagger is an optional interface for Object
+type Tagger interface {
+	// Tags returns the tags or labels the Object has in its
+	// metadata
+	Tags() []string
+}
+
+// Metadataer is an optional interface for ObjectInfo
+type Metadataer interface {
+	// Metadata returns the user metadata of the Object with the
+	// keys in lower case.
+	//
+	// Backends which are MetadataStorers store the Metadata of the
+	// src passed to Put with the new Object.  It is read before
+	// the data is uploaded.
+	Metadata() map[string]string
+}
+
 // Purger is an optional interfaces for Fs
 type Purger interface {
 	// Purge all files in the root and the root directory
@@ -297,6 +377,29 @@ type CleanUpper interface {
 	CleanUp() error
 }
 
+// MetadataStorer is an optional interface for Fs
+type MetadataStorer interface {
+	// StoresMetadata returns whether the Fs stores the Metadata
+	// of a src passed to Put which is a Metadataer, so it is
+	// returned by the Metadata of the new Object
+	StoresMetadata() bool
+}
+
+// FreeSpacer is an optional interface for Fs
+type FreeSpacer interface {
+	// FreeSpace returns the number of bytes which can still be
+	// stored on the remote, eg before the quota is reached, or -1
+	// if this isn't known
+	FreeSpace() (int64, error)
+}
+
+// SlowHasher is an optional interface for Fs
+type SlowHasher interface {
+	// SlowHash returns whether finding the hash of an Object
+	// needs its data to be read, eg on a local disk
+	SlowHash() bool
+}
+
 // ObjectsChan is a channel of Objects
 type ObjectsChan chan Object
 
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"reflect"
 	"sync"
 	"time"
@@ -98,7 +99,7 @@ func (ci *ConfigInfo) Transport() http.RoundTripper {
 		// This also means we get new stuff when it gets added to go
 		t := new(http.Transport)
 		setDefaults(t, http.DefaultTransport.(*http.Transport))
-		t.Proxy = http.ProxyFromEnvironment
+		t.Proxy = ci.proxy
 		t.MaxIdleConnsPerHost = 4 * (ci.Checkers + ci.Transfers + 1)
 		t.TLSHandshakeTimeout = ci.ConnectTimeout
 		t.ResponseHeaderTimeout = ci.Timeout
@@ -117,6 +118,18 @@ func (ci *ConfigInfo) Transport() http.RoundTripper {
 	return transport
 }
 
+// proxy returns the proxy to send req through
+//
+// GET requests, which read data, use ReadProxyURL if set so they can
+// be served by a caching proxy.  Otherwise the proxy is read from the
+// environment.
+func (ci *ConfigInfo) proxy(req *http.Request) (*url.URL, error) {
+	if ci.ReadProxyURL != nil && req.Method == "GET" {
+		return ci.ReadProxyURL, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
 // Client returns an http.Client with the correct timeouts
 func (ci *ConfigInfo) Client() *http.Client {
 	return &http.Client{
@@ -5,6 +5,8 @@ package fs
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,3 +40,64 @@ func TestSetDefaults(t *testing.T) {
 	assert.Equal(t, old.TLSNextProto, new.TLSNextProto, "when checking .TLSNextProto")
 	assert.Equal(t, old.MaxResponseHeaderBytes, new.MaxResponseHeaderBytes, "when checking .MaxResponseHeaderBytes")
 }
+
+func TestReadProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Method+" "+r.URL.String())
+		_, _ = w.Write([]byte("from proxy"))
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err)
+
+	ci := *Config
+	ci.ReadProxyURL = proxyURL
+
+	// Reads are sent through the proxy
+	req, err := http.NewRequest("GET", "http://example.invalid/bucket/file", nil)
+	assert.NoError(t, err)
+	got, err := ci.proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, proxyURL, got)
+
+	// Other requests aren't
+	req, err = http.NewRequest("PUT", "http://example.invalid/bucket/file", nil)
+	assert.NoError(t, err)
+	want, err := http.ProxyFromEnvironment(req)
+	assert.NoError(t, err)
+	got, err = ci.proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// The transport used by the backends sends reads to the proxy
+	oldReadProxyURL := Config.ReadProxyURL
+	Config.ReadProxyURL = proxyURL
+	defer func() { Config.ReadProxyURL = oldReadProxyURL }()
+	resp, err := Config.Client().Get("http://example.invalid/bucket/file")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, []string{"GET http://example.invalid/bucket/file"}, proxied)
+}
+
+func TestUserAgent(t *testing.T) {
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.UserAgent())
+	}))
+	defer server.Close()
+
+	oldUserAgent := UserAgent
+	UserAgent = "my-agent/1.0"
+	defer func() { UserAgent = oldUserAgent }()
+	resp, err := Config.Client().Get(server.URL + "/bucket/file")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	req, err := http.NewRequest("PUT", server.URL+"/bucket/file", nil)
+	assert.NoError(t, err)
+	req.Header.Set("User-Agent", "overridden")
+	resp, err = Config.Client().Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, []string{"my-agent/1.0", "my-agent/1.0"}, userAgents)
+}
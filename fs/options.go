@@ -73,6 +73,51 @@ func (o *SeekOption) Mandatory() bool {
 	return true
 }
 
+// IfMatchOption defines an HTTP If-Match option so the Open only
+// succeeds if the object still has the given ETag.
+//
+// Backends which support it should return ErrorObjectChanged if it
+// doesn't.  It isn't mandatory so the others ignore it, and callers
+// should check the ETag of the object opened themselves too.
+type IfMatchOption struct {
+	ETag string
+}
+
+// Header formats the option as an http header
+func (o *IfMatchOption) Header() (key string, value string) {
+	return "If-Match", o.ETag
+}
+
+// String formats the option into human readable form
+func (o *IfMatchOption) String() string {
+	return fmt.Sprintf("IfMatchOption(%q)", o.ETag)
+}
+
+// Mandatory returns whether the option must be parsed or can be ignored
+func (o *IfMatchOption) Mandatory() bool {
+	return false
+}
+
+// DecompressOption asks the backend to decompress an Object stored
+// with a Content-Encoding on the server so the decoded data is
+// returned.  Backends which can't do this ignore it.
+type DecompressOption struct{}
+
+// Header formats the option as an http header
+func (o *DecompressOption) Header() (key string, value string) {
+	return "Accept-Encoding", "identity"
+}
+
+// String formats the option into human readable form
+func (o *DecompressOption) String() string {
+	return "DecompressOption()"
+}
+
+// Mandatory returns whether the option must be parsed or can be ignored
+func (o *DecompressOption) Mandatory() bool {
+	return false
+}
+
 // HTTPOption defines a general purpose HTTP option
 type HTTPOption struct {
 	Key   string
@@ -133,5 +178,6 @@ func OpenOptionAddHTTPHeaders(headers http.Header, options []OpenOption) {
 var (
 	_ OpenOption = (*RangeOption)(nil)
 	_ OpenOption = (*SeekOption)(nil)
+	_ OpenOption = (*IfMatchOption)(nil)
 	_ OpenOption = (*HTTPOption)(nil)
 )
@@ -143,13 +143,15 @@ type Fs struct {
 //
 // Will definitely have info but maybe not meta
 type Object struct {
-	fs       *Fs       // what this object is part of
-	remote   string    // The remote path
-	url      string    // download path
-	md5sum   string    // The MD5Sum of the object
-	bytes    int64     // Bytes in the object
-	modTime  time.Time // Modified time of the object
-	mimeType string
+	fs         *Fs       // what this object is part of
+	remote     string    // The remote path
+	url        string    // download path
+	md5sum     string    // The MD5Sum of the object
+	bytes      int64     // Bytes in the object
+	modTime    time.Time // Modified time of the object
+	mimeType   string
+	encoding   string // Content-Encoding the object is stored with or ""
+	generation int64  // generation of the object which changes when it is overwritten
 }
 
 // ------------------------------------------------------------
@@ -560,6 +562,8 @@ func (o *Object) setMetaData(info *storage.Object) {
 	o.url = info.MediaLink
 	o.bytes = int64(info.Size)
 	o.mimeType = info.ContentType
+	o.encoding = info.ContentEncoding
+	o.generation = info.Generation
 
 	// Read md5sum
 	md5sumData, err := base64.StdEncoding.DecodeString(info.Md5Hash)
@@ -703,10 +707,30 @@ func (o *Object) MimeType() string {
 	return o.mimeType
 }
 
+// ContentEncoding returns the Content-Encoding the object is stored
+// with or "" if none.  The data read from it is decoded either by
+// Google Cloud Storage or the http client.
+func (o *Object) ContentEncoding() string {
+	return o.encoding
+}
+
+// DecodedSize returns -1 as the size of the decoded data isn't known
+func (o *Object) DecodedSize() int64 {
+	return -1
+}
+
+// Generation returns the generation of the object which Google Cloud
+// Storage changes whenever the object is overwritten
+func (o *Object) Generation() int64 {
+	return o.generation
+}
+
 // Check the interfaces are satisfied
 var (
-	_ fs.Fs        = &Fs{}
-	_ fs.Copier    = &Fs{}
-	_ fs.Object    = &Object{}
-	_ fs.MimeTyper = &Object{}
+	_ fs.Fs             = &Fs{}
+	_ fs.Copier         = &Fs{}
+	_ fs.Object         = &Object{}
+	_ fs.MimeTyper      = &Object{}
+	_ fs.ContentEncoder = &Object{}
+	_ fs.Generationer   = &Object{}
 )
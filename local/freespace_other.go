@@ -0,0 +1,8 @@
+// +build !linux,!darwin,!freebsd
+
+package local
+
+// FreeSpace returns -1 as the free space can't be read on this OS
+func (f *Fs) FreeSpace() (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,29 @@
+// +build linux darwin freebsd
+
+package local
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to unprivileged
+// users on the file system the root is on.
+//
+// If the root doesn't exist yet the file system of the nearest
+// directory above it which does is used.
+func (f *Fs) FreeSpace() (int64, error) {
+	dir := f.root
+	for {
+		var s syscall.Statfs_t
+		err := syscall.Statfs(dir, &s)
+		if err == syscall.ENOENT && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if err != nil {
+			return -1, err
+		}
+		return int64(s.Bavail) * int64(s.Bsize), nil
+	}
+}
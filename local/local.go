@@ -465,6 +465,11 @@ func (f *Fs) Hashes() fs.HashSet {
 	return fs.SupportedHashes
 }
 
+// SlowHash returns true as the hashes are found by reading the files
+func (f *Fs) SlowHash() bool {
+	return true
+}
+
 // ------------------------------------------------------------
 
 // Fs returns the parent Fs
@@ -803,9 +808,11 @@ func cleanWindowsName(f *Fs, name string) string {
 
 // Check the interfaces are satisfied
 var (
-	_ fs.Fs       = &Fs{}
-	_ fs.Purger   = &Fs{}
-	_ fs.Mover    = &Fs{}
-	_ fs.DirMover = &Fs{}
-	_ fs.Object   = &Object{}
+	_ fs.Fs         = &Fs{}
+	_ fs.Purger     = &Fs{}
+	_ fs.Mover      = &Fs{}
+	_ fs.DirMover   = &Fs{}
+	_ fs.FreeSpacer = &Fs{}
+	_ fs.SlowHasher = &Fs{}
+	_ fs.Object     = &Object{}
 )
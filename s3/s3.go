@@ -202,6 +202,7 @@ func init() {
 // Constants
 const (
 	metaMtime      = "Mtime"                // the meta key to store mtime in - eg X-Amz-Meta-Mtime
+	metaTags       = "tags"                 // the lower case meta key to store comma separated tags in
 	listChunkSize  = 1024                   // number of items to read at once
 	maxRetries     = 10                     // number of retries to make of operations
 	maxSizeForCopy = 5 * 1024 * 1024 * 1024 // The maximum size of object we can COPY
@@ -212,6 +213,7 @@ var (
 	// Flags
 	s3ACL          = pflag.StringP("s3-acl", "", "", "Canned ACL used when creating buckets and/or storing objects in S3")
 	s3StorageClass = pflag.StringP("s3-storage-class", "", "", "Storage class to use when uploading S3 objects (STANDARD|REDUCED_REDUNDANCY|STANDARD_IA)")
+	s3CopyMetadata = pflag.BoolP("s3-copy-metadata", "", false, "Copy the user metadata (eg tags) of S3 sources to the objects uploaded")
 )
 
 // Fs represents a remote s3 server
@@ -240,6 +242,8 @@ type Object struct {
 	lastModified time.Time          // Last modified
 	meta         map[string]*string // The object metadata if known - may be nil
 	mimeType     string             // MimeType of object - may be ""
+	storageClass string             // storage class of the object - may be ""
+	restored     bool               // set if an archived object has a restored copy
 }
 
 // ------------------------------------------------------------
@@ -418,6 +422,7 @@ func (f *Fs) newObjectWithInfo(remote string, info *s3.Object) (fs.Object, error
 		}
 		o.etag = aws.StringValue(info.ETag)
 		o.bytes = aws.Int64Value(info.Size)
+		o.storageClass = aws.StringValue(info.StorageClass)
 	} else {
 		err := o.readMetaData() // reads info and meta, returning an error
 		if err != nil {
@@ -697,6 +702,12 @@ func (f *Fs) Copy(src fs.Object, remote string) (fs.Object, error) {
 	return f.NewObject(remote)
 }
 
+// StoresMetadata returns true as the Metadata of the src passed to Put
+// is stored as the user metadata of the object
+func (f *Fs) StoresMetadata() bool {
+	return true
+}
+
 // Hashes returns the supported hash sets.
 func (f *Fs) Hashes() fs.HashSet {
 	return fs.HashSet(fs.HashMD5)
@@ -780,6 +791,12 @@ func (o *Object) readMetaData() (err error) {
 		o.lastModified = *resp.LastModified
 	}
 	o.mimeType = aws.StringValue(resp.ContentType)
+	// The storage class header is left out for STANDARD objects
+	o.storageClass = aws.StringValue(resp.StorageClass)
+	if o.storageClass == "" {
+		o.storageClass = "STANDARD"
+	}
+	o.restored = strings.Contains(aws.StringValue(resp.Restore), `ongoing-request="false"`)
 	return nil
 }
 
@@ -853,10 +870,12 @@ func (o *Object) Open(options ...fs.OpenOption) (in io.ReadCloser, err error) {
 		Key:    &key,
 	}
 	for _, option := range options {
-		switch option.(type) {
+		switch x := option.(type) {
 		case *fs.RangeOption, *fs.SeekOption:
 			_, value := option.Header()
 			req.Range = &value
+		case *fs.IfMatchOption:
+			req.IfMatch = aws.String(x.ETag)
 		default:
 			if option.Mandatory() {
 				fs.Log(o, "Unsupported mandatory option: %v", option)
@@ -865,6 +884,11 @@ func (o *Object) Open(options ...fs.OpenOption) (in io.ReadCloser, err error) {
 	}
 	resp, err := o.fs.c.GetObject(&req)
 	if err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok {
+			if awsErr.StatusCode() == http.StatusPreconditionFailed {
+				return nil, fs.ErrorObjectChanged
+			}
+		}
 		return nil, err
 	}
 	return resp.Body, nil
@@ -893,6 +917,15 @@ func (o *Object) Update(in io.Reader, src fs.ObjectInfo) error {
 		metaMtime: aws.String(swift.TimeToFloatString(modTime)),
 	}
 
+	// Store the metadata of the src if it has any and we were asked to
+	if do, ok := src.(fs.Metadataer); ok && *s3CopyMetadata {
+		for k, v := range do.Metadata() {
+			if !strings.EqualFold(k, metaMtime) {
+				metadata[k] = aws.String(v)
+			}
+		}
+	}
+
 	// Guess the content type
 	mimeType := fs.MimeType(src)
 
@@ -944,10 +977,77 @@ func (o *Object) MimeType() string {
 	return o.mimeType
 }
 
+// ETag returns the entity tag of the object
+func (o *Object) ETag() string {
+	return o.etag
+}
+
+// Metadata returns the user metadata of the object with the keys in
+// lower case, not including the modification time stored there
+func (o *Object) Metadata() map[string]string {
+	err := o.readMetaData()
+	if err != nil {
+		fs.Log(o, "Failed to read metadata: %v", err)
+		return nil
+	}
+	metadata := make(map[string]string, len(o.meta))
+	for k, v := range o.meta {
+		if v != nil && !strings.EqualFold(k, metaMtime) {
+			metadata[strings.ToLower(k)] = *v
+		}
+	}
+	return metadata
+}
+
+// Tags returns the comma separated tags stored in the "tags" user
+// metadata of the object
+func (o *Object) Tags() []string {
+	var tags []string
+	for _, tag := range strings.Split(o.Metadata()[metaTags], ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// StorageClass returns the storage class of the object
+func (o *Object) StorageClass() string {
+	if o.storageClass == "" {
+		err := o.readMetaData()
+		if err != nil {
+			fs.Log(o, "Failed to read metadata: %v", err)
+			return ""
+		}
+	}
+	return o.storageClass
+}
+
+// Archived returns whether the object is in GLACIER without a
+// restored copy so it can't be read
+func (o *Object) Archived() bool {
+	if o.StorageClass() != "GLACIER" {
+		return false
+	}
+	// Listings don't say whether the object has been restored
+	err := o.readMetaData()
+	if err != nil {
+		fs.Log(o, "Failed to read metadata: %v", err)
+		return true
+	}
+	return !o.restored
+}
+
 // Check the interfaces are satisfied
 var (
-	_ fs.Fs        = &Fs{}
-	_ fs.Copier    = &Fs{}
-	_ fs.Object    = &Object{}
-	_ fs.MimeTyper = &Object{}
+	_ fs.Fs             = &Fs{}
+	_ fs.Copier         = &Fs{}
+	_ fs.MetadataStorer = &Fs{}
+	_ fs.Object         = &Object{}
+	_ fs.MimeTyper      = &Object{}
+	_ fs.ETagger        = &Object{}
+	_ fs.Metadataer     = &Object{}
+	_ fs.Tagger         = &Object{}
+	_ fs.StorageClasser = &Object{}
 )